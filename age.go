@@ -23,10 +23,16 @@
 // config files, while secret keys should be stored in dedicated files, through
 // secret management systems, or as environment variables.
 //
-// There is no default path for age keys. Instead, they should be stored at
-// application-specific paths. The CLI supports files where private keys are
-// listed one per line, ignoring empty lines and lines starting with "#". These
-// files can be parsed with ParseIdentities.
+// Keys used by an application should be stored at application-specific paths.
+// The CLI supports files where private keys are listed one per line, ignoring
+// empty lines and lines starting with "#". These files can be parsed with
+// ParseIdentities.
+//
+// Keys that belong to the user rather than to an application are
+// conventionally stored at the paths returned by DefaultIdentityPaths and
+// DefaultRecipientPaths, which the CLI uses when no keys are specified. Tools
+// that operate on behalf of the user are encouraged to look for them there,
+// instead of inventing their own locations.
 //
 // When integrating age into a new system, it's recommended that you only
 // support X25519 keys, and not SSH keys. The latter are supported for manual
@@ -46,6 +52,8 @@
 package age
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"crypto/hmac"
 	"crypto/rand"
 	"errors"
@@ -54,7 +62,7 @@ import (
 	"sort"
 
 	"filippo.io/age/internal/format"
-	"filippo.io/age/internal/stream"
+	"filippo.io/age/stream"
 )
 
 // An Identity is passed to Decrypt to unwrap an opaque file key from a
@@ -122,22 +130,258 @@ const streamNonceSize = 16
 //
 // The caller must call Close on the WriteCloser when done for the last chunk to
 // be encrypted and flushed to dst.
+//
+// The WriteCloser also has a SetProgressFunc(func(processedBytes int64))
+// method, which can be reached with a type assertion, to set a function that
+// is called after each 64KiB chunk (or Options.ChunkSize) is encrypted and
+// written, with the total number of plaintext bytes encrypted so far.
 func Encrypt(dst io.Writer, recipients ...Recipient) (io.WriteCloser, error) {
+	return EncryptWithOptions(dst, nil, recipients...)
+}
+
+// Options configures optional behaviors of EncryptWithOptions and
+// DecryptWithOptions. A nil *Options is equivalent to the zero value, which
+// behaves like Encrypt and DecryptWithResult.
+type Options struct {
+	// Metadata, if not nil, is stored encrypted in the header of the file.
+	Metadata *Metadata
+
+	// CompactX25519, if true, makes EncryptWithOptions wrap the file key for
+	// all X25519Recipient values in a single compact stanza, instead of one
+	// stanza per recipient. This makes the header about three times smaller
+	// when encrypting to many recipients.
+	//
+	// Files encrypted this way can only be decrypted by versions of age that
+	// support the compact encoding.
+	CompactX25519 bool
+
+	// Rand, if not nil, is used instead of crypto/rand as the source of all
+	// the randomness that ends up in the file: the file key, the payload
+	// nonce, the ephemeral keys of the recipients, and the salt of a
+	// ScryptRecipient. With a deterministic Rand, such as one returned by
+	// DeterministicRand, encrypting the same plaintext to the same recipients
+	// produces byte-identical files.
+	//
+	// Not all recipient types support Rand, and EncryptWithOptions returns an
+	// error if Rand is set and any of the recipients doesn't.
+	//
+	// WARNING: the file key and the payload nonce are drawn from Rand, so if
+	// Rand produces the same output for two different plaintexts, the payload
+	// key and nonce will be reused, and the confidentiality of both files is
+	// lost. Only use a deterministic Rand with inputs that are guaranteed to
+	// be unique to the plaintext, and never for interactive use.
+	Rand io.Reader
+
+	// Grease, if true, makes EncryptWithOptions add a stanza of a random
+	// unknown type at a random position in the header. Implementations are
+	// required to ignore unknown stanzas, and this helps ensure they do.
+	//
+	// No grease stanza is added when encrypting to a ScryptRecipient, which
+	// must be the only stanza in the header.
+	Grease bool
+
+	// Logger, if not nil, receives debug events about the processing of the
+	// header. It's used by both EncryptWithOptions and DecryptWithOptions.
+	Logger Logger
+
+	// Tracer, if not nil, is used to start spans around the header parsing,
+	// each Wrap and Unwrap call, and the payload processing.
+	Tracer Tracer
+
+	// Warn, if not nil, is called by DecryptWithOptions for each non-fatal
+	// anomaly observed in the file. See Warning for the possible codes.
+	Warn func(*Warning)
+
+	// SourceSize, if positive, is the number of bytes that DecryptWithOptions
+	// can read from src, such as the Content-Length of an HTTP response. It's
+	// used to compute the size of the plaintext when src is not an io.Seeker.
+	SourceSize int64
+
+	// Policy, if not nil, is called by DecryptWithOptions after parsing the
+	// header and before trying any identity. If it returns an error, the file
+	// is rejected with a PolicyError wrapping it. It can be used to enforce
+	// rules such as allowed stanza types, a minimum scrypt work factor, or a
+	// maximum number of recipients.
+	Policy func(HeaderInfo) error
+
+	// Audit, if not nil, is called by DecryptWithOptions after each identity
+	// is tried, whether it successfully unwrapped the file key or not. It can
+	// be used to log which key decrypted which file.
+	Audit func(*AuditEvent)
+
+	// AuditContext is an opaque value, such as a request ID or a file path,
+	// that is passed to Audit in AuditEvent.Context.
+	AuditContext any
+
+	// MaxPayloadSize, if positive, is the maximum size of the plaintext that
+	// DecryptWithOptions will produce. If the size of the plaintext is known
+	// in advance and larger, DecryptWithOptions fails with ErrPayloadTooLarge.
+	// Otherwise, the Reader returns ErrPayloadTooLarge after returning
+	// MaxPayloadSize bytes, if there are more. It protects applications that
+	// decrypt untrusted files from resource exhaustion.
+	MaxPayloadSize int64
+
+	// SigningKey, if not nil, makes EncryptWithOptions sign the header and the
+	// payload nonce with it, in a stanza of type "signature". Recipients can
+	// then check who sent the file with DecryptResult.Signer or VerifySigner,
+	// even if other parties can encrypt to the same recipients.
+	//
+	// The signature proves that the holder of SigningKey generated the file
+	// key and chose the recipients. However, every recipient knows the file
+	// key, so a recipient could replace the payload with a different one
+	// without invalidating the signature. It doesn't authenticate the
+	// plaintext to a recipient against the other recipients.
+	SigningKey ed25519.PrivateKey
+
+	// ChunkSize, if not zero, is the size in bytes of the payload chunks,
+	// which must be a power of two between 64 KiB, the default, and 16 MiB.
+	// Larger chunks reduce the authentication overhead and the number of
+	// writes when encrypting large files, but each chunk is held in memory
+	// while it's encrypted and decrypted.
+	//
+	// A non-default chunk size is recorded in the header in a stanza of type
+	// "chunk-size", and DecryptWithOptions picks it up automatically. Files
+	// encrypted this way can only be decrypted by versions of age that support
+	// the chunk-size stanza.
+	ChunkSize int
+
+	// Concurrency, if greater than one, is the maximum number of payload
+	// chunks that EncryptWithOptions and DecryptWithOptions encrypt or
+	// decrypt concurrently, in separate goroutines. Chunks are still written
+	// and returned in order, and the output is the same, but up to about
+	// twice as many chunks are buffered in memory. It's also the number of
+	// workers of EncryptFrom, which uses runtime.GOMAXPROCS(0) by default.
+	//
+	// With the default of one, chunks are processed in the goroutine calling
+	// Write or Read.
+	Concurrency int
+}
+
+// EncryptWithOptions is like Encrypt, but with the behaviors configured by
+// opts, which may be nil.
+func EncryptWithOptions(dst io.Writer, opts *Options, recipients ...Recipient) (io.WriteCloser, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
 	if len(recipients) == 0 {
 		return nil, errors.New("no recipients specified")
 	}
 
 	fileKey := make([]byte, fileKeySize)
-	if _, err := rand.Read(fileKey); err != nil {
+	if _, err := io.ReadFull(opts.rand(), fileKey); err != nil {
 		return nil, err
 	}
 
+	hdr, err := encryptHdr(fileKey, opts, recipients...)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, streamNonceSize)
+	if _, err := io.ReadFull(opts.rand(), nonce); err != nil {
+		return nil, err
+	}
+	if opts.SigningKey != nil {
+		if err := signHeader(hdr, fileKey, nonce, opts.SigningKey); err != nil {
+			return nil, fmt.Errorf("failed to sign header: %v", err)
+		}
+		opts.debug("added signature stanza")
+	}
+
+	if err := hdr.Marshal(dst); err != nil {
+		return nil, fmt.Errorf("failed to write header: %v", err)
+	}
+	if _, err := dst.Write(nonce); err != nil {
+		return nil, fmt.Errorf("failed to write nonce: %v", err)
+	}
+
+	w, err := stream.NewWriterSize(streamKey(fileKey, nonce), dst, opts.chunkSize())
+	if err != nil {
+		return nil, err
+	}
+	w.SetConcurrency(opts.Concurrency)
+	if opts.Tracer != nil {
+		return &tracedWriter{w, opts.startSpan("age.Payload")}, nil
+	}
+	return w, nil
+}
+
+func (opts *Options) rand() io.Reader {
+	if opts.Rand != nil {
+		return opts.Rand
+	}
+	return rand.Reader
+}
+
+// encryptHdr wraps fileKey for each recipient, and returns the resulting
+// header, including the MAC.
+func encryptHdr(fileKey []byte, opts *Options, recipients ...Recipient) (*format.Header, error) {
+	stanzas, err := wrapFileKey(fileKey, opts, recipients...)
+	if err != nil {
+		return nil, err
+	}
 	hdr := &format.Header{}
+	for _, s := range stanzas {
+		hdr.Recipients = append(hdr.Recipients, (*format.Stanza)(s))
+	}
+	if opts.Grease && !hasPassphraseStanza(hdr.Recipients) {
+		s, err := greaseStanza(opts.rand())
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate grease stanza: %v", err)
+		}
+		var pos [1]byte
+		if _, err := io.ReadFull(opts.rand(), pos[:]); err != nil {
+			return nil, err
+		}
+		i := int(pos[0]) % (len(hdr.Recipients) + 1)
+		hdr.Recipients = append(hdr.Recipients[:i], append([]*format.Stanza{s}, hdr.Recipients[i:]...)...)
+		opts.debug("added grease stanza", "type", s.Type, "position", i)
+	}
+	if opts.Metadata != nil {
+		s, err := opts.Metadata.stanza(fileKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt metadata: %v", err)
+		}
+		hdr.Recipients = append(hdr.Recipients, s)
+		opts.debug("added metadata stanza")
+	}
+	if opts.ChunkSize != 0 && opts.ChunkSize != stream.ChunkSize {
+		if err := checkChunkSize(opts.ChunkSize); err != nil {
+			return nil, err
+		}
+		hdr.Recipients = append(hdr.Recipients, chunkSizeStanza(opts.ChunkSize))
+		opts.debug("added chunk-size stanza", "size", opts.ChunkSize)
+	}
+	if mac, err := headerMAC(fileKey, hdr); err != nil {
+		return nil, fmt.Errorf("failed to compute header MAC: %v", err)
+	} else {
+		hdr.MAC = mac
+	}
+	opts.debug("encrypted header", "stanzas", stanzaTypes(hdr.Recipients))
+	return hdr, nil
+}
+
+// wrapFileKey wraps fileKey for each recipient, and returns the resulting
+// recipient stanzas.
+func wrapFileKey(fileKey []byte, opts *Options, recipients ...Recipient) ([]*Stanza, error) {
+	var all []*Stanza
 	var labels []string
+	var compact []*X25519Recipient
 	for i, r := range recipients {
-		stanzas, l, err := wrapWithLabels(r, fileKey)
-		if err != nil {
-			return nil, fmt.Errorf("failed to wrap key for recipient #%d: %v", i, err)
+		var stanzas []*Stanza
+		var l []string
+		if x, ok := r.(*X25519Recipient); ok && opts.CompactX25519 {
+			compact = append(compact, x)
+		} else {
+			var err error
+			span := opts.startSpan("age.Wrap", "recipient", i, "type", typeName(r))
+			stanzas, l, err = wrapWithLabels(r, fileKey, opts.Rand)
+			span.End(err)
+			if err != nil {
+				opts.debug("failed to wrap file key", "recipient", i, "type", typeName(r), "error", err)
+				return nil, &RecipientError{Index: i, Recipient: r, Err: err}
+			}
+			opts.debug("wrapped file key", "recipient", i, "type", typeName(r),
+				"stanzas", len(stanzas), "labels", l)
 		}
 		sort.Strings(l)
 		if i == 0 {
@@ -145,31 +389,81 @@ func Encrypt(dst io.Writer, recipients ...Recipient) (io.WriteCloser, error) {
 		} else if !slicesEqual(labels, l) {
 			return nil, fmt.Errorf("incompatible recipients")
 		}
-		for _, s := range stanzas {
-			hdr.Recipients = append(hdr.Recipients, (*format.Stanza)(s))
+		all = append(all, stanzas...)
+	}
+	if len(compact) > 0 {
+		span := opts.startSpan("age.Wrap", "recipients", len(compact), "type", "X25519-compact")
+		s, err := wrapX25519Compact(fileKey, compact, opts.rand())
+		span.End(err)
+		if err != nil {
+			return nil, fmt.Errorf("failed to wrap key for X25519 recipients: %v", err)
 		}
+		all = append(all, s)
+		opts.debug("wrapped file key in compact stanza", "recipients", len(compact))
 	}
-	if mac, err := headerMAC(fileKey, hdr); err != nil {
-		return nil, fmt.Errorf("failed to compute header MAC: %v", err)
-	} else {
-		hdr.MAC = mac
+	return all, nil
+}
+
+// WrapFileKey wraps fileKey for each of the recipients, and returns the
+// resulting stanzas, like the recipient stanzas of the header Encrypt would
+// produce, including the check that the recipients' labels match.
+//
+// It doesn't produce a header, a MAC, or a payload, and is meant for bindings
+// and protocols that embed age stanzas in their own containers. fileKey must
+// be 16 bytes from crypto/rand, and must be used for a single message.
+func WrapFileKey(fileKey []byte, recipients ...Recipient) ([]*Stanza, error) {
+	if len(fileKey) != fileKeySize {
+		return nil, fmt.Errorf("invalid file key size %d", len(fileKey))
 	}
-	if err := hdr.Marshal(dst); err != nil {
-		return nil, fmt.Errorf("failed to write header: %v", err)
+	if len(recipients) == 0 {
+		return nil, errors.New("no recipients specified")
 	}
+	return wrapFileKey(fileKey, &Options{}, recipients...)
+}
 
-	nonce := make([]byte, streamNonceSize)
-	if _, err := rand.Read(nonce); err != nil {
+// UnwrapFileKey tries each of the identities in order with stanzas, and
+// returns the file key unwrapped by the first one that matches. If none of
+// them do, it returns a *NoIdentityMatchError.
+//
+// Unlike Decrypt, UnwrapFileKey has no header MAC to check, so the caller
+// must authenticate the stanzas some other way, for example with a MAC
+// keyed by the file key, as age does. Otherwise, an attacker that can modify
+// the stanzas might be able to substitute the file key.
+func UnwrapFileKey(stanzas []*Stanza, identities ...Identity) ([]byte, error) {
+	fileKey, _, err := unwrapFileKey(stanzas, nil, nil, identities...)
+	if err != nil {
 		return nil, err
 	}
-	if _, err := dst.Write(nonce); err != nil {
-		return nil, fmt.Errorf("failed to write nonce: %v", err)
+	if len(fileKey) != fileKeySize {
+		return nil, fmt.Errorf("identity returned a file key of invalid size %d", len(fileKey))
+	}
+	return fileKey, nil
+}
+
+func hasPassphraseStanza(stanzas []*format.Stanza) bool {
+	for _, s := range stanzas {
+		if _, ok := passphraseKDFs[s.Type]; ok {
+			return true
+		}
 	}
+	return false
+}
 
-	return stream.NewWriter(streamKey(fileKey, nonce), dst)
+// randRecipient is implemented by recipients that can draw their randomness
+// from Options.Rand. Like RecipientWithLabels, it returns the recipient's
+// labels, if any.
+type randRecipient interface {
+	wrapWithRand(fileKey []byte, rand io.Reader) ([]*Stanza, []string, error)
 }
 
-func wrapWithLabels(r Recipient, fileKey []byte) (s []*Stanza, labels []string, err error) {
+func wrapWithLabels(r Recipient, fileKey []byte, rand io.Reader) (s []*Stanza, labels []string, err error) {
+	if rand != nil {
+		rr, ok := r.(randRecipient)
+		if !ok {
+			return nil, nil, fmt.Errorf("recipient type %T doesn't support Options.Rand", r)
+		}
+		return rr.wrapWithRand(fileKey, rand)
+	}
 	if r, ok := r.(RecipientWithLabels); ok {
 		return r.WrapWithLabels(fileKey)
 	}
@@ -189,12 +483,24 @@ func slicesEqual(s1, s2 []string) bool {
 	return true
 }
 
+// SupportedVersions returns the header version lines, such as
+// "age-encryption.org/v1", of the format versions that Decrypt can read, in
+// order of preference. Encrypt always produces files of the first version.
+func SupportedVersions() []string {
+	return format.Versions()
+}
+
 // NoIdentityMatchError is returned by Decrypt when none of the supplied
 // identities match the encrypted file.
 type NoIdentityMatchError struct {
 	// Errors is a slice of all the errors returned to Decrypt by the Unwrap
 	// calls it made. They all wrap ErrIncorrectIdentity.
 	Errors []error
+
+	// StanzaTypes are the types of the recipient stanzas in the header, in
+	// order, which hint at the kind of key the file was encrypted to. They
+	// don't include the metadata, signature, and chunk-size stanzas.
+	StanzaTypes []string
 }
 
 func (*NoIdentityMatchError) Error() string {
@@ -205,56 +511,334 @@ func (*NoIdentityMatchError) Error() string {
 //
 // It returns a Reader reading the decrypted plaintext of the age file read
 // from src. All identities will be tried until one successfully decrypts the file.
+//
+// Like the Encrypt WriteCloser, the Reader has a SetProgressFunc method, which
+// sets a function that is called after each chunk is decrypted and
+// authenticated.
+//
+// The Reader also has a Size() int64 method, which returns the exact size of
+// the plaintext if the size of src is known, or -1 otherwise. See
+// DecryptResult.PayloadSize for details.
 func Decrypt(src io.Reader, identities ...Identity) (io.Reader, error) {
+	r, _, err := DecryptWithResult(src, identities...)
+	return r, err
+}
+
+// DecryptResult is information about a file decrypted by DecryptWithResult.
+//
+// Note that the labels returned by RecipientWithLabels are not stored in the
+// file, so they can't be reported.
+type DecryptResult struct {
+	// Metadata is the metadata stored in the file header, if any.
+	Metadata *Metadata
+
+	// Identity is the identity that unwrapped the file key, and IdentityIndex
+	// is its zero-based position in the arguments to DecryptWithResult.
+	Identity      Identity
+	IdentityIndex int
+
+	// Version is the header version line, such as "age-encryption.org/v1".
+	Version string
+
+	// Stanzas are the types of the stanzas in the header, in order, including
+	// those that were not addressed to any of the identities.
+	Stanzas []string
+
+	// Signer is the public key that signed the header, if the file was
+	// encrypted with Options.SigningKey, or nil otherwise. If the header has
+	// an invalid signature, DecryptWithOptions fails with ErrBadSignature.
+	Signer ed25519.PublicKey
+
+	// PayloadSize is the size of the plaintext, or -1 if it's not known. It's
+	// only known if src implements io.Seeker or Options.SourceSize is set, and
+	// even then it's not authenticated until the Reader returns io.EOF.
+	PayloadSize int64
+}
+
+// DecryptWithResult is like Decrypt, but it also returns information about the
+// decrypted file.
+func DecryptWithResult(src io.Reader, identities ...Identity) (io.Reader, *DecryptResult, error) {
+	return DecryptWithOptions(src, nil, identities...)
+}
+
+// DecryptWithOptions is like DecryptWithResult, but with the behaviors
+// configured by opts, which may be nil. Options that only affect encryption
+// are ignored.
+func DecryptWithOptions(src io.Reader, opts *Options, identities ...Identity) (io.Reader, *DecryptResult, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
 	if len(identities) == 0 {
-		return nil, errors.New("no identities specified")
+		return nil, nil, errors.New("no identities specified")
+	}
+
+	srcSize := int64(-1)
+	if opts.SourceSize > 0 {
+		srcSize = opts.SourceSize
+	} else if s, ok := src.(io.Seeker); ok {
+		srcSize = remainingSize(s)
+	}
+
+	dh, err := readHeader(src, opts, identities)
+	if err != nil {
+		return nil, nil, err
 	}
+	hdr, fileKey := dh.hdr, dh.fileKey
 
+	warnHeader(opts, hdr)
+
+	chunkSize, err := payloadChunkSize(hdr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res := &DecryptResult{
+		Identity:      identities[dh.matched],
+		IdentityIndex: dh.matched,
+		Version:       format.V1.Name,
+		Stanzas:       stanzaTypes(hdr.Recipients),
+		PayloadSize:   -1,
+	}
+	if hdr.Version != nil {
+		res.Version = hdr.Version.Name
+	}
+	if srcSize >= 0 && dh.size >= 0 {
+		if n, err := plaintextSize(srcSize-dh.size, chunkSize); err == nil {
+			res.PayloadSize = n
+		}
+	} else if srcSize >= 0 {
+		res.PayloadSize = payloadSize(srcSize, hdr, chunkSize)
+	}
+	for _, s := range hdr.Recipients {
+		if s.Type != metadataStanzaType {
+			continue
+		}
+		res.Metadata, err = parseMetadata(s, fileKey)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if opts.MaxPayloadSize > 0 && res.PayloadSize > opts.MaxPayloadSize {
+		return nil, nil, ErrPayloadTooLarge
+	}
+
+	nonce := make([]byte, streamNonceSize)
+	if _, err := io.ReadFull(dh.payload, nonce); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, nil, fmt.Errorf("failed to read nonce: %w", &PayloadTruncatedError{})
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("failed to read nonce: %w", err)
+	}
+	res.Signer, err = verifySignature(hdr, dh.signedHash, nonce)
+	if err != nil {
+		opts.debug("header signature verification failed", "error", err)
+		return nil, nil, err
+	}
+	if res.Signer != nil {
+		opts.debug("header signature verified")
+	}
+
+	sr, err := stream.NewReaderSize(streamKey(fileKey, nonce), dh.payload, chunkSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	sr.SetConcurrency(opts.Concurrency)
+	r := &payloadReader{Reader: sr, size: res.PayloadSize, max: opts.MaxPayloadSize, chunkSize: chunkSize}
+	if opts.Tracer != nil {
+		return &tracedReader{Reader: r, span: opts.startSpan("age.Payload")}, res, nil
+	}
+	return r, res, nil
+}
+
+// readHeader reads the header from src and unwraps the file key, one stanza at
+// a time if possible.
+func readHeader(src io.Reader, opts *Options, identities []Identity) (*decryptedHeader, error) {
+	if canStreamHeader(opts, identities) {
+		return streamHeader(src, opts, identities)
+	}
+
+	span := opts.startSpan("age.ParseHeader")
 	hdr, payload, err := format.Parse(src)
+	span.End(err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", headerError(err))
+	}
+
+	if opts.Policy != nil {
+		if err := opts.Policy(headerInfo(hdr)); err != nil {
+			opts.debug("header rejected by policy", "error", err)
+			return nil, &PolicyError{Err: err}
+		}
+	}
+
+	fileKey, matched, err := decryptHdr(hdr, opts, identities...)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptedHeader{hdr: hdr, payload: payload, fileKey: fileKey, matched: matched, size: -1}, nil
+}
+
+// VerifyHeader reads the header of the age file from src, unwraps the file key
+// with the first matching identity, and checks the header MAC. It returns nil
+// if the header is valid, or the same error Decrypt would return.
+//
+// The payload is not read, so files with a valid header but a corrupted or
+// truncated payload are not detected. VerifyHeader may read a small amount of
+// data past the end of the header from src.
+func VerifyHeader(src io.Reader, identities ...Identity) error {
+	if len(identities) == 0 {
+		return errors.New("no identities specified")
+	}
+	_, err := readHeader(src, &Options{}, identities)
+	return err
+}
+
+// payloadReader is the Reader returned by DecryptWithOptions.
+type payloadReader struct {
+	*stream.Reader
+	size int64
+	// max is Options.MaxPayloadSize, and n is the number of bytes read.
+	max, n    int64
+	chunkSize int
+}
+
+func (r *payloadReader) Read(p []byte) (int, error) {
+	if r.max > 0 && r.n > r.max {
+		return 0, ErrPayloadTooLarge
+	}
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	if r.max > 0 && r.n > r.max {
+		return n - int(r.n-r.max), ErrPayloadTooLarge
+	}
+	if err != nil && err != io.EOF {
+		err = payloadError(err, r.n, r.chunkSize)
+	}
+	return n, err
+}
+
+// Size returns the size of the plaintext, or -1 if it's not known.
+func (r *payloadReader) Size() int64 {
+	return r.size
+}
+
+// remainingSize returns the number of bytes between the current offset of src
+// and its end, or -1 if it can't be determined. The current offset of src is
+// preserved.
+func remainingSize(src io.Seeker) int64 {
+	cur, err := src.Seek(0, io.SeekCurrent)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read header: %w", err)
+		return -1
 	}
+	end, err := src.Seek(0, io.SeekEnd)
+	if _, err := src.Seek(cur, io.SeekStart); err != nil {
+		return -1
+	}
+	if err != nil {
+		return -1
+	}
+	return end - cur
+}
 
+// payloadSize returns the size of the plaintext of a file of srcSize bytes
+// with header hdr and payload chunks of chunkSize bytes, or -1 if it can't be
+// determined.
+func payloadSize(srcSize int64, hdr *format.Header, chunkSize int) int64 {
+	// The header encoding is not malleable, so we can recompute its length.
+	hdrBuf := &bytes.Buffer{}
+	if err := hdr.Marshal(hdrBuf); err != nil {
+		return -1
+	}
+	n, err := plaintextSize(srcSize-int64(hdrBuf.Len()), chunkSize)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// decryptHdr unwraps the file key from hdr with the first matching identity,
+// and checks the header MAC. It returns the file key and the index of the
+// identity that unwrapped it. opts may be nil.
+func decryptHdr(hdr *format.Header, opts *Options, identities ...Identity) (fileKey []byte, matched int, err error) {
+	opts.debug("parsed header", "stanzas", stanzaTypes(hdr.Recipients))
 	stanzas := make([]*Stanza, 0, len(hdr.Recipients))
-	for _, s := range hdr.Recipients {
+	// positions maps the index of a stanza in stanzas to its index in hdr.
+	positions := make([]int, 0, len(hdr.Recipients))
+	var metadata int
+	for n, s := range hdr.Recipients {
+		// Metadata, signature, and chunk-size stanzas are not recipient
+		// stanzas, and are not passed to the identities, so that
+		// ScryptIdentity still finds itself alone.
+		if s.Type == metadataStanzaType {
+			metadata++
+			continue
+		}
+		if s.Type == signatureStanzaType || s.Type == chunkSizeStanzaType {
+			continue
+		}
 		stanzas = append(stanzas, (*Stanza)(s))
+		positions = append(positions, n)
+	}
+	if metadata > 1 {
+		return nil, 0, errors.New("multiple metadata stanzas")
 	}
+	fileKey, matched, err = unwrapFileKey(stanzas, positions, opts, identities...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if mac, err := headerMAC(fileKey, hdr); err != nil {
+		return nil, 0, fmt.Errorf("failed to compute header MAC: %v", err)
+	} else if !hmac.Equal(mac, hdr.MAC) {
+		opts.debug("header MAC mismatch")
+		return nil, 0, &HeaderMACError{Identity: identities[matched], IdentityIndex: matched}
+	}
+	opts.debug("header MAC verified")
+	return fileKey, matched, nil
+}
+
+// unwrapFileKey returns the file key unwrapped from stanzas by the first
+// matching identity, and the index of that identity. positions, if not nil,
+// maps the index of a stanza to its index in the header, for StanzaError.
+// opts may be nil.
+func unwrapFileKey(stanzas []*Stanza, positions []int, opts *Options, identities ...Identity) (fileKey []byte, matched int, err error) {
 	errNoMatch := &NoIdentityMatchError{}
-	var fileKey []byte
-	for _, id := range identities {
+	for _, s := range stanzas {
+		errNoMatch.StanzaTypes = append(errNoMatch.StanzaTypes, s.Type)
+	}
+	for i, id := range identities {
+		span := opts.startSpan("age.Unwrap", "identity", i, "type", typeName(id))
 		fileKey, err = id.Unwrap(stanzas)
+		span.End(err)
+		opts.audit(i, id, stanzas, err)
 		if errors.Is(err, ErrIncorrectIdentity) {
+			opts.debug("identity didn't match", "identity", i, "type", typeName(id))
 			errNoMatch.Errors = append(errNoMatch.Errors, err)
 			continue
 		}
 		if err != nil {
-			return nil, err
+			opts.debug("identity failed", "identity", i, "type", typeName(id), "error", err)
+			var se *StanzaError
+			if errors.As(err, &se) && se.Index >= 0 && se.Index < len(positions) {
+				se.Index = positions[se.Index]
+			}
+			return nil, 0, &IdentityError{Index: i, Identity: id, Err: err}
 		}
 
+		opts.debug("identity matched", "identity", i, "type", typeName(id))
+		matched = i
 		break
 	}
 	if fileKey == nil {
-		return nil, errNoMatch
-	}
-
-	if mac, err := headerMAC(fileKey, hdr); err != nil {
-		return nil, fmt.Errorf("failed to compute header MAC: %v", err)
-	} else if !hmac.Equal(mac, hdr.MAC) {
-		return nil, errors.New("bad header MAC")
+		return nil, 0, errNoMatch
 	}
-
-	nonce := make([]byte, streamNonceSize)
-	if _, err := io.ReadFull(payload, nonce); err != nil {
-		return nil, fmt.Errorf("failed to read nonce: %w", err)
-	}
-
-	return stream.NewReader(streamKey(fileKey, nonce), payload)
+	return fileKey, matched, nil
 }
 
 // multiUnwrap is a helper that implements Identity.Unwrap in terms of a
 // function that unwraps a single recipient stanza.
 func multiUnwrap(unwrap func(*Stanza) ([]byte, error), stanzas []*Stanza) ([]byte, error) {
-	for _, s := range stanzas {
+	for i, s := range stanzas {
 		fileKey, err := unwrap(s)
 		if errors.Is(err, ErrIncorrectIdentity) {
 			// If we ever start returning something interesting wrapping
@@ -263,7 +847,7 @@ func multiUnwrap(unwrap func(*Stanza) ([]byte, error), stanzas []*Stanza) ([]byt
 			continue
 		}
 		if err != nil {
-			return nil, err
+			return nil, &StanzaError{Index: i, Type: s.Type, Err: err}
 		}
 		return fileKey, nil
 	}
@@ -6,14 +6,24 @@ package age_test
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"filippo.io/age"
+	"filippo.io/age/stream"
 )
 
 func ExampleEncrypt() {
@@ -189,6 +199,1553 @@ func TestEncryptDecryptScrypt(t *testing.T) {
 	}
 }
 
+func TestScryptMixedRecipients(t *testing.T) {
+	key, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newRecipient := func(password string) *age.ScryptRecipient {
+		r, err := age.NewScryptRecipient(password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.SetWorkFactor(10)
+		return r
+	}
+	newIdentity := func(password string) *age.ScryptIdentity {
+		i, err := age.NewScryptIdentity(password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return i
+	}
+
+	if _, err := age.Encrypt(io.Discard, key.Recipient(), newRecipient("recovery")); err == nil {
+		t.Error("expected mixing a ScryptRecipient to fail by default")
+	}
+
+	recovery, other := newRecipient("recovery"), newRecipient("other")
+	recovery.AllowMixedRecipients()
+	other.AllowMixedRecipients()
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, key.Recipient(), recovery, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := age.Decrypt(bytes.NewReader(buf.Bytes()), newIdentity("recovery")); err == nil ||
+		!strings.Contains(err.Error(), "must be the only one") {
+		t.Errorf("expected mixed file to be rejected by default, got %v", err)
+	}
+	for _, id := range []age.Identity{key, newIdentity("recovery"), newIdentity("other")} {
+		if i, ok := id.(*age.ScryptIdentity); ok {
+			i.AllowMixedRecipients()
+		}
+		out, err := age.Decrypt(bytes.NewReader(buf.Bytes()), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outBytes, err := io.ReadAll(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(outBytes) != helloWorld {
+			t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+		}
+	}
+	wrong := newIdentity("wrong")
+	wrong.AllowMixedRecipients()
+	if _, err := age.Decrypt(bytes.NewReader(buf.Bytes()), wrong); !errors.As(err, new(*age.NoIdentityMatchError)) {
+		t.Errorf("expected NoIdentityMatchError, got %v", err)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	password := "twitch.tv/filosottile"
+	r, err := age.NewScryptRecipient(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetWorkFactor(15)
+	i, err := age.NewScryptIdentity(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := &age.Metadata{
+		Name:        "hello.txt",
+		ModTime:     time.Unix(1700000000, 0),
+		ContentType: "text/plain",
+	}
+	buf := &bytes.Buffer{}
+	w, err := age.EncryptWithOptions(buf, &age.Options{Metadata: metadata}, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("hello.txt")) {
+		t.Error("metadata stored in plaintext")
+	}
+
+	out, res, err := age.DecryptWithResult(bytes.NewReader(buf.Bytes()), i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outBytes, err := io.ReadAll(out); err != nil {
+		t.Fatal(err)
+	} else if string(outBytes) != helloWorld {
+		t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+	}
+	if res.Metadata == nil || res.Metadata.Name != metadata.Name ||
+		!res.Metadata.ModTime.Equal(metadata.ModTime) ||
+		res.Metadata.ContentType != metadata.ContentType {
+		t.Errorf("wrong metadata: %+v", res.Metadata)
+	}
+
+	if _, err := age.Decrypt(bytes.NewReader(buf.Bytes()), i); err != nil {
+		t.Errorf("Decrypt failed on file with metadata: %v", err)
+	}
+
+	buf.Reset()
+	w, err = age.Encrypt(buf, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, res, err := age.DecryptWithResult(buf, i); err != nil {
+		t.Fatal(err)
+	} else if res.Metadata != nil {
+		t.Errorf("unexpected metadata: %+v", res.Metadata)
+	}
+}
+
+func TestDeterministicRand(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypt := func(seed string, recipients ...age.Recipient) ([]byte, error) {
+		buf := &bytes.Buffer{}
+		opts := &age.Options{Rand: age.DeterministicRand([]byte(seed))}
+		w, err := age.EncryptWithOptions(buf, opts, recipients...)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(w, helloWorld); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	a, err := encrypt("seed", i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := encrypt("seed", i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a, b) {
+		t.Error("same seed produced different files")
+	}
+	c, err := encrypt("other seed", i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(a, c) {
+		t.Error("different seeds produced the same file")
+	}
+
+	out, err := age.Decrypt(bytes.NewReader(a), i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outBytes, err := io.ReadAll(out); err != nil {
+		t.Fatal(err)
+	} else if string(outBytes) != helloWorld {
+		t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+	}
+
+	sr, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr.SetWorkFactor(10)
+	a, err = encrypt("seed", sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = encrypt("seed", sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a, b) {
+		t.Error("same seed produced different scrypt files")
+	}
+	si, err := age.NewScryptIdentity("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.Decrypt(bytes.NewReader(a), si); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encrypt("seed", sr, sr); err == nil {
+		t.Error("expected multiple scrypt recipients to fail")
+	}
+
+	x448, err := age.GenerateX448Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encrypt("seed", x448.Recipient()); err == nil {
+		t.Error("expected recipient without Rand support to fail")
+	}
+}
+
+// writerAtBuffer is an in-memory io.WriterAt.
+type writerAtBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (b *writerAtBuffer) WriteAt(p []byte, off int64) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if end := int(off) + len(p); end > len(b.buf) {
+		b.buf = append(b.buf, make([]byte, end-len(b.buf))...)
+	}
+	return copy(b.buf[off:], p), nil
+}
+
+func TestEncryptAt(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const chunk = 64 * 1024
+	for _, size := range []int{0, 1, chunk, 5*chunk + 100} {
+		plaintext := bytes.Repeat([]byte("x"), size)
+		expected := &bytes.Buffer{}
+		w, err := age.EncryptWithOptions(expected, &age.Options{
+			Rand: age.DeterministicRand([]byte("seed"))}, i.Recipient())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(plaintext); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		dst := &writerAtBuffer{}
+		pw, err := age.EncryptAt(dst, int64(size), &age.Options{
+			Rand: age.DeterministicRand([]byte("seed"))}, i.Recipient())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Write pairs of chunks concurrently, in reverse order.
+		var wg sync.WaitGroup
+		for off := (size - 1) / (2 * chunk) * 2 * chunk; off >= 0 && size > 0; off -= 2 * chunk {
+			end := off + 2*chunk
+			if end > size {
+				end = size
+			}
+			wg.Add(1)
+			go func(off, end int) {
+				defer wg.Done()
+				if _, err := pw.WriteAt(plaintext[off:end], int64(off)); err != nil {
+					t.Error(err)
+				}
+			}(off, end)
+		}
+		wg.Wait()
+		if err := pw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(dst.buf, expected.Bytes()) {
+			t.Errorf("size %d: EncryptAt output differs from EncryptWithOptions", size)
+		}
+		if pw.EncryptedSize() != int64(expected.Len()) {
+			t.Errorf("size %d: EncryptedSize is %d, expected %d", size, pw.EncryptedSize(), expected.Len())
+		}
+	}
+
+	pw, err := age.EncryptAt(&writerAtBuffer{}, 3*chunk, nil, i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pw.WriteAt(make([]byte, chunk), 100); err == nil {
+		t.Error("expected unaligned write to fail")
+	}
+	if _, err := pw.WriteAt(make([]byte, 100), 0); err == nil {
+		t.Error("expected short write to fail")
+	}
+	if _, err := pw.WriteAt(make([]byte, chunk), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pw.WriteAt(make([]byte, chunk), 0); err == nil {
+		t.Error("expected rewriting a chunk to fail")
+	}
+	if err := pw.Close(); err == nil {
+		t.Error("expected Close with missing chunks to fail")
+	}
+}
+
+func TestEncryptFrom(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const chunk = 64 * 1024
+	for _, size := range []int{0, 1, chunk, 50*chunk + 100} {
+		plaintext := make([]byte, size)
+		for j := range plaintext {
+			plaintext[j] = byte(j / chunk)
+		}
+		expected := &bytes.Buffer{}
+		w, err := age.EncryptWithOptions(expected, &age.Options{
+			Rand: age.DeterministicRand([]byte("seed"))}, i.Recipient())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(plaintext); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		out := &bytes.Buffer{}
+		if err := age.EncryptFrom(out, bytes.NewReader(plaintext), int64(size), &age.Options{
+			Rand: age.DeterministicRand([]byte("seed"))}, i.Recipient()); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), expected.Bytes()) {
+			t.Errorf("size %d: EncryptFrom output differs from EncryptWithOptions", size)
+		}
+	}
+
+	src := bytes.NewReader(make([]byte, 3*chunk))
+	if err := age.EncryptFrom(io.Discard, src, 5*chunk, nil, i.Recipient()); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected ErrUnexpectedEOF for short source, got %v", err)
+	}
+}
+
+func TestChunkSize(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const chunk = 128 * 1024
+	size := 3*chunk + 100
+	plaintext := make([]byte, size)
+	for j := range plaintext {
+		plaintext[j] = byte(j / chunk)
+	}
+	opts := &age.Options{ChunkSize: chunk, Rand: age.DeterministicRand([]byte("seed"))}
+	buf := &bytes.Buffer{}
+	w, err := age.EncryptWithOptions(buf, opts, i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var info age.HeaderInfo
+	for _, opts := range []*age.Options{nil, {Policy: func(hi age.HeaderInfo) error {
+		info = hi
+		return nil
+	}}} {
+		r, res, err := age.DecryptWithOptions(bytes.NewReader(buf.Bytes()), opts, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.PayloadSize != int64(size) {
+			t.Errorf("PayloadSize is %d, expected %d", res.PayloadSize, size)
+		}
+		out, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, plaintext) {
+			t.Error("wrong data")
+		}
+	}
+	if info.ChunkSize != chunk || len(info.Stanzas) != 1 {
+		t.Errorf("unexpected HeaderInfo: %+v", info)
+	}
+
+	out := &bytes.Buffer{}
+	opts.Rand = age.DeterministicRand([]byte("seed"))
+	if err := age.EncryptFrom(out, bytes.NewReader(plaintext), int64(size), opts, i.Recipient()); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), buf.Bytes()) {
+		t.Error("EncryptFrom output differs from EncryptWithOptions")
+	}
+
+	j, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := age.Rekey(out, bytes.NewReader(buf.Bytes()), []age.Identity{i}, []age.Recipient{j.Recipient()}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := age.Decrypt(out, j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, plaintext) {
+		t.Errorf("rekeyed file failed to decrypt: %v", err)
+	}
+
+	out.Reset()
+	w, err = age.EncryptWithOptions(out, &age.Options{ChunkSize: 64 * 1024}, i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, res, err := age.DecryptWithResult(out, i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Stanzas) != 1 {
+		t.Errorf("default chunk size added stanzas: %v", res.Stanzas)
+	}
+
+	for _, size := range []int{-1, 1000, 3 * 64 * 1024, 32 * 1024 * 1024} {
+		if _, err := age.EncryptWithOptions(io.Discard, &age.Options{ChunkSize: size}, i.Recipient()); err == nil {
+			t.Errorf("chunk size %d was accepted", size)
+		}
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const chunk = 64 * 1024
+	plaintext := make([]byte, 10*chunk+100)
+	for j := range plaintext {
+		plaintext[j] = byte(j / chunk)
+	}
+	encrypt := func(concurrency int) []byte {
+		buf := &bytes.Buffer{}
+		w, err := age.EncryptWithOptions(buf, &age.Options{Concurrency: concurrency,
+			Rand: age.DeterministicRand([]byte("seed"))}, i.Recipient())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(plaintext); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	expected := encrypt(1)
+	if got := encrypt(4); !bytes.Equal(got, expected) {
+		t.Error("concurrent encryption output differs from sequential")
+	}
+
+	r, _, err := age.DecryptWithOptions(bytes.NewReader(expected), &age.Options{Concurrency: 4}, i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, plaintext) {
+		t.Error("wrong data")
+	}
+
+	damaged := append([]byte{}, expected...)
+	damaged[len(damaged)-2*chunk] ^= 1
+	r, _, err = age.DecryptWithOptions(bytes.NewReader(damaged), &age.Options{Concurrency: 4}, i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = io.ReadAll(r)
+	if err == nil {
+		t.Error("damaged payload was decrypted")
+	}
+	if len(out)%chunk != 0 || !bytes.HasPrefix(plaintext, out) {
+		t.Errorf("returned %d bytes of wrong data before the damaged chunk", len(out))
+	}
+}
+
+func TestGrease(t *testing.T) {
+	x25519, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	x448, err := age.GenerateX448Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	scryptRecipient, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scryptRecipient.SetWorkFactor(10)
+	scryptIdentity, err := age.NewScryptIdentity("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		recipients []age.Recipient
+		identity   age.Identity
+	}{
+		{[]age.Recipient{x25519.Recipient()}, x25519},
+		{[]age.Recipient{x25519.Recipient(), x448.Recipient()}, x448},
+		{[]age.Recipient{scryptRecipient}, scryptIdentity},
+	}
+	for _, tt := range tests {
+		for n := 0; n < 10; n++ {
+			buf := &bytes.Buffer{}
+			w, err := age.EncryptWithOptions(buf, &age.Options{Grease: true}, tt.recipients...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.WriteString(w, helloWorld); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			_, isScrypt := tt.identity.(*age.ScryptIdentity)
+			if hasGrease := bytes.Contains(buf.Bytes(), []byte("-grease")); hasGrease == isScrypt {
+				t.Errorf("unexpected grease presence: %v", hasGrease)
+			}
+
+			out, err := age.Decrypt(buf, tt.identity)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if outBytes, err := io.ReadAll(out); err != nil {
+				t.Fatal(err)
+			} else if string(outBytes) != helloWorld {
+				t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+			}
+		}
+	}
+}
+
+func TestMultiDecryptor(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sizes := []int{0, 5, 64 * 1024, 64*1024 + 1, 128*1024 - 10, 128 * 1024, 0}
+	buf := &bytes.Buffer{}
+	var plaintexts [][]byte
+	for n, size := range sizes {
+		r := a.Recipient()
+		if n%2 == 1 {
+			r = b.Recipient()
+		}
+		w, err := age.Encrypt(buf, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := bytes.Repeat([]byte{byte(n)}, size)
+		if _, err := w.Write(p); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		plaintexts = append(plaintexts, p)
+	}
+	data := buf.Bytes()
+
+	d := age.NewMultiDecryptor(bytes.NewReader(data), a, b)
+	for n, p := range plaintexts {
+		r, err := d.Next()
+		if err != nil {
+			t.Fatalf("file %d: %v", n, err)
+		}
+		if n == 2 {
+			// Leave this one unread, for Next to skip.
+			continue
+		}
+		out, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("file %d: %v", n, err)
+		}
+		if !bytes.Equal(out, p) {
+			t.Errorf("file %d: wrong data", n)
+		}
+	}
+	if _, err := d.Next(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+
+	d = age.NewMultiDecryptor(bytes.NewReader(data[:len(data)-1]), a, b)
+	for {
+		r, err := d.Next()
+		if err == io.EOF {
+			t.Fatal("expected truncated stream to fail")
+		}
+		if err != nil {
+			break
+		}
+		if _, err := io.ReadAll(r); err != nil {
+			break
+		}
+	}
+}
+
+type testLogger struct {
+	msgs []string
+	args []interface{}
+}
+
+func (l *testLogger) Debug(msg string, args ...interface{}) {
+	l.msgs = append(l.msgs, msg)
+	l.args = append(l.args, args...)
+}
+
+func TestLogger(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := &testLogger{}
+	buf := &bytes.Buffer{}
+	w, err := age.EncryptWithOptions(buf, &age.Options{Logger: l}, b.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(l.msgs) == 0 {
+		t.Error("no events logged during encryption")
+	}
+
+	l = &testLogger{}
+	if _, _, err := age.DecryptWithOptions(buf, &age.Options{Logger: l}, a, b); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(l.msgs, "\n")
+	for _, want := range []string{"parsed header", "identity didn't match",
+		"identity matched", "header MAC verified"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing event %q in:\n%s", want, got)
+		}
+	}
+	for _, arg := range l.args {
+		s := fmt.Sprint(arg)
+		if strings.Contains(s, a.String()) || strings.Contains(s, b.String()) {
+			t.Errorf("secret key logged: %v", arg)
+		}
+	}
+}
+
+type testTracer struct {
+	started, ended []string
+}
+
+type testSpan struct {
+	t    *testTracer
+	name string
+}
+
+func (t *testTracer) StartSpan(name string, attrs ...interface{}) age.Span {
+	t.started = append(t.started, name)
+	return &testSpan{t, name}
+}
+
+func (s *testSpan) End(err error) {
+	s.t.ended = append(s.t.ended, s.name)
+}
+
+func TestTracer(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := &testTracer{}
+	buf := &bytes.Buffer{}
+	w, err := age.EncryptWithOptions(buf, &age.Options{Tracer: tr}, a.Recipient(), b.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(tr.ended, ","), "age.Wrap,age.Wrap,age.Payload"; got != want {
+		t.Errorf("encryption spans: got %q, want %q", got, want)
+	}
+
+	tr = &testTracer{}
+	r, _, err := age.DecryptWithOptions(buf, &age.Options{Tracer: tr}, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(tr.ended, ","), "age.ParseHeader,age.Unwrap,age.Payload"; got != want {
+		t.Errorf("decryption spans: got %q, want %q", got, want)
+	}
+	if len(tr.started) != len(tr.ended) {
+		t.Errorf("started %d spans, ended %d", len(tr.started), len(tr.ended))
+	}
+}
+
+func TestDecryptResultIdentity(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, b.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, res, err := age.DecryptWithResult(buf, a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.IdentityIndex != 1 || res.Identity != b {
+		t.Errorf("wrong matched identity: #%d %v", res.IdentityIndex, res.Identity)
+	}
+	if res.Version != "age-encryption.org/v1" {
+		t.Errorf("wrong version: %q", res.Version)
+	}
+	if len(res.Stanzas) != 1 || res.Stanzas[0] != "X25519" {
+		t.Errorf("wrong stanzas: %q", res.Stanzas)
+	}
+	if res.PayloadSize != -1 {
+		t.Errorf("expected unknown payload size, got %d", res.PayloadSize)
+	}
+}
+
+func TestManyRecipients(t *testing.T) {
+	first, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipients := []age.Recipient{first.Recipient()}
+	for i := 0; i < 1000; i++ {
+		i, err := age.GenerateX25519Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		recipients = append(recipients, i.Recipient())
+	}
+	recipients = append(recipients, last.Recipient())
+
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, recipients...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	corrupted := append([]byte(nil), buf.Bytes()...)
+	mac := bytes.Index(corrupted, []byte("\n--- ")) + len("\n--- ")
+	if corrupted[mac] == 'A' {
+		corrupted[mac] = 'B'
+	} else {
+		corrupted[mac] = 'A'
+	}
+
+	for name, src := range map[string]func([]byte) io.Reader{
+		"seeker": func(b []byte) io.Reader { return bytes.NewReader(b) },
+		// io.MultiReader hides the Seek method of bytes.Reader.
+		"stream": func(b []byte) io.Reader { return io.MultiReader(bytes.NewReader(b)) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			// The first identity that matches any stanza is used, even if
+			// another one matches an earlier stanza.
+			r, res, err := age.DecryptWithResult(src(buf.Bytes()), last, first)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.IdentityIndex != 0 {
+				t.Errorf("wrong matched identity: #%d", res.IdentityIndex)
+			}
+			if len(res.Stanzas) != len(recipients) {
+				t.Errorf("wrong number of stanzas: %d", len(res.Stanzas))
+			}
+			out, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != helloWorld {
+				t.Errorf("wrong data: %q", out)
+			}
+
+			_, err = age.Decrypt(src(corrupted), last)
+			if err == nil || !strings.Contains(err.Error(), "bad header MAC") {
+				t.Errorf("expected bad header MAC, got %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifyHeader(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, a.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+
+	if err := age.VerifyHeader(bytes.NewReader(file), b, a); err != nil {
+		t.Errorf("valid header: %v", err)
+	}
+	var noMatch *age.NoIdentityMatchError
+	if err := age.VerifyHeader(bytes.NewReader(file), b); !errors.As(err, &noMatch) {
+		t.Errorf("expected NoIdentityMatchError, got %v", err)
+	}
+
+	// The payload is not checked.
+	corrupted := append([]byte{}, file...)
+	corrupted[len(corrupted)-1] ^= 1
+	if err := age.VerifyHeader(bytes.NewReader(corrupted), a); err != nil {
+		t.Errorf("corrupted payload: %v", err)
+	}
+
+	corrupted = append([]byte{}, file...)
+	mac := bytes.Index(corrupted, []byte("\n--- ")) + len("\n--- ")
+	if corrupted[mac] == 'A' {
+		corrupted[mac] = 'B'
+	} else {
+		corrupted[mac] = 'A'
+	}
+	if err := age.VerifyHeader(bytes.NewReader(corrupted), a); err == nil {
+		t.Error("corrupted MAC: expected error")
+	}
+	if err := age.VerifyHeader(strings.NewReader("age-encryption.org/v1\n"), a); err == nil {
+		t.Error("truncated header: expected error")
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	x25519 := &bytes.Buffer{}
+	w, err := age.EncryptWithOptions(x25519, &age.Options{
+		Metadata: &age.Metadata{Name: "test.txt"},
+	}, i.Recipient(), j.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sr, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr.SetWorkFactor(10)
+	scrypt := &bytes.Buffer{}
+	w, err = age.Encrypt(scrypt, sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	si, err := age.NewScryptIdentity("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var info age.HeaderInfo
+	errPolicy := errors.New("policy violation")
+	decrypt := func(file []byte, policy func(age.HeaderInfo) error, identity age.Identity) error {
+		_, _, err := age.DecryptWithOptions(bytes.NewReader(file), &age.Options{
+			Policy: func(h age.HeaderInfo) error {
+				info = h
+				return policy(h)
+			},
+		}, identity)
+		return err
+	}
+
+	if err := decrypt(x25519.Bytes(), func(h age.HeaderInfo) error { return nil }, i); err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "age-encryption.org/v1" || len(info.Stanzas) != 2 ||
+		info.Stanzas[0].Type != "X25519" || !info.Metadata || info.ScryptWorkFactor != 0 {
+		t.Errorf("unexpected header info: %+v", info)
+	}
+
+	maxRecipients := func(h age.HeaderInfo) error {
+		if len(h.Stanzas) > 1 {
+			return errPolicy
+		}
+		return nil
+	}
+	err = decrypt(x25519.Bytes(), maxRecipients, i)
+	var pe *age.PolicyError
+	if !errors.As(err, &pe) || !errors.Is(err, errPolicy) {
+		t.Errorf("expected PolicyError, got %v", err)
+	}
+
+	minWorkFactor := func(h age.HeaderInfo) error {
+		if h.ScryptWorkFactor != 0 && h.ScryptWorkFactor < 15 {
+			return errPolicy
+		}
+		return nil
+	}
+	if err := decrypt(scrypt.Bytes(), minWorkFactor, si); !errors.Is(err, errPolicy) {
+		t.Errorf("expected policy violation, got %v", err)
+	}
+	if info.ScryptWorkFactor != 10 {
+		t.Errorf("unexpected work factor: %d", info.ScryptWorkFactor)
+	}
+	if err := decrypt(x25519.Bytes(), minWorkFactor, i); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	w, err := age.EncryptWithOptions(buf, &age.Options{Grease: true}, b.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []*age.AuditEvent
+	_, _, err = age.DecryptWithOptions(buf, &age.Options{
+		Audit:        func(e *age.AuditEvent) { events = append(events, e) },
+		AuditContext: "backup.tar.age",
+	}, a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+	for i, e := range events {
+		if e.IdentityIndex != i || e.Context != "backup.tar.age" ||
+			e.StanzaType != "X25519" || len(e.Stanzas) != 2 {
+			t.Errorf("unexpected event #%d: %+v", i, e)
+		}
+	}
+	if !errors.Is(events[0].Err, age.ErrIncorrectIdentity) || events[0].Identity != a {
+		t.Errorf("expected first identity to not match, got %v", events[0].Err)
+	}
+	if events[1].Err != nil || events[1].Identity != b {
+		t.Errorf("expected second identity to match, got %v", events[1].Err)
+	}
+	if want := "X25519 " + b.Recipient().String(); events[1].Description != want {
+		t.Errorf("Description = %q, want %q", events[1].Description, want)
+	}
+	for _, e := range events {
+		if strings.Contains(e.Description, "AGE-SECRET-KEY-") {
+			t.Errorf("secret key in description: %q", e.Description)
+		}
+	}
+}
+
+func TestDecryptResultPayloadSize(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 1, 64 * 1024, 64*1024 + 1, 3*64*1024 + 17} {
+		buf := &bytes.Buffer{}
+		w, err := age.Encrypt(buf, i.Recipient())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		src := bytes.NewReader(buf.Bytes())
+		r, res, err := age.DecryptWithResult(src, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.PayloadSize != int64(size) {
+			t.Errorf("size %d: got PayloadSize %d", size, res.PayloadSize)
+		}
+		if n := r.(interface{ Size() int64 }).Size(); n != int64(size) {
+			t.Errorf("size %d: got Size %d", size, n)
+		}
+		out, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) != size {
+			t.Errorf("size %d: read %d bytes", size, len(out))
+		}
+
+		// A non-seekable source with an explicit size.
+		opts := &age.Options{SourceSize: int64(buf.Len())}
+		r, _, err = age.DecryptWithOptions(bytes.NewBuffer(buf.Bytes()), opts, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := r.(interface{ Size() int64 }).Size(); n != int64(size) {
+			t.Errorf("size %d: got Size %d with SourceSize", size, n)
+		}
+
+		r, _, err = age.DecryptWithResult(bytes.NewBuffer(buf.Bytes()), i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := r.(interface{ Size() int64 }).Size(); n != -1 {
+			t.Errorf("size %d: got Size %d for unknown source size", size, n)
+		}
+	}
+}
+
+func TestMaxPayloadSize(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := bytes.Repeat([]byte("A"), 100*1024)
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// If the size is known, the file is rejected upfront.
+	_, _, err = age.DecryptWithOptions(bytes.NewReader(buf.Bytes()), &age.Options{MaxPayloadSize: 1000}, i)
+	if err != age.ErrPayloadTooLarge {
+		t.Errorf("expected ErrPayloadTooLarge, got %v", err)
+	}
+
+	// Otherwise, the Reader stops at the limit.
+	r, _, err := age.DecryptWithOptions(bytes.NewBuffer(buf.Bytes()), &age.Options{MaxPayloadSize: 1000}, i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(r)
+	if err != age.ErrPayloadTooLarge {
+		t.Errorf("expected ErrPayloadTooLarge, got %v", err)
+	}
+	if len(out) != 1000 {
+		t.Errorf("expected 1000 bytes before the error, got %d", len(out))
+	}
+
+	// A payload of exactly the maximum size is accepted.
+	r, _, err = age.DecryptWithOptions(bytes.NewBuffer(buf.Bytes()), &age.Options{MaxPayloadSize: int64(len(plaintext))}, i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, plaintext) {
+		t.Error("wrong plaintext")
+	}
+}
+
+func TestWrapFileKey(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileKey := make([]byte, 16)
+	if _, err := rand.Read(fileKey); err != nil {
+		t.Fatal(err)
+	}
+
+	stanzas, err := age.WrapFileKey(fileKey, a.Recipient(), b.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stanzas) != 2 || stanzas[0].Type != "X25519" || stanzas[1].Type != "X25519" {
+		t.Fatalf("unexpected stanzas: %v", stanzas)
+	}
+	got, err := age.UnwrapFileKey(stanzas, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, fileKey) {
+		t.Errorf("unwrapped file key %x, expected %x", got, fileKey)
+	}
+
+	c, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var noMatch *age.NoIdentityMatchError
+	if _, err := age.UnwrapFileKey(stanzas, c); !errors.As(err, &noMatch) {
+		t.Errorf("expected NoIdentityMatchError, got %v", err)
+	}
+
+	s, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.WrapFileKey(fileKey, a.Recipient(), s); err == nil {
+		t.Error("scrypt recipient was mixed with an X25519 recipient")
+	}
+	if _, err := age.WrapFileKey(fileKey[:15], a.Recipient()); err == nil {
+		t.Error("short file key was accepted")
+	}
+	if _, err := age.WrapFileKey(fileKey); err == nil {
+		t.Error("no recipients were accepted")
+	}
+}
+
+func TestRekey(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	opts := &age.Options{Metadata: &age.Metadata{Name: "hello.txt"}}
+	w, err := age.EncryptWithOptions(buf, opts, a.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	if err := age.Rekey(out, bytes.NewReader(buf.Bytes()), []age.Identity{a}, []age.Recipient{b.Recipient()}); err != nil {
+		t.Fatal(err)
+	}
+	r, res, err := age.DecryptWithResult(bytes.NewReader(out.Bytes()), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Metadata == nil || res.Metadata.Name != "hello.txt" {
+		t.Errorf("metadata was not preserved: %+v", res.Metadata)
+	}
+	outStr, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(outStr) != helloWorld {
+		t.Errorf("wrong data: %q, excepted %q", outStr, helloWorld)
+	}
+
+	var noMatch *age.NoIdentityMatchError
+	if _, err := age.Decrypt(bytes.NewReader(out.Bytes()), a); !errors.As(err, &noMatch) {
+		t.Errorf("old identity decrypted the rekeyed file: %v", err)
+	}
+	if err := age.Rekey(io.Discard, bytes.NewReader(buf.Bytes()), []age.Identity{b}, []age.Recipient{b.Recipient()}); !errors.As(err, &noMatch) {
+		t.Errorf("expected NoIdentityMatchError, got %v", err)
+	}
+}
+
+func TestSigningKey(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypt := func(opts *age.Options, r age.Recipient) []byte {
+		buf := &bytes.Buffer{}
+		w, err := age.EncryptWithOptions(buf, opts, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, helloWorld); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	signed := encrypt(&age.Options{SigningKey: priv, Metadata: &age.Metadata{Name: "hello.txt"}}, i.Recipient())
+
+	// The signature is checked both when streaming the header, and when
+	// parsing it in full because of a Policy.
+	for _, opts := range []*age.Options{{}, {Policy: func(h age.HeaderInfo) error {
+		if !h.Signed {
+			return errors.New("expected a signed header")
+		}
+		return nil
+	}}} {
+		r, res, err := age.DecryptWithOptions(bytes.NewBuffer(signed), opts, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(res.Signer, pub) {
+			t.Errorf("got signer %x, want %x", res.Signer, pub)
+		}
+		if res.Metadata == nil || res.Metadata.Name != "hello.txt" {
+			t.Errorf("unexpected metadata %+v", res.Metadata)
+		}
+		if out, err := io.ReadAll(r); err != nil {
+			t.Fatal(err)
+		} else if string(out) != helloWorld {
+			t.Errorf("wrong data: %q", out)
+		}
+	}
+
+	if err := age.VerifySigner(bytes.NewReader(signed), pub); err != nil {
+		t.Errorf("VerifySigner: %v", err)
+	}
+	if err := age.VerifySigner(bytes.NewReader(signed), other); err != age.ErrWrongSigner {
+		t.Errorf("expected ErrWrongSigner, got %v", err)
+	}
+	unsigned := encrypt(nil, i.Recipient())
+	if err := age.VerifySigner(bytes.NewReader(unsigned), pub); err != age.ErrNotSigned {
+		t.Errorf("expected ErrNotSigned, got %v", err)
+	}
+	if _, res, err := age.DecryptWithResult(bytes.NewReader(unsigned), i); err != nil {
+		t.Fatal(err)
+	} else if res.Signer != nil {
+		t.Errorf("unexpected signer %x", res.Signer)
+	}
+
+	// The signature covers the payload nonce, which follows the header.
+	hdrLen := bytes.Index(signed, []byte("\n---")) + len("\n--- ") + 43 + 1
+	tampered := append([]byte(nil), signed...)
+	tampered[hdrLen] ^= 1
+	if err := age.VerifySigner(bytes.NewReader(tampered), pub); err != age.ErrBadSignature {
+		t.Errorf("expected ErrBadSignature, got %v", err)
+	}
+	if _, _, err := age.DecryptWithResult(bytes.NewReader(tampered), i); err != age.ErrBadSignature {
+		t.Errorf("expected ErrBadSignature, got %v", err)
+	}
+
+	// Passphrase-encrypted files can be signed too.
+	sr, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr.SetWorkFactor(10)
+	si, err := age.NewScryptIdentity("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, res, err := age.DecryptWithResult(bytes.NewReader(encrypt(&age.Options{SigningKey: priv}, sr)), si); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(res.Signer, pub) {
+		t.Errorf("got signer %x, want %x", res.Signer, pub)
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const chunk = 64 * 1024
+	buf := &bytes.Buffer{}
+	w, err := age.EncryptWithOptions(buf, &age.Options{Grease: true}, a.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, 3*chunk+100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+
+	// The Policy forces the whole header to be parsed before unwrapping.
+	policy := &age.Options{Policy: func(age.HeaderInfo) error { return nil }}
+	for _, opts := range []*age.Options{nil, policy} {
+		_, _, err := age.DecryptWithOptions(bytes.NewReader(file), opts, b)
+		var noMatch *age.NoIdentityMatchError
+		if !errors.As(err, &noMatch) {
+			t.Fatalf("expected NoIdentityMatchError, got %v", err)
+		}
+		if len(noMatch.StanzaTypes) != 2 || noMatch.StanzaTypes[0] != "X25519" &&
+			noMatch.StanzaTypes[1] != "X25519" {
+			t.Errorf("unexpected stanza types: %v", noMatch.StanzaTypes)
+		}
+	}
+
+	hdrEnd := bytes.Index(file, []byte("\n--- ")) + len("\n--- ")
+	badMAC := append([]byte{}, file...)
+	if badMAC[hdrEnd] == 'A' {
+		badMAC[hdrEnd] = 'B'
+	} else {
+		badMAC[hdrEnd] = 'A'
+	}
+	for _, opts := range []*age.Options{nil, policy} {
+		_, _, err := age.DecryptWithOptions(bytes.NewReader(badMAC), opts, b, a)
+		var macErr *age.HeaderMACError
+		if !errors.As(err, &macErr) || macErr.IdentityIndex != 1 || macErr.Identity != a {
+			t.Errorf("expected HeaderMACError for identity #1, got %v", err)
+		}
+	}
+
+	payload := bytes.IndexByte(file[hdrEnd:], '\n') + hdrEnd + 1 + 16
+	if _, err := age.Decrypt(bytes.NewReader(file[:payload-1]), a); !errors.As(err, new(*age.PayloadTruncatedError)) {
+		t.Errorf("expected PayloadTruncatedError for a truncated nonce, got %v", err)
+	}
+
+	decrypt := func(file []byte) (int, error) {
+		r, err := age.Decrypt(bytes.NewReader(file), a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := io.ReadAll(r)
+		return len(out), err
+	}
+
+	n, err := decrypt(file[:payload+3*(chunk+16)])
+	var truncated *age.PayloadTruncatedError
+	if !errors.As(err, &truncated) || truncated.Chunk != 3 || n != 3*chunk {
+		t.Errorf("expected PayloadTruncatedError at chunk 3, got %v after %d bytes", err, n)
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("PayloadTruncatedError doesn't wrap io.ErrUnexpectedEOF")
+	}
+
+	corrupted := append([]byte{}, file...)
+	corrupted[payload+chunk+16+100] ^= 1
+	n, err = decrypt(corrupted)
+	var corrupt *age.PayloadCorruptError
+	if !errors.As(err, &corrupt) || corrupt.Chunk != 1 || n != chunk {
+		t.Errorf("expected PayloadCorruptError at chunk 1, got %v after %d bytes", err, n)
+	}
+	if !errors.Is(err, stream.ErrInvalidChunk) {
+		t.Errorf("PayloadCorruptError doesn't wrap stream.ErrInvalidChunk")
+	}
+
+	// Trailing data makes the short last chunk fail to authenticate.
+	n, err = decrypt(append(append([]byte{}, file...), 0))
+	if !errors.As(err, &corrupt) || corrupt.Chunk != 3 || n != 3*chunk {
+		t.Errorf("expected PayloadCorruptError at chunk 3, got %v after %d bytes", err, n)
+	}
+}
+
+func TestErrorContext(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, b.Recipient(), a.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Replace the ephemeral share of the second stanza with a short one.
+	lines := strings.Split(buf.String(), "\n")
+	if !strings.HasPrefix(lines[3], "-> X25519 ") {
+		t.Fatalf("unexpected header line %q", lines[3])
+	}
+	lines[3] = "-> X25519 AAAA"
+	corrupted := strings.Join(lines, "\n")
+
+	p, err := age.NewScryptIdentity("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = age.Decrypt(strings.NewReader(corrupted), p, a)
+	var ie *age.IdentityError
+	if !errors.As(err, &ie) {
+		t.Fatalf("expected IdentityError, got %v", err)
+	}
+	if ie.Index != 1 || ie.Identity != a {
+		t.Errorf("wrong identity in error: #%d %v", ie.Index, ie.Identity)
+	}
+	var se *age.StanzaError
+	if !errors.As(err, &se) {
+		t.Fatalf("expected StanzaError, got %v", err)
+	}
+	if se.Index != 1 || se.Type != "X25519" {
+		t.Errorf("wrong stanza in error: #%d %q", se.Index, se.Type)
+	}
+
+	_, err = age.EncryptWithOptions(io.Discard, &age.Options{Rand: age.DeterministicRand([]byte("seed"))},
+		a.Recipient(), &age.ScryptRecipient{})
+	var re *age.RecipientError
+	if !errors.As(err, &re) || re.Index != 1 {
+		t.Errorf("expected RecipientError for recipient #1, got %v", err)
+	}
+}
+
+type unknownRecipient struct{}
+
+func (unknownRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	return []*age.Stanza{{Type: "unknown", Body: []byte("x")}}, nil
+}
+
+func TestWarnings(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	w, err := age.EncryptWithOptions(buf, &age.Options{Grease: true}, unknownRecipient{}, i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var warnings []*age.Warning
+	opts := &age.Options{Warn: func(w *age.Warning) { warnings = append(warnings, w) }}
+	if _, _, err := age.DecryptWithOptions(buf, opts, i); err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || warnings[0].Code != age.WarningUnknownStanza ||
+		!strings.Contains(warnings[0].Message, `"unknown"`) {
+		t.Errorf("unexpected warnings: %v", warnings)
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	f := age.Features()
+	if len(f.Versions) == 0 || f.Versions[0] != "age-encryption.org/v1" {
+		t.Errorf("unexpected versions: %q", f.Versions)
+	}
+	var x25519 bool
+	for _, typ := range f.StanzaTypes {
+		if typ == "X25519" {
+			x25519 = true
+		}
+	}
+	if !x25519 {
+		t.Errorf("X25519 missing from stanza types: %q", f.StanzaTypes)
+	}
+	if len(f.PayloadCiphers) == 0 {
+		t.Error("no payload ciphers")
+	}
+}
+
 func TestParseIdentities(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -219,6 +1776,38 @@ AGE-SECRET-KEY--1D6K0SGAX3NU66R4GYFZY0UQWCLM3UUSF3CXLW4KXZM342WQSJ82QKU59Q`},
 			}
 		})
 	}
+
+	t.Run("types", func(t *testing.T) {
+		x25519, err := age.GenerateX25519Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		subkey, err := x25519.Subkey("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		x448, err := age.GenerateX448Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hpke, err := age.GenerateHPKEIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := fmt.Sprintf("%s\n%s\n%s\n%s\n", x25519, subkey, x448, hpke)
+		got, err := age.ParseIdentities(strings.NewReader(file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 4 {
+			t.Fatalf("ParseIdentities() returned %d identities, want 4", len(got))
+		}
+		for i, want := range []fmt.Stringer{x25519, subkey, x448, hpke} {
+			if s, ok := got[i].(fmt.Stringer); !ok || s.String() != want.String() {
+				t.Errorf("identity %d: got %T, want %T", i, got[i], want)
+			}
+		}
+	})
 }
 
 type testRecipient struct {
@@ -284,3 +1873,116 @@ func TestLabels(t *testing.T) {
 		t.Errorf("expected pqc+foo mixed with foo+pqc to work, got %v", err)
 	}
 }
+
+func TestDefaultPaths(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	if p := age.DefaultIdentityPaths(); len(p) == 0 || p[0] != filepath.Join(dir, "age", "keys.txt") {
+		t.Errorf("unexpected identity paths: %q", p)
+	}
+	if p := age.DefaultRecipientPaths(); len(p) == 0 || p[0] != filepath.Join(dir, "age", "recipients.txt") {
+		t.Errorf("unexpected recipient paths: %q", p)
+	}
+}
+
+func TestParseRecipientsFromCommand(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command("sh", "-c", "echo '# comment'; echo "+i.Recipient().String())
+	recs, err := age.ParseRecipientsFromCommand(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || recs[0].(*age.X25519Recipient).String() != i.Recipient().String() {
+		t.Errorf("unexpected recipients: %v", recs)
+	}
+
+	cmd = exec.Command("sh", "-c", "echo oops >&2; exit 1")
+	if _, err := age.ParseRecipientsFromCommand(cmd); err == nil {
+		t.Error("expected error from failing command")
+	} else if !strings.Contains(err.Error(), "oops") {
+		t.Errorf("error doesn't include stderr: %v", err)
+	}
+}
+
+func TestOpenFS(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypt := func(plaintext []byte) []byte {
+		buf := &bytes.Buffer{}
+		w, err := age.Encrypt(buf, i.Recipient())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(plaintext); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	big := bytes.Repeat([]byte("0123456789abcdef"), 3*64*1024/16+1)
+	fsys := age.OpenFS(fstest.MapFS{
+		"big.bin.age":     {Data: encrypt(big)},
+		"conf/small.age":  {Data: encrypt([]byte("hello"))},
+		"conf/plain.txt":  {Data: []byte("not encrypted")},
+		"conf/empty.age":  {Data: encrypt(nil)},
+		"conf/nested/.gz": {Data: []byte{}},
+	}, i)
+
+	if err := fstest.TestFS(fsys, "big.bin", "conf/small", "conf/empty", "conf/nested"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := fs.ReadFile(fsys, "conf/small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("unexpected contents: %q", got)
+	}
+	if _, err := fs.ReadFile(fsys, "conf/plain.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected plaintext file to be hidden, got %v", err)
+	}
+
+	f, err := fsys.Open("big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	s, ok := f.(io.ReadSeeker)
+	if !ok {
+		t.Fatal("file doesn't implement io.Seeker")
+	}
+	off := int64(2*64*1024 - 3)
+	if _, err := s.Seek(off, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 10)
+	if _, err := io.ReadFull(s, p); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, big[off:off+10]) {
+		t.Errorf("unexpected data after Seek: %q", p)
+	}
+
+	wrong, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = age.OpenFS(fstest.MapFS{"a.age": {Data: encrypt(nil)}}, wrong).Open("a")
+	var e *age.NoIdentityMatchError
+	if !errors.As(err, &e) {
+		t.Errorf("expected NoIdentityMatchError, got %v", err)
+	}
+}
@@ -0,0 +1,366 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package agecard provides an age.Identity backed by the Curve25519 decryption
+// key of an OpenPGP smartcard, such as a Nitrokey or a YubiKey with the
+// OpenPGP applet, without going through GnuPG.
+//
+// The card's decryption key is used as a native X25519 key: files are
+// encrypted to the regular age.X25519Recipient returned by Card.Recipient, and
+// the card performs the X25519 operation to decrypt them.
+//
+// This package doesn't talk to PC/SC directly, to avoid depending on cgo or on
+// platform libraries. Instead, applications provide a Transport, which is
+// satisfied for example by the Card type of github.com/ebfe/scard.
+package agecard
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"filippo.io/age"
+	"filippo.io/age/bech32"
+	"filippo.io/age/internal/format"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Transport transmits a command APDU to a smartcard, and returns the response
+// APDU, including the trailing two status bytes.
+type Transport interface {
+	Transmit(apdu []byte) ([]byte, error)
+}
+
+// Card is a connection to the OpenPGP application of a smartcard.
+type Card struct {
+	t         Transport
+	publicKey []byte
+}
+
+var openPGPAID = []byte{0xD2, 0x76, 0x00, 0x01, 0x24, 0x01}
+
+// cv25519OID is the OID of Curve25519 for ECDH, 1.3.6.1.4.1.3029.1.5.1.
+var cv25519OID = []byte{0x2B, 0x06, 0x01, 0x04, 0x01, 0x97, 0x55, 0x01, 0x05, 0x01}
+
+// Open selects the OpenPGP application on the card, and reads the public key
+// of its decryption key, which must be a Curve25519 ECDH key.
+func Open(t Transport) (*Card, error) {
+	c := &Card{t: t}
+	if _, err := c.command(0xA4, 0x04, 0x00, openPGPAID, true); err != nil {
+		return nil, fmt.Errorf("failed to select OpenPGP application: %v", err)
+	}
+
+	// Algorithm attributes of the decryption key: ECDH (0x12) and the OID.
+	attrs, err := c.command(0xCA, 0x00, 0xC2, nil, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read decryption key attributes: %v", err)
+	}
+	if len(attrs) < 1 || attrs[0] != 0x12 || !bytes.HasPrefix(attrs[1:], cv25519OID) {
+		return nil, errors.New("card decryption key is not a Curve25519 ECDH key")
+	}
+
+	// GENERATE ASYMMETRIC KEY PAIR in read mode, for the decryption key
+	// (control reference template 0xB8).
+	res, err := c.command(0x47, 0x81, 0x00, []byte{0xB8, 0x00}, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read decryption public key: %v", err)
+	}
+	tmpl, ok := findTLV(res, 0x7F49)
+	if !ok {
+		return nil, errors.New("malformed public key response from card")
+	}
+	pk, ok := findTLV(tmpl, 0x86)
+	if !ok {
+		return nil, errors.New("malformed public key response from card")
+	}
+	// Some cards return the point with the OpenPGP 0x40 native prefix.
+	if len(pk) == curve25519.PointSize+1 && pk[0] == 0x40 {
+		pk = pk[1:]
+	}
+	if len(pk) != curve25519.PointSize {
+		return nil, errors.New("invalid Curve25519 public key on card")
+	}
+	c.publicKey = pk
+	return c, nil
+}
+
+// Recipient returns the X25519Recipient corresponding to the card's decryption
+// key. Files encrypted to it can be decrypted with the card.
+func (c *Card) Recipient() *age.X25519Recipient {
+	s, _ := bech32.Encode("age", c.publicKey)
+	r, err := age.ParseX25519Recipient(s)
+	if err != nil {
+		panic("agecard: internal error: " + err.Error())
+	}
+	return r
+}
+
+// Identity returns an age.Identity that decrypts files with the card. pin is
+// called to obtain the user PIN the first time the card needs to be unlocked.
+func (c *Card) Identity(pin func() (string, error)) *Identity {
+	return &Identity{card: c, pin: pin}
+}
+
+// Identity is an age.Identity that unwraps X25519 stanzas with the decryption
+// key of an OpenPGP card.
+type Identity struct {
+	card     *Card
+	pin      func() (string, error)
+	retry    func(*age.PINError) bool
+	verified bool
+}
+
+// SetPINRetry sets a function that is invoked when the card rejects the PIN.
+// If it returns true, the PIN callback is invoked again. Otherwise, or if retry
+// is not set, Unwrap fails with an error wrapping the *age.PINError.
+//
+// retry should show err.Remaining to the user, and should not return true
+// without user interaction, to avoid blocking the card.
+func (i *Identity) SetPINRetry(retry func(err *age.PINError) bool) {
+	i.retry = retry
+}
+
+var _ age.Identity = &Identity{}
+
+const x25519Label = "age-encryption.org/v1/X25519"
+
+const fileKeySize = 16
+
+func (i *Identity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	return multiUnwrap(i.unwrap, stanzas)
+}
+
+func (i *Identity) unwrap(block *age.Stanza) ([]byte, error) {
+	if block.Type != "X25519" {
+		return nil, age.ErrIncorrectIdentity
+	}
+	if len(block.Args) != 1 {
+		return nil, errors.New("invalid X25519 recipient block")
+	}
+	publicKey, err := format.DecodeString(block.Args[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse X25519 recipient: %v", err)
+	}
+	if len(publicKey) != curve25519.PointSize {
+		return nil, errors.New("invalid X25519 recipient block")
+	}
+	if len(block.Body) != fileKeySize+chacha20poly1305.Overhead {
+		return nil, errors.New("invalid X25519 recipient block: incorrect file key size")
+	}
+
+	sharedSecret, err := i.decipher(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 0, len(publicKey)+len(i.card.publicKey))
+	salt = append(salt, publicKey...)
+	salt = append(salt, i.card.publicKey...)
+	h := hkdf.New(sha256.New, sharedSecret, salt, []byte(x25519Label))
+	wrappingKey := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(h, wrappingKey); err != nil {
+		return nil, err
+	}
+
+	fileKey, err := aeadDecrypt(wrappingKey, block.Body)
+	if err != nil {
+		return nil, age.ErrIncorrectIdentity
+	}
+	return fileKey, nil
+}
+
+// decipher performs the X25519 operation between the card's decryption key and
+// the peer share, with the PSO:DECIPHER command.
+func (i *Identity) decipher(share []byte) ([]byte, error) {
+	if !i.verified {
+		if err := i.verify(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Cipher DO: A6 { 7F49 { 86 <point> } }.
+	point := tlv(0x86, share)
+	data := tlv(0xA6, tlv(0x7F49, point))
+	res, err := i.card.command(0x2A, 0x80, 0x86, data, true)
+	if err != nil {
+		return nil, fmt.Errorf("card failed to decrypt: %v", err)
+	}
+	if len(res) != curve25519.PointSize {
+		return nil, errors.New("card returned a malformed shared secret")
+	}
+	var zero [curve25519.PointSize]byte
+	if bytes.Equal(res, zero[:]) {
+		return nil, errors.New("invalid X25519 recipient: low order point")
+	}
+	return res, nil
+}
+
+func (i *Identity) verify() error {
+	for {
+		err := i.verifyOnce()
+		var pe *age.PINError
+		if i.retry == nil || !errors.As(err, &pe) || pe.Blocked || !i.retry(pe) {
+			return err
+		}
+	}
+}
+
+func (i *Identity) verifyOnce() error {
+	if i.pin == nil {
+		return errors.New("card PIN required, but no PIN callback was provided")
+	}
+	pin, err := i.pin()
+	if err != nil {
+		return fmt.Errorf("failed to read card PIN: %v", err)
+	}
+	// VERIFY PW1 for the PSO:DECIPHER command (reference 0x82).
+	_, err = i.card.command(0x20, 0x00, 0x82, []byte(pin), false)
+	var sw statusError
+	switch {
+	case errors.As(err, &sw) && sw == 0x63C0:
+		return &age.PINError{Blocked: true, Err: err}
+	case errors.As(err, &sw) && sw&0xFFF0 == 0x63C0:
+		return &age.PINError{Remaining: int(sw & 0x0F), Err: err}
+	case errors.As(err, &sw) && sw == 0x6983:
+		return &age.PINError{Blocked: true, Err: err}
+	case err != nil:
+		return fmt.Errorf("failed to verify card PIN: %v", err)
+	}
+	i.verified = true
+	return nil
+}
+
+type statusError uint16
+
+func (sw statusError) Error() string {
+	return fmt.Sprintf("card returned status %04X", uint16(sw))
+}
+
+// command sends a short APDU with an optional data field, and returns the
+// response data, following GET RESPONSE chains. If le is true, the command
+// requests the maximum response length.
+func (c *Card) command(ins, p1, p2 byte, data []byte, le bool) ([]byte, error) {
+	if len(data) > 255 {
+		return nil, errors.New("command data too long")
+	}
+	apdu := []byte{0x00, ins, p1, p2}
+	if len(data) > 0 {
+		apdu = append(apdu, byte(len(data)))
+		apdu = append(apdu, data...)
+	}
+	if le {
+		apdu = append(apdu, 0x00)
+	}
+
+	var out []byte
+	for {
+		res, err := c.t.Transmit(apdu)
+		if err != nil {
+			return nil, err
+		}
+		if len(res) < 2 {
+			return nil, errors.New("short response from card")
+		}
+		sw1, sw2 := res[len(res)-2], res[len(res)-1]
+		out = append(out, res[:len(res)-2]...)
+		switch {
+		case sw1 == 0x90 && sw2 == 0x00:
+			return out, nil
+		case sw1 == 0x61:
+			// More data available, fetch it with GET RESPONSE.
+			apdu = []byte{0x00, 0xC0, 0x00, 0x00, sw2}
+		default:
+			return nil, statusError(uint16(sw1)<<8 | uint16(sw2))
+		}
+	}
+}
+
+func tlv(tag uint16, value []byte) []byte {
+	var out []byte
+	if tag > 0xFF {
+		out = append(out, byte(tag>>8))
+	}
+	out = append(out, byte(tag))
+	switch {
+	case len(value) < 0x80:
+		out = append(out, byte(len(value)))
+	case len(value) <= 0xFF:
+		out = append(out, 0x81, byte(len(value)))
+	default:
+		out = append(out, 0x82, byte(len(value)>>8), byte(len(value)))
+	}
+	return append(out, value...)
+}
+
+// findTLV returns the value of the first top-level BER-TLV object in data with
+// the given tag.
+func findTLV(data []byte, tag uint16) ([]byte, bool) {
+	for len(data) > 0 {
+		t := uint16(data[0])
+		data = data[1:]
+		if t&0x1F == 0x1F {
+			if len(data) < 1 {
+				return nil, false
+			}
+			t = t<<8 | uint16(data[0])
+			data = data[1:]
+		}
+		if len(data) < 1 {
+			return nil, false
+		}
+		l := int(data[0])
+		data = data[1:]
+		switch l {
+		case 0x81:
+			if len(data) < 1 {
+				return nil, false
+			}
+			l, data = int(data[0]), data[1:]
+		case 0x82:
+			if len(data) < 2 {
+				return nil, false
+			}
+			l, data = int(data[0])<<8|int(data[1]), data[2:]
+		}
+		if len(data) < l {
+			return nil, false
+		}
+		if t == tag {
+			return data[:l], true
+		}
+		data = data[l:]
+	}
+	return nil, false
+}
+
+// multiUnwrap is copied from package age. It's a helper that implements
+// Identity.Unwrap in terms of a function that unwraps a single recipient
+// stanza.
+func multiUnwrap(unwrap func(*age.Stanza) ([]byte, error), stanzas []*age.Stanza) ([]byte, error) {
+	for _, s := range stanzas {
+		fileKey, err := unwrap(s)
+		if errors.Is(err, age.ErrIncorrectIdentity) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return fileKey, nil
+	}
+	return nil, age.ErrIncorrectIdentity
+}
+
+// aeadDecrypt is copied from package age.
+func aeadDecrypt(key, ciphertext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
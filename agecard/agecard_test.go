@@ -0,0 +1,177 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package agecard_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/agecard"
+	"golang.org/x/crypto/curve25519"
+)
+
+// fakeCard implements the subset of the OpenPGP card application used by
+// agecard, with a Curve25519 decryption key.
+type fakeCard struct {
+	secretKey []byte
+	pin       string
+	tries     int
+	verified  bool
+}
+
+func ok(data []byte) []byte { return append(data, 0x90, 0x00) }
+
+func (c *fakeCard) Transmit(apdu []byte) ([]byte, error) {
+	ins, p1, p2 := apdu[1], apdu[2], apdu[3]
+	var data []byte
+	if len(apdu) > 5 {
+		data = apdu[5 : 5+int(apdu[4])]
+	}
+	switch {
+	case ins == 0xA4:
+		return ok(nil), nil
+	case ins == 0xCA && p2 == 0xC2:
+		return ok([]byte{0x12, 0x2B, 0x06, 0x01, 0x04, 0x01, 0x97, 0x55, 0x01, 0x05, 0x01}), nil
+	case ins == 0x47 && p1 == 0x81:
+		pk, _ := curve25519.X25519(c.secretKey, curve25519.Basepoint)
+		res := append([]byte{0x7F, 0x49, 0x22, 0x86, 0x20}, pk...)
+		return ok(res), nil
+	case ins == 0x20 && p2 == 0x82:
+		if string(data) != c.pin {
+			c.tries--
+			return []byte{0x63, 0xC0 | byte(c.tries)}, nil
+		}
+		c.verified = true
+		return ok(nil), nil
+	case ins == 0x2A && p1 == 0x80 && p2 == 0x86:
+		if !c.verified {
+			return []byte{0x69, 0x82}, nil
+		}
+		share := data[len(data)-32:]
+		ss, err := curve25519.X25519(c.secretKey, share)
+		if err != nil {
+			return []byte{0x6A, 0x80}, nil
+		}
+		return ok(ss), nil
+	}
+	return []byte{0x6D, 0x00}, nil
+}
+
+func TestCardRoundTrip(t *testing.T) {
+	card := &fakeCard{secretKey: make([]byte, 32), pin: "123456", tries: 3}
+	if _, err := rand.Read(card.secretKey); err != nil {
+		t.Fatal(err)
+	}
+	c, err := agecard.Open(card)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, c.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+
+	wrong := c.Identity(func() (string, error) { return "000000", nil })
+	_, err = age.Decrypt(bytes.NewReader(file), wrong)
+	var pe *age.PINError
+	if !errors.As(err, &pe) || pe.Remaining != 2 || pe.Blocked ||
+		!strings.Contains(err.Error(), "2 attempts remaining") {
+		t.Errorf("expected wrong PIN error, got %v", err)
+	}
+
+	i := c.Identity(func() (string, error) { return "123456", nil })
+	r, err := age.Decrypt(bytes.NewReader(file), i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "hello" {
+		t.Errorf("wrong data: %q", out)
+	}
+
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if _, err := age.Encrypt(buf, other.Recipient()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.Decrypt(bytes.NewReader(buf.Bytes()), i); err == nil {
+		t.Error("expected decryption of a file for another key to fail")
+	}
+}
+
+func TestCardPINRetry(t *testing.T) {
+	card := &fakeCard{secretKey: make([]byte, 32), pin: "123456", tries: 3}
+	if _, err := rand.Read(card.secretKey); err != nil {
+		t.Fatal(err)
+	}
+	c, err := agecard.Open(card)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, c.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+
+	pins := []string{"000000", "111111", "123456"}
+	i := c.Identity(func() (string, error) {
+		pin := pins[0]
+		pins = pins[1:]
+		return pin, nil
+	})
+	var remaining []int
+	i.SetPINRetry(func(err *age.PINError) bool {
+		remaining = append(remaining, err.Remaining)
+		return true
+	})
+	if _, err := age.Decrypt(bytes.NewReader(file), i); err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 2 || remaining[0] != 2 || remaining[1] != 1 {
+		t.Errorf("unexpected retries: %v", remaining)
+	}
+
+	// A blocked PIN is never retried.
+	card.verified, card.tries = false, 1
+	var retries int
+	blocked := c.Identity(func() (string, error) { return "000000", nil })
+	blocked.SetPINRetry(func(err *age.PINError) bool {
+		retries++
+		return true
+	})
+	_, err = age.Decrypt(bytes.NewReader(file), blocked)
+	var pe *age.PINError
+	if !errors.As(err, &pe) || !pe.Blocked {
+		t.Errorf("expected blocked PIN error, got %v", err)
+	}
+	if retries != 0 {
+		t.Errorf("blocked PIN was retried %d times", retries)
+	}
+}
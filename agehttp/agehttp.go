@@ -0,0 +1,265 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package agehttp implements HTTP client and server middleware that encrypt
+// request and response bodies with age, providing an end-to-end encrypted
+// channel through untrusted proxies and queues.
+//
+// The client encrypts request bodies to the server's recipients, and sends the
+// recipient of its own X25519 identity in the Age-Recipient header. The server
+// decrypts request bodies with its identities, and encrypts response bodies to
+// the client's recipient. Encrypted bodies are marked with the "age"
+// Content-Encoding.
+//
+// Bodies are streamed, but since age encrypts and authenticates data in 64 KiB
+// chunks, a chunk is only delivered to the other side once it's full or the
+// body ends. Flushing a response flushes only the complete chunks.
+//
+// Request and response headers, including the method, path, and status code,
+// are not encrypted or authenticated.
+package agehttp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"filippo.io/age"
+)
+
+const (
+	// ContentEncoding is the Content-Encoding of encrypted bodies.
+	ContentEncoding = "age"
+
+	// RecipientHeader is the request header that carries the recipient the
+	// response must be encrypted to.
+	RecipientHeader = "Age-Recipient"
+)
+
+// Transport is an http.RoundTripper that encrypts request bodies to
+// Recipients, and decrypts response bodies with Identity.
+//
+// Responses that are not encrypted are rejected, except for responses without
+// a body, such as those to HEAD requests.
+type Transport struct {
+	// Base is the underlying RoundTripper. If nil, http.DefaultTransport is
+	// used.
+	Base http.RoundTripper
+
+	// Recipients are the recipients of the server.
+	Recipients []age.Recipient
+
+	// Identity is the identity responses are encrypted to. If nil, an
+	// ephemeral identity is generated the first time it's needed.
+	Identity *age.X25519Identity
+
+	once sync.Once
+	err  error
+}
+
+func (t *Transport) identity() (*age.X25519Identity, error) {
+	t.once.Do(func() {
+		if t.Identity == nil {
+			t.Identity, t.err = age.GenerateX25519Identity()
+		}
+	})
+	return t.Identity, t.err
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(t.Recipients) == 0 {
+		return nil, errors.New("agehttp: no recipients specified")
+	}
+	id, err := t.identity()
+	if err != nil {
+		return nil, fmt.Errorf("agehttp: failed to generate identity: %v", err)
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set(RecipientHeader, id.Recipient().String())
+	if req.Body != nil && req.Body != http.NoBody {
+		pr, pw := io.Pipe()
+		go func(body io.ReadCloser) {
+			defer body.Close()
+			w, err := age.Encrypt(pw, t.Recipients...)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if _, err := io.Copy(w, body); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			pw.CloseWithError(w.Close())
+		}(req.Body)
+		req.Body = pr
+		req.GetBody = nil
+		req.ContentLength = -1
+		req.Header.Set("Content-Encoding", ContentEncoding)
+		req.Header.Del("Content-Length")
+	}
+
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Header.Get("Content-Encoding") != ContentEncoding {
+		if resp.ContentLength == 0 || resp.Body == nil || resp.Body == http.NoBody {
+			return resp, nil
+		}
+		resp.Body.Close()
+		return nil, fmt.Errorf("agehttp: response is not encrypted: %s", resp.Status)
+	}
+	r, err := age.Decrypt(resp.Body, id)
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("agehttp: failed to decrypt response: %w", err)
+	}
+	resp.Body = &readCloser{Reader: r, Closer: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = false
+	return resp, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// NewHandler returns a handler that decrypts request bodies with identities,
+// encrypts response bodies to the recipient in the RecipientHeader of the
+// request, and calls h.
+//
+// Requests without a valid RecipientHeader, and requests with an unencrypted
+// body, are rejected without calling h.
+func NewHandler(h http.Handler, identities ...age.Identity) http.Handler {
+	return &handler{h: h, identities: identities}
+}
+
+type handler struct {
+	h          http.Handler
+	identities []age.Identity
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	recipient, err := age.ParseX25519Recipient(r.Header.Get(RecipientHeader))
+	if err != nil {
+		http.Error(w, "missing or invalid "+RecipientHeader+" header", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Header.Get("Content-Encoding") {
+	case ContentEncoding:
+		body, err := age.Decrypt(r.Body, h.identities...)
+		if err != nil {
+			http.Error(w, "failed to decrypt request body", http.StatusBadRequest)
+			return
+		}
+		r = r.Clone(r.Context())
+		r.Body = &readCloser{Reader: body, Closer: r.Body}
+		r.ContentLength = -1
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+	case "":
+		if r.ContentLength != 0 {
+			http.Error(w, "request body is not encrypted", http.StatusUnsupportedMediaType)
+			return
+		}
+	default:
+		http.Error(w, "request body is not encrypted", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	ew := &encryptingWriter{ResponseWriter: w, recipient: recipient, head: r.Method == http.MethodHead}
+	h.h.ServeHTTP(ew, r)
+	if err := ew.close(); err != nil {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// encryptingWriter is the http.ResponseWriter passed to the handler by
+// NewHandler.
+type encryptingWriter struct {
+	http.ResponseWriter
+	recipient age.Recipient
+	head      bool
+
+	wroteHeader bool
+	noBody      bool // the status or method doesn't allow a body
+	w           io.WriteCloser
+	err         error
+}
+
+func (ew *encryptingWriter) WriteHeader(code int) {
+	if ew.wroteHeader {
+		ew.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if code >= 200 {
+		ew.wroteHeader = true
+		ew.noBody = ew.head || code == http.StatusNoContent || code == http.StatusNotModified
+		if !ew.noBody {
+			ew.Header().Set("Content-Encoding", ContentEncoding)
+			ew.Header().Del("Content-Length")
+		}
+	}
+	ew.ResponseWriter.WriteHeader(code)
+}
+
+func (ew *encryptingWriter) Write(p []byte) (int, error) {
+	if !ew.wroteHeader {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if ew.noBody {
+		return ew.ResponseWriter.Write(p)
+	}
+	if ew.err != nil {
+		return 0, ew.err
+	}
+	if ew.w == nil {
+		ew.w, ew.err = age.Encrypt(ew.ResponseWriter, ew.recipient)
+		if ew.err != nil {
+			return 0, ew.err
+		}
+	}
+	n, err := ew.w.Write(p)
+	if err != nil {
+		ew.err = err
+	}
+	return n, err
+}
+
+// Flush flushes the complete chunks written so far.
+func (ew *encryptingWriter) Flush() {
+	if f, ok := ew.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// close finishes the encrypted body. If the handler didn't write a body, an
+// encrypted empty body is sent, so that the client can tell it apart from a
+// response generated by an intermediary.
+func (ew *encryptingWriter) close() error {
+	if ew.noBody {
+		return nil
+	}
+	if ew.err != nil {
+		return ew.err
+	}
+	if ew.w == nil {
+		if _, err := ew.Write(nil); err != nil {
+			return err
+		}
+	}
+	return ew.w.Close()
+}
@@ -0,0 +1,148 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package agehttp_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/agehttp"
+)
+
+func TestRoundTrip(t *testing.T) {
+	server, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	big := bytes.Repeat([]byte("A"), 3*64*1024+10)
+	var sawEncoding []string
+	spy := func(h http.Handler) http.Handler {
+		// spy plays the untrusted proxy, checking the bodies are encrypted.
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sawEncoding = append(sawEncoding, r.Header.Get("Content-Encoding"))
+			h.ServeHTTP(w, r)
+		})
+	}
+	ts := httptest.NewServer(spy(agehttp.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/echo":
+			io.Copy(w, r.Body)
+		case "/empty":
+			w.WriteHeader(http.StatusNoContent)
+		case "/big":
+			w.Write(big)
+		}
+	}), server)))
+	defer ts.Close()
+
+	client := &http.Client{Transport: &agehttp.Transport{
+		Recipients: []age.Recipient{server.Recipient()},
+	}}
+
+	resp, err := client.Post(ts.URL+"/echo", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello" {
+		t.Errorf("unexpected echo: %q", body)
+	}
+	if len(sawEncoding) != 1 || sawEncoding[0] != agehttp.ContentEncoding {
+		t.Errorf("request body was not encrypted: %q", sawEncoding)
+	}
+
+	resp, err = client.Get(ts.URL + "/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, big) {
+		t.Errorf("unexpected body of length %d", len(body))
+	}
+
+	resp, err = client.Get(ts.URL + "/empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("unexpected status: %v", resp.Status)
+	}
+
+	// Requests without a recipient are rejected.
+	raw, err := http.Get(ts.URL + "/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.Body.Close()
+	if raw.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected request without recipient to fail, got %v", raw.Status)
+	}
+
+	// The response is encrypted on the wire.
+	req, _ := http.NewRequest("GET", ts.URL+"/big", nil)
+	req.Header.Set(agehttp.RecipientHeader, server.Recipient().String())
+	raw, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawBody, _ := io.ReadAll(raw.Body)
+	raw.Body.Close()
+	if raw.Header.Get("Content-Encoding") != agehttp.ContentEncoding || bytes.Contains(rawBody, big[:100]) {
+		t.Error("response body was not encrypted")
+	}
+
+	// Plaintext request bodies are rejected.
+	raw, err = http.Post(ts.URL+"/echo", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.Body.Close()
+	if raw.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected plaintext request to fail, got %v", raw.Status)
+	}
+	req, _ = http.NewRequest("POST", ts.URL+"/echo", strings.NewReader("hello"))
+	req.Header.Set(agehttp.RecipientHeader, server.Recipient().String())
+	raw, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.Body.Close()
+	if raw.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("expected plaintext request to fail, got %v", raw.Status)
+	}
+}
+
+func TestUnencryptedResponse(t *testing.T) {
+	server, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "injected by a proxy")
+	}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: &agehttp.Transport{
+		Recipients: []age.Recipient{server.Recipient()},
+	}}
+	if _, err := client.Get(ts.URL); err == nil || !strings.Contains(err.Error(), "not encrypted") {
+		t.Errorf("expected unencrypted response to be rejected, got %v", err)
+	}
+}
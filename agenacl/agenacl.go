@@ -0,0 +1,212 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package agenacl provides age.Recipient and age.Identity implementations that
+// wrap the file key with NaCl box and secretbox, using existing libsodium keys.
+//
+// These types are for MIGRATIONS ONLY. They allow systems moving off
+// libsodium-based formats to re-encrypt their data into age incrementally,
+// while the old Curve25519 key pairs and raw symmetric keys are still in use.
+// New files should be encrypted to native X25519 recipients as soon as
+// possible, and new deployments should never use this package.
+//
+// The "nacl-box" stanza is a libsodium sealed box (crypto_box_seal) of the
+// file key, which is anonymous like the X25519 stanza. The "nacl-secretbox"
+// stanza is a secretbox (crypto_secretbox_easy) of the file key under the
+// symmetric key, with a random 24-byte nonce as its argument. Since anyone
+// with a symmetric key can both encrypt and decrypt, files encrypted to a
+// SecretboxRecipient are only as authenticated as the key is secret.
+package agenacl
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"filippo.io/age"
+	"filippo.io/age/internal/format"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	boxStanzaType       = "nacl-box"
+	secretboxStanzaType = "nacl-secretbox"
+
+	fileKeySize = 16
+	// sealedBoxSize is the size of a sealed box of a file key: the ephemeral
+	// public key, the Poly1305 tag, and the file key.
+	sealedBoxSize = 32 + box.Overhead + fileKeySize
+	nonceSize     = 24
+)
+
+// BoxRecipient is a NaCl box Curve25519 public key, for migrations only.
+type BoxRecipient struct {
+	publicKey [32]byte
+}
+
+var _ age.Recipient = &BoxRecipient{}
+
+// NewBoxRecipient returns a BoxRecipient for a 32-byte Curve25519 public
+// key, such as one generated by libsodium's crypto_box_keypair.
+func NewBoxRecipient(publicKey []byte) (*BoxRecipient, error) {
+	if len(publicKey) != 32 {
+		return nil, errors.New("invalid NaCl box public key size")
+	}
+	r := &BoxRecipient{}
+	copy(r.publicKey[:], publicKey)
+	return r, nil
+}
+
+func (r *BoxRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	body, err := box.SealAnonymous(nil, fileKey, &r.publicKey, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return []*age.Stanza{{Type: boxStanzaType, Body: body}}, nil
+}
+
+// BoxIdentity is a NaCl box Curve25519 private key, for migrations only.
+type BoxIdentity struct {
+	publicKey, privateKey [32]byte
+}
+
+var _ age.Identity = &BoxIdentity{}
+
+// NewBoxIdentity returns a BoxIdentity for a 32-byte Curve25519 private key,
+// such as one generated by libsodium's crypto_box_keypair.
+func NewBoxIdentity(privateKey []byte) (*BoxIdentity, error) {
+	if len(privateKey) != 32 {
+		return nil, errors.New("invalid NaCl box private key size")
+	}
+	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NaCl box private key: %v", err)
+	}
+	i := &BoxIdentity{}
+	copy(i.privateKey[:], privateKey)
+	copy(i.publicKey[:], publicKey)
+	return i, nil
+}
+
+// Recipient returns the public BoxRecipient value corresponding to i.
+func (i *BoxIdentity) Recipient() *BoxRecipient {
+	return &BoxRecipient{publicKey: i.publicKey}
+}
+
+func (i *BoxIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	return multiUnwrap(i.unwrap, stanzas)
+}
+
+func (i *BoxIdentity) unwrap(block *age.Stanza) ([]byte, error) {
+	if block.Type != boxStanzaType {
+		return nil, age.ErrIncorrectIdentity
+	}
+	if len(block.Args) != 0 {
+		return nil, errors.New("invalid nacl-box recipient block")
+	}
+	if len(block.Body) != sealedBoxSize {
+		return nil, errors.New("invalid nacl-box recipient block body")
+	}
+	fileKey, ok := box.OpenAnonymous(nil, block.Body, &i.publicKey, &i.privateKey)
+	if !ok {
+		return nil, age.ErrIncorrectIdentity
+	}
+	return fileKey, nil
+}
+
+// SecretboxRecipient is a NaCl secretbox symmetric key, for migrations only.
+type SecretboxRecipient struct {
+	key [32]byte
+}
+
+var _ age.Recipient = &SecretboxRecipient{}
+
+// NewSecretboxRecipient returns a SecretboxRecipient for a 32-byte symmetric
+// key, such as one generated by libsodium's crypto_secretbox_keygen.
+func NewSecretboxRecipient(key []byte) (*SecretboxRecipient, error) {
+	if len(key) != 32 {
+		return nil, errors.New("invalid NaCl secretbox key size")
+	}
+	r := &SecretboxRecipient{}
+	copy(r.key[:], key)
+	return r, nil
+}
+
+func (r *SecretboxRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	var nonce [nonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	return []*age.Stanza{{
+		Type: secretboxStanzaType,
+		Args: []string{format.EncodeToString(nonce[:])},
+		Body: secretbox.Seal(nil, fileKey, &nonce, &r.key),
+	}}, nil
+}
+
+// SecretboxIdentity is a NaCl secretbox symmetric key, for migrations only.
+type SecretboxIdentity struct {
+	key [32]byte
+}
+
+var _ age.Identity = &SecretboxIdentity{}
+
+// NewSecretboxIdentity returns a SecretboxIdentity for a 32-byte symmetric
+// key, such as one generated by libsodium's crypto_secretbox_keygen.
+func NewSecretboxIdentity(key []byte) (*SecretboxIdentity, error) {
+	if len(key) != 32 {
+		return nil, errors.New("invalid NaCl secretbox key size")
+	}
+	i := &SecretboxIdentity{}
+	copy(i.key[:], key)
+	return i, nil
+}
+
+// Recipient returns the SecretboxRecipient value with the same key as i.
+func (i *SecretboxIdentity) Recipient() *SecretboxRecipient {
+	return &SecretboxRecipient{key: i.key}
+}
+
+func (i *SecretboxIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	return multiUnwrap(i.unwrap, stanzas)
+}
+
+func (i *SecretboxIdentity) unwrap(block *age.Stanza) ([]byte, error) {
+	if block.Type != secretboxStanzaType {
+		return nil, age.ErrIncorrectIdentity
+	}
+	if len(block.Args) != 1 {
+		return nil, errors.New("invalid nacl-secretbox recipient block")
+	}
+	n, err := format.DecodeString(block.Args[0])
+	if err != nil || len(n) != nonceSize {
+		return nil, errors.New("invalid nacl-secretbox recipient block nonce")
+	}
+	if len(block.Body) != secretbox.Overhead+fileKeySize {
+		return nil, errors.New("invalid nacl-secretbox recipient block body")
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], n)
+	fileKey, ok := secretbox.Open(nil, block.Body, &nonce, &i.key)
+	if !ok {
+		return nil, age.ErrIncorrectIdentity
+	}
+	return fileKey, nil
+}
+
+func multiUnwrap(unwrap func(*age.Stanza) ([]byte, error), stanzas []*age.Stanza) ([]byte, error) {
+	for _, s := range stanzas {
+		fileKey, err := unwrap(s)
+		if errors.Is(err, age.ErrIncorrectIdentity) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return fileKey, nil
+	}
+	return nil, age.ErrIncorrectIdentity
+}
@@ -0,0 +1,152 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package agenacl_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/agenacl"
+	"golang.org/x/crypto/nacl/box"
+)
+
+const helloWorld = "Hello, Twitch!"
+
+func roundTrip(t *testing.T, r age.Recipient, i age.Identity) {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out, err := age.Decrypt(buf, i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outBytes, err := io.ReadAll(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(outBytes) != helloWorld {
+		t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+	}
+}
+
+func TestBoxRoundTrip(t *testing.T) {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := agenacl.NewBoxRecipient(pub[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := agenacl.NewBoxIdentity(priv[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, r, i)
+	roundTrip(t, i.Recipient(), i)
+
+	// The stanza body is a libsodium sealed box of the file key.
+	fileKey := make([]byte, 16)
+	stanzas, err := r.Wrap(fileKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := box.OpenAnonymous(nil, stanzas[0].Body, pub, priv); !ok || !bytes.Equal(got, fileKey) {
+		t.Error("stanza body is not a sealed box of the file key")
+	}
+
+	_, other, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong, err := agenacl.NewBoxIdentity(other[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wrong.Unwrap(stanzas); !errors.Is(err, age.ErrIncorrectIdentity) {
+		t.Errorf("expected ErrIncorrectIdentity, got %v", err)
+	}
+}
+
+func TestSecretboxRoundTrip(t *testing.T) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	r, err := agenacl.NewSecretboxRecipient(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := agenacl.NewSecretboxIdentity(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, r, i)
+	roundTrip(t, i.Recipient(), i)
+
+	key[0] ^= 1
+	wrong, err := agenacl.NewSecretboxIdentity(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stanzas, err := r.Wrap(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wrong.Unwrap(stanzas); !errors.Is(err, age.ErrIncorrectIdentity) {
+		t.Errorf("expected ErrIncorrectIdentity, got %v", err)
+	}
+
+	if _, err := agenacl.NewSecretboxRecipient(key[:16]); err == nil {
+		t.Error("short key was accepted")
+	}
+}
+
+func TestMigration(t *testing.T) {
+	// A file encrypted to both the old key and a new native key can be
+	// decrypted with either, which allows migrating incrementally.
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := agenacl.NewBoxIdentity(priv[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := agenacl.NewBoxRecipient(pub[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	native, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, r, native.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []age.Identity{old, native} {
+		if _, err := age.Decrypt(bytes.NewReader(buf.Bytes()), i); err != nil {
+			t.Errorf("%T: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,517 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package agepgp converts Curve25519 encryption subkeys of OpenPGP keys into
+// native age X25519 recipients and identities, to help with migrations from
+// PGP by allowing encryption to existing key material.
+//
+// Only v4 ECDH keys on Curve25519 ("cv25519") are supported, which are the
+// default encryption subkeys generated by modern GnuPG versions. Files are
+// encrypted with the age format, not with OpenPGP, so they can only be
+// decrypted with age, not with GnuPG.
+package agepgp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/bech32"
+	"golang.org/x/crypto/curve25519"
+)
+
+// ParseRecipients returns an age.X25519Recipient for each Curve25519
+// encryption key found in an OpenPGP transferable public (or secret) key. The
+// input can be binary or ASCII armored, and can contain multiple keys.
+func ParseRecipients(f io.Reader) ([]*age.X25519Recipient, error) {
+	keys, err := parseKeys(f)
+	if err != nil {
+		return nil, err
+	}
+	var recipients []*age.X25519Recipient
+	for _, k := range keys {
+		s, err := bech32.Encode("age", k.publicKey)
+		if err != nil {
+			return nil, err
+		}
+		r, err := age.ParseX25519Recipient(s)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, r)
+	}
+	if len(recipients) == 0 {
+		return nil, errors.New("no Curve25519 encryption keys found")
+	}
+	return recipients, nil
+}
+
+// ParseIdentities returns an age.X25519Identity for each Curve25519 encryption
+// secret key found in an OpenPGP transferable secret key. The input can be
+// binary or ASCII armored, and can contain multiple keys.
+//
+// If the secret keys are protected, passphrase is called at most once to
+// obtain the passphrase. Secret keys stored on smartcards (GnuPG stubs) are
+// skipped; see package filippo.io/age/agecard for those.
+func ParseIdentities(f io.Reader, passphrase func() ([]byte, error)) ([]*age.X25519Identity, error) {
+	keys, err := parseKeys(f)
+	if err != nil {
+		return nil, err
+	}
+	var pass []byte
+	var identities []*age.X25519Identity
+	for _, k := range keys {
+		if k.secret == nil || k.secret.stub {
+			continue
+		}
+		if k.secret.protected() && pass == nil {
+			if passphrase == nil {
+				return nil, errors.New("secret key is protected, but no passphrase callback was provided")
+			}
+			pass, err = passphrase()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read passphrase: %v", err)
+			}
+		}
+		scalar, err := k.secret.decrypt(pass)
+		if err != nil {
+			return nil, err
+		}
+		if pk, _ := curve25519.X25519(scalar, curve25519.Basepoint); !bytes.Equal(pk, k.publicKey) {
+			return nil, errors.New("secret key doesn't match its public key")
+		}
+		s, err := bech32.Encode("AGE-SECRET-KEY-", scalar)
+		if err != nil {
+			return nil, err
+		}
+		i, err := age.ParseX25519Identity(strings.ToUpper(s))
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, i)
+	}
+	if len(identities) == 0 {
+		return nil, errors.New("no Curve25519 encryption secret keys found")
+	}
+	return identities, nil
+}
+
+// OpenPGP packet tags and algorithm identifiers, from RFC 4880.
+const (
+	tagSecretKey    = 5
+	tagPublicKey    = 6
+	tagSecretSubkey = 7
+	tagPublicSubkey = 14
+
+	algoECDH = 18
+)
+
+// cv25519OID is the OID of Curve25519 for ECDH, 1.3.6.1.4.1.3029.1.5.1.
+var cv25519OID = []byte{0x2B, 0x06, 0x01, 0x04, 0x01, 0x97, 0x55, 0x01, 0x05, 0x01}
+
+type key struct {
+	publicKey []byte
+	secret    *secretMaterial
+}
+
+const armorPrefix = "-----BEGIN PGP "
+
+func parseKeys(f io.Reader) ([]*key, error) {
+	const keySizeLimit = 1 << 24 // 16 MiB
+	data, err := io.ReadAll(io.LimitReader(f, keySizeLimit))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %v", err)
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(armorPrefix)) {
+		data, err = dearmor(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var keys []*key
+	for len(data) > 0 {
+		tag, body, rest, err := readPacket(data)
+		if err != nil {
+			return nil, err
+		}
+		data = rest
+		switch tag {
+		case tagPublicKey, tagPublicSubkey, tagSecretKey, tagSecretSubkey:
+		default:
+			continue
+		}
+		k, rest, err := parsePublicKey(body)
+		if err != nil {
+			return nil, err
+		}
+		if k == nil {
+			continue
+		}
+		if tag == tagSecretKey || tag == tagSecretSubkey {
+			k.secret, err = parseSecretMaterial(rest)
+			if err != nil {
+				return nil, err
+			}
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// dearmor decodes the first OpenPGP ASCII armor block in data, ignoring the
+// armor headers and checksum.
+func dearmor(data []byte) ([]byte, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	var b64 strings.Builder
+	inBody, inHeaders := false, false
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case !inBody && !inHeaders && strings.HasPrefix(line, armorPrefix):
+			inHeaders = true
+		case inHeaders && line == "":
+			inHeaders, inBody = false, true
+		case inHeaders && !strings.Contains(line, ": "):
+			// Armor headers are optional, so this is already the body.
+			inHeaders, inBody = false, true
+			b64.WriteString(line)
+		case inBody && strings.HasPrefix(line, "-----END PGP "):
+			out, err := base64.StdEncoding.DecodeString(b64.String())
+			if err != nil {
+				return nil, fmt.Errorf("invalid armor: %v", err)
+			}
+			return out, nil
+		case inBody && strings.HasPrefix(line, "="):
+			// CRC-24 checksum, optional and not checked.
+		case inBody:
+			b64.WriteString(line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("invalid armor: missing end line")
+}
+
+// readPacket parses an OpenPGP packet header, supporting both old and new
+// formats, but not partial body lengths, which are not allowed for keys.
+func readPacket(data []byte) (tag byte, body, rest []byte, err error) {
+	if len(data) < 2 || data[0]&0x80 == 0 {
+		return 0, nil, nil, errors.New("invalid OpenPGP packet")
+	}
+	var length int
+	if data[0]&0x40 != 0 {
+		tag = data[0] & 0x3F
+		data = data[1:]
+		switch o := int(data[0]); {
+		case o < 192:
+			length, data = o, data[1:]
+		case o < 224:
+			if len(data) < 2 {
+				return 0, nil, nil, errors.New("truncated OpenPGP packet")
+			}
+			length, data = (o-192)<<8+int(data[1])+192, data[2:]
+		case o == 255:
+			if len(data) < 5 {
+				return 0, nil, nil, errors.New("truncated OpenPGP packet")
+			}
+			length = int(data[1])<<24 | int(data[2])<<16 | int(data[3])<<8 | int(data[4])
+			data = data[5:]
+		default:
+			return 0, nil, nil, errors.New("unsupported OpenPGP partial body length")
+		}
+	} else {
+		tag = (data[0] >> 2) & 0x0F
+		lengthType := data[0] & 0x03
+		data = data[1:]
+		switch lengthType {
+		case 0:
+			length, data = int(data[0]), data[1:]
+		case 1:
+			if len(data) < 2 {
+				return 0, nil, nil, errors.New("truncated OpenPGP packet")
+			}
+			length, data = int(data[0])<<8|int(data[1]), data[2:]
+		case 2:
+			if len(data) < 4 {
+				return 0, nil, nil, errors.New("truncated OpenPGP packet")
+			}
+			length = int(data[0])<<24 | int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+			data = data[4:]
+		case 3:
+			length = len(data)
+		}
+	}
+	if length < 0 || length > len(data) {
+		return 0, nil, nil, errors.New("truncated OpenPGP packet")
+	}
+	return tag, data[:length], data[length:], nil
+}
+
+// parsePublicKey parses the public part of a key packet. It returns a nil key
+// for keys that are not v4 Curve25519 ECDH keys.
+func parsePublicKey(body []byte) (k *key, rest []byte, err error) {
+	// Version, creation time, and algorithm.
+	if len(body) < 6 {
+		return nil, nil, errors.New("truncated OpenPGP key packet")
+	}
+	if body[0] != 4 || body[5] != algoECDH {
+		return nil, nil, nil
+	}
+	body = body[6:]
+	if len(body) < 1 || len(body) < 1+int(body[0]) {
+		return nil, nil, errors.New("truncated OpenPGP key packet")
+	}
+	oid := body[1 : 1+int(body[0])]
+	body = body[1+int(body[0]):]
+	point, body, err := readMPI(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	// KDF parameters, which age doesn't use.
+	if len(body) < 1 || len(body) < 1+int(body[0]) {
+		return nil, nil, errors.New("truncated OpenPGP key packet")
+	}
+	body = body[1+int(body[0]):]
+	if !bytes.Equal(oid, cv25519OID) {
+		return nil, nil, nil
+	}
+	// Curve25519 points use the 0x40 native prefix.
+	if len(point) != 1+curve25519.PointSize || point[0] != 0x40 {
+		return nil, nil, errors.New("invalid Curve25519 public key")
+	}
+	return &key{publicKey: point[1:]}, body, nil
+}
+
+func readMPI(data []byte) (mpi, rest []byte, err error) {
+	if len(data) < 2 {
+		return nil, nil, errors.New("truncated OpenPGP MPI")
+	}
+	bits := int(data[0])<<8 | int(data[1])
+	n := (bits + 7) / 8
+	if len(data) < 2+n {
+		return nil, nil, errors.New("truncated OpenPGP MPI")
+	}
+	return data[2 : 2+n], data[2+n:], nil
+}
+
+// secretMaterial is the (possibly encrypted) secret part of a key packet.
+type secretMaterial struct {
+	usage     byte
+	cipher    byte
+	s2k       s2k
+	iv        []byte
+	data      []byte
+	stub      bool
+	plaintext bool
+}
+
+func (s *secretMaterial) protected() bool {
+	return !s.plaintext && !s.stub
+}
+
+type s2k struct {
+	mode      byte
+	hash      byte
+	salt      []byte
+	count     int
+	gnuDummy  bool
+	gnuDivert bool
+}
+
+func parseSecretMaterial(data []byte) (*secretMaterial, error) {
+	if len(data) < 1 {
+		return nil, errors.New("truncated OpenPGP secret key packet")
+	}
+	s := &secretMaterial{usage: data[0]}
+	data = data[1:]
+	switch s.usage {
+	case 0:
+		s.plaintext = true
+		s.data = data
+		return s, nil
+	case 254, 255:
+	default:
+		return nil, fmt.Errorf("unsupported OpenPGP secret key protection %d", s.usage)
+	}
+	if len(data) < 1 {
+		return nil, errors.New("truncated OpenPGP secret key packet")
+	}
+	s.cipher, data = data[0], data[1:]
+	var err error
+	s.s2k, data, err = parseS2K(data)
+	if err != nil {
+		return nil, err
+	}
+	if s.s2k.gnuDummy || s.s2k.gnuDivert {
+		s.stub = true
+		return s, nil
+	}
+	if _, ok := cipherKeySize(s.cipher); !ok {
+		return nil, fmt.Errorf("unsupported OpenPGP secret key cipher %d", s.cipher)
+	}
+	if len(data) < aes.BlockSize {
+		return nil, errors.New("truncated OpenPGP secret key packet")
+	}
+	s.iv, s.data = data[:aes.BlockSize], data[aes.BlockSize:]
+	return s, nil
+}
+
+func parseS2K(data []byte) (s s2k, rest []byte, err error) {
+	if len(data) < 2 {
+		return s, nil, errors.New("truncated OpenPGP S2K specifier")
+	}
+	s.mode, s.hash, data = data[0], data[1], data[2:]
+	switch s.mode {
+	case 0:
+	case 1, 3:
+		if len(data) < 8 {
+			return s, nil, errors.New("truncated OpenPGP S2K specifier")
+		}
+		s.salt, data = data[:8], data[8:]
+		if s.mode == 3 {
+			if len(data) < 1 {
+				return s, nil, errors.New("truncated OpenPGP S2K specifier")
+			}
+			c := int(data[0])
+			s.count, data = (16+(c&15))<<((c>>4)+6), data[1:]
+		}
+	case 101:
+		// GnuPG extension: "GNU" followed by 1 (no secret) or 2 (on card).
+		if len(data) < 4 || string(data[:3]) != "GNU" {
+			return s, nil, errors.New("unsupported OpenPGP S2K specifier")
+		}
+		switch data[3] {
+		case 1:
+			s.gnuDummy = true
+		case 2:
+			s.gnuDivert = true
+		default:
+			return s, nil, errors.New("unsupported OpenPGP S2K specifier")
+		}
+		return s, nil, nil
+	default:
+		return s, nil, fmt.Errorf("unsupported OpenPGP S2K mode %d", s.mode)
+	}
+	return s, data, nil
+}
+
+func cipherKeySize(c byte) (int, bool) {
+	switch c {
+	case 7:
+		return 16, true // AES-128
+	case 8:
+		return 24, true // AES-192
+	case 9:
+		return 32, true // AES-256
+	}
+	return 0, false
+}
+
+func s2kHash(h byte) (func() hash.Hash, bool) {
+	switch h {
+	case 2:
+		return sha1.New, true
+	case 8:
+		return sha256.New, true
+	case 10:
+		return sha512.New, true
+	}
+	return nil, false
+}
+
+// deriveKey implements the OpenPGP String-to-Key function, RFC 4880,
+// Section 3.7.1.
+func (s *s2k) deriveKey(passphrase []byte, size int) ([]byte, error) {
+	newHash, ok := s2kHash(s.hash)
+	if !ok {
+		return nil, fmt.Errorf("unsupported OpenPGP S2K hash %d", s.hash)
+	}
+	input := append(append([]byte{}, s.salt...), passphrase...)
+	count := len(input)
+	if s.mode == 3 && s.count > count {
+		count = s.count
+	}
+	var key []byte
+	for i := 0; len(key) < size; i++ {
+		h := newHash()
+		h.Write(make([]byte, i))
+		for n := count; n > 0; n -= len(input) {
+			if n < len(input) {
+				h.Write(input[:n])
+			} else {
+				h.Write(input)
+			}
+		}
+		key = h.Sum(key)
+	}
+	return key[:size], nil
+}
+
+// decrypt returns the native little-endian Curve25519 scalar.
+func (s *secretMaterial) decrypt(passphrase []byte) ([]byte, error) {
+	data := s.data
+	if !s.plaintext {
+		size, _ := cipherKeySize(s.cipher)
+		k, err := s.s2k.deriveKey(passphrase, size)
+		if err != nil {
+			return nil, err
+		}
+		b, err := aes.NewCipher(k)
+		if err != nil {
+			return nil, err
+		}
+		data = make([]byte, len(s.data))
+		cipher.NewCFBDecrypter(b, s.iv).XORKeyStream(data, s.data)
+	}
+
+	mpi, rest, err := readMPI(data)
+	if err != nil {
+		return nil, errors.New("failed to decrypt secret key: incorrect passphrase?")
+	}
+	switch {
+	case s.usage == 254:
+		if len(rest) != sha1.Size {
+			return nil, errors.New("failed to decrypt secret key: incorrect passphrase?")
+		}
+		sum := sha1.Sum(data[:len(data)-sha1.Size])
+		if subtle.ConstantTimeCompare(sum[:], rest) != 1 {
+			return nil, errors.New("failed to decrypt secret key: incorrect passphrase?")
+		}
+	default:
+		if len(rest) != 2 {
+			return nil, errors.New("failed to decrypt secret key: incorrect passphrase?")
+		}
+		var sum uint16
+		for _, b := range data[:len(data)-2] {
+			sum += uint16(b)
+		}
+		if sum != uint16(rest[0])<<8|uint16(rest[1]) {
+			return nil, errors.New("failed to decrypt secret key: incorrect passphrase?")
+		}
+	}
+
+	// The Curve25519 secret is stored as a big-endian MPI of the scalar.
+	if len(mpi) > curve25519.ScalarSize {
+		return nil, errors.New("invalid Curve25519 secret key")
+	}
+	scalar := make([]byte, curve25519.ScalarSize)
+	for i, b := range mpi {
+		scalar[len(mpi)-1-i] = b
+	}
+	return scalar, nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package agepgp_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/agepgp"
+)
+
+func TestGnuPGKeys(t *testing.T) {
+	tests := []struct {
+		pub, sec   string
+		passphrase string
+	}{
+		{"testdata/protected_pub.asc", "testdata/protected_sec.asc", "hunter2"},
+		{"testdata/plain_pub.gpg", "testdata/plain_sec.gpg", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pub, func(t *testing.T) {
+			f, err := os.Open(tt.pub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			recipients, err := agepgp.ParseRecipients(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(recipients) != 1 {
+				t.Fatalf("expected one recipient, got %d", len(recipients))
+			}
+
+			sec, err := os.ReadFile(tt.sec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.passphrase != "" {
+				_, err := agepgp.ParseIdentities(bytes.NewReader(sec), func() ([]byte, error) {
+					return []byte("wrong"), nil
+				})
+				if err == nil {
+					t.Error("expected wrong passphrase to fail")
+				}
+			}
+			identities, err := agepgp.ParseIdentities(bytes.NewReader(sec), func() ([]byte, error) {
+				return []byte(tt.passphrase), nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(identities) != 1 {
+				t.Fatalf("expected one identity, got %d", len(identities))
+			}
+			if identities[0].Recipient().String() != recipients[0].String() {
+				t.Errorf("identity doesn't match recipient")
+			}
+
+			buf := &bytes.Buffer{}
+			w, err := age.Encrypt(buf, recipients[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.WriteString(w, "hello"); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			r, err := age.Decrypt(buf, identities[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out, err := io.ReadAll(r); err != nil {
+				t.Fatal(err)
+			} else if string(out) != "hello" {
+				t.Errorf("wrong data: %q", out)
+			}
+		})
+	}
+}
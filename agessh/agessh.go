@@ -22,8 +22,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strings"
 
 	"filippo.io/age"
+	"filippo.io/age/bech32"
 	"filippo.io/age/internal/format"
 	"filippo.io/edwards25519"
 	"golang.org/x/crypto/chacha20poly1305"
@@ -197,6 +199,43 @@ func ed25519PublicKeyToCurve25519(pk ed25519.PublicKey) ([]byte, error) {
 	return p.BytesMontgomery(), nil
 }
 
+// X25519RecipientFromEd25519 converts a raw Ed25519 public key into a native
+// X25519Recipient, using the same birational map as Ed25519Recipient.
+//
+// Unlike Ed25519Recipient, the resulting recipient produces regular X25519
+// stanzas, which are anonymous and don't depend on any SSH encoding. It can be
+// used by systems that already distribute Ed25519 signing keys, for example
+// minisign or libsodium applications, to reuse them for encryption. Files
+// encrypted to it can be decrypted with the X25519IdentityFromEd25519 identity.
+func X25519RecipientFromEd25519(pk ed25519.PublicKey) (*age.X25519Recipient, error) {
+	if len(pk) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid Ed25519 public key size")
+	}
+	mpk, err := ed25519PublicKeyToCurve25519(pk)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Ed25519 public key: %v", err)
+	}
+	s, err := bech32.Encode("age", mpk)
+	if err != nil {
+		return nil, err
+	}
+	return age.ParseX25519Recipient(s)
+}
+
+// X25519IdentityFromEd25519 converts a raw Ed25519 private key into a native
+// X25519Identity, using the same birational map as Ed25519Identity. It's the
+// identity corresponding to X25519RecipientFromEd25519(key.Public()).
+func X25519IdentityFromEd25519(key ed25519.PrivateKey) (*age.X25519Identity, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, errors.New("invalid Ed25519 private key size")
+	}
+	s, err := bech32.Encode("AGE-SECRET-KEY-", ed25519PrivateKeyToCurve25519(key))
+	if err != nil {
+		return nil, err
+	}
+	return age.ParseX25519Identity(strings.ToUpper(s))
+}
+
 const ed25519Label = "age-encryption.org/v1/ssh-ed25519"
 
 func (r *Ed25519Recipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
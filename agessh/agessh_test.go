@@ -101,3 +101,44 @@ func TestSSHEd25519RoundTrip(t *testing.T) {
 		t.Errorf("invalid output: %x, expected %x", out, fileKey)
 	}
 }
+
+func TestX25519FromEd25519RoundTrip(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := agessh.X25519RecipientFromEd25519(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := agessh.X25519IdentityFromEd25519(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.String() != i.Recipient().String() {
+		t.Fatalf("i.Recipient is different from r")
+	}
+
+	fileKey := make([]byte, 16)
+	if _, err := rand.Read(fileKey); err != nil {
+		t.Fatal(err)
+	}
+	stanzas, err := r.Wrap(fileKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stanzas) != 1 || stanzas[0].Type != "X25519" {
+		t.Fatalf("expected a single X25519 stanza, got %v", stanzas)
+	}
+
+	out, err := i.Unwrap(stanzas)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(fileKey, out) {
+		t.Errorf("invalid output: %x, expected %x", out, fileKey)
+	}
+}
@@ -0,0 +1,293 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"filippo.io/age/internal/format"
+	"filippo.io/age/stream"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// An archive is an age file with multiple named payloads after a single
+// header. The header is a regular age header, followed by the nonce. Then, each
+// entry is its own STREAM, keyed with the file key, the nonce, and the index
+// of the entry. After the entries, an index STREAM lists the length and name of
+// each entry, and the file ends with the 8-byte big-endian offset of the index.
+//
+// Archives can't be decrypted with Decrypt, which fails when reading the first
+// payload chunk.
+
+// ArchiveWriter writes an archive of named entries encrypted to a single set of
+// recipients. Entries are written sequentially, like with archive/zip.
+type ArchiveWriter struct {
+	dst     *countingWriter
+	fileKey []byte
+	nonce   []byte
+	entries []archiveEntry
+	cur     *stream.Writer
+	closed  bool
+}
+
+type archiveEntry struct {
+	name   string
+	offset int64
+	length int64
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// NewArchiveWriter writes the header of an archive to dst, encrypted to one or
+// more recipients, and returns an ArchiveWriter to add entries to it.
+//
+// The caller must call Close on the ArchiveWriter when done for the last entry
+// and the index to be written to dst.
+func NewArchiveWriter(dst io.Writer, recipients ...Recipient) (*ArchiveWriter, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("no recipients specified")
+	}
+
+	fileKey := make([]byte, fileKeySize)
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, err
+	}
+
+	hdr, err := encryptHdr(fileKey, &Options{}, recipients...)
+	if err != nil {
+		return nil, err
+	}
+	w := &ArchiveWriter{dst: &countingWriter{w: dst}, fileKey: fileKey}
+	if err := hdr.Marshal(w.dst); err != nil {
+		return nil, fmt.Errorf("failed to write header: %v", err)
+	}
+
+	w.nonce = make([]byte, streamNonceSize)
+	if _, err := rand.Read(w.nonce); err != nil {
+		return nil, err
+	}
+	if _, err := w.dst.Write(w.nonce); err != nil {
+		return nil, fmt.Errorf("failed to write nonce: %v", err)
+	}
+
+	return w, nil
+}
+
+// Create adds a new entry with the given name to the archive, and returns a
+// Writer for its contents. The previous entry, if any, is finished, and can't
+// be written to anymore.
+func (w *ArchiveWriter) Create(name string) (io.Writer, error) {
+	if w.closed {
+		return nil, errors.New("archive is closed")
+	}
+	if name == "" || len(name) > 0xFFFF {
+		return nil, fmt.Errorf("invalid entry name %q", name)
+	}
+	for _, e := range w.entries {
+		if e.name == name {
+			return nil, fmt.Errorf("duplicate entry name %q", name)
+		}
+	}
+	if err := w.finishEntry(); err != nil {
+		return nil, err
+	}
+
+	key := archiveKey(w.fileKey, w.nonce, len(w.entries))
+	sw, err := stream.NewWriter(key, w.dst)
+	if err != nil {
+		return nil, err
+	}
+	w.cur = sw
+	w.entries = append(w.entries, archiveEntry{name: name, offset: w.dst.n})
+	return sw, nil
+}
+
+func (w *ArchiveWriter) finishEntry() error {
+	if w.cur == nil {
+		return nil
+	}
+	if err := w.cur.Close(); err != nil {
+		return err
+	}
+	w.cur = nil
+	e := &w.entries[len(w.entries)-1]
+	e.length = w.dst.n - e.offset
+	return nil
+}
+
+// Close finishes the last entry, and writes the index of the archive. It
+// doesn't close the underlying Writer.
+func (w *ArchiveWriter) Close() error {
+	if w.closed {
+		return errors.New("archive is closed")
+	}
+	w.closed = true
+	if err := w.finishEntry(); err != nil {
+		return err
+	}
+
+	var index []byte
+	for _, e := range w.entries {
+		index = binary.BigEndian.AppendUint64(index, uint64(e.length))
+		index = binary.BigEndian.AppendUint16(index, uint16(len(e.name)))
+		index = append(index, e.name...)
+	}
+	indexOffset := w.dst.n
+	sw, err := stream.NewWriter(archiveKey(w.fileKey, w.nonce, -1), w.dst)
+	if err != nil {
+		return err
+	}
+	if _, err := sw.Write(index); err != nil {
+		return err
+	}
+	if err := sw.Close(); err != nil {
+		return err
+	}
+	return binary.Write(w.dst, binary.BigEndian, uint64(indexOffset))
+}
+
+// ArchiveReader provides access to the entries of an archive written by an
+// ArchiveWriter.
+type ArchiveReader struct {
+	src     io.ReaderAt
+	fileKey []byte
+	nonce   []byte
+	entries []archiveEntry
+}
+
+// OpenArchive decrypts the header and the index of the archive of the given
+// size read from src. All identities will be tried until one successfully
+// decrypts the file.
+func OpenArchive(src io.ReaderAt, size int64, identities ...Identity) (*ArchiveReader, error) {
+	if len(identities) == 0 {
+		return nil, errors.New("no identities specified")
+	}
+	if size < 8 {
+		return nil, errors.New("archive too short")
+	}
+
+	hdr, payload, err := format.Parse(io.NewSectionReader(src, 0, size-8))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", headerError(err))
+	}
+	fileKey, _, err := decryptHdr(hdr, nil, identities...)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, streamNonceSize)
+	if _, err := io.ReadFull(payload, nonce); err != nil {
+		return nil, fmt.Errorf("failed to read nonce: %w", err)
+	}
+
+	// The header encoding is not malleable, so we can recompute its length.
+	hdrBuf := &bytes.Buffer{}
+	if err := hdr.Marshal(hdrBuf); err != nil {
+		return nil, fmt.Errorf("internal error: %v", err)
+	}
+	entriesOffset := int64(hdrBuf.Len() + streamNonceSize)
+
+	var trailer [8]byte
+	if _, err := src.ReadAt(trailer[:], size-8); err != nil {
+		return nil, fmt.Errorf("failed to read archive trailer: %w", err)
+	}
+	indexOffset := int64(binary.BigEndian.Uint64(trailer[:]))
+	if indexOffset < entriesOffset || indexOffset > size-8 {
+		return nil, errors.New("invalid archive index offset")
+	}
+
+	sr, err := stream.NewReader(archiveKey(fileKey, nonce, -1),
+		io.NewSectionReader(src, indexOffset, size-8-indexOffset))
+	if err != nil {
+		return nil, err
+	}
+	index, err := io.ReadAll(sr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive index: %w", err)
+	}
+
+	a := &ArchiveReader{src: src, fileKey: fileKey, nonce: nonce}
+	offset := entriesOffset
+	names := make(map[string]bool)
+	for len(index) > 0 {
+		if len(index) < 10 {
+			return nil, errors.New("malformed archive index")
+		}
+		length := int64(binary.BigEndian.Uint64(index))
+		nameLen := int(binary.BigEndian.Uint16(index[8:]))
+		index = index[10:]
+		if nameLen == 0 || len(index) < nameLen {
+			return nil, errors.New("malformed archive index")
+		}
+		name := string(index[:nameLen])
+		index = index[nameLen:]
+		if names[name] {
+			return nil, fmt.Errorf("malformed archive index: duplicate entry name %q", name)
+		}
+		names[name] = true
+		if length < 0 || length > indexOffset-offset {
+			return nil, errors.New("malformed archive index: invalid entry length")
+		}
+		a.entries = append(a.entries, archiveEntry{name: name, offset: offset, length: length})
+		offset += length
+	}
+	if offset != indexOffset {
+		return nil, errors.New("malformed archive index: entries don't match index offset")
+	}
+
+	return a, nil
+}
+
+// Names returns the names of the entries in the archive, in the order they
+// were written.
+func (a *ArchiveReader) Names() []string {
+	names := make([]string, 0, len(a.entries))
+	for _, e := range a.entries {
+		names = append(names, e.name)
+	}
+	return names
+}
+
+// Open returns a Reader reading the decrypted contents of the named entry.
+func (a *ArchiveReader) Open(name string) (io.Reader, error) {
+	for i, e := range a.entries {
+		if e.name != name {
+			continue
+		}
+		key := archiveKey(a.fileKey, a.nonce, i)
+		return stream.NewReader(key, io.NewSectionReader(a.src, e.offset, e.length))
+	}
+	return nil, fmt.Errorf("entry %q not found in archive", name)
+}
+
+// archiveKey derives the STREAM key for the entry with the given index, or for
+// the archive index if entry is -1.
+func archiveKey(fileKey, nonce []byte, entry int) []byte {
+	info := []byte("archive index")
+	if entry >= 0 {
+		info = binary.BigEndian.AppendUint64([]byte("archive entry "), uint64(entry))
+	}
+	h := hkdf.New(sha256.New, fileKey, nonce, info)
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(h, key); err != nil {
+		panic("age: internal error: failed to read from HKDF: " + err.Error())
+	}
+	return key
+}
@@ -0,0 +1,84 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func TestArchive(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := map[string][]byte{
+		"a":     []byte("hello"),
+		"empty": nil,
+		"big":   bytes.Repeat([]byte("A"), 200*1024),
+	}
+	order := []string{"a", "empty", "big"}
+
+	buf := &bytes.Buffer{}
+	w, err := age.NewArchiveWriter(buf, i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range order {
+		ew, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ew.Write(entries[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := w.Create("a"); err == nil {
+		t.Error("expected duplicate name to fail")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data := buf.Bytes()
+	a, err := age.OpenArchive(bytes.NewReader(data), int64(len(data)), i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := a.Names(); len(names) != len(order) {
+		t.Fatalf("unexpected names: %q", names)
+	}
+	for _, name := range order {
+		r, err := a.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, entries[name]) {
+			t.Errorf("entry %q: wrong contents", name)
+		}
+	}
+	if _, err := a.Open("missing"); err == nil {
+		t.Error("expected missing entry to fail")
+	}
+
+	if r, err := age.Decrypt(bytes.NewReader(data), i); err == nil {
+		if _, err := io.ReadAll(r); err == nil {
+			t.Error("expected Decrypt of archive to fail")
+		}
+	}
+
+	data[len(data)-20] ^= 1
+	if _, err := age.OpenArchive(bytes.NewReader(data), int64(len(data)), i); err == nil {
+		t.Error("expected tampered index to fail")
+	}
+}
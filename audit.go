@@ -0,0 +1,92 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"errors"
+	"strings"
+)
+
+// An AuditEvent reports the outcome of an identity's attempt to unwrap the
+// file key of a file being decrypted. Events are delivered to Options.Audit.
+//
+// File keys, secret keys, and stanza bodies are never included.
+type AuditEvent struct {
+	// Identity is the identity that was tried, and IdentityIndex is its
+	// zero-based position in the arguments to DecryptWithOptions.
+	Identity      Identity
+	IdentityIndex int
+
+	// Description identifies Identity without revealing secrets. For the
+	// native identity types, it's the type followed by the public key or
+	// recipient, otherwise it's just the type.
+	Description string
+
+	// StanzaType is the type of the stanza involved, if it can be determined:
+	// the stanza that caused the failure, or the type shared by all the
+	// recipient stanzas in the header, excluding grease.
+	StanzaType string
+
+	// Stanzas are the types of the recipient stanzas in the header.
+	Stanzas []string
+
+	// Context is Options.AuditContext.
+	Context any
+
+	// Err is nil if Identity unwrapped the file key. Otherwise, it wraps
+	// ErrIncorrectIdentity if Identity didn't match any stanza, or is the
+	// error returned by Unwrap. Note that a successful unwrap is still
+	// followed by the header MAC check, which might fail.
+	Err error
+}
+
+func (opts *Options) audit(i int, id Identity, stanzas []*Stanza, err error) {
+	if opts == nil || opts.Audit == nil {
+		return
+	}
+	e := &AuditEvent{
+		Identity:      id,
+		IdentityIndex: i,
+		Description:   describeIdentity(id),
+		Context:       opts.AuditContext,
+		Err:           err,
+	}
+	var mixed bool
+	for _, s := range stanzas {
+		e.Stanzas = append(e.Stanzas, s.Type)
+		if strings.HasSuffix(s.Type, "-grease") {
+			continue
+		}
+		if e.StanzaType != "" && e.StanzaType != s.Type {
+			mixed = true
+		}
+		e.StanzaType = s.Type
+	}
+	if mixed {
+		e.StanzaType = ""
+	}
+	var se *StanzaError
+	if errors.As(err, &se) {
+		e.StanzaType = se.Type
+	}
+	opts.Audit(e)
+}
+
+// describeIdentity returns a description of id that doesn't include secrets.
+func describeIdentity(id Identity) string {
+	switch id := id.(type) {
+	case *X25519Identity:
+		return "X25519 " + id.Recipient().String()
+	case *X25519SubkeyIdentity:
+		return "X25519 subkey " + id.Recipient().String()
+	case *X448Identity:
+		return "X448 " + id.Recipient().String()
+	case *HPKEIdentity:
+		return "HPKE " + id.Recipient().String()
+	case *ScryptIdentity:
+		return "scrypt passphrase"
+	}
+	return typeName(id)
+}
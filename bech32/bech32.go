@@ -19,7 +19,15 @@
 // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
 // THE SOFTWARE.
 
-// Package bech32 is a modified version of the reference implementation of BIP173.
+// Package bech32 implements the Bech32 encoding used by age for recipients
+// ("age1...") and identities ("AGE-SECRET-KEY-1..."), including those of
+// plugins. It is a modified version of the reference implementation of BIP173.
+//
+// Unlike BIP173, this package doesn't limit the length of the encoded string
+// to 90 characters, as keys such as post-quantum recipients and plugin
+// identities can be much longer. Everything else follows BIP173: the checksum
+// is the original Bech32 one (not Bech32m), and strings must be all lowercase
+// or all uppercase.
 package bech32
 
 import (
@@ -17,10 +17,11 @@
 package bech32_test
 
 import (
+	"fmt"
 	"strings"
 	"testing"
 
-	"filippo.io/age/internal/bech32"
+	"filippo.io/age/bech32"
 )
 
 func TestBech32(t *testing.T) {
@@ -93,3 +94,20 @@ func TestBech32(t *testing.T) {
 		}
 	}
 }
+
+func ExampleEncode() {
+	s, err := bech32.Encode("age1example", []byte{0x42})
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(s)
+
+	hrp, data, err := bech32.Decode(s)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(hrp, data)
+	// Output:
+	// age1example1gg4505fk
+	// age1example [66]
+}
@@ -0,0 +1,72 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"filippo.io/age/internal/format"
+	"filippo.io/age/stream"
+)
+
+// A chunk-size stanza records the size of the payload chunks, if it's not the
+// default 64 KiB. Its only argument is the size in bytes, in decimal, and its
+// body is empty. Like every stanza, it's authenticated by the header MAC.
+//
+// Implementations that don't support it ignore it, like any unknown stanza,
+// and then fail to authenticate the first payload chunk.
+const chunkSizeStanzaType = "chunk-size"
+
+// checkChunkSize checks that n is a power of two between stream.ChunkSize and
+// stream.MaxChunkSize.
+func checkChunkSize(n int) error {
+	if n < stream.ChunkSize || n > stream.MaxChunkSize || n&(n-1) != 0 {
+		return fmt.Errorf("invalid chunk size %d: must be a power of two between %d and %d",
+			n, stream.ChunkSize, stream.MaxChunkSize)
+	}
+	return nil
+}
+
+func (opts *Options) chunkSize() int {
+	if opts.ChunkSize == 0 {
+		return stream.ChunkSize
+	}
+	return opts.ChunkSize
+}
+
+func chunkSizeStanza(n int) *format.Stanza {
+	return &format.Stanza{Type: chunkSizeStanzaType, Args: []string{strconv.Itoa(n)}}
+}
+
+// payloadChunkSize returns the size of the payload chunks of a file with
+// header hdr, which is stream.ChunkSize unless there is a chunk-size stanza.
+func payloadChunkSize(hdr *format.Header) (int, error) {
+	size := 0
+	for _, s := range hdr.Recipients {
+		if s.Type != chunkSizeStanzaType {
+			continue
+		}
+		if size != 0 {
+			return 0, errors.New("multiple chunk-size stanzas")
+		}
+		if len(s.Args) != 1 || len(s.Body) != 0 {
+			return 0, errors.New("invalid chunk-size stanza")
+		}
+		n, err := strconv.Atoi(s.Args[0])
+		if err != nil || strconv.Itoa(n) != s.Args[0] {
+			return 0, errors.New("invalid chunk-size stanza")
+		}
+		if err := checkChunkSize(n); err != nil {
+			return 0, fmt.Errorf("invalid chunk-size stanza: %v", err)
+		}
+		size = n
+	}
+	if size == 0 {
+		return stream.ChunkSize, nil
+	}
+	return size, nil
+}
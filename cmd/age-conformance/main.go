@@ -0,0 +1,77 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"filippo.io/age/conformance"
+)
+
+const usage = `Usage:
+    age-conformance --dir DIR [--timeout DURATION] COMMAND [ARGS...]
+
+Options:
+    --dir DIR                 Read the test vectors from DIR.
+    --timeout DURATION        Maximum time for each vector. Default: 10s.
+
+age-conformance runs the age test vectors from c2sp.org/CCTV/age against an
+external age implementation, and prints a compatibility report. DIR is the
+"age/testdata" directory of a checkout of https://github.com/C2SP/CCTV.
+
+For each vector, COMMAND is run with ARGS, followed by "-d -i PATH", where
+PATH is a file containing the identities of the vector. The age file is
+provided on standard input. COMMAND must write the plaintext to standard
+output and exit successfully, or exit with a non-zero status on failure.
+
+Vectors that require a passphrase are skipped.
+
+age-conformance exits with status 1 if any vector failed.
+
+Examples:
+
+    $ age-conformance --dir CCTV/age/testdata age
+    $ age-conformance --dir CCTV/age/testdata rage
+    $ age-conformance --dir CCTV/age/testdata python3 -m age`
+
+func main() {
+	log.SetFlags(0)
+	flag.Usage = func() { fmt.Fprintf(os.Stderr, "%s\n", usage) }
+
+	var (
+		dirFlag     string
+		timeoutFlag time.Duration
+	)
+	flag.StringVar(&dirFlag, "dir", "", "read the test vectors from `DIR`")
+	flag.DurationVar(&timeoutFlag, "timeout", 10*time.Second, "maximum time for each vector")
+	flag.Parse()
+
+	if flag.NArg() == 0 || dirFlag == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	vectors, err := conformance.ReadVectors(os.DirFS(dirFlag))
+	if err != nil {
+		log.Fatalf("age-conformance: error: failed to load test vectors: %v", err)
+	}
+
+	c := &conformance.Command{
+		Path:    flag.Arg(0),
+		Args:    flag.Args()[1:],
+		Timeout: timeoutFlag,
+	}
+	failed, err := conformance.WriteReport(os.Stdout, c.RunAll(vectors))
+	if err != nil {
+		log.Fatalf("age-conformance: error: %v", err)
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
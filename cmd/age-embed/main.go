@@ -0,0 +1,302 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"go/token"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"filippo.io/age"
+)
+
+const usage = `Usage:
+    age-embed [-o DIR] [--package NAME] [--env VAR] (-r RECIPIENT | -R PATH)... FILE...
+
+Options:
+    -o, --output DIR          Write the package to DIR. Default: current directory.
+    --package NAME            Name the package NAME. Default: the name of DIR.
+    --env VAR                 Read the identity path from VAR at runtime.
+                              Default: AGE_EMBED_IDENTITY.
+    -r, --recipient RECIPIENT Encrypt to the specified RECIPIENT. Can be repeated.
+    -R, --recipients-file PATH Encrypt to recipients listed at PATH. Can be repeated.
+
+age-embed encrypts each FILE to the recipients, writes it to DIR with a ".age"
+extension, and generates an age_embed.go file that embeds the encrypted files
+into a Go package, for shipping secrets such as API keys inside binaries.
+
+The generated package has two functions. Open(identities...) returns an fs.FS
+that serves the decrypted files by their original name. Load() reads the
+identities from the file at the path in the VAR environment variable, checks
+that all the files can be decrypted, and returns the same fs.FS. It's meant to
+be called at startup, so that a missing or wrong identity is reported early.
+
+Only native X25519, X448, and HPKE recipients are supported. The generated
+package imports filippo.io/age.
+
+age-embed is designed to be used with go:generate.
+
+Example:
+
+    //go:generate go run filippo.io/age/cmd/age-embed -R deploy.txt -o secrets api_key.txt
+
+    assets, err := secrets.Load()
+    if err != nil {
+        log.Fatal(err)
+    }
+    apiKey, err := fs.ReadFile(assets, "api_key.txt")`
+
+type multiFlag []string
+
+func (f *multiFlag) String() string { return fmt.Sprint(*f) }
+
+func (f *multiFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+func main() {
+	log.SetFlags(0)
+	flag.Usage = func() { fmt.Fprintf(os.Stderr, "%s\n", usage) }
+
+	var (
+		outFlag, packageFlag, envFlag       string
+		recipientFlags, recipientsFileFlags multiFlag
+	)
+	flag.StringVar(&outFlag, "o", ".", "write the package to `DIR`")
+	flag.StringVar(&outFlag, "output", ".", "write the package to `DIR`")
+	flag.StringVar(&packageFlag, "package", "", "name the package `NAME`")
+	flag.StringVar(&envFlag, "env", "AGE_EMBED_IDENTITY", "read the identity path from `VAR`")
+	flag.Var(&recipientFlags, "r", "recipient (can be repeated)")
+	flag.Var(&recipientFlags, "recipient", "recipient (can be repeated)")
+	flag.Var(&recipientsFileFlags, "R", "recipients file (can be repeated)")
+	flag.Var(&recipientsFileFlags, "recipients-file", "recipients file (can be repeated)")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if len(recipientFlags)+len(recipientsFileFlags) == 0 {
+		errorf("missing recipients, specify at least one with -r or -R")
+	}
+	if envFlag == "" {
+		errorf("--env can't be empty")
+	}
+
+	var recipients []age.Recipient
+	for _, arg := range recipientFlags {
+		r, err := parseRecipient(arg)
+		if err != nil {
+			errorf("%v", err)
+		}
+		recipients = append(recipients, r)
+	}
+	for _, name := range recipientsFileFlags {
+		recs, err := parseRecipientsFile(name)
+		if err != nil {
+			errorf("failed to parse recipient file %q: %v", name, err)
+		}
+		recipients = append(recipients, recs...)
+	}
+
+	if packageFlag == "" {
+		abs, err := filepath.Abs(outFlag)
+		if err != nil {
+			errorf("%v", err)
+		}
+		packageFlag = filepath.Base(abs)
+	}
+	if !token.IsIdentifier(packageFlag) || token.IsKeyword(packageFlag) {
+		errorf("invalid package name %q, specify one with --package", packageFlag)
+	}
+
+	if err := os.MkdirAll(outFlag, 0755); err != nil {
+		errorf("failed to create output directory: %v", err)
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, path := range flag.Args() {
+		name := filepath.Base(path)
+		if seen[name] {
+			errorf("duplicate file name %q", name)
+		}
+		seen[name] = true
+		if !validEmbedName(name) {
+			errorf("file name %q can't be embedded", name)
+		}
+		if err := encryptFile(path, filepath.Join(outFlag, name+".age"), recipients); err != nil {
+			errorf("failed to encrypt %q: %v", path, err)
+		}
+		names = append(names, name)
+	}
+
+	src, err := generate(packageFlag, envFlag, names)
+	if err != nil {
+		errorf("internal error: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(outFlag, "age_embed.go"), src, 0644); err != nil {
+		errorf("failed to write package: %v", err)
+	}
+}
+
+func parseRecipient(arg string) (age.Recipient, error) {
+	switch {
+	case strings.HasPrefix(arg, "age1hpke1"):
+		return age.ParseHPKERecipient(arg)
+	case strings.HasPrefix(arg, "age1x4481"):
+		return age.ParseX448Recipient(arg)
+	case strings.HasPrefix(arg, "age1") && strings.Count(arg, "1") > 1:
+		return nil, fmt.Errorf("plugin recipients are not supported: %q", arg)
+	case strings.HasPrefix(arg, "age1"):
+		return age.ParseX25519Recipient(arg)
+	}
+	return nil, fmt.Errorf("unknown recipient type: %q", arg)
+}
+
+func parseRecipientsFile(name string) ([]age.Recipient, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var recs []age.Recipient
+	scanner := bufio.NewScanner(f)
+	var n int
+	for scanner.Scan() {
+		n++
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") || line == "" {
+			continue
+		}
+		r, err := parseRecipient(line)
+		if err != nil {
+			// Hide the error since it might unintentionally leak the contents
+			// of confidential files.
+			return nil, fmt.Errorf("malformed recipient at line %d", n)
+		}
+		recs = append(recs, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(recs) == 0 {
+		return nil, fmt.Errorf("no recipients found")
+	}
+	return recs, nil
+}
+
+// validEmbedName reports whether name can be used in a go:embed pattern and
+// will not be excluded by it.
+func validEmbedName(name string) bool {
+	if name == "" || name[0] == '.' || name[0] == '_' {
+		return false
+	}
+	return !strings.ContainsAny(name, "*?[]\\\"` \t")
+}
+
+func encryptFile(in, out string, recipients []age.Recipient) error {
+	plaintext, err := os.ReadFile(in)
+	if err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, recipients...)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return os.WriteFile(out, buf.Bytes(), 0644)
+}
+
+var tmpl = template.Must(template.New("").Parse(`// Code generated by age-embed. DO NOT EDIT.
+
+package {{ .Package }}
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"filippo.io/age"
+)
+
+//go:embed{{ range .Names }} {{ . }}.age{{ end }}
+var encrypted embed.FS
+
+// Names are the names of the embedded files.
+var Names = []string{ {{- range .Names }}{{ printf "%q" . }}, {{ end -}} }
+
+// IdentityEnv is the environment variable Load reads the identity file path
+// from.
+const IdentityEnv = {{ printf "%q" .Env }}
+
+// Open returns a file system that serves the embedded files, decrypted with
+// the first matching identity when opened.
+func Open(identities ...age.Identity) fs.FS {
+	return age.OpenFS(encrypted, identities...)
+}
+
+// Load reads the identities from the file at the path in the IdentityEnv
+// environment variable, checks that all the embedded files can be decrypted,
+// and returns Open(identities...).
+func Load() (fs.FS, error) {
+	path := os.Getenv(IdentityEnv)
+	if path == "" {
+		return nil, fmt.Errorf("%s is not set", IdentityEnv)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open identity file: %w", err)
+	}
+	defer f.Close()
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse identity file %q: %w", path, err)
+	}
+	fsys := Open(identities...)
+	for _, name := range Names {
+		f, err := fsys.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+	}
+	return fsys, nil
+}
+`))
+
+func generate(pkg, env string, names []string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := tmpl.Execute(buf, struct {
+		Package, Env string
+		Names        []string
+	}{pkg, env, names})
+	if err != nil {
+		return nil, err
+	}
+	return format.Source(buf.Bytes())
+}
+
+func errorf(format string, v ...interface{}) {
+	log.Printf("age-embed: error: "+format, v...)
+	log.Fatalf("age-embed: report unexpected or unhelpful errors at https://filippo.io/age/report")
+}
@@ -0,0 +1,59 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	kernel32               = windows.NewLazySystemDLL("kernel32.dll")
+	procGetConsoleCP       = kernel32.NewProc("GetConsoleCP")
+	procSetConsoleCP       = kernel32.NewProc("SetConsoleCP")
+	procGetConsoleOutputCP = kernel32.NewProc("GetConsoleOutputCP")
+	procSetConsoleOutputCP = kernel32.NewProc("SetConsoleOutputCP")
+)
+
+const cpUTF8 = 65001
+
+// withTerminal runs f with the terminal the plugins interact with the user on.
+var withTerminal = withConsole
+
+// withConsole runs f with the console input and output, even if standard input
+// and output are redirected.
+func withConsole(f func(in, out *os.File) error) error {
+	defer useUTF8Console()()
+	in, err := os.OpenFile("CONIN$", os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile("CONOUT$", os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return f(in, out)
+}
+
+// useUTF8Console switches the console input and output code pages to UTF-8
+// while prompting, so that non-ASCII values are read as the same bytes as on
+// other platforms, and returns a function that restores the previous ones.
+func useUTF8Console() (restore func()) {
+	in, _, _ := procGetConsoleCP.Call()
+	out, _, _ := procGetConsoleOutputCP.Call()
+	if in == 0 || out == 0 {
+		// Not attached to a console.
+		return func() {}
+	}
+	procSetConsoleCP.Call(cpUTF8)
+	procSetConsoleOutputCP.Call(cpUTF8)
+	return func() {
+		procSetConsoleCP.Call(in)
+		procSetConsoleOutputCP.Call(out)
+	}
+}
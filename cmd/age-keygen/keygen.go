@@ -5,35 +5,79 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"runtime/debug"
+	"strings"
 	"time"
 
 	"filippo.io/age"
+	"filippo.io/age/internal/keychain"
+	"filippo.io/age/plugin"
 	"golang.org/x/term"
 )
 
 const usage = `Usage:
-    age-keygen [-o OUTPUT]
+    age-keygen [--x448 | --mlkem] [--format FORMAT] [-o OUTPUT]
+    age-keygen [--x448 | --mlkem] --store NAME
     age-keygen -y [-o OUTPUT] [INPUT]
+    age-keygen --subkey LABEL [-y] [-o OUTPUT] [INPUT]
+    age-keygen --plugin NAME --list [-o OUTPUT]
 
 Options:
     -o, --output OUTPUT       Write the result to the file at path OUTPUT.
     -y                        Convert an identity file to a recipients file.
+    --subkey LABEL            Derive the subkey with the given LABEL.
+    --x448                    Generate an X448 key pair.
+    --mlkem                   Generate an experimental ML-KEM-1024 key pair.
+    --store NAME              Store the identity in the OS keychain as NAME.
+    --format FORMAT           Output the key pair as "text", "json", or "pem".
+    --plugin NAME --list      List the identities available to a plugin.
 
 age-keygen generates a new native X25519 key pair, and outputs it to
-standard output or to the OUTPUT file.
+standard output or to the OUTPUT file. With --x448, it generates an X448 key
+pair instead. With --mlkem, it generates an EXPERIMENTAL pure post-quantum
+ML-KEM-1024 key pair, which is only available if age-keygen was built with
+the age_mlkem build tag.
 
 If an OUTPUT file is specified, the public key is printed to standard error.
 If OUTPUT already exists, it is not overwritten.
 
+With --format json, the key pair is output as a JSON object with the
+"recipient", "identity", "created_at", and "fingerprint" fields. The
+fingerprint is "SHA256:" followed by the unpadded base64 SHA-256 hash of the
+recipient. With --format pem, the identity is output as an "AGE SECRET KEY"
+PEM block with the same information in its headers. Only the default text
+format can be used directly as an identity file.
+
+With --store, the identity is saved in the OS keychain (the macOS Keychain, or
+the Secret Service through secret-tool elsewhere) under NAME instead of being
+output, and only the recipient is printed to standard output. The identity can
+then be used with "age -i keychain://NAME".
+
 In -y mode, age-keygen reads an identity file from INPUT or from standard
 input and writes the corresponding recipient(s) to OUTPUT or to standard
-output, one per line, with no comments.
+output, one per line, with no comments. Plugin identities ("AGE-PLUGIN-...")
+can't be converted, use --plugin NAME --list to print their recipients.
+
+In --subkey mode, age-keygen reads native identities from INPUT or from
+standard input and derives from each the subkey identity for LABEL, such as
+"backups/2024" or "ci". Files encrypted to a subkey recipient can be decrypted
+with the subkey identity. The original identity can't decrypt them on its own,
+because the files don't reveal the label. With -y, the subkey recipients are
+output instead.
+
+In --list mode, age-keygen asks the age-plugin-NAME binary for the identities
+it can use, such as the keys in the slots of connected hardware tokens, and
+outputs them as an identity file, with their description and recipient in
+comments.
 
 Examples:
 
@@ -46,7 +90,13 @@ Examples:
     Public key: age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
 
     $ age-keygen -y key.txt
-    age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p`
+    age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
+
+    $ age-keygen --store work
+    age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
+
+    $ age-keygen --subkey ci -o ci-key.txt key.txt
+    Public key: age1zvkyg2lqzraa2lnjvqej32nkuu0ues2s82hzrye869xeexvn73equnujwj`
 
 // Version can be set at link time to override debug.BuildInfo.Main.Version,
 // which is "(devel)" when building from within the module. See
@@ -59,20 +109,60 @@ func main() {
 
 	var (
 		versionFlag, convertFlag bool
-		outFlag                  string
+		x448Flag, listFlag       bool
+		mlkemFlag                bool
+		outFlag, subkeyFlag      string
+		pluginFlag, storeFlag    string
+		formatFlag               string
 	)
 
 	flag.BoolVar(&versionFlag, "version", false, "print the version")
 	flag.BoolVar(&convertFlag, "y", false, "convert identities to recipients")
 	flag.StringVar(&outFlag, "o", "", "output to `FILE` (default stdout)")
 	flag.StringVar(&outFlag, "output", "", "output to `FILE` (default stdout)")
+	flag.StringVar(&subkeyFlag, "subkey", "", "derive the subkey for `LABEL`")
+	flag.BoolVar(&x448Flag, "x448", false, "generate an X448 key pair")
+	flag.BoolVar(&mlkemFlag, "mlkem", false, "generate an experimental ML-KEM-1024 key pair")
+	flag.StringVar(&pluginFlag, "plugin", "", "use the plugin `NAME`")
+	flag.BoolVar(&listFlag, "list", false, "list the identities available to --plugin")
+	flag.StringVar(&storeFlag, "store", "", "store the identity in the OS keychain as `NAME`")
+	flag.StringVar(&formatFlag, "format", "text", "output the key pair in `FORMAT`")
 	flag.Parse()
-	if len(flag.Args()) != 0 && !convertFlag {
+	if len(flag.Args()) != 0 && !convertFlag && subkeyFlag == "" {
 		errorf("too many arguments")
 	}
-	if len(flag.Args()) > 1 && convertFlag {
+	if len(flag.Args()) > 1 {
 		errorf("too many arguments")
 	}
+	if x448Flag && (convertFlag || subkeyFlag != "") {
+		errorf("--x448 can't be used with -y or --subkey")
+	}
+	if mlkemFlag && (convertFlag || subkeyFlag != "" || x448Flag) {
+		errorf("--mlkem can't be used with -y, --subkey, or --x448")
+	}
+	if (pluginFlag != "") != listFlag {
+		errorf("--plugin and --list must be used together")
+	}
+	if listFlag && (convertFlag || subkeyFlag != "" || x448Flag || mlkemFlag || len(flag.Args()) != 0) {
+		errorf("--list can't be used with other modes or an INPUT")
+	}
+	if storeFlag != "" && (convertFlag || subkeyFlag != "" || listFlag || outFlag != "") {
+		errorf("--store can't be used with -o, -y, --subkey, or --list")
+	}
+	switch formatFlag {
+	case "text":
+	case "json", "pem":
+		if convertFlag || subkeyFlag != "" || listFlag || storeFlag != "" {
+			errorf("--format can only be used when generating a key pair")
+		}
+	default:
+		errorf("unknown --format %q, must be text, json, or pem", formatFlag)
+	}
+	if storeFlag != "" {
+		if err := keychain.CheckName(storeFlag); err != nil {
+			errorf("%v", err)
+		}
+	}
 	if versionFlag {
 		if Version != "" {
 			fmt.Println(Version)
@@ -86,6 +176,11 @@ func main() {
 		return
 	}
 
+	if storeFlag != "" {
+		store(storeFlag, x448Flag, mlkemFlag)
+		return
+	}
+
 	out := os.Stdout
 	if outFlag != "" {
 		f, err := os.OpenFile(outFlag, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
@@ -110,32 +205,160 @@ func main() {
 		in = f
 	}
 
-	if convertFlag {
-		convert(in, out)
+	if listFlag {
+		list(out, pluginFlag)
+	} else if convertFlag {
+		convert(in, out, subkeyFlag)
 	} else {
 		if fi, err := out.Stat(); err == nil && fi.Mode().IsRegular() && fi.Mode().Perm()&0004 != 0 {
 			warning("writing secret key to a world-readable file")
 		}
-		generate(out)
+		if subkeyFlag != "" {
+			subkey(in, out, subkeyFlag)
+		} else {
+			generate(out, x448Flag, mlkemFlag, formatFlag)
+		}
 	}
 }
 
-func generate(out *os.File) {
-	k, err := age.GenerateX25519Identity()
+// newKeyPair returns a new identity and its recipient.
+func newKeyPair(x448, mlkem bool) (k, r fmt.Stringer) {
+	if mlkem {
+		k, r, err := newMLKEMKeyPair()
+		if err != nil {
+			errorf("%v", err)
+		}
+		return k, r
+	}
+	if x448 {
+		i, err := age.GenerateX448Identity()
+		if err != nil {
+			errorf("internal error: %v", err)
+		}
+		return i, i.Recipient()
+	}
+	i, err := age.GenerateX25519Identity()
 	if err != nil {
 		errorf("internal error: %v", err)
 	}
+	return i, i.Recipient()
+}
+
+func generate(out *os.File, x448, mlkem bool, format string) {
+	k, r := newKeyPair(x448, mlkem)
 
 	if !term.IsTerminal(int(out.Fd())) {
-		fmt.Fprintf(os.Stderr, "Public key: %s\n", k.Recipient())
+		fmt.Fprintf(os.Stderr, "Public key: %s\n", r)
 	}
 
-	fmt.Fprintf(out, "# created: %s\n", time.Now().Format(time.RFC3339))
-	fmt.Fprintf(out, "# public key: %s\n", k.Recipient())
-	fmt.Fprintf(out, "%s\n", k)
+	created := time.Now().Format(time.RFC3339)
+	switch format {
+	case "json":
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(struct {
+			Recipient   string `json:"recipient"`
+			Identity    string `json:"identity"`
+			Created     string `json:"created_at"`
+			Fingerprint string `json:"fingerprint"`
+		}{r.String(), k.String(), created, fingerprint(r)}); err != nil {
+			errorf("failed to write output: %v", err)
+		}
+	case "pem":
+		if err := pem.Encode(out, &pem.Block{
+			Type: "AGE SECRET KEY",
+			Headers: map[string]string{
+				"Created":     created,
+				"Public-Key":  r.String(),
+				"Fingerprint": fingerprint(r),
+			},
+			Bytes: []byte(k.String()),
+		}); err != nil {
+			errorf("failed to write output: %v", err)
+		}
+	default:
+		fmt.Fprintf(out, "# created: %s\n", created)
+		fmt.Fprintf(out, "# public key: %s\n", r)
+		fmt.Fprintf(out, "%s\n", k)
+	}
+}
+
+// fingerprint returns a short identifier for the recipient r, in the same
+// format as OpenSSH key fingerprints.
+func fingerprint(r fmt.Stringer) string {
+	h := sha256.Sum256([]byte(r.String()))
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(h[:])
 }
 
-func convert(in io.Reader, out io.Writer) {
+func store(name string, x448, mlkem bool) {
+	k, r := newKeyPair(x448, mlkem)
+	if err := keychain.Store(name, []byte(k.String())); err != nil {
+		errorf("failed to store identity in the keychain: %v", err)
+	}
+	fmt.Printf("%s\n", r)
+}
+
+func subkey(in io.Reader, out *os.File, label string) {
+	ids := parseMasterIdentities(in, label)
+	for i, id := range ids {
+		if i == 0 && !term.IsTerminal(int(out.Fd())) {
+			fmt.Fprintf(os.Stderr, "Public key: %s\n", id.Recipient())
+		}
+		fmt.Fprintf(out, "# subkey: %s\n", id.Label())
+		fmt.Fprintf(out, "# public key: %s\n", id.Recipient())
+		fmt.Fprintf(out, "%s\n", id)
+	}
+}
+
+func parseMasterIdentities(in io.Reader, label string) []*age.X25519SubkeyIdentity {
+	ids, err := age.ParseIdentities(in)
+	if err != nil {
+		errorf("failed to parse input: %v", err)
+	}
+	var subkeys []*age.X25519SubkeyIdentity
+	for _, id := range ids {
+		x25519, ok := id.(*age.X25519Identity)
+		if !ok {
+			errorf("subkeys can only be derived from native X25519 identities")
+		}
+		sk, err := x25519.Subkey(label)
+		if err != nil {
+			errorf("failed to derive subkey: %v", err)
+		}
+		subkeys = append(subkeys, sk)
+	}
+	return subkeys
+}
+
+func list(out io.Writer, name string) {
+	ids, err := plugin.ListIdentities(name, pluginUI)
+	if err != nil {
+		errorf("failed to list identities: %v", err)
+	}
+	if len(ids) == 0 {
+		errorf("the %s plugin reported no identities", name)
+	}
+	for _, id := range ids {
+		if id.Description != "" {
+			for _, line := range strings.Split(id.Description, "\n") {
+				fmt.Fprintf(out, "# %s\n", line)
+			}
+		}
+		if id.Recipient != nil {
+			fmt.Fprintf(out, "# public key: %s\n", id.Recipient)
+		}
+		fmt.Fprintf(out, "%s\n", id.Identity)
+	}
+}
+
+func convert(in io.Reader, out io.Writer, subkeyLabel string) {
+	if subkeyLabel != "" {
+		for _, id := range parseMasterIdentities(in, subkeyLabel) {
+			fmt.Fprintf(out, "%s\n", id.Recipient())
+		}
+		return
+	}
+
 	ids, err := age.ParseIdentities(in)
 	if err != nil {
 		errorf("failed to parse input: %v", err)
@@ -144,14 +367,48 @@ func convert(in io.Reader, out io.Writer) {
 		errorf("no identities found in the input")
 	}
 	for _, id := range ids {
-		id, ok := id.(*age.X25519Identity)
-		if !ok {
-			errorf("internal error: unexpected identity type: %T", id)
+		switch id := id.(type) {
+		case *age.X25519Identity:
+			fmt.Fprintf(out, "%s\n", id.Recipient())
+		case *age.X25519SubkeyIdentity:
+			fmt.Fprintf(out, "%s\n", id.Recipient())
+		case *age.X448Identity:
+			fmt.Fprintf(out, "%s\n", id.Recipient())
+		case *age.HPKEIdentity:
+			fmt.Fprintf(out, "%s\n", id.Recipient())
+		default:
+			r, ok := mlkemRecipient(id)
+			if !ok {
+				errorf("internal error: unexpected identity type: %T", id)
+			}
+			fmt.Fprintf(out, "%s\n", r)
 		}
-		fmt.Fprintf(out, "%s\n", id.Recipient())
 	}
 }
 
+var pluginUI = &plugin.ClientUI{
+	DisplayMessage: func(name, message string) error {
+		log.Printf("age-keygen: %s plugin: %s", name, message)
+		return nil
+	},
+	RequestValue: func(name, message string, _ bool) (s string, err error) {
+		err = withTerminal(func(in, out *os.File) error {
+			fmt.Fprintf(out, "%s ", message)
+			defer fmt.Fprintf(out, "\n")
+			secret, err := term.ReadPassword(int(in.Fd()))
+			if err != nil {
+				return err
+			}
+			s = string(secret)
+			return nil
+		})
+		return s, err
+	},
+	WaitTimer: func(name string) {
+		log.Printf("age-keygen: waiting on %s plugin...", name)
+	},
+}
+
 func errorf(format string, v ...interface{}) {
 	log.Printf("age-keygen: error: "+format, v...)
 	log.Fatalf("age-keygen: report unexpected or unhelpful errors at https://filippo.io/age/report")
@@ -0,0 +1,31 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.24 && age_mlkem
+
+package main
+
+import (
+	"fmt"
+
+	"filippo.io/age"
+)
+
+// newMLKEMKeyPair returns a new EXPERIMENTAL ML-KEM-1024 identity and its
+// recipient. It's only available with the "age_mlkem" build tag.
+func newMLKEMKeyPair() (k, r fmt.Stringer, err error) {
+	i, err := age.GenerateMLKEMIdentity()
+	if err != nil {
+		return nil, nil, err
+	}
+	return i, i.Recipient(), nil
+}
+
+// mlkemRecipient returns the recipient of id if it's an *age.MLKEMIdentity.
+func mlkemRecipient(id age.Identity) (fmt.Stringer, bool) {
+	if id, ok := id.(*age.MLKEMIdentity); ok {
+		return id.Recipient(), true
+	}
+	return nil, false
+}
@@ -0,0 +1,22 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !go1.24 || !age_mlkem
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"filippo.io/age"
+)
+
+func newMLKEMKeyPair() (k, r fmt.Stringer, err error) {
+	return nil, nil, errors.New("ML-KEM keys are experimental, and require building age-keygen with Go 1.24+ and the age_mlkem build tag")
+}
+
+func mlkemRecipient(id age.Identity) (fmt.Stringer, bool) {
+	return nil, false
+}
@@ -0,0 +1,273 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// age-plugin-test is a reference age plugin, for testing age clients and plugin
+// integrations end to end. It wraps file keys with a key derived from a fixed,
+// public passphrase, so it provides NO SECURITY.
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime/debug"
+
+	"filippo.io/age"
+	"filippo.io/age/plugin"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const usage = `Usage:
+    age-plugin-test [--msg] [--prompt] [--confirm] [--fail]
+
+Options:
+    --msg        The identity displays a message before unwrapping.
+    --prompt     The identity requests the passphrase instead of using the
+                 built-in one.
+    --confirm    The identity asks for confirmation before unwrapping.
+    --fail       The identity reports an error instead of unwrapping.
+
+age-plugin-test is a deterministic age plugin, for testing age clients and
+plugin integrations end to end. It wraps file keys with a key derived from the
+fixed passphrase "age-plugin-test", so it provides NO SECURITY, and must never
+be used to protect real data.
+
+age-plugin-test outputs a new identity, preceded by a comment with its
+recipient. The recipient is always the same, and the identity only encodes the
+options, which select the interactions exercised when decrypting.
+
+With --prompt, the passphrase is requested with request-secret, and must be
+"age-plugin-test". With --confirm, the confirmation is requested with confirm,
+and if the client can't request it, the user is asked to type "yes" with
+request-public.
+
+Examples:
+
+    $ age-plugin-test --prompt > key.txt
+    $ age -r age1test1dzqdan -o secret.txt.age secret.txt
+    $ age -d -i key.txt secret.txt.age`
+
+// testPassphrase is the passphrase the wrapping key is derived from.
+const testPassphrase = "age-plugin-test"
+
+// Identity options, encoded as a bitmask in the first byte of the identity.
+const (
+	optMsg = 1 << iota
+	optPrompt
+	optConfirm
+	optFail
+	optAll = optMsg | optPrompt | optConfirm | optFail
+)
+
+// Version can be set at link time to override debug.BuildInfo.Main.Version,
+// which is "(devel)" when building from within the module. See
+// golang.org/issue/29814 and golang.org/issue/29228.
+var Version string
+
+func main() {
+	log.SetFlags(0)
+	flag.Usage = func() { fmt.Fprintf(os.Stderr, "%s\n", usage) }
+
+	var (
+		versionFlag, msgFlag, promptFlag bool
+		confirmFlag, failFlag            bool
+		stateMachineFlag                 string
+	)
+	flag.BoolVar(&versionFlag, "version", false, "print the version")
+	flag.BoolVar(&msgFlag, "msg", false, "display a message before unwrapping")
+	flag.BoolVar(&promptFlag, "prompt", false, "request the passphrase")
+	flag.BoolVar(&confirmFlag, "confirm", false, "ask for confirmation before unwrapping")
+	flag.BoolVar(&failFlag, "fail", false, "report an error instead of unwrapping")
+	flag.StringVar(&stateMachineFlag, "age-plugin", "", "run the `STATE-MACHINE`")
+	flag.Parse()
+	if flag.NArg() != 0 {
+		errorf("too many arguments")
+	}
+
+	if versionFlag {
+		if Version != "" {
+			fmt.Println("age-plugin-test", Version)
+			return
+		}
+		if buildInfo, ok := debug.ReadBuildInfo(); ok {
+			fmt.Println("age-plugin-test", buildInfo.Main.Version)
+			return
+		}
+		fmt.Println("age-plugin-test (unknown)")
+		return
+	}
+
+	switch stateMachineFlag {
+	case "":
+	case "recipient-v1", "identity-v1":
+		os.Exit(newServer().Run(stateMachineFlag))
+	default:
+		errorf("unsupported state machine %q", stateMachineFlag)
+	}
+
+	var opts byte
+	if msgFlag {
+		opts |= optMsg
+	}
+	if promptFlag {
+		opts |= optPrompt
+	}
+	if confirmFlag {
+		opts |= optConfirm
+	}
+	if failFlag {
+		opts |= optFail
+	}
+	fmt.Printf("# recipient: %s\n", plugin.EncodeRecipient("test", nil))
+	fmt.Printf("%s\n", plugin.EncodeIdentity("test", []byte{opts}))
+}
+
+// wrappingKey derives the ChaCha20-Poly1305 key that wraps file keys.
+func wrappingKey(passphrase string) []byte {
+	h := hkdf.New(sha256.New, []byte(passphrase), nil, []byte("age-plugin-test"))
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(h, key); err != nil {
+		panic("age-plugin-test: internal error: failed to read from HKDF: " + err.Error())
+	}
+	return key
+}
+
+// The nonce is always zero: wrapping is deterministic by design, like the rest
+// of this plugin, since it provides no security anyway.
+func wrap(fileKey []byte) []byte {
+	aead, err := chacha20poly1305.New(wrappingKey(testPassphrase))
+	if err != nil {
+		panic("age-plugin-test: internal error: " + err.Error())
+	}
+	return aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), fileKey, nil)
+}
+
+func unwrap(passphrase string, body []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(wrappingKey(passphrase))
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), body, nil)
+}
+
+// newServer returns a plugin.Server that wraps file keys for the "test"
+// recipient, and for any test identity, and unwraps them with test identities.
+func newServer() *plugin.Server {
+	srv, err := plugin.NewServer("test")
+	if err != nil {
+		errorf("%v", err)
+	}
+	srv.HandleRecipient(func(data []byte) (age.Recipient, error) {
+		return recipient{}, nil
+	})
+	srv.HandleIdentityAsRecipient(func(data []byte) (age.Recipient, error) {
+		if _, err := parseIdentityData(data); err != nil {
+			return nil, err
+		}
+		return recipient{}, nil
+	})
+	srv.HandleIdentity(func(data []byte) (age.Identity, error) {
+		opts, err := parseIdentityData(data)
+		if err != nil {
+			return nil, err
+		}
+		return &identity{srv: srv, opts: opts}, nil
+	})
+	return srv
+}
+
+func parseIdentityData(data []byte) (byte, error) {
+	if len(data) != 1 {
+		return 0, errors.New("invalid identity")
+	}
+	if data[0]&^optAll != 0 {
+		return 0, errors.New("unknown identity options")
+	}
+	return data[0], nil
+}
+
+type recipient struct{}
+
+func (recipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	if len(fileKey) != 16 {
+		return nil, errors.New("invalid file key length")
+	}
+	return []*age.Stanza{{Type: "test", Body: wrap(fileKey)}}, nil
+}
+
+// identity runs the interactions selected by its options, and unwraps the
+// file key.
+type identity struct {
+	srv  *plugin.Server
+	opts byte
+}
+
+func (i *identity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	for _, s := range stanzas {
+		if s.Type != "test" {
+			continue
+		}
+		if len(s.Args) != 0 || len(s.Body) != 16+chacha20poly1305.Overhead {
+			return nil, errors.New("malformed test stanza")
+		}
+		return i.unwrap(s.Body)
+	}
+	return nil, age.ErrIncorrectIdentity
+}
+
+func (i *identity) unwrap(body []byte) ([]byte, error) {
+	if i.opts&optFail != 0 {
+		return nil, errors.New("the identity was generated with --fail")
+	}
+	if i.opts&optMsg != 0 {
+		if err := i.srv.DisplayMessage("unwrapping with the test plugin, which provides no security"); err != nil {
+			return nil, err
+		}
+	}
+	if i.opts&optConfirm != 0 {
+		if ok, err := i.confirm(); err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, age.ErrIncorrectIdentity
+		}
+	}
+	passphrase := testPassphrase
+	if i.opts&optPrompt != 0 {
+		p, err := i.srv.RequestValue("Enter the age-plugin-test passphrase:", true)
+		if err != nil {
+			return nil, errors.New("the passphrase is required")
+		}
+		passphrase = p
+	}
+	fileKey, err := unwrap(passphrase, body)
+	if err != nil {
+		if i.opts&optPrompt != 0 {
+			return nil, errors.New("incorrect passphrase")
+		}
+		return nil, errors.New("failed to unwrap the file key")
+	}
+	return fileKey, nil
+}
+
+// confirm asks the user to confirm unwrapping, with confirm if the client
+// supports it, and with request-public otherwise.
+func (i *identity) confirm() (bool, error) {
+	if ok, err := i.srv.Confirm("Unwrap the file key with the test plugin?", "Unwrap", "Skip"); err == nil {
+		return ok, nil
+	}
+	v, err := i.srv.RequestValue(`Type "yes" to unwrap the file key with the test plugin:`, false)
+	if err != nil {
+		return false, errors.New("confirmation is required")
+	}
+	return v == "yes", nil
+}
+
+func errorf(format string, v ...interface{}) {
+	log.Fatalf("age-plugin-test: error: "+format, v...)
+}
@@ -5,20 +5,22 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"crypto/ed25519"
 	"flag"
 	"fmt"
 	"io"
 	"os"
 	"regexp"
-	"runtime/debug"
 	"strings"
+	"time"
 
 	"filippo.io/age"
 	"filippo.io/age/agessh"
 	"filippo.io/age/armor"
+	"filippo.io/age/parity"
 	"filippo.io/age/plugin"
+	"golang.org/x/crypto/blake2b"
 	"golang.org/x/term"
 )
 
@@ -26,6 +28,17 @@ const usage = `Usage:
     age [--encrypt] (-r RECIPIENT | -R PATH)... [--armor] [-o OUTPUT] [INPUT]
     age [--encrypt] --passphrase [--armor] [-o OUTPUT] [INPUT]
     age --decrypt [-i PATH]... [-o OUTPUT] [INPUT]
+    age --decrypt --dry-run [-i PATH]... [INPUT]
+    age --rearmor [--armor] [-o OUTPUT] [INPUT]
+    age --repair [-o OUTPUT] INPUT
+    age --diagnose [-i PATH]... [INPUT]
+    age tar (-r RECIPIENT | -R PATH)... -o OUTPUT DIR
+    age untar [-i PATH]... [-C DIR] [--list] INPUT [NAME...]
+    age watch --dir DIR --out DIR (-r RECIPIENT | -R PATH)... [--delete]
+    age diff [-i PATH]... A B
+    age plugin-test [-r RECIPIENT] [-i PATH] NAME
+    age plugin NAME [ARGS...]
+    age bench [--size SIZE] [-r RECIPIENT]... [-R PATH]...
 
 Options:
     -e, --encrypt               Encrypt the input to the output. Default if omitted.
@@ -35,10 +48,31 @@ Options:
     -p, --passphrase            Encrypt with a passphrase.
     -r, --recipient RECIPIENT   Encrypt to the specified RECIPIENT. Can be repeated.
     -R, --recipients-file PATH  Encrypt to recipients listed at PATH. Can be repeated.
+    --recipients-from-command COMMAND
+                                Encrypt to recipients printed by COMMAND. Can be repeated.
     -i, --identity PATH         Use the identity file at PATH. Can be repeated.
+    --rearmor                   Re-encode the input as binary, or PEM with --armor.
+    --diagnose                  Report on the structure of a damaged input.
+    --dry-run                   Report which identities match, without decrypting.
+    --lax                       Find the armored file in surrounding text.
+    --max-output SIZE           Fail if the decrypted output exceeds SIZE (e.g. 10M).
+    --allow-mixed-passphrase    Allow -p alongside other recipients, see below.
+    --signing-key PATH          Sign the header with the SSH Ed25519 key at PATH.
+    --signer KEY                Require the header to be signed by KEY.
+    --sign PATH                 Write a detached signature to OUTPUT.minisig.
+    --verify-sig KEY            Check the detached signature at INPUT.minisig.
+    --parity                    Write Reed-Solomon parity data to OUTPUT.parity.
+    --repair                    Repair INPUT with INPUT.parity before decrypting.
+    --progress                  Show the amount of data processed.
+    --profile NAME              Use the defaults of profile NAME in the config file.
+    --clipboard                 Use the clipboard as the input and the output.
+    --batch                     Never prompt, and exit with status 3 or 4 instead.
+    --output-template TEMPLATE  Write the result to the path generated by TEMPLATE.
 
 INPUT defaults to standard input, and OUTPUT defaults to standard output.
-If OUTPUT exists, it will be overwritten.
+If OUTPUT exists, it will be overwritten. INPUT and OUTPUT can also be
+s3://, gs://, or sftp:// URLs, which are streamed with the aws, gcloud, or
+curl command, or with an age-remote-SCHEME helper if one is in $PATH.
 
 RECIPIENT can be an age public key generated by age-keygen ("age1...")
 or an SSH public key ("ssh-ed25519 AAAA...", "ssh-rsa AAAA...").
@@ -52,10 +86,44 @@ one per line, or an SSH key. Empty lines and lines starting with "#" are
 ignored as comments. Passphrase encrypted age files can be used as
 identity files. Multiple key files can be provided, and any unused ones
 will be ignored. "-" may be used to read identities from standard input.
+Identities can also be fetched from password managers with PATH set to an
+"op://", "pass://", or "bw://" reference, or from the OS keychain with
+"keychain://NAME" for identities generated with age-keygen --store NAME.
 
 When --encrypt is specified explicitly, -i can also be used to encrypt to an
 identity file symmetrically, instead or in addition to normal recipients.
 
+With --allow-mixed-passphrase, -p can be combined with other recipients, for
+example to add a recovery passphrase, and such files can be decrypted with the
+passphrase. Note that any of the other recipients can then produce files that
+decrypt with the passphrase, so the passphrase no longer authenticates the file.
+
+With --signing-key, the header is signed with an SSH Ed25519 private key, and
+--signer ("ssh-ed25519 AAAA...") makes decryption fail unless the file was
+signed by that key. This shows who encrypted the file, even if others can
+encrypt to the same recipients, but since every recipient can decrypt the
+file, a recipient can replace the contents without invalidating the signature.
+
+With --sign, the encrypted OUTPUT is also signed with an SSH Ed25519 private
+key, and the signature is written to OUTPUT.minisig in the minisign format,
+which includes the minisign public key ("RW...") in its untrusted comment.
+With --verify-sig, the signature at INPUT.minisig is checked against KEY, a
+minisign public key or an SSH Ed25519 public key, before decrypting INPUT.
+minisign and signify signatures made by other tools are accepted too.
+
+With --parity, parity data is written to OUTPUT.parity, which can repair
+limited damage to OUTPUT, such as bit rot in archives, where otherwise a single
+flipped bit makes the rest of the file undecryptable. With --repair, INPUT is
+repaired with INPUT.parity while decrypting, or without -d, a repaired copy
+of INPUT is written to OUTPUT. OUTPUT stays a regular age file.
+
+If no recipients are specified, the recipients file at the default location
+($XDG_CONFIG_HOME/age/recipients.txt or the OS equivalent) is used, if present.
+If no identities are specified, the identity file at the default location
+($XDG_CONFIG_HOME/age/keys.txt or the OS equivalent) is used, if present.
+With --profile, the identities, recipients, and armor setting of the
+[profile.NAME] section of $XDG_CONFIG_HOME/age/config.toml are used instead.
+
 Example:
     $ age-keygen -o key.txt
     Public key: age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
@@ -67,6 +135,20 @@ Example:
 // golang.org/issue/29814 and golang.org/issue/29228.
 var Version string
 
+// showProgress is set by the --progress flag.
+var showProgress bool
+
+// maxOutput is set by the --max-output flag, and is zero if unlimited.
+var maxOutput int64
+
+// allowMixedPassphrase is set by the --allow-mixed-passphrase flag.
+var allowMixedPassphrase bool
+
+// signingKey is set by the --signing-key flag, and expectedSigner by the
+// --signer flag.
+var signingKey ed25519.PrivateKey
+var expectedSigner ed25519.PublicKey
+
 // stdinInUse is used to ensure only one of input, recipients, or identities
 // file is read from stdin. It's a singleton like os.Stdin.
 var stdinInUse bool
@@ -106,16 +188,53 @@ func main() {
 		exit(1)
 	}
 
+	switch os.Args[1] {
+	case "tar":
+		tarMain(os.Args[2:])
+		return
+	case "untar":
+		untarMain(os.Args[2:])
+		return
+	case "watch":
+		watchMain(os.Args[2:])
+		return
+	case "diff":
+		diffMain(os.Args[2:])
+		return
+	case "plugin-test":
+		pluginTestMain(os.Args[2:])
+		return
+	case "plugin":
+		pluginMain(os.Args[2:])
+		return
+	case "bench":
+		benchMain(os.Args[2:])
+		return
+	}
+
 	var (
 		outFlag                          string
 		decryptFlag, encryptFlag         bool
 		passFlag, versionFlag, armorFlag bool
+		rearmorFlag, diagnoseFlag        bool
+		dryRunFlag, jsonFlag, laxFlag    bool
 		recipientFlags                   multiFlag
 		recipientsFileFlags              multiFlag
+		recipientCommandFlags            multiFlag
 		identityFlags                    identityFlags
+		secretCacheFlag                  time.Duration
+		profileFlag                      string
+		clipboardFlag                    bool
+		clipboardClearFlag               time.Duration
+		outputTemplateFlag               string
+		maxOutputFlag                    string
+		signingKeyFlag, signerFlag       string
+		signFlag, verifySigFlag          string
+		parityFlag, repairFlag           bool
 	)
 
 	flag.BoolVar(&versionFlag, "version", false, "print the version")
+	flag.BoolVar(&jsonFlag, "json", false, "print the version and capabilities as JSON")
 	flag.BoolVar(&decryptFlag, "d", false, "decrypt the input")
 	flag.BoolVar(&decryptFlag, "decrypt", false, "decrypt the input")
 	flag.BoolVar(&encryptFlag, "e", false, "encrypt the input")
@@ -124,29 +243,49 @@ func main() {
 	flag.BoolVar(&passFlag, "passphrase", false, "use a passphrase")
 	flag.StringVar(&outFlag, "o", "", "output to `FILE` (default stdout)")
 	flag.StringVar(&outFlag, "output", "", "output to `FILE` (default stdout)")
+	flag.StringVar(&outputTemplateFlag, "output-template", "", "output to the path generated by `TEMPLATE`")
 	flag.BoolVar(&armorFlag, "a", false, "generate an armored file")
 	flag.BoolVar(&armorFlag, "armor", false, "generate an armored file")
+	flag.BoolVar(&rearmorFlag, "rearmor", false, "convert between binary and armored files")
+	flag.BoolVar(&diagnoseFlag, "diagnose", false, "report on the structure of a damaged file")
+	flag.BoolVar(&dryRunFlag, "dry-run", false, "report which identities match the file")
+	flag.BoolVar(&laxFlag, "lax", false, "find the armored file in the input")
+	flag.StringVar(&maxOutputFlag, "max-output", "", "fail if the decrypted output exceeds `SIZE`")
+	flag.BoolVar(&allowMixedPassphrase, "allow-mixed-passphrase", false, "allow passphrases alongside other recipients")
+	flag.StringVar(&signingKeyFlag, "signing-key", "", "sign the header with the SSH key at `PATH`")
+	flag.StringVar(&signerFlag, "signer", "", "require the header to be signed by `KEY`")
+	flag.StringVar(&signFlag, "sign", "", "write a detached signature made with the SSH key at `PATH`")
+	flag.StringVar(&verifySigFlag, "verify-sig", "", "check the detached signature of the input with `KEY`")
+	flag.BoolVar(&parityFlag, "parity", false, "write parity data to repair damage to the output")
+	flag.BoolVar(&repairFlag, "repair", false, "repair the input with its parity data")
 	flag.Var(&recipientFlags, "r", "recipient (can be repeated)")
 	flag.Var(&recipientFlags, "recipient", "recipient (can be repeated)")
 	flag.Var(&recipientsFileFlags, "R", "recipients file (can be repeated)")
 	flag.Var(&recipientsFileFlags, "recipients-file", "recipients file (can be repeated)")
+	flag.Var(&recipientCommandFlags, "recipients-from-command", "recipients `COMMAND` (can be repeated)")
 	flag.Func("i", "identity (can be repeated)", identityFlags.addIdentityFlag)
 	flag.Func("identity", "identity (can be repeated)", identityFlags.addIdentityFlag)
 	flag.Func("j", "data-less plugin (can be repeated)", identityFlags.addPluginFlag)
+	flag.DurationVar(&secretCacheFlag, "plugin-secret-cache", 0, "reuse plugin PINs for `DURATION`")
+	flag.BoolVar(&showProgress, "progress", false, "show the amount of data processed")
+	flag.BoolVar(&batchMode, "batch", false, "never prompt, and fail with a specific exit code instead")
+	flag.StringVar(&profileFlag, "profile", "", "use the defaults of the config file profile `NAME`")
+	flag.BoolVar(&clipboardFlag, "clipboard", false, "read the input from and write the output to the clipboard")
+	flag.DurationVar(&clipboardClearFlag, "clipboard-clear", 45*time.Second, "clear decrypted output from the clipboard after `DURATION`")
 	flag.Parse()
+	if batchMode {
+		prompter = nonInteractivePrompter{}
+	}
 
+	if jsonFlag && !versionFlag {
+		errorf("--json can only be used with --version")
+	}
 	if versionFlag {
-		if Version != "" {
-			fmt.Println(Version)
+		if jsonFlag {
+			printVersionJSON()
 			return
 		}
-		if buildInfo, ok := debug.ReadBuildInfo(); ok {
-			// TODO: use buildInfo.Settings to prepare a pseudoversion such as
-			// v0.0.0-20210817164053-32db794688a5+dirty on Go 1.18+.
-			fmt.Println(buildInfo.Main.Version)
-			return
-		}
-		fmt.Println("(unknown)")
+		fmt.Println(version())
 		return
 	}
 
@@ -182,7 +321,120 @@ func main() {
 		errorWithHint("too many INPUT arguments: "+quotedArgs, hints...)
 	}
 
+	if profileFlag != "" {
+		p, err := loadProfile(profileFlag)
+		if err != nil {
+			errorf("failed to load profile %q: %v", profileFlag, err)
+		}
+		switch {
+		case rearmorFlag || (repairFlag && !decryptFlag):
+		case decryptFlag || diagnoseFlag:
+			if len(identityFlags) == 0 {
+				for _, name := range p.Identities {
+					identityFlags.addIdentityFlag(name)
+				}
+			}
+		default:
+			if !passFlag && len(recipientFlags)+len(recipientsFileFlags)+len(recipientCommandFlags)+len(identityFlags) == 0 {
+				recipientFlags = append(recipientFlags, p.Recipients...)
+				recipientsFileFlags = append(recipientsFileFlags, p.RecipientsFiles...)
+			}
+			armorFlag = armorFlag || p.Armor
+		}
+	}
+
+	if maxOutputFlag != "" {
+		n, err := parseSize(maxOutputFlag)
+		if err != nil {
+			errorf("invalid --max-output: %v", err)
+		}
+		maxOutput = n
+	}
+
 	switch {
+	case maxOutputFlag != "" && (!decryptFlag || dryRunFlag):
+		errorf("--max-output can only be used with -d/--decrypt")
+	case signerFlag != "" && (!decryptFlag || dryRunFlag):
+		errorf("--signer can only be used with -d/--decrypt")
+	case signingKeyFlag != "" && (decryptFlag || diagnoseFlag || rearmorFlag):
+		errorf("--signing-key can only be used when encrypting")
+	case signFlag != "" && (decryptFlag || diagnoseFlag || rearmorFlag):
+		errorf("--sign can only be used when encrypting")
+	case signFlag != "" && (clipboardFlag || (outFlag == "" && outputTemplateFlag == "") || outFlag == "-" || remoteScheme(outFlag) != ""):
+		errorWithHint("--sign requires a local OUTPUT file",
+			"the signature is written to OUTPUT.minisig")
+	case verifySigFlag != "" && (!decryptFlag || dryRunFlag):
+		errorf("--verify-sig can only be used with -d/--decrypt")
+	case verifySigFlag != "" && (clipboardFlag || flag.Arg(0) == "" || flag.Arg(0) == "-" || remoteScheme(flag.Arg(0)) != ""):
+		errorWithHint("--verify-sig requires a local INPUT file",
+			"the signature is read from INPUT.minisig")
+	case parityFlag && (decryptFlag || diagnoseFlag || rearmorFlag || repairFlag):
+		errorf("--parity can only be used when encrypting")
+	case parityFlag && (clipboardFlag || (outFlag == "" && outputTemplateFlag == "") || outFlag == "-" || remoteScheme(outFlag) != ""):
+		errorWithHint("--parity requires a local OUTPUT file",
+			"the parity data is written to OUTPUT.parity")
+	case repairFlag && (diagnoseFlag || rearmorFlag):
+		errorf("--repair can't be used with --diagnose or --rearmor")
+	case repairFlag && (clipboardFlag || flag.Arg(0) == "" || flag.Arg(0) == "-" || remoteScheme(flag.Arg(0)) != ""):
+		errorWithHint("--repair requires a local INPUT file",
+			"the parity data is read from INPUT.parity")
+	case repairFlag && verifySigFlag != "":
+		errorWithHint("--repair can't be used with --verify-sig",
+			"the signature covers the undamaged file, so save a repaired copy with --repair -o first")
+	case allowMixedPassphrase && !passFlag && !decryptFlag:
+		errorf("--allow-mixed-passphrase can only be used with -p/--passphrase or -d/--decrypt")
+	case laxFlag && !decryptFlag:
+		errorf("--lax can only be used with -d/--decrypt")
+	case dryRunFlag && !decryptFlag:
+		errorf("--dry-run can only be used with -d/--decrypt")
+	case dryRunFlag && (outFlag != "" || outputTemplateFlag != "" || clipboardFlag || showProgress):
+		errorWithHint("--dry-run can't be used with -o/--output, --output-template, --clipboard, or --progress",
+			"the file is not decrypted in dry-run mode")
+	case showProgress && (diagnoseFlag || rearmorFlag):
+		errorf("--progress can't be used with --diagnose or --rearmor")
+	case clipboardFlag && (diagnoseFlag || rearmorFlag):
+		errorf("--clipboard can't be used with --diagnose or --rearmor")
+	case clipboardFlag && (flag.NArg() > 0 || outFlag != "" || outputTemplateFlag != ""):
+		errorWithHint("--clipboard can't be used with an INPUT argument, -o/--output, or --output-template",
+			"the clipboard is used as both the input and the output")
+	case outputTemplateFlag != "" && (outFlag != "" || diagnoseFlag):
+		errorf("--output-template can't be used with -o/--output or --diagnose")
+	case outputTemplateFlag != "" && (flag.Arg(0) == "" || flag.Arg(0) == "-" || remoteScheme(flag.Arg(0)) != ""):
+		errorWithHint("--output-template requires a local INPUT file",
+			"the output path is generated from the INPUT path")
+	case diagnoseFlag:
+		if decryptFlag || encryptFlag || rearmorFlag {
+			errorf("--diagnose can't be used with -e/--encrypt, -d/--decrypt, or --rearmor")
+		}
+		if armorFlag {
+			errorWithHint("-a/--armor can't be used with --diagnose",
+				"note that armored files are detected automatically")
+		}
+		if passFlag || len(recipientFlags)+len(recipientsFileFlags)+len(recipientCommandFlags) > 0 {
+			errorWithHint("--diagnose can't be used with -p, -r, -R, or --recipients-from-command",
+				"use -i/--identity to also check the header MAC and the payload")
+		}
+		if outFlag != "" {
+			errorf("-o/--output can't be used with --diagnose")
+		}
+	case rearmorFlag:
+		if decryptFlag || encryptFlag {
+			errorWithHint("--rearmor can't be used with -e/--encrypt or -d/--decrypt",
+				"the file is converted without being decrypted")
+		}
+		if passFlag || len(recipientFlags)+len(recipientsFileFlags)+len(recipientCommandFlags)+len(identityFlags) > 0 {
+			errorWithHint("--rearmor can't be used with -p, -r, -R, --recipients-from-command, -i, or -j",
+				"no keys are needed to convert a file")
+		}
+	case repairFlag && !decryptFlag:
+		if encryptFlag || armorFlag {
+			errorWithHint("--repair can't be used with -e/--encrypt or -a/--armor",
+				"the file is repaired without being decrypted or re-encoded")
+		}
+		if passFlag || len(recipientFlags)+len(recipientsFileFlags)+len(recipientCommandFlags)+len(identityFlags) > 0 {
+			errorWithHint("--repair can't be used with -p, -r, -R, --recipients-from-command, -i, or -j",
+				"did you forget to specify -d/--decrypt?")
+		}
 	case decryptFlag:
 		if encryptFlag {
 			errorf("-e/--encrypt can't be used with -d/--decrypt")
@@ -203,29 +455,101 @@ func main() {
 			errorWithHint("-R/--recipients-file can't be used with -d/--decrypt",
 				"did you mean to use -i/--identity to specify a private key?")
 		}
+		if len(recipientCommandFlags) > 0 {
+			errorWithHint("--recipients-from-command can't be used with -d/--decrypt",
+				"did you mean to use -i/--identity to specify a private key?")
+		}
 	default: // encrypt
 		if len(identityFlags) > 0 && !encryptFlag {
 			errorWithHint("-i/--identity and -j can't be used in encryption mode unless symmetric encryption is explicitly selected with -e/--encrypt",
 				"did you forget to specify -d/--decrypt?")
 		}
-		if len(recipientFlags)+len(recipientsFileFlags)+len(identityFlags) == 0 && !passFlag {
-			errorWithHint("missing recipients",
-				"did you forget to specify -r/--recipient, -R/--recipients-file or -p/--passphrase?")
+		if len(recipientFlags)+len(recipientsFileFlags)+len(recipientCommandFlags)+len(identityFlags) == 0 && !passFlag {
+			name := findDefaultFile(age.DefaultRecipientPaths())
+			if name == "" {
+				errorWithHint("missing recipients",
+					"did you forget to specify -r/--recipient, -R/--recipients-file or -p/--passphrase?")
+			}
+			recipientsFileFlags = append(recipientsFileFlags, name)
+		}
+		const mixedHint = "use --allow-mixed-passphrase to add a passphrase to a file encrypted to other recipients"
+		if len(recipientFlags) > 0 && passFlag && !allowMixedPassphrase {
+			errorWithHint("-p/--passphrase can't be combined with -r/--recipient", mixedHint)
 		}
-		if len(recipientFlags) > 0 && passFlag {
-			errorf("-p/--passphrase can't be combined with -r/--recipient")
+		if len(recipientsFileFlags) > 0 && passFlag && !allowMixedPassphrase {
+			errorWithHint("-p/--passphrase can't be combined with -R/--recipients-file", mixedHint)
 		}
-		if len(recipientsFileFlags) > 0 && passFlag {
-			errorf("-p/--passphrase can't be combined with -R/--recipients-file")
+		if len(recipientCommandFlags) > 0 && passFlag && !allowMixedPassphrase {
+			errorWithHint("-p/--passphrase can't be combined with --recipients-from-command", mixedHint)
 		}
-		if len(identityFlags) > 0 && passFlag {
-			errorf("-p/--passphrase can't be combined with -i/--identity and -j")
+		if len(identityFlags) > 0 && passFlag && !allowMixedPassphrase {
+			errorWithHint("-p/--passphrase can't be combined with -i/--identity and -j", mixedHint)
 		}
 	}
 
+	if signerFlag != "" {
+		k, err := parseSigner(signerFlag)
+		if err != nil {
+			errorf("invalid --signer: %v", err)
+		}
+		expectedSigner = k
+	}
+	if signingKeyFlag != "" {
+		k, err := parseSigningKey(signingKeyFlag)
+		if err != nil {
+			errorf("reading --signing-key %q: %v", signingKeyFlag, err)
+		}
+		signingKey = k
+	}
+	var detachedKey ed25519.PrivateKey
+	if signFlag != "" {
+		k, err := parseSigningKey(signFlag)
+		if err != nil {
+			errorf("reading --sign %q: %v", signFlag, err)
+		}
+		detachedKey = k
+	}
+	var verifySigKey ed25519.PublicKey
+	var verifySigKeyID []byte
+	if verifySigFlag != "" {
+		k, id, err := parseVerifySigKey(verifySigFlag)
+		if err != nil {
+			errorf("invalid --verify-sig: %v", err)
+		}
+		verifySigKey, verifySigKeyID = k, id
+	}
+
+	var recipients []age.Recipient
+	if outputTemplateFlag != "" {
+		if !decryptFlag && !passFlag && !rearmorFlag {
+			recipients = parseRecipientFlags(recipientFlags, recipientsFileFlags, recipientCommandFlags, identityFlags)
+		}
+		name, err := expandOutputTemplate(outputTemplateFlag, flag.Arg(0), recipients)
+		if err != nil {
+			errorf("invalid --output-template: %v", err)
+		}
+		outFlag = name
+	}
+
 	var in io.Reader = os.Stdin
 	var out io.Writer = os.Stdout
-	if name := flag.Arg(0); name != "" && name != "-" {
+	clipboardOut := &bytes.Buffer{}
+	if clipboardFlag {
+		contents, err := readClipboard()
+		if err != nil {
+			errorf("failed to read the clipboard: %v", err)
+		}
+		in = bytes.NewReader(contents)
+		// Binary files don't survive a trip through the clipboard.
+		armorFlag = !decryptFlag
+	} else if name := flag.Arg(0); remoteScheme(name) != "" {
+		r, err := openRemote(name)
+		if err != nil {
+			errorf("failed to open input %q: %v", name, err)
+		}
+		defer r.Close()
+		in = r
+	} else if name != "" && name != "-" {
 		f, err := os.Open(name)
 		if err != nil {
 			errorf("failed to open input file %q: %v", name, err)
@@ -234,7 +558,7 @@ func main() {
 		in = f
 	} else {
 		stdinInUse = true
-		if decryptFlag && term.IsTerminal(int(os.Stdin.Fd())) {
+		if decryptFlag && !batchMode && term.IsTerminal(int(os.Stdin.Fd())) {
 			// If the input comes from a TTY, assume it's armored, and buffer up
 			// to the END line (or EOF/EOT) so that a password prompt or the
 			// output don't get in the way of typing the input. See Issue 364.
@@ -245,7 +569,17 @@ func main() {
 			in = buf
 		}
 	}
-	if name := outFlag; name != "" && name != "-" {
+	if clipboardFlag {
+		out = clipboardOut
+	} else if name := outFlag; remoteScheme(name) != "" {
+		w := newRemoteWriter(name)
+		defer func() {
+			if err := w.Close(); err != nil {
+				errorf("failed to write output %q: %v", name, err)
+			}
+		}()
+		out = w
+	} else if name != "" && name != "-" {
 		f := newLazyOpener(name)
 		defer func() {
 			if err := f.Close(); err != nil {
@@ -253,9 +587,35 @@ func main() {
 			}
 		}()
 		out = f
-	} else if term.IsTerminal(int(os.Stdout.Fd())) {
+		if detachedKey != nil {
+			h, _ := blake2b.New512(nil)
+			out = io.MultiWriter(f, h)
+			defer func() {
+				sig := signMinisign(detachedKey, h, name)
+				if err := os.WriteFile(name+".minisig", sig, 0644); err != nil {
+					errorf("failed to write signature: %v", err)
+				}
+			}()
+		}
+		if parityFlag {
+			pf := newLazyOpener(name + ".parity")
+			pw, err := parity.NewWriter(pf, nil)
+			if err != nil {
+				errorf("failed to initialize parity data: %v", err)
+			}
+			out = io.MultiWriter(out, pw)
+			defer func() {
+				if err := pw.Close(); err != nil {
+					errorf("failed to write parity data: %v", err)
+				}
+				if err := pf.Close(); err != nil {
+					errorf("failed to close parity file %q: %v", name+".parity", err)
+				}
+			}()
+		}
+	} else if !batchMode && term.IsTerminal(int(os.Stdout.Fd())) {
 		if name != "-" {
-			if decryptFlag {
+			if decryptFlag || diagnoseFlag {
 				// TODO: buffer the output and check it's printable.
 			} else if !armorFlag {
 				// If the output wouldn't be armored, refuse to send binary to
@@ -274,15 +634,82 @@ func main() {
 		}
 	}
 
+	if out == os.Stdout && !diagnoseFlag && !dryRunFlag && stdoutIsPowerShellPipe() {
+		if armorFlag && !decryptFlag {
+			warningf("PowerShell re-encodes redirected output as UTF-16, which age can still decrypt but other tools might not; use -o to write the file directly")
+		} else {
+			warningf("PowerShell might corrupt binary output redirected with > or |; use -o to write the file directly")
+		}
+	}
+
+	if secretCacheFlag > 0 {
+		pluginTerminalUI.SecretCache = plugin.NewSecretCache(secretCacheFlag, 0)
+		defer pluginTerminalUI.SecretCache.Flush()
+	}
+
+	if verifySigKey != nil {
+		name := flag.Arg(0)
+		sig, err := os.ReadFile(name + ".minisig")
+		if err != nil {
+			errorf("failed to read signature: %v", err)
+		}
+		f := in.(*os.File)
+		if err := verifyMinisign(sig, verifySigKey, verifySigKeyID, f); err != nil {
+			errorf("failed to verify %q: %v", name+".minisig", err)
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			errorf("failed to read input file %q: %v", name, err)
+		}
+	}
+
+	var reportRepair func()
+	if repairFlag {
+		in, reportRepair = repairInput(in.(*os.File))
+	}
+
+	if laxFlag {
+		r, err := laxInput(in)
+		if err != nil {
+			errorf("failed to read input: %v", err)
+		}
+		in = r
+	}
+
 	switch {
+	case diagnoseFlag:
+		diagnose(identityFlags, in, out)
+	case rearmorFlag:
+		rearmor(in, out, armorFlag)
+	case repairFlag && !decryptFlag:
+		if _, err := io.Copy(out, in); err != nil {
+			errorf("%v", err)
+		}
+	case decryptFlag && dryRunFlag:
+		dryRun(identityFlags, in, out)
 	case decryptFlag && len(identityFlags) == 0:
 		decryptPass(in, out)
 	case decryptFlag:
 		decryptNotPass(identityFlags, in, out)
 	case passFlag:
-		encryptPass(in, out, armorFlag)
+		others := parseRecipientFlags(recipientFlags, recipientsFileFlags, recipientCommandFlags, identityFlags)
+		encryptPass(others, in, out, armorFlag)
+	case recipients != nil:
+		encrypt(recipients, in, out, armorFlag)
 	default:
-		encryptNotPass(recipientFlags, recipientsFileFlags, identityFlags, in, out, armorFlag)
+		encryptNotPass(recipientFlags, recipientsFileFlags, recipientCommandFlags, identityFlags, in, out, armorFlag)
+	}
+
+	if reportRepair != nil {
+		reportRepair()
+	}
+
+	if clipboardFlag {
+		if err := writeClipboard(clipboardOut.Bytes()); err != nil {
+			errorf("failed to write the clipboard: %v", err)
+		}
+		if decryptFlag && clipboardClearFlag > 0 {
+			clearClipboardAfter(clipboardOut.Bytes(), clipboardClearFlag)
+		}
 	}
 }
 
@@ -314,7 +741,14 @@ func passphrasePromptForEncryption() (string, error) {
 	return p, nil
 }
 
-func encryptNotPass(recs, files []string, identities identityFlags, in io.Reader, out io.Writer, armor bool) {
+func encryptNotPass(recs, files, commands []string, identities identityFlags, in io.Reader, out io.Writer, armor bool) {
+	encrypt(parseRecipientFlags(recs, files, commands, identities), in, out, armor)
+}
+
+// parseRecipientFlags parses the recipients specified with -r, -R, and
+// --recipients-from-command, and the identities specified with -i and -j to be
+// used as recipients.
+func parseRecipientFlags(recs, files, commands []string, identities identityFlags) []age.Recipient {
 	var recipients []age.Recipient
 	for _, arg := range recs {
 		r, err := parseRecipient(arg)
@@ -335,6 +769,13 @@ func encryptNotPass(recs, files []string, identities identityFlags, in io.Reader
 		}
 		recipients = append(recipients, recs...)
 	}
+	for _, command := range commands {
+		recs, err := parseRecipientsCommand(command)
+		if err != nil {
+			errorf("failed to read recipients from command %q: %v", command, err)
+		}
+		recipients = append(recipients, recs...)
+	}
 	for _, f := range identities {
 		switch f.Type {
 		case "i":
@@ -355,10 +796,12 @@ func encryptNotPass(recs, files []string, identities identityFlags, in io.Reader
 			recipients = append(recipients, id.Recipient())
 		}
 	}
-	encrypt(recipients, in, out, armor)
+	return recipients
 }
 
-func encryptPass(in io.Reader, out io.Writer, armor bool) {
+// encryptPass encrypts to a passphrase, and to the other recipients if
+// --allow-mixed-passphrase was specified.
+func encryptPass(others []age.Recipient, in io.Reader, out io.Writer, armor bool) {
 	pass, err := passphrasePromptForEncryption()
 	if err != nil {
 		errorf("%v", err)
@@ -368,8 +811,11 @@ func encryptPass(in io.Reader, out io.Writer, armor bool) {
 	if err != nil {
 		errorf("%v", err)
 	}
+	if allowMixedPassphrase {
+		r.AllowMixedRecipients()
+	}
 	testOnlyConfigureScryptIdentity(r)
-	encrypt([]age.Recipient{r}, in, out, armor)
+	encrypt(append([]age.Recipient{r}, others...), in, out, armor)
 }
 
 var testOnlyConfigureScryptIdentity = func(*age.ScryptRecipient) {}
@@ -384,10 +830,19 @@ func encrypt(recipients []age.Recipient, in io.Reader, out io.Writer, withArmor
 		}()
 		out = a
 	}
-	w, err := age.Encrypt(out, recipients...)
+	recipients = plugin.GroupRecipients(recipients)
+	w, err := age.EncryptWithOptions(out, &age.Options{
+		Logger:     debugLogger,
+		SigningKey: signingKey,
+	}, recipients...)
 	if err != nil {
 		errorf("%v", err)
 	}
+	if showProgress {
+		p := &progressPrinter{}
+		w.(progressSetter).SetProgressFunc(p.update)
+		defer p.done()
+	}
 	if _, err := io.Copy(w, in); err != nil {
 		errorf("%v", err)
 	}
@@ -415,7 +870,13 @@ func (rejectScryptIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
 
 func decryptNotPass(flags identityFlags, in io.Reader, out io.Writer) {
 	identities := []age.Identity{rejectScryptIdentity{}}
+	identities = append(identities, parseIdentityFlags(flags)...)
+	decrypt(identities, in, out)
+}
 
+// parseIdentityFlags parses the identities specified with -i and -j.
+func parseIdentityFlags(flags identityFlags) []age.Identity {
+	var identities []age.Identity
 	for _, f := range flags {
 		switch f.Type {
 		case "i":
@@ -432,22 +893,30 @@ func decryptNotPass(flags identityFlags, in io.Reader, out io.Writer) {
 			identities = append(identities, id)
 		}
 	}
-
-	decrypt(identities, in, out)
+	return identities
 }
 
 func decryptPass(in io.Reader, out io.Writer) {
 	identities := []age.Identity{
-		// If there is an scrypt recipient (it will have to be the only one and)
-		// this identity will be invoked.
-		&LazyScryptIdentity{passphrasePromptForDecryption},
+		// If there is an scrypt recipient (it will have to be the only one,
+		// unless --allow-mixed-passphrase is set) this identity will be invoked.
+		&LazyScryptIdentity{Passphrase: passphrasePromptForDecryption, AllowMixed: allowMixedPassphrase},
+	}
+
+	// Otherwise, fall back to the identity file at the default location.
+	if name := findDefaultFile(age.DefaultIdentityPaths()); name != "" {
+		ids, err := parseIdentitiesFile(name)
+		if err != nil {
+			errorf("reading %q: %v", name, err)
+		}
+		identities = append(identities, ids...)
 	}
 
 	decrypt(identities, in, out)
 }
 
 func decrypt(identities []age.Identity, in io.Reader, out io.Writer) {
-	rr := bufio.NewReader(in)
+	rr := unmangleInput(in)
 	if intro, _ := rr.Peek(len(crlfMangledIntro)); string(intro) == crlfMangledIntro ||
 		string(intro) == utf16MangledIntro {
 		errorWithHint("invalid header intro",
@@ -461,15 +930,56 @@ func decrypt(identities []age.Identity, in io.Reader, out io.Writer) {
 		in = rr
 	}
 
-	r, err := age.Decrypt(in, identities...)
+	r, res, err := age.DecryptWithOptions(in, &age.Options{
+		Logger:         debugLogger,
+		MaxPayloadSize: maxOutput,
+	}, identities...)
+	if err == age.ErrPayloadTooLarge {
+		errorf("the decrypted output exceeds --max-output %s", formatSize(maxOutput))
+	}
 	if err != nil {
 		errorf("%v", err)
 	}
-	if _, err := io.Copy(out, r); err != nil {
+	if expectedSigner != nil && res.Signer == nil {
+		errorf("the file is not signed, but --signer was specified")
+	}
+	if expectedSigner != nil && !expectedSigner.Equal(res.Signer) {
+		errorf("the file was signed by a different key than --signer")
+	}
+	if showProgress {
+		p := &progressPrinter{}
+		r.(progressSetter).SetProgressFunc(p.update)
+		defer p.done()
+	}
+	if _, err := io.Copy(out, r); err == age.ErrPayloadTooLarge {
+		errorf("the decrypted output exceeds --max-output %s", formatSize(maxOutput))
+	} else if err != nil {
+		errorf("%v", err)
+	}
+}
+
+func rearmor(in io.Reader, out io.Writer, withArmor bool) {
+	var err error
+	if withArmor {
+		err = age.Rearmor(out, in)
+	} else {
+		err = age.Dearmor(out, in)
+	}
+	if err != nil {
 		errorf("%v", err)
 	}
 }
 
+func diagnose(flags identityFlags, in io.Reader, out io.Writer) {
+	d := age.Diagnose(in, parseIdentityFlags(flags)...)
+	if _, err := io.WriteString(out, d.String()); err != nil {
+		errorf("%v", err)
+	}
+	if len(d.Problems) > 0 {
+		exit(1)
+	}
+}
+
 func passphrasePromptForDecryption() (string, error) {
 	pass, err := readSecret("Enter passphrase:")
 	if err != nil {
@@ -484,6 +994,12 @@ func identitiesToRecipients(ids []age.Identity) ([]age.Recipient, error) {
 		switch id := id.(type) {
 		case *age.X25519Identity:
 			recipients = append(recipients, id.Recipient())
+		case *age.HPKEIdentity:
+			recipients = append(recipients, id.Recipient())
+		case *age.X25519SubkeyIdentity:
+			recipients = append(recipients, id.Recipient())
+		case *age.X448Identity:
+			recipients = append(recipients, id.Recipient())
 		case *plugin.Identity:
 			recipients = append(recipients, id.Recipient())
 		case *agessh.RSAIdentity:
@@ -498,13 +1014,33 @@ func identitiesToRecipients(ids []age.Identity) ([]age.Recipient, error) {
 				return nil, err
 			}
 			recipients = append(recipients, r...)
+		case *PasswordManagerIdentity:
+			r, err := id.Recipients()
+			if err != nil {
+				return nil, err
+			}
+			recipients = append(recipients, r...)
 		default:
+			if r, ok := mlkemIdentityToRecipient(id); ok {
+				recipients = append(recipients, r)
+				continue
+			}
 			return nil, fmt.Errorf("unexpected identity type: %T", id)
 		}
 	}
 	return recipients, nil
 }
 
+// findDefaultFile returns the first of paths that exists, or an empty string.
+func findDefaultFile(paths []string) string {
+	for _, p := range paths {
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return ""
+}
+
 type lazyOpener struct {
 	name string
 	f    *os.File
@@ -6,8 +6,12 @@ package main
 
 import (
 	"bufio"
+	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"unicode/utf16"
 
 	"filippo.io/age"
 	"github.com/rogpeppe/go-internal/testscript"
@@ -68,6 +72,37 @@ func TestMain(m *testing.M) {
 				scanner.Scan() // body
 				os.Stdout.WriteString("-> done\n\n")
 				return 0
+			case "--echo":
+				fmt.Println(strings.Join(os.Args[2:], " "))
+				return 0
+			case "--fail":
+				return 7
+			default:
+				return 1
+			}
+		},
+		// age-plugin-lax reads phase 1 up to "done" whatever it contains, and
+		// then behaves like age-plugin-test. It's used to check age plugin-test.
+		"age-plugin-lax": func() (exitCode int) {
+			switch os.Args[1] {
+			case "--age-plugin=recipient-v1":
+				scanner := bufio.NewScanner(os.Stdin)
+				fileKey := readPhase1(scanner)["wrap-file-key"]
+				os.Stdout.WriteString("-> recipient-stanza 0 test\n")
+				os.Stdout.WriteString(fileKey + "\n")
+				scanner.Scan() // ok
+				scanner.Scan() // body
+				os.Stdout.WriteString("-> done\n\n")
+				return 0
+			case "--age-plugin=identity-v1":
+				scanner := bufio.NewScanner(os.Stdin)
+				fileKey := readPhase1(scanner)["recipient-stanza"]
+				os.Stdout.WriteString("-> file-key 0\n")
+				os.Stdout.WriteString(fileKey + "\n")
+				scanner.Scan() // ok
+				scanner.Scan() // body
+				os.Stdout.WriteString("-> done\n\n")
+				return 0
 			default:
 				return 1
 			}
@@ -75,9 +110,65 @@ func TestMain(m *testing.M) {
 	}))
 }
 
+// readPhase1 reads the stanzas sent by the client until "done", and returns
+// the last body line of each stanza type.
+func readPhase1(scanner *bufio.Scanner) map[string]string {
+	stanzas := make(map[string]string)
+	for scanner.Scan() {
+		t := strings.Fields(scanner.Text())[1]
+		scanner.Scan() // body
+		if t == "done" {
+			break
+		}
+		stanzas[t] = scanner.Text()
+	}
+	return stanzas
+}
+
 func TestScript(t *testing.T) {
 	testscript.Run(t, testscript.Params{
 		Dir: "testdata",
+		Condition: func(cond string) (bool, error) {
+			switch cond {
+			case "mlkem":
+				return mlkemSupported, nil
+			default:
+				return false, fmt.Errorf("unknown condition %q", cond)
+			}
+		},
 		// TODO: enable AGEDEBUG=plugin without breaking stderr checks.
+		Cmds: map[string]func(ts *testscript.TestScript, neg bool, args []string){
+			// powershell-redirect IN OUT simulates Windows PowerShell
+			// redirecting the contents of IN to OUT: it decodes it as text,
+			// and writes it back as UTF-16LE with a byte order mark and CRLF
+			// line endings.
+			"powershell-redirect": func(ts *testscript.TestScript, neg bool, args []string) {
+				if neg || len(args) != 2 {
+					ts.Fatalf("usage: powershell-redirect IN OUT")
+				}
+				in := strings.ReplaceAll(ts.ReadFile(args[0]), "\n", "\r\n")
+				out := []byte{0xff, 0xfe}
+				for _, c := range utf16.Encode([]rune(in)) {
+					out = append(out, byte(c), byte(c>>8))
+				}
+				ts.Check(os.WriteFile(ts.MkAbs(args[1]), out, 0644))
+			},
+			// damage FILE OFFSET... flips the bits of the bytes of FILE at
+			// each OFFSET, simulating bit rot.
+			"damage": func(ts *testscript.TestScript, neg bool, args []string) {
+				if neg || len(args) < 2 {
+					ts.Fatalf("usage: damage FILE OFFSET...")
+				}
+				b := []byte(ts.ReadFile(args[0]))
+				for _, arg := range args[1:] {
+					off, err := strconv.Atoi(arg)
+					if err != nil || off < 0 || off >= len(b) {
+						ts.Fatalf("invalid offset %q", arg)
+					}
+					b[off] ^= 0xff
+				}
+				ts.Check(os.WriteFile(ts.MkAbs(args[0]), b, 0644))
+			},
+		},
 	})
 }
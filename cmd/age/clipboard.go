@@ -0,0 +1,82 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+// clipboardCommands returns the commands that print the contents of the system
+// clipboard, and that replace them with their standard input.
+func clipboardCommands() (paste, copy []string, err error) {
+	switch {
+	case runtime.GOOS == "darwin":
+		return []string{"pbpaste"}, []string{"pbcopy"}, nil
+	case runtime.GOOS == "windows":
+		return []string{"powershell", "-NoProfile", "-Command", "Get-Clipboard -Raw"},
+			[]string{"clip"}, nil
+	case os.Getenv("WAYLAND_DISPLAY") != "":
+		return []string{"wl-paste", "--no-newline"}, []string{"wl-copy"}, nil
+	}
+	if _, err := exec.LookPath("xclip"); err == nil {
+		return []string{"xclip", "-selection", "clipboard", "-out"},
+			[]string{"xclip", "-selection", "clipboard", "-in"}, nil
+	}
+	if _, err := exec.LookPath("xsel"); err == nil {
+		return []string{"xsel", "--clipboard", "--output"},
+			[]string{"xsel", "--clipboard", "--input"}, nil
+	}
+	return nil, nil, fmt.Errorf("no clipboard tool found, install wl-clipboard, xclip, or xsel")
+}
+
+func readClipboard() ([]byte, error) {
+	paste, _, err := clipboardCommands()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(paste[0], paste[1:]...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run %s: %v", paste[0], err)
+	}
+	return out, nil
+}
+
+func writeClipboard(contents []byte) error {
+	_, copy, err := clipboardCommands()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(copy[0], copy[1:]...)
+	cmd.Stdin = bytes.NewReader(contents)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to run %s: %v", copy[0], err)
+	}
+	return nil
+}
+
+// clearClipboardAfter waits for d, and then clears the clipboard, unless its
+// contents changed in the meantime.
+func clearClipboardAfter(secret []byte, d time.Duration) {
+	printf("copied to the clipboard, it will be cleared in %v (press Ctrl-C to keep it)", d)
+	time.Sleep(d)
+	current, err := readClipboard()
+	if err != nil {
+		errorf("failed to clear the clipboard: %v", err)
+	}
+	if !bytes.Equal(current, secret) {
+		return
+	}
+	if err := writeClipboard(nil); err != nil {
+		errorf("failed to clear the clipboard: %v", err)
+	}
+}
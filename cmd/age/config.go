@@ -0,0 +1,165 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// A profile is a named set of defaults selected with --profile, from a
+// [profile.NAME] section of the config file.
+type profile struct {
+	Identities      []string
+	Recipients      []string
+	RecipientsFiles []string
+	Armor           bool
+}
+
+// configPaths returns the paths where the config file is looked up, next to
+// the default identity file.
+func configPaths() []string {
+	var paths []string
+	for _, p := range age.DefaultIdentityPaths() {
+		paths = append(paths, filepath.Join(filepath.Dir(p), "config.toml"))
+	}
+	return paths
+}
+
+func loadProfile(name string) (*profile, error) {
+	path := findDefaultFile(configPaths())
+	if path == "" {
+		return nil, fmt.Errorf("config file not found at %s", strings.Join(configPaths(), " or "))
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %v", err)
+	}
+	defer f.Close()
+	profiles, err := parseConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %v", path, err)
+	}
+	p, ok := profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("profile not found in %q", path)
+	}
+	return p, nil
+}
+
+var profileSection = regexp.MustCompile(`^\[profile\.([A-Za-z0-9_-]+)\]$`)
+
+// parseConfig parses the small subset of TOML used by the config file:
+// [profile.NAME] sections with string, string array, and boolean values.
+func parseConfig(f io.Reader) (map[string]*profile, error) {
+	profiles := make(map[string]*profile)
+	var p *profile
+	scanner := bufio.NewScanner(f)
+	var n int
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") || line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			m := profileSection.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("line %d: unknown section %s", n, line)
+			}
+			if profiles[m[1]] != nil {
+				return nil, fmt.Errorf("line %d: duplicate profile %q", n, m[1])
+			}
+			p = &profile{}
+			profiles[m[1]] = p
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+		if p == nil {
+			return nil, fmt.Errorf("line %d: key outside of a [profile.NAME] section", n)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		var err error
+		switch key {
+		case "identities":
+			p.Identities, err = parseConfigStrings(value)
+		case "recipients":
+			p.Recipients, err = parseConfigStrings(value)
+		case "recipients_files":
+			p.RecipientsFiles, err = parseConfigStrings(value)
+		case "armor":
+			p.Armor, err = strconv.ParseBool(value)
+		default:
+			return nil, fmt.Errorf("line %d: unknown key %q", n, key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid value for %q", n, key)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+	for _, p := range profiles {
+		for _, paths := range [][]string{p.Identities, p.RecipientsFiles} {
+			for i, path := range paths {
+				paths[i] = expandHome(path)
+			}
+		}
+	}
+	return profiles, nil
+}
+
+// parseConfigStrings parses a quoted string, or an array of quoted strings.
+func parseConfigStrings(value string) ([]string, error) {
+	if !strings.HasPrefix(value, "[") {
+		s, err := strconv.Unquote(value)
+		if err != nil {
+			return nil, err
+		}
+		return []string{s}, nil
+	}
+	value = strings.TrimSpace(strings.TrimPrefix(value, "["))
+	var values []string
+	for !strings.HasPrefix(value, "]") {
+		q, err := strconv.QuotedPrefix(value)
+		if err != nil {
+			return nil, err
+		}
+		s, _ := strconv.Unquote(q)
+		values = append(values, s)
+		value = strings.TrimSpace(value[len(q):])
+		if strings.HasPrefix(value, ",") {
+			value = strings.TrimSpace(value[1:])
+		} else if !strings.HasPrefix(value, "]") {
+			return nil, fmt.Errorf("expected , or ]")
+		}
+	}
+	if value != "]" {
+		return nil, fmt.Errorf("unexpected trailing data")
+	}
+	return values, nil
+}
+
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[2:])
+}
@@ -0,0 +1,35 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// defaultPrompter interacts with the user through the TTY.
+var defaultPrompter PromptProvider = &terminalPrompter{withTerminal: withTTY}
+
+// withTTY runs f with /dev/tty, or with standard input if it's a terminal and
+// /dev/tty is not available.
+func withTTY(f func(in, out *os.File) error) error {
+	if tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0); err == nil {
+		defer tty.Close()
+		return f(tty, tty)
+	} else if term.IsTerminal(int(os.Stdin.Fd())) {
+		return f(os.Stdin, os.Stdin)
+	} else {
+		return fmt.Errorf("standard input is not a terminal, and /dev/tty is not available: %v", err)
+	}
+}
+
+// stdoutIsPowerShellPipe always returns false outside Windows.
+func stdoutIsPowerShellPipe() bool {
+	return false
+}
@@ -0,0 +1,101 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	kernel32               = windows.NewLazySystemDLL("kernel32.dll")
+	procGetConsoleCP       = kernel32.NewProc("GetConsoleCP")
+	procSetConsoleCP       = kernel32.NewProc("SetConsoleCP")
+	procGetConsoleOutputCP = kernel32.NewProc("GetConsoleOutputCP")
+	procSetConsoleOutputCP = kernel32.NewProc("SetConsoleOutputCP")
+)
+
+const cpUTF8 = 65001
+
+// defaultPrompter interacts with the user through the console.
+var defaultPrompter PromptProvider = &terminalPrompter{withTerminal: withConsole}
+
+// withConsole runs f with the console input and output, even if standard input
+// and output are redirected.
+func withConsole(f func(in, out *os.File) error) error {
+	defer useUTF8Console()()
+	in, err := os.OpenFile("CONIN$", os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile("CONOUT$", os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return f(in, out)
+}
+
+// useUTF8Console switches the console input and output code pages to UTF-8
+// while prompting, so that non-ASCII passphrases are read as the same bytes
+// as on other platforms instead of in the legacy code page, and returns a
+// function that restores the previous code pages.
+func useUTF8Console() (restore func()) {
+	in, _, _ := procGetConsoleCP.Call()
+	out, _, _ := procGetConsoleOutputCP.Call()
+	if in == 0 || out == 0 {
+		// Not attached to a console.
+		return func() {}
+	}
+	procSetConsoleCP.Call(cpUTF8)
+	procSetConsoleOutputCP.Call(cpUTF8)
+	return func() {
+		procSetConsoleCP.Call(in)
+		procSetConsoleOutputCP.Call(out)
+	}
+}
+
+// stdoutIsPowerShellPipe reports whether standard output is a pipe to the
+// PowerShell process that started age. PowerShell before 7.4 decodes the
+// output of native commands as text when redirecting it with > or |, which
+// corrupts binary data and re-encodes text as UTF-16. See issue 290.
+func stdoutIsPowerShellPipe() bool {
+	t, err := windows.GetFileType(windows.Handle(os.Stdout.Fd()))
+	if err != nil || t != windows.FILE_TYPE_PIPE {
+		return false
+	}
+	parent := parentProcessName()
+	return strings.EqualFold(parent, "powershell.exe") || strings.EqualFold(parent, "pwsh.exe")
+}
+
+// parentProcessName returns the executable name of the parent process, or an
+// empty string if it can't be determined.
+func parentProcessName() string {
+	snapshot, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPPROCESS, 0)
+	if err != nil {
+		return ""
+	}
+	defer windows.CloseHandle(snapshot)
+
+	names := make(map[uint32]string)
+	var ppid uint32
+	pid := uint32(os.Getpid())
+	var e windows.ProcessEntry32
+	e.Size = uint32(unsafe.Sizeof(e))
+	for err = windows.Process32First(snapshot, &e); err == nil; err = windows.Process32Next(snapshot, &e) {
+		names[e.ProcessID] = windows.UTF16ToString(e.ExeFile[:])
+		if e.ProcessID == pid {
+			ppid = e.ParentProcessID
+		}
+	}
+	if ppid == 0 {
+		return ""
+	}
+	return names[ppid]
+}
@@ -0,0 +1,23 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+
+package main
+
+import (
+	"log/slog"
+	"os"
+)
+
+func init() {
+	if logging, _, _ := debugOptions(); !logging {
+		return
+	}
+	l := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	debugLogger = l
+	pluginTerminalUI.Logger = l
+}
@@ -0,0 +1,198 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"filippo.io/age/internal/format"
+	"filippo.io/age/plugin"
+)
+
+const diffUsage = `Usage:
+    age diff [-i PATH]... A B
+
+age diff compares the headers of the age files A and B, without decrypting
+them, and reports whether their payloads are byte-identical. It exits with a
+non-zero status if the files differ.
+
+Stanzas are identified by type and fingerprint. For SSH stanzas, the
+fingerprint is the key tag, which is the same across files encrypted to the
+same key. Other stanzas are anonymous, and are identified by a hash of their
+contents, so they only match if they were copied unmodified.
+
+To check which files a key can decrypt, specify it with -i/--identity.`
+
+// diffMain implements "age diff".
+func diffMain(args []string) {
+	flags := flag.NewFlagSet("age diff", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprintf(os.Stderr, "%s\n", diffUsage) }
+	var identityFlags identityFlags
+	flags.Func("i", "identity (can be repeated)", identityFlags.addIdentityFlag)
+	flags.Func("identity", "identity (can be repeated)", identityFlags.addIdentityFlag)
+	flags.Func("j", "data-less plugin (can be repeated)", identityFlags.addPluginFlag)
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		errorWithHint("age diff requires exactly two file arguments",
+			"the files must be specified after all flags")
+	}
+	a, b := readDiffFile(flags.Arg(0)), readDiffFile(flags.Arg(1))
+
+	same := true
+	if a.version != b.version {
+		fmt.Printf("version: %s -> %s\n", a.version, b.version)
+		same = false
+	}
+
+	count := make(map[string]int)
+	for _, s := range a.stanzas {
+		count[s]++
+	}
+	for _, s := range b.stanzas {
+		count[s]--
+	}
+	var unchanged int
+	for _, s := range a.stanzas {
+		if count[s] > 0 {
+			fmt.Printf("- %s\n", s)
+			count[s]--
+			same = false
+		} else {
+			unchanged++
+		}
+	}
+	for _, s := range b.stanzas {
+		if count[s] < 0 {
+			fmt.Printf("+ %s\n", s)
+			count[s]++
+			same = false
+		}
+	}
+	fmt.Printf("unchanged stanzas: %d\n", unchanged)
+
+	if bytes.Equal(a.payloadHash, b.payloadHash) {
+		fmt.Printf("payload: identical\n")
+	} else {
+		fmt.Printf("payload: different\n")
+		same = false
+	}
+
+	for _, f := range identityFlags {
+		var ids []age.Identity
+		switch f.Type {
+		case "i":
+			var err error
+			ids, err = parseIdentitiesFile(f.Value)
+			if err != nil {
+				errorf("reading %q: %v", f.Value, err)
+			}
+		case "j":
+			id, err := plugin.NewIdentityWithoutData(f.Value, pluginTerminalUI)
+			if err != nil {
+				errorf("initializing %q: %v", f.Value, err)
+			}
+			ids = []age.Identity{id}
+		}
+		canA, canB := a.decryptableBy(ids), b.decryptableBy(ids)
+		fmt.Printf("identity %s: %s %s, %s %s\n", f.Value,
+			canDecrypt(canA), flags.Arg(0), canDecrypt(canB), flags.Arg(1))
+		if canA != canB {
+			same = false
+		}
+	}
+
+	if !same {
+		exit(1)
+	}
+}
+
+func canDecrypt(ok bool) string {
+	if ok {
+		return "decrypts"
+	}
+	return "doesn't decrypt"
+}
+
+type diffFile struct {
+	name        string
+	version     string
+	stanzas     []string
+	payloadHash []byte
+}
+
+// openDiffFile opens the named file, and decodes it if it's armored.
+func openDiffFile(name string) (io.Reader, func() error) {
+	f, err := os.Open(name)
+	if err != nil {
+		errorf("failed to open %q: %v", name, err)
+	}
+	br := bufio.NewReader(f)
+	if start, _ := br.Peek(len(armor.Header)); string(start) == armor.Header {
+		return armor.NewReader(br), f.Close
+	}
+	return br, f.Close
+}
+
+func readDiffFile(name string) *diffFile {
+	r, close := openDiffFile(name)
+	defer close()
+	hdr, payload, err := format.Parse(r)
+	if err != nil {
+		errorf("failed to read header of %q: %v", name, err)
+	}
+	d := &diffFile{name: name, version: format.V1.Name}
+	if hdr.Version != nil {
+		d.version = hdr.Version.Name
+	}
+	for _, s := range hdr.Recipients {
+		d.stanzas = append(d.stanzas, s.Type+" "+stanzaFingerprint(s))
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, payload); err != nil {
+		errorf("failed to read payload of %q: %v", name, err)
+	}
+	d.payloadHash = h.Sum(nil)
+	return d
+}
+
+// stanzaFingerprint returns the SSH key tag for SSH stanzas, and a short hash
+// of the whole stanza otherwise.
+func stanzaFingerprint(s *format.Stanza) string {
+	if strings.HasPrefix(s.Type, "ssh-") && len(s.Args) > 0 {
+		return s.Args[0]
+	}
+	buf := &bytes.Buffer{}
+	if err := s.Marshal(buf); err != nil {
+		errorf("internal error: %v", err)
+	}
+	h := sha256.Sum256(buf.Bytes())
+	return hex.EncodeToString(h[:4])
+}
+
+func (d *diffFile) decryptableBy(ids []age.Identity) bool {
+	r, close := openDiffFile(d.name)
+	defer close()
+	_, err := age.Decrypt(r, ids...)
+	var errNoMatch *age.NoIdentityMatchError
+	switch {
+	case errors.As(err, &errNoMatch):
+		return false
+	case err != nil:
+		errorf("failed to decrypt %q: %v", d.name, err)
+	}
+	return true
+}
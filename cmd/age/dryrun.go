@@ -0,0 +1,129 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"filippo.io/age/plugin"
+)
+
+// dryRunIdentities parses the identities specified with -i and -j, or the
+// identity file at the default location if there are none, and returns them
+// along with a label for each, describing where it came from.
+func dryRunIdentities(flags identityFlags) ([]age.Identity, []string) {
+	if len(flags) == 0 {
+		if name := findDefaultFile(age.DefaultIdentityPaths()); name != "" {
+			flags = append(flags, identityFlag{Type: "i", Value: name})
+		}
+	}
+	var identities []age.Identity
+	var labels []string
+	for _, f := range flags {
+		switch f.Type {
+		case "i":
+			ids, err := parseIdentitiesFile(f.Value)
+			if err != nil {
+				errorf("reading %q: %v", f.Value, err)
+			}
+			for n, id := range ids {
+				identities = append(identities, id)
+				if len(ids) > 1 {
+					labels = append(labels, fmt.Sprintf("%s (#%d)", f.Value, n+1))
+				} else {
+					labels = append(labels, f.Value)
+				}
+			}
+		case "j":
+			id, err := plugin.NewIdentityWithoutData(f.Value, pluginTerminalUI)
+			if err != nil {
+				errorf("initializing %q: %v", f.Value, err)
+			}
+			identities = append(identities, id)
+			labels = append(labels, "-j "+f.Value)
+		}
+	}
+	return identities, labels
+}
+
+// errDryRun stops DecryptWithOptions after the header is parsed.
+var errDryRun = errors.New("dry run")
+
+// dryRun reports which identities unwrap which stanzas of the header of the
+// input, and whether the header MAC is valid, without decrypting the payload
+// or producing any output other than the report. Identities are still invoked,
+// so plugins and encrypted identity files might prompt for a PIN or passphrase.
+func dryRun(flags identityFlags, in io.Reader, out io.Writer) {
+	identities, labels := dryRunIdentities(flags)
+
+	rr := unmangleInput(in)
+	if start, _ := rr.Peek(len(armor.Header)); string(start) == armor.Header {
+		in = armor.NewReader(rr)
+	} else {
+		in = rr
+	}
+
+	// Keep a copy of what's read while parsing the header, to check the MAC.
+	hdrBuf := &bytes.Buffer{}
+	var stanzas []*age.Stanza
+	_, _, err := age.DecryptWithOptions(io.TeeReader(in, hdrBuf), &age.Options{
+		Logger: debugLogger,
+		Policy: func(h age.HeaderInfo) error {
+			stanzas = h.Stanzas
+			return errDryRun
+		},
+	}, &LazyScryptIdentity{}) // never invoked, since the policy rejects the header
+	if !errors.Is(err, errDryRun) {
+		errorf("%v", err)
+	}
+
+	matched := -1
+	for n, s := range stanzas {
+		prefix := fmt.Sprintf("stanza #%d (%s):", n, s.Type)
+		if s.Type == "scrypt" {
+			if len(flags) == 0 {
+				fmt.Fprintf(out, "%s passphrase-encrypted, would prompt for the passphrase\n", prefix)
+			} else {
+				fmt.Fprintf(out, "%s passphrase-encrypted, but identities were specified\n", prefix)
+			}
+			continue
+		}
+		var found bool
+		for i, id := range identities {
+			_, err := id.Unwrap([]*age.Stanza{s})
+			if errors.Is(err, age.ErrIncorrectIdentity) {
+				continue
+			}
+			found = true
+			if err != nil {
+				fmt.Fprintf(out, "%s error from %s: %v\n", prefix, labels[i], err)
+				continue
+			}
+			fmt.Fprintf(out, "%s matched by %s\n", prefix, labels[i])
+			if matched < 0 {
+				matched = i
+			}
+		}
+		if !found {
+			fmt.Fprintf(out, "%s no matching identity\n", prefix)
+		}
+	}
+
+	if matched < 0 {
+		fmt.Fprintf(out, "header MAC: not checked, no identity matched\n")
+		exit(1)
+	}
+	err = age.VerifyHeader(io.MultiReader(hdrBuf, in), identities[matched])
+	if err != nil {
+		fmt.Fprintf(out, "header MAC: invalid: %v\n", err)
+		exit(1)
+	}
+	fmt.Fprintf(out, "header MAC: valid, the file can be decrypted with %s\n", labels[matched])
+}
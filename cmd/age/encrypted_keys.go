@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"time"
 
 	"filippo.io/age"
 )
@@ -15,19 +16,25 @@ import (
 // LazyScryptIdentity is an age.Identity that requests a passphrase only if it
 // encounters an scrypt stanza. After obtaining a passphrase, it delegates to
 // ScryptIdentity.
+//
+// If AllowMixed is true, the scrypt stanzas don't need to be alone in the
+// header, see ScryptIdentity.AllowMixedRecipients.
 type LazyScryptIdentity struct {
 	Passphrase func() (string, error)
+	AllowMixed bool
 }
 
 var _ age.Identity = &LazyScryptIdentity{}
 
 func (i *LazyScryptIdentity) Unwrap(stanzas []*age.Stanza) (fileKey []byte, err error) {
+	var found bool
 	for _, s := range stanzas {
-		if s.Type == "scrypt" && len(stanzas) != 1 {
+		if s.Type == "scrypt" && len(stanzas) != 1 && !i.AllowMixed {
 			return nil, errors.New("an scrypt recipient must be the only one")
 		}
+		found = found || s.Type == "scrypt"
 	}
-	if len(stanzas) != 1 || stanzas[0].Type != "scrypt" {
+	if !found {
 		return nil, age.ErrIncorrectIdentity
 	}
 	pass, err := i.Passphrase()
@@ -38,6 +45,13 @@ func (i *LazyScryptIdentity) Unwrap(stanzas []*age.Stanza) (fileKey []byte, err
 	if err != nil {
 		return nil, err
 	}
+	if i.AllowMixed {
+		ii.AllowMixedRecipients()
+	}
+	ii.SetConfirmWorkFactor(20, func(logN int, estimate time.Duration) bool {
+		printf("the passphrase has a work factor of 2^%d, decrypting might take ~%v...", logN, estimate.Round(time.Second))
+		return true
+	})
 	fileKey, err = ii.Unwrap(stanzas)
 	if errors.Is(err, age.ErrIncorrectIdentity) {
 		// ScryptIdentity returns ErrIncorrectIdentity for an incorrect
@@ -92,7 +106,7 @@ func (i *EncryptedIdentity) Unwrap(stanzas []*age.Stanza) (fileKey []byte, err e
 }
 
 func (i *EncryptedIdentity) decrypt() error {
-	d, err := age.Decrypt(bytes.NewReader(i.Contents), &LazyScryptIdentity{i.Passphrase})
+	d, err := age.Decrypt(bytes.NewReader(i.Contents), &LazyScryptIdentity{Passphrase: i.Passphrase})
 	if e := new(age.NoIdentityMatchError); errors.As(err, &e) {
 		return fmt.Errorf("identity file is encrypted with age but not with a passphrase")
 	}
@@ -0,0 +1,83 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+
+	"filippo.io/age/armor"
+)
+
+// laxInputLimit is the maximum size of the input in --lax mode, which is
+// buffered in memory to look for the armored file.
+const laxInputLimit = 64 << 20 // 64 MiB
+
+// maxArmorLayers is how many times an input can be armored in --lax mode.
+const maxArmorLayers = 4
+
+// laxInput returns the age file found in the input, which might be armored
+// multiple times, or embedded in other text, such as an email with a
+// signature. If the armored file was quoted, like with "> ", the quote prefix
+// of the header line is removed from every line. Binary age files are
+// returned as they are.
+func laxInput(in io.Reader) (io.Reader, error) {
+	data, err := io.ReadAll(io.LimitReader(in, laxInputLimit+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > laxInputLimit {
+		return nil, errors.New("input is too large for --lax")
+	}
+
+	for layer := 0; ; layer++ {
+		block, ok := findArmor(data)
+		if !ok {
+			return bytes.NewReader(data), nil
+		}
+		if layer == maxArmorLayers {
+			return nil, errors.New("input is armored too many times")
+		}
+		if layer == 0 && !bytes.Equal(bytes.TrimSpace(data), bytes.TrimSpace(block)) {
+			warningf("ignoring the text around the armored file")
+		}
+		if layer == 1 {
+			warningf("the file was armored more than once, decoding all layers")
+		}
+		data, err = io.ReadAll(armor.NewReader(bytes.NewReader(block)))
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// findArmor returns the first armored block in data, from the header line to
+// the footer line, with any quote prefix and trailing whitespace removed.
+func findArmor(data []byte) ([]byte, bool) {
+	lines := strings.SplitAfter(string(data), "\n")
+	for i, line := range lines {
+		idx := strings.Index(line, armor.Header)
+		if idx < 0 {
+			continue
+		}
+		prefix := line[:idx]
+		if strings.TrimLeft(prefix, " \t>") != "" {
+			continue
+		}
+		block := &strings.Builder{}
+		for _, l := range lines[i:] {
+			l = strings.TrimPrefix(l, prefix)
+			l = strings.TrimRight(l, " \t\r\n")
+			block.WriteString(l + "\n")
+			if l == armor.Footer {
+				return []byte(block.String()), true
+			}
+		}
+		return nil, false
+	}
+	return nil, false
+}
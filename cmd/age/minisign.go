@@ -0,0 +1,144 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Detached signatures are produced by --sign and checked by --verify-sig in
+// the minisign format, which is a superset of the signify format. See
+// https://jedisct1.github.io/minisign/#signature-format.
+//
+// The signing keys are SSH Ed25519 keys, like for --signing-key. Their
+// minisign key ID is the first eight bytes of the SHA-256 hash of the public
+// key, and the minisign public key is included in the untrusted comment of the
+// signature file, so it can be used with minisign -V -P.
+
+const (
+	// minisignAlgHashed signs the BLAKE2b-512 hash of the file.
+	minisignAlgHashed = "ED"
+	// minisignAlgLegacy signs the file itself, like signify.
+	minisignAlgLegacy = "Ed"
+
+	untrustedCommentPrefix = "untrusted comment: "
+	trustedCommentPrefix   = "trusted comment: "
+)
+
+// minisignKeyID returns the key ID used in signatures made with pub.
+func minisignKeyID(pub ed25519.PublicKey) []byte {
+	h := sha256.Sum256(pub)
+	return h[:8]
+}
+
+// minisignPublicKey returns the minisign encoding of pub, such as "RWQ...".
+func minisignPublicKey(pub ed25519.PublicKey) string {
+	b := append([]byte(minisignAlgLegacy), minisignKeyID(pub)...)
+	return base64.StdEncoding.EncodeToString(append(b, pub...))
+}
+
+// parseVerifySigKey parses the --verify-sig argument, which can be a minisign
+// public key ("RWQ...") or an SSH Ed25519 public key ("ssh-ed25519 AAAA...").
+// It returns the key and its minisign key ID.
+func parseVerifySigKey(arg string) (ed25519.PublicKey, []byte, error) {
+	if strings.HasPrefix(arg, "ssh-") {
+		pub, err := parseSigner(arg)
+		if err != nil {
+			return nil, nil, err
+		}
+		return pub, minisignKeyID(pub), nil
+	}
+	b, err := base64.StdEncoding.DecodeString(arg)
+	if err != nil || len(b) != 2+8+ed25519.PublicKeySize || string(b[:2]) != minisignAlgLegacy {
+		return nil, nil, errors.New(`malformed public key, expected a minisign key ("RW...") or an SSH Ed25519 key`)
+	}
+	return ed25519.PublicKey(b[10:]), b[2:10], nil
+}
+
+// signMinisign returns a signature file for the data hashed into h, which must
+// be a BLAKE2b-512 hash, for the file with the given name.
+func signMinisign(key ed25519.PrivateKey, h hash.Hash, name string) []byte {
+	pub := key.Public().(ed25519.PublicKey)
+	sig := ed25519.Sign(key, h.Sum(nil))
+	sigBlob := append([]byte(minisignAlgHashed), minisignKeyID(pub)...)
+	sigBlob = append(sigBlob, sig...)
+	trusted := fmt.Sprintf("timestamp:%d\tfile:%s\thashed", time.Now().Unix(), filepath.Base(name))
+	globalSig := ed25519.Sign(key, append(append([]byte(nil), sig...), trusted...))
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "%ssignature from age, public key %s\n", untrustedCommentPrefix, minisignPublicKey(pub))
+	fmt.Fprintf(buf, "%s\n", base64.StdEncoding.EncodeToString(sigBlob))
+	fmt.Fprintf(buf, "%s%s\n", trustedCommentPrefix, trusted)
+	fmt.Fprintf(buf, "%s\n", base64.StdEncoding.EncodeToString(globalSig))
+	return buf.Bytes()
+}
+
+// verifyMinisign checks the signature file sigFile over the contents of data.
+// Files in the signify format, without a trusted comment, are also accepted.
+func verifyMinisign(sigFile []byte, pub ed25519.PublicKey, keyID []byte, data io.Reader) error {
+	lines := strings.Split(strings.TrimRight(string(sigFile), "\n"), "\n")
+	if len(lines) != 2 && len(lines) != 4 {
+		return errors.New("malformed signature file: unexpected number of lines")
+	}
+	if !strings.HasPrefix(lines[0], untrustedCommentPrefix) {
+		return errors.New("malformed signature file: missing untrusted comment")
+	}
+	sigBlob, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(sigBlob) != 2+8+ed25519.SignatureSize {
+		return errors.New("malformed signature file: invalid signature encoding")
+	}
+	alg, sigKeyID, sig := string(sigBlob[:2]), sigBlob[2:10], sigBlob[10:]
+	if alg != minisignAlgHashed && alg != minisignAlgLegacy {
+		return fmt.Errorf("unsupported signature algorithm %q", alg)
+	}
+	if !bytes.Equal(sigKeyID, keyID) {
+		return errors.New("the signature was made with a different key")
+	}
+
+	var msg []byte
+	if alg == minisignAlgHashed {
+		h, _ := blake2b.New512(nil)
+		if _, err := io.Copy(h, data); err != nil {
+			return err
+		}
+		msg = h.Sum(nil)
+	} else {
+		msg, err = io.ReadAll(data)
+		if err != nil {
+			return err
+		}
+	}
+	if !ed25519.Verify(pub, msg, sig) {
+		return errors.New("invalid signature")
+	}
+
+	if len(lines) == 2 {
+		return nil
+	}
+	if !strings.HasPrefix(lines[2], trustedCommentPrefix) {
+		return errors.New("malformed signature file: missing trusted comment")
+	}
+	trusted := strings.TrimPrefix(lines[2], trustedCommentPrefix)
+	globalSig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return errors.New("malformed signature file: invalid global signature encoding")
+	}
+	if !ed25519.Verify(pub, append(append([]byte(nil), sig...), trusted...), globalSig) {
+		return errors.New("invalid signature of the trusted comment")
+	}
+	return nil
+}
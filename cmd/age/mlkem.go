@@ -0,0 +1,30 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.24 && age_mlkem
+
+package main
+
+import "filippo.io/age"
+
+// mlkemSupported is true if age was built with the "age_mlkem" tag, which
+// enables the EXPERIMENTAL ML-KEM-1024 recipients and identities.
+const mlkemSupported = true
+
+func parseMLKEMRecipient(s string) (age.Recipient, error) {
+	return age.ParseMLKEMRecipient(s)
+}
+
+func parseMLKEMIdentity(s string) (age.Identity, error) {
+	return age.ParseMLKEMIdentity(s)
+}
+
+// mlkemIdentityToRecipient returns the recipient of id if it's an
+// *age.MLKEMIdentity.
+func mlkemIdentityToRecipient(id age.Identity) (age.Recipient, bool) {
+	if id, ok := id.(*age.MLKEMIdentity); ok {
+		return id.Recipient(), true
+	}
+	return nil, false
+}
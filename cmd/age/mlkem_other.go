@@ -0,0 +1,29 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !go1.24 || !age_mlkem
+
+package main
+
+import (
+	"errors"
+
+	"filippo.io/age"
+)
+
+const mlkemSupported = false
+
+var errMLKEMUnsupported = errors.New("ML-KEM keys are experimental, and require building age with Go 1.24+ and the age_mlkem build tag")
+
+func parseMLKEMRecipient(s string) (age.Recipient, error) {
+	return nil, errMLKEMUnsupported
+}
+
+func parseMLKEMIdentity(s string) (age.Identity, error) {
+	return nil, errMLKEMUnsupported
+}
+
+func mlkemIdentityToRecipient(id age.Identity) (age.Recipient, bool) {
+	return nil, false
+}
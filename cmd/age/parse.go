@@ -6,10 +6,14 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/ed25519"
 	"encoding/base64"
 	"fmt"
 	"io"
 	"os"
+	"os/exec"
+	"runtime"
 	"strings"
 
 	"filippo.io/age"
@@ -30,6 +34,12 @@ func (gitHubRecipientError) Error() string {
 
 func parseRecipient(arg string) (age.Recipient, error) {
 	switch {
+	case strings.HasPrefix(arg, "age1hpke1"):
+		return age.ParseHPKERecipient(arg)
+	case strings.HasPrefix(arg, "age1x4481"):
+		return age.ParseX448Recipient(arg)
+	case strings.HasPrefix(arg, "age1mlkem1"):
+		return parseMLKEMRecipient(arg)
 	case strings.HasPrefix(arg, "age1") && strings.Count(arg, "1") > 1:
 		return plugin.NewRecipient(arg, pluginTerminalUI)
 	case strings.HasPrefix(arg, "age1"):
@@ -60,7 +70,30 @@ func parseRecipientsFile(name string) ([]age.Recipient, error) {
 		}
 		defer f.Close()
 	}
+	return parseRecipients(name, f)
+}
+
+// parseRecipientsCommand runs command with the system shell, and parses its
+// standard output as a recipients file. The command's standard error is
+// passed through, so it can report errors or prompt on the terminal.
+func parseRecipientsCommand(command string) ([]age.Recipient, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", command)
+	}
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run command: %v", err)
+	}
+	return parseRecipients("command output", bytes.NewReader(out))
+}
 
+// parseRecipients parses a recipients file read from f. name is only used in
+// error messages and warnings.
+func parseRecipients(name string, f io.Reader) ([]age.Recipient, error) {
 	const recipientFileSizeLimit = 16 << 20 // 16 MiB
 	const lineLengthLimit = 8 << 10         // 8 KiB, same as sshd(8)
 	var recs []age.Recipient
@@ -122,8 +155,12 @@ func sshKeyType(s string) (string, bool) {
 
 // parseIdentitiesFile parses a file that contains age or SSH keys. It returns
 // one or more of *age.X25519Identity, *agessh.RSAIdentity, *agessh.Ed25519Identity,
-// *agessh.EncryptedSSHIdentity, or *EncryptedIdentity.
+// *agessh.EncryptedSSHIdentity, *EncryptedIdentity, or *PasswordManagerIdentity.
 func parseIdentitiesFile(name string) ([]age.Identity, error) {
+	if isPasswordManagerRef(name) {
+		return []age.Identity{&PasswordManagerIdentity{Ref: name}}, nil
+	}
+
 	var f *os.File
 	if name == "-" {
 		if stdinInUse {
@@ -201,6 +238,14 @@ func parseIdentity(s string) (age.Identity, error) {
 		return plugin.NewIdentity(s, pluginTerminalUI)
 	case strings.HasPrefix(s, "AGE-SECRET-KEY-1"):
 		return age.ParseX25519Identity(s)
+	case strings.HasPrefix(s, "AGE-SECRET-KEY-HPKE-1"):
+		return age.ParseHPKEIdentity(s)
+	case strings.HasPrefix(s, "AGE-SECRET-KEY-X448-1"):
+		return age.ParseX448Identity(s)
+	case strings.HasPrefix(s, "AGE-SECRET-KEY-SUB-1"):
+		return age.ParseX25519SubkeyIdentity(s)
+	case strings.HasPrefix(s, "AGE-SECRET-KEY-MLKEM-1"):
+		return parseMLKEMIdentity(s)
 	default:
 		return nil, fmt.Errorf("unknown identity type")
 	}
@@ -288,3 +333,44 @@ Ensure %q exists, or convert the private key %q to a modern format with "ssh-key
 	}
 	return pubKey, nil
 }
+
+// parseSigningKey reads the SSH Ed25519 private key at name, for --signing-key,
+// prompting for its passphrase if it's encrypted.
+func parseSigningKey(name string) (ed25519.PrivateKey, error) {
+	pemBytes, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	k, err := ssh.ParseRawPrivateKey(pemBytes)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		pass, err := readSecret(fmt.Sprintf("Enter passphrase for %q:", name))
+		if err != nil {
+			return nil, fmt.Errorf("could not read passphrase for %q: %v", name, err)
+		}
+		k, err = ssh.ParseRawPrivateKeyWithPassphrase(pemBytes, pass)
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("malformed SSH key: %v", err)
+	}
+	switch k := k.(type) {
+	case *ed25519.PrivateKey:
+		return *k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	}
+	return nil, fmt.Errorf("unsupported SSH key type %T, only Ed25519 keys can sign", k)
+}
+
+// parseSigner parses an "ssh-ed25519 AAAA..." public key, for --signer.
+func parseSigner(arg string) (ed25519.PublicKey, error) {
+	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(arg))
+	if err != nil {
+		return nil, fmt.Errorf("malformed SSH public key: %v", err)
+	}
+	if pk.Type() != ssh.KeyAlgoED25519 {
+		return nil, fmt.Errorf("unsupported SSH key type %q, only Ed25519 keys can sign", pk.Type())
+	}
+	return pk.(ssh.CryptoPublicKey).CryptoPublicKey().(ed25519.PublicKey), nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/internal/keychain"
+)
+
+// passwordManagers maps the URL schemes accepted by -i to the command that
+// prints the identity file stored at the rest of the URL.
+var passwordManagers = map[string]func(ref string) *exec.Cmd{
+	// 1Password CLI, which takes the whole secret reference.
+	"op://": func(ref string) *exec.Cmd {
+		return exec.Command("op", "read", "--no-newline", ref)
+	},
+	// pass, the standard Unix password manager.
+	"pass://": func(ref string) *exec.Cmd {
+		return exec.Command("pass", "show", strings.TrimPrefix(ref, "pass://"))
+	},
+	// Bitwarden CLI, which stores the identity in the notes of an item.
+	"bw://": func(ref string) *exec.Cmd {
+		return exec.Command("bw", "get", "notes", strings.TrimPrefix(ref, "bw://"))
+	},
+	// The OS credential store, where age-keygen --store saves identities.
+	"keychain://": func(ref string) *exec.Cmd {
+		return keychain.LookupCommand(strings.TrimPrefix(ref, "keychain://"))
+	},
+}
+
+func isPasswordManagerRef(name string) bool {
+	for prefix := range passwordManagers {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// passwordManagerCache holds the identity files already fetched by reference,
+// so that each password manager is queried at most once per invocation.
+var passwordManagerCache = map[string][]age.Identity{}
+
+// PasswordManagerIdentity is an age.Identity that fetches an identity file
+// from a password manager only when it's first used. After fetching it, it
+// delegates to the identities in the file.
+type PasswordManagerIdentity struct {
+	Ref string
+}
+
+var _ age.Identity = &PasswordManagerIdentity{}
+
+func (i *PasswordManagerIdentity) Recipients() ([]age.Recipient, error) {
+	ids, err := i.identities()
+	if err != nil {
+		return nil, err
+	}
+	return identitiesToRecipients(ids)
+}
+
+func (i *PasswordManagerIdentity) Unwrap(stanzas []*age.Stanza) (fileKey []byte, err error) {
+	ids, err := i.identities()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		fileKey, err = id.Unwrap(stanzas)
+		if errors.Is(err, age.ErrIncorrectIdentity) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return fileKey, nil
+	}
+	return nil, age.ErrIncorrectIdentity
+}
+
+func (i *PasswordManagerIdentity) identities() ([]age.Identity, error) {
+	if ids, ok := passwordManagerCache[i.Ref]; ok {
+		return ids, nil
+	}
+	var cmd *exec.Cmd
+	for prefix, command := range passwordManagers {
+		if strings.HasPrefix(i.Ref, prefix) {
+			cmd = command(i.Ref)
+		}
+	}
+	if cmd == nil {
+		return nil, fmt.Errorf("unknown password manager reference %q", i.Ref)
+	}
+	// The password manager might need to prompt for an unlock on the terminal.
+	cmd.Stdin = os.Stdin
+	if stdinInUse {
+		cmd.Stdin = nil
+	}
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run %q: %v", cmd.Args[0], err)
+	}
+	ids, err := parseIdentities(bytes.NewReader(out))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %q: %v", i.Ref, err)
+	}
+	passwordManagerCache[i.Ref] = ids
+	return ids, nil
+}
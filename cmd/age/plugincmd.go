@@ -0,0 +1,55 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"filippo.io/age/plugin"
+)
+
+const pluginUsage = `Usage:
+    age plugin NAME [ARGS...]
+
+age plugin runs the age-plugin-NAME binary with ARGS, connected to the
+standard input, output, and error of age, and exits with its exit status. The
+binary is found in $PATH the same way as when encrypting and decrypting.
+
+The supported ARGS are defined by each plugin, and usually include commands to
+generate keys and list identities.
+
+Examples:
+
+    $ age plugin yubikey --generate
+    $ age plugin yubikey --identity`
+
+func pluginMain(args []string) {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+		fmt.Fprintf(os.Stderr, "%s\n", pluginUsage)
+		exit(2)
+	}
+	name := args[0]
+	if strings.HasPrefix(name, "-") || strings.ContainsAny(name, `/\`) {
+		errorWithHint(fmt.Sprintf("invalid plugin name %q", name),
+			"the name must be specified before any plugin arguments, without the age-plugin- prefix")
+	}
+
+	cmd := plugin.Command(name, args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exit(exitErr.ExitCode())
+		}
+		errorWithHint(fmt.Sprintf("failed to run age-plugin-%s: %v", name, err),
+			"is the plugin installed and in $PATH?")
+	}
+}
@@ -0,0 +1,421 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/internal/format"
+	"filippo.io/age/plugin"
+)
+
+const pluginTestUsage = `Usage:
+    age plugin-test [-r RECIPIENT] [-i PATH] NAME
+
+age plugin-test runs the age-plugin-NAME binary through a conformance suite,
+and prints a report. It exits with a non-zero status if any check fails.
+
+The checks that wrap and unwrap a file key require a RECIPIENT for the plugin,
+and an identity file at PATH containing the corresponding plugin identity.
+They are skipped if -r or -i are not specified. The plugin might request user
+interaction during these checks.
+
+The other checks start the plugin with malformed or interrupted sessions, and
+expect it to reject them without hanging.`
+
+// pluginTestTimeout is how long a plugin is given to respond in the checks that
+// don't involve user interaction.
+const pluginTestTimeout = 10 * time.Second
+
+// pluginTestMain implements "age plugin-test".
+func pluginTestMain(args []string) {
+	flags := flag.NewFlagSet("age plugin-test", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprintf(os.Stderr, "%s\n", pluginTestUsage) }
+	var recipientFlag, identityFlag string
+	flags.StringVar(&recipientFlag, "r", "", "plugin recipient")
+	flags.StringVar(&recipientFlag, "recipient", "", "plugin recipient")
+	flags.StringVar(&identityFlag, "i", "", "plugin identity file")
+	flags.StringVar(&identityFlag, "identity", "", "plugin identity file")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		errorWithHint("age plugin-test requires exactly one plugin name",
+			"the name must be specified after all flags, without the age-plugin- prefix")
+	}
+	t := &pluginTester{name: flags.Arg(0)}
+
+	if recipientFlag != "" {
+		r, err := plugin.NewRecipient(recipientFlag, pluginTerminalUI)
+		if err != nil {
+			errorf("invalid recipient %q: %v", recipientFlag, err)
+		}
+		if r.Name() != t.name {
+			errorf("recipient %q is for the %s plugin", recipientFlag, r.Name())
+		}
+		t.recipient = r
+	}
+	if identityFlag != "" {
+		ids, err := parseIdentitiesFile(identityFlag)
+		if err != nil {
+			errorf("reading %q: %v", identityFlag, err)
+		}
+		for _, id := range ids {
+			if id, ok := id.(*plugin.Identity); ok && id.Name() == t.name {
+				t.identity = id
+				break
+			}
+		}
+		if t.identity == nil {
+			errorf("no identity for the %s plugin found in %q", t.name, identityFlag)
+		}
+	}
+
+	t.run()
+	fmt.Printf("%d passed, %d failed, %d skipped\n", t.passed, t.failed, t.skipped)
+	if t.failed > 0 {
+		exit(1)
+	}
+}
+
+type pluginTester struct {
+	name      string
+	recipient *plugin.Recipient
+	identity  *plugin.Identity
+
+	// stanzas are the stanzas produced by the recipient-v1 check, for the
+	// identity-v1 check to unwrap.
+	fileKey []byte
+	stanzas []*age.Stanza
+
+	passed, failed, skipped int
+}
+
+// errSkip is returned by a check that can't run with the provided flags.
+type errSkip string
+
+func (e errSkip) Error() string { return string(e) }
+
+func (t *pluginTester) run() {
+	if _, err := exec.LookPath("age-plugin-" + t.name); err != nil {
+		t.report("binary", err)
+		return
+	}
+	t.report("binary", nil)
+	t.report("unknown-state-machine", t.checkUnknownStateMachine())
+	t.report("recipient-v1", t.checkRecipient())
+	t.report("identity-v1", t.checkIdentity())
+	t.report("identity-v1-unknown-stanza", t.checkIdentityUnknownStanza())
+	t.report("malformed-recipient", t.checkRejected(
+		&format.Stanza{Type: "add-recipient", Args: []string{"age1invalid"}},
+		&format.Stanza{Type: "wrap-file-key", Body: make([]byte, 16)},
+	))
+	t.report("malformed-stanza", t.checkMalformedStanza())
+	t.report("interrupted-session", t.checkInterrupted())
+	t.report("huge-body", t.checkHugeBody())
+}
+
+func (t *pluginTester) report(check string, err error) {
+	var skip errSkip
+	switch {
+	case errors.As(err, &skip):
+		fmt.Printf("SKIP  %s: %v\n", check, err)
+		t.skipped++
+	case err != nil:
+		fmt.Printf("FAIL  %s: %v\n", check, err)
+		t.failed++
+	default:
+		fmt.Printf("PASS  %s\n", check)
+		t.passed++
+	}
+}
+
+func (t *pluginTester) checkUnknownStateMachine() error {
+	s, err := startPluginSession(t.name, "plugin-test-unknown-v1")
+	if err != nil {
+		return err
+	}
+	s.stdin.Close()
+	err = s.wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("plugin exited successfully")
+}
+
+func (t *pluginTester) checkRecipient() error {
+	if t.recipient == nil {
+		return errSkip("no recipient specified with -r")
+	}
+	t.fileKey = make([]byte, 16)
+	if _, err := rand.Read(t.fileKey); err != nil {
+		return err
+	}
+	stanzas, err := t.recipient.Wrap(t.fileKey)
+	if err != nil {
+		return err
+	}
+	if len(stanzas) == 0 {
+		return fmt.Errorf("plugin returned no stanzas")
+	}
+	t.stanzas = stanzas
+	return nil
+}
+
+func (t *pluginTester) checkIdentity() error {
+	if t.identity == nil {
+		return errSkip("no identity specified with -i")
+	}
+	if t.stanzas == nil {
+		return errSkip("recipient-v1 check didn't produce stanzas")
+	}
+	fileKey, err := t.identity.Unwrap(t.stanzas)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(fileKey, t.fileKey) {
+		return fmt.Errorf("unwrapped file key doesn't match the wrapped one")
+	}
+	return nil
+}
+
+func (t *pluginTester) checkIdentityUnknownStanza() error {
+	if t.identity == nil {
+		return errSkip("no identity specified with -i")
+	}
+	_, err := t.identity.Unwrap([]*age.Stanza{{Type: "plugin-test-unknown", Body: make([]byte, 32)}})
+	if !errors.Is(err, age.ErrIncorrectIdentity) {
+		return fmt.Errorf("expected ErrIncorrectIdentity, got %v", err)
+	}
+	return nil
+}
+
+// checkRejected sends the phase 1 stanzas of a recipient-v1 session, and
+// expects the plugin to reply with an error, or to exit with an error status.
+func (t *pluginTester) checkRejected(stanzas ...*format.Stanza) error {
+	s, err := startPluginSession(t.name, "recipient-v1")
+	if err != nil {
+		return err
+	}
+	defer s.kill()
+	for _, st := range stanzas {
+		if err := st.Marshal(s.stdin); err != nil {
+			return s.exitError(err)
+		}
+	}
+	if err := (&format.Stanza{Type: "done"}).Marshal(s.stdin); err != nil {
+		return s.exitError(err)
+	}
+	return s.expectRejection()
+}
+
+func (t *pluginTester) checkMalformedStanza() error {
+	s, err := startPluginSession(t.name, "recipient-v1")
+	if err != nil {
+		return err
+	}
+	defer s.kill()
+	if _, err := io.WriteString(s.stdin, "-> wrap-file-key\n!!invalid base64!!\n-> done\n\n"); err != nil {
+		return s.exitError(err)
+	}
+	return s.expectRejection()
+}
+
+func (t *pluginTester) checkInterrupted() error {
+	s, err := startPluginSession(t.name, "recipient-v1")
+	if err != nil {
+		return err
+	}
+	defer s.kill()
+	if _, err := io.WriteString(s.stdin, "-> add-recipient"); err != nil {
+		return s.exitError(err)
+	}
+	s.stdin.Close()
+	select {
+	case <-s.done:
+		return nil
+	case <-time.After(pluginTestTimeout):
+		return fmt.Errorf("plugin didn't exit within %v after its input was closed", pluginTestTimeout)
+	}
+}
+
+func (t *pluginTester) checkHugeBody() error {
+	if t.recipient == nil {
+		return errSkip("no recipient specified with -r")
+	}
+	s, err := startPluginSession(t.name, "recipient-v1")
+	if err != nil {
+		return err
+	}
+	defer s.kill()
+	fileKey := make([]byte, 16)
+	if _, err := rand.Read(fileKey); err != nil {
+		return err
+	}
+	stanzas := []*format.Stanza{
+		{Type: "add-recipient", Args: []string{t.recipient.String()}},
+		{Type: "plugin-test-grease", Body: make([]byte, 1<<20)},
+		{Type: "wrap-file-key", Body: fileKey},
+		{Type: "done"},
+	}
+	errc := make(chan error, 1)
+	go func() {
+		for _, st := range stanzas {
+			if err := st.Marshal(s.stdin); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+	st, err := s.readStanza()
+	if err != nil {
+		return err
+	}
+	if err := <-errc; err != nil {
+		return s.exitError(err)
+	}
+	if st.Type != "recipient-stanza" {
+		return fmt.Errorf("expected a recipient-stanza command, got %q", st.Type)
+	}
+	return nil
+}
+
+// A pluginSession is a plugin process driven directly, to exercise behaviors
+// that the plugin package doesn't produce.
+type pluginSession struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	sr    *format.StanzaReader
+	done  chan struct{}
+	err   error
+}
+
+func startPluginSession(name, stateMachine string) (*pluginSession, error) {
+	cmd := plugin.Command(name, "--age-plugin="+stateMachine)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	// Use an os.Pipe rather than StdoutPipe, so that the output can still be
+	// read after the process exits and Wait returns.
+	stdout, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdout = w
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		stdout.Close()
+		return nil, err
+	}
+	s := &pluginSession{cmd: cmd, stdin: stdin, done: make(chan struct{}),
+		sr: format.NewStanzaReader(bufio.NewReader(stdout))}
+	go func() {
+		s.err = cmd.Wait()
+		close(s.done)
+	}()
+	return s, nil
+}
+
+// wait waits for the plugin to exit, and returns its exit error.
+func (s *pluginSession) wait() error {
+	select {
+	case <-s.done:
+		return s.err
+	case <-time.After(pluginTestTimeout):
+		s.kill()
+		return fmt.Errorf("plugin didn't exit within %v", pluginTestTimeout)
+	}
+}
+
+func (s *pluginSession) kill() {
+	s.cmd.Process.Kill()
+}
+
+// exitError wraps err, which occurred while writing to the plugin, with the
+// plugin exit status, as the write usually fails because the plugin exited.
+func (s *pluginSession) exitError(err error) error {
+	if werr := s.wait(); werr != nil {
+		return fmt.Errorf("%v (%v)", err, werr)
+	}
+	return err
+}
+
+var errPluginExited = errors.New("plugin exited without responding")
+
+// readStanza reads the next stanza from the plugin, replying "unsupported" to
+// the commands that request user interaction.
+func (s *pluginSession) readStanza() (*format.Stanza, error) {
+	type result struct {
+		s   *format.Stanza
+		err error
+	}
+	for {
+		c := make(chan result, 1)
+		go func() {
+			st, err := s.sr.ReadStanza()
+			c <- result{st, err}
+		}()
+		var r result
+		select {
+		case r = <-c:
+		case <-time.After(pluginTestTimeout):
+			s.kill()
+			return nil, fmt.Errorf("plugin didn't respond within %v", pluginTestTimeout)
+		}
+		if errors.Is(r.err, io.EOF) {
+			if err := s.wait(); err != nil {
+				return nil, fmt.Errorf("%w (%v)", errPluginExited, err)
+			}
+			return nil, errPluginExited
+		}
+		if r.err != nil {
+			return nil, fmt.Errorf("malformed response: %v", r.err)
+		}
+		switch r.s.Type {
+		case "msg", "confirm", "request-public", "request-secret", "extension":
+			if err := (&format.Stanza{Type: "unsupported"}).Marshal(s.stdin); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return r.s, nil
+	}
+}
+
+// expectRejection expects the plugin to reply with an error command, or to
+// exit with an error status without replying.
+func (s *pluginSession) expectRejection() error {
+	st, err := s.readStanza()
+	if errors.Is(err, errPluginExited) {
+		var exitErr *exec.ExitError
+		if errors.As(s.wait(), &exitErr) {
+			return nil
+		}
+		return fmt.Errorf("plugin exited successfully without reporting an error")
+	}
+	if err != nil {
+		return err
+	}
+	if st.Type != "error" {
+		return fmt.Errorf("expected an error command, got %q", st.Type)
+	}
+	return nil
+}
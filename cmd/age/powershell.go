@@ -0,0 +1,52 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// utf16MangledArmor is the start of an armored file after Windows PowerShell
+// redirection re-encoded it as UTF-16LE with a byte order mark. Unlike binary
+// files, armored files survive the conversion, since they are ASCII.
+const utf16MangledArmor = "\xff\xfe" + "-\x00-\x00-\x00-\x00-\x00B\x00E\x00G\x00I\x00N\x00"
+
+// unmangleInput returns a reader for in that transparently reverts the
+// re-encoding of armored files by PowerShell, printing a warning if needed.
+func unmangleInput(in io.Reader) *bufio.Reader {
+	rr := bufio.NewReader(in)
+	if start, _ := rr.Peek(len(utf16MangledArmor)); string(start) == utf16MangledArmor {
+		warningf("the input was re-encoded as UTF-16 by PowerShell, decoding it")
+		rr.Discard(2) // byte order mark
+		return bufio.NewReader(&utf16Decoder{r: rr})
+	}
+	return rr
+}
+
+// utf16Decoder decodes UTF-16LE text that is expected to contain only ASCII.
+type utf16Decoder struct {
+	r *bufio.Reader
+}
+
+func (d *utf16Decoder) Read(p []byte) (n int, err error) {
+	var c [2]byte
+	for n < len(p) {
+		// Don't block if some data was already decoded.
+		if n > 0 && d.r.Buffered() < 2 {
+			break
+		}
+		if _, err := io.ReadFull(d.r, c[:]); err != nil {
+			return n, err
+		}
+		if c[1] != 0 || c[0] >= 0x80 {
+			return n, errors.New("invalid UTF-16 armored input: unexpected non-ASCII character")
+		}
+		p[n] = c[0]
+		n++
+	}
+	return n, nil
+}
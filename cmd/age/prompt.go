@@ -0,0 +1,134 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// A PromptProvider implements all the user interaction of cmd/age, so that it
+// can be replaced, for example by a GUI wrapper or a pinentry, without
+// changing the rest of the CLI logic. Prompts are ephemeral: implementations
+// should remove them once they're answered, if possible.
+type PromptProvider interface {
+	// ReadPassphrase shows prompt and reads a secret value, without echoing it.
+	ReadPassphrase(prompt string) ([]byte, error)
+
+	// Confirm shows prompt and asks the user to choose between yes and no. If
+	// no is empty, the only option is to acknowledge the prompt with yes.
+	Confirm(prompt, yes, no string) (bool, error)
+
+	// Message shows msg to the user, in the same place as the prompts. It's
+	// used for information that must not end up in logs or redirected
+	// standard error, like an autogenerated passphrase.
+	Message(msg string) error
+}
+
+// prompter is the PromptProvider used by cmd/age. It's replaced with
+// nonInteractivePrompter in batch mode.
+var prompter PromptProvider = defaultPrompter
+
+// errNonInteractive is returned by nonInteractivePrompter.
+var errNonInteractive = errors.New("prompts are disabled")
+
+// nonInteractivePrompter is a PromptProvider that fails every prompt.
+type nonInteractivePrompter struct{}
+
+func (nonInteractivePrompter) ReadPassphrase(string) ([]byte, error) { return nil, errNonInteractive }
+func (nonInteractivePrompter) Confirm(string, string, string) (bool, error) {
+	return false, errNonInteractive
+}
+func (nonInteractivePrompter) Message(string) error { return errNonInteractive }
+
+// terminalPrompter is a PromptProvider that interacts with the user through
+// the terminal files opened by withTerminal, which are the TTY on Unix and
+// the console on Windows.
+type terminalPrompter struct {
+	// withTerminal runs f with the terminal input and output files, if
+	// available. It must not open a non-terminal stdin, so that the caller
+	// doesn't need to check stdinInUse.
+	withTerminal func(f func(in, out *os.File) error) error
+}
+
+func (t *terminalPrompter) ReadPassphrase(prompt string) (s []byte, err error) {
+	err = t.withTerminal(func(in, out *os.File) error {
+		fmt.Fprintf(out, "%s ", prompt)
+		defer clearLine(out)
+		s, err = term.ReadPassword(int(in.Fd()))
+		return err
+	})
+	return
+}
+
+func (t *terminalPrompter) Confirm(prompt, yes, no string) (bool, error) {
+	if no == "" {
+		prompt += fmt.Sprintf(" (press enter for %q)", yes)
+		if _, err := t.ReadPassphrase(prompt); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	prompt += fmt.Sprintf(" (press [1] for %q or [2] for %q)", yes, no)
+	for {
+		selection, err := t.readCharacter(prompt)
+		if err != nil {
+			return false, err
+		}
+		switch selection {
+		case '1':
+			return true, nil
+		case '2':
+			return false, nil
+		case '\x03': // CTRL-C
+			return false, errors.New("user cancelled prompt")
+		default:
+			warningf("invalid selection %q", selection)
+		}
+	}
+}
+
+// readCharacter reads a single character from the terminal with no echo.
+func (t *terminalPrompter) readCharacter(prompt string) (c byte, err error) {
+	err = t.withTerminal(func(in, out *os.File) error {
+		fmt.Fprintf(out, "%s ", prompt)
+		defer clearLine(out)
+
+		oldState, err := term.MakeRaw(int(in.Fd()))
+		if err != nil {
+			return err
+		}
+		defer term.Restore(int(in.Fd()), oldState)
+
+		b := make([]byte, 1)
+		if _, err := in.Read(b); err != nil {
+			return err
+		}
+
+		c = b[0]
+		return nil
+	})
+	return
+}
+
+func (t *terminalPrompter) Message(msg string) error {
+	return t.withTerminal(func(_, out *os.File) error {
+		_, err := fmt.Fprintf(out, "age: %s\n", msg)
+		return err
+	})
+}
+
+func printfToTerminal(format string, v ...interface{}) error {
+	return prompter.Message(fmt.Sprintf(format, v...))
+}
+
+// readSecret reads a value from the user with no echo.
+func readSecret(prompt string) ([]byte, error) {
+	requireInteractive(exitPassphraseRequired, "a passphrase is required")
+	return prompter.ReadPassphrase(prompt)
+}
@@ -0,0 +1,179 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// remoteSchemes maps the URL schemes accepted for INPUT and -o/--output to the
+// commands that stream an object to standard output (get) and from standard
+// input (put). If a helper named "age-remote-SCHEME" is found in $PATH, it's
+// used instead, invoked as "age-remote-SCHEME get URL" or "... put URL".
+var remoteSchemes = map[string]struct {
+	get, put func(url string) []string
+}{
+	"s3": {
+		get: func(url string) []string { return []string{"aws", "s3", "cp", url, "-"} },
+		put: func(url string) []string { return []string{"aws", "s3", "cp", "-", url} },
+	},
+	"gs": {
+		get: func(url string) []string { return []string{"gcloud", "storage", "cp", url, "-"} },
+		put: func(url string) []string { return []string{"gcloud", "storage", "cp", "-", url} },
+	},
+	"sftp": {
+		get: func(url string) []string { return []string{"curl", "--silent", "--show-error", "--fail", url} },
+		put: func(url string) []string {
+			return []string{"curl", "--silent", "--show-error", "--fail", "-T", "-", url}
+		},
+	},
+}
+
+// remoteScheme returns the scheme of name if it's a supported remote URL, or
+// the empty string otherwise.
+func remoteScheme(name string) string {
+	scheme, _, ok := strings.Cut(name, "://")
+	if !ok {
+		return ""
+	}
+	if _, ok := remoteSchemes[scheme]; !ok {
+		return ""
+	}
+	return scheme
+}
+
+func remoteCommand(url, op string) *exec.Cmd {
+	scheme := remoteScheme(url)
+	if helper, err := exec.LookPath("age-remote-" + scheme); err == nil {
+		return exec.Command(helper, op, url)
+	}
+	var args []string
+	if op == "get" {
+		args = remoteSchemes[scheme].get(url)
+	} else {
+		args = remoteSchemes[scheme].put(url)
+	}
+	return exec.Command(args[0], args[1:]...)
+}
+
+// remoteReader streams the object at a remote URL. If the command fails, the
+// error is returned by Read in place of io.EOF, so that a truncated download
+// is not mistaken for a complete input.
+type remoteReader struct {
+	url  string
+	cmd  *exec.Cmd
+	pipe io.ReadCloser
+	done bool
+	err  error
+}
+
+func openRemote(url string) (io.ReadCloser, error) {
+	cmd := remoteCommand(url, "get")
+	cmd.Stderr = os.Stderr
+	pipe, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to run %q: %v", cmd.Args[0], err)
+	}
+	return &remoteReader{url: url, cmd: cmd, pipe: pipe}, nil
+}
+
+func (r *remoteReader) Read(p []byte) (int, error) {
+	if r.done {
+		return 0, r.err
+	}
+	n, err := r.pipe.Read(p)
+	if err == io.EOF {
+		r.done = true
+		r.err = io.EOF
+		if err := r.cmd.Wait(); err != nil {
+			r.err = fmt.Errorf("failed to download %q: %s: %v", r.url, r.cmd.Args[0], err)
+		}
+		return n, r.err
+	}
+	return n, err
+}
+
+func (r *remoteReader) Close() error {
+	if !r.done {
+		r.done = true
+		r.cmd.Process.Kill()
+		r.cmd.Wait()
+	}
+	return nil
+}
+
+// pendingUploads are the remote uploads in progress, which are aborted by exit
+// so that a failed operation doesn't leave a partial object behind.
+var pendingUploads []*exec.Cmd
+
+func abortRemoteUploads() {
+	for _, cmd := range pendingUploads {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+	pendingUploads = nil
+}
+
+// remoteWriter uploads to a remote URL. Like lazyOpener, it starts the upload
+// only at the first Write, and Close reports whether the upload succeeded.
+type remoteWriter struct {
+	url  string
+	cmd  *exec.Cmd
+	pipe io.WriteCloser
+	err  error
+}
+
+func newRemoteWriter(url string) io.WriteCloser {
+	return &remoteWriter{url: url}
+}
+
+func (w *remoteWriter) Write(p []byte) (int, error) {
+	if w.cmd == nil && w.err == nil {
+		w.start()
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	return w.pipe.Write(p)
+}
+
+func (w *remoteWriter) start() {
+	w.cmd = remoteCommand(w.url, "put")
+	w.cmd.Stdout = os.Stderr
+	w.cmd.Stderr = os.Stderr
+	w.pipe, w.err = w.cmd.StdinPipe()
+	if w.err != nil {
+		return
+	}
+	if err := w.cmd.Start(); err != nil {
+		w.err = fmt.Errorf("failed to run %q: %v", w.cmd.Args[0], err)
+		return
+	}
+	pendingUploads = append(pendingUploads, w.cmd)
+}
+
+func (w *remoteWriter) Close() error {
+	if w.cmd == nil || w.err != nil {
+		return w.err
+	}
+	for i, cmd := range pendingUploads {
+		if cmd == w.cmd {
+			pendingUploads = append(pendingUploads[:i], pendingUploads[i+1:]...)
+			break
+		}
+	}
+	w.pipe.Close()
+	if err := w.cmd.Wait(); err != nil {
+		return fmt.Errorf("failed to upload: %s: %v", w.cmd.Args[0], err)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"filippo.io/age/parity"
+)
+
+// repairInput returns the contents of f, repaired with the parity file at
+// f.Name() + ".parity" as they are read. The returned function reports any
+// damage that was repaired, and must be called once the input was processed.
+func repairInput(f *os.File) (io.Reader, func()) {
+	name := f.Name()
+	pf, err := os.Open(name + ".parity")
+	if err != nil {
+		errorf("failed to open parity file: %v", err)
+	}
+	info, err := pf.Stat()
+	if err != nil {
+		errorf("failed to open parity file: %v", err)
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan *parity.Result, 1)
+	go func() {
+		res, err := parity.Repair(pw, f, pf, info.Size())
+		if err != nil {
+			err = fmt.Errorf("failed to repair %q: %v", name, err)
+		}
+		pw.CloseWithError(err)
+		done <- res
+	}()
+
+	return pr, func() {
+		// Let Repair finish even if the input was not read to the end.
+		io.Copy(io.Discard, pr)
+		res := <-done
+		pf.Close()
+		if res == nil {
+			return
+		}
+		if res.Damaged > 0 {
+			warningf("repaired %d damaged blocks of %q; consider replacing it with a copy made with --repair -o", res.Damaged, name)
+		}
+		if res.DamagedParity > 0 {
+			warningf("%d blocks of %q are damaged; consider making a new one with --parity", res.DamagedParity, name+".parity")
+		}
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/plugin"
+)
+
+const tarUsage = `Usage:
+    age tar (-r RECIPIENT | -R PATH)... -o OUTPUT DIR
+    age untar [-i PATH]... [-C DIR] [--list] INPUT [NAME...]
+
+age tar encrypts the regular files in DIR to an archive at OUTPUT. Each file
+is encrypted separately, and an encrypted index of the files is appended, so
+that age untar can extract individual files without decrypting the rest.
+
+age untar extracts the files named by NAME, or all of them, to DIR, which
+defaults to the current directory. With --list, it prints the names of the
+files in the archive instead.
+
+Only file contents are stored, not permissions, ownership, or times.`
+
+// tarMain implements "age tar".
+func tarMain(args []string) {
+	flags := flag.NewFlagSet("age tar", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprintf(os.Stderr, "%s\n", tarUsage) }
+	var (
+		outFlag             string
+		recipientFlags      multiFlag
+		recipientsFileFlags multiFlag
+	)
+	flags.StringVar(&outFlag, "o", "", "output to `FILE`")
+	flags.StringVar(&outFlag, "output", "", "output to `FILE`")
+	flags.Var(&recipientFlags, "r", "recipient (can be repeated)")
+	flags.Var(&recipientFlags, "recipient", "recipient (can be repeated)")
+	flags.Var(&recipientsFileFlags, "R", "recipients file (can be repeated)")
+	flags.Var(&recipientsFileFlags, "recipients-file", "recipients file (can be repeated)")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		errorWithHint("age tar requires exactly one DIR argument",
+			"the input directory must be specified after all flags")
+	}
+	if outFlag == "" || outFlag == "-" {
+		errorf("age tar requires -o/--output, as the archive can't be written to a pipe")
+	}
+	if len(recipientFlags)+len(recipientsFileFlags) == 0 {
+		errorWithHint("missing recipients",
+			"did you forget to specify -r/--recipient or -R/--recipients-file?")
+	}
+	recipients := plugin.GroupRecipients(parseRecipientFlags(recipientFlags, recipientsFileFlags, nil, nil))
+
+	dir := flags.Arg(0)
+	out, err := os.Create(outFlag)
+	if err != nil {
+		errorf("failed to create output file %q: %v", outFlag, err)
+	}
+	defer func() {
+		if err := out.Close(); err != nil {
+			errorf("failed to close output file %q: %v", outFlag, err)
+		}
+	}()
+	outInfo, err := out.Stat()
+	if err != nil {
+		errorf("%v", err)
+	}
+	w, err := age.NewArchiveWriter(out, recipients...)
+	if err != nil {
+		errorf("%v", err)
+	}
+	err = filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			warningf("skipping %q, which is not a regular file", name)
+			return nil
+		}
+		if info, err := d.Info(); err == nil && os.SameFile(info, outInfo) {
+			// Don't archive the archive itself.
+			return nil
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		ew, err := w.Create(filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(ew, f)
+		return err
+	})
+	if err != nil {
+		errorf("%v", err)
+	}
+	if err := w.Close(); err != nil {
+		errorf("%v", err)
+	}
+}
+
+// untarMain implements "age untar".
+func untarMain(args []string) {
+	flags := flag.NewFlagSet("age untar", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprintf(os.Stderr, "%s\n", tarUsage) }
+	var (
+		dirFlag       string
+		listFlag      bool
+		identityFlags identityFlags
+	)
+	flags.StringVar(&dirFlag, "C", ".", "extract to `DIR`")
+	flags.BoolVar(&listFlag, "list", false, "list the files in the archive")
+	flags.Func("i", "identity (can be repeated)", identityFlags.addIdentityFlag)
+	flags.Func("identity", "identity (can be repeated)", identityFlags.addIdentityFlag)
+	flags.Func("j", "data-less plugin (can be repeated)", identityFlags.addPluginFlag)
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		errorWithHint("age untar requires an INPUT argument",
+			"the input file must be specified after all flags")
+	}
+	if listFlag && flags.NArg() > 1 {
+		errorf("NAME arguments can't be used with --list")
+	}
+	if len(identityFlags) == 0 {
+		name := findDefaultFile(age.DefaultIdentityPaths())
+		if name == "" {
+			errorWithHint("missing identities",
+				"did you forget to specify -i/--identity?")
+		}
+		identityFlags.addIdentityFlag(name)
+	}
+	identities := parseIdentityFlags(identityFlags)
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		errorf("failed to open input file %q: %v", flags.Arg(0), err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		errorf("%v", err)
+	}
+	a, err := age.OpenArchive(f, info.Size(), identities...)
+	if err != nil {
+		errorf("%v", err)
+	}
+
+	if listFlag {
+		for _, name := range a.Names() {
+			fmt.Println(name)
+		}
+		return
+	}
+
+	names := flags.Args()[1:]
+	if len(names) == 0 {
+		names = a.Names()
+	}
+	for _, name := range names {
+		if !isLocalSlashPath(name) {
+			errorf("refusing to extract %q outside of the destination directory", name)
+		}
+		r, err := a.Open(name)
+		if err != nil {
+			errorf("%v", err)
+		}
+		dst := filepath.Join(dirFlag, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+			errorf("%v", err)
+		}
+		out, err := os.Create(dst)
+		if err != nil {
+			errorf("%v", err)
+		}
+		if _, err := io.Copy(out, r); err != nil {
+			out.Close()
+			errorf("failed to extract %q: %v", name, err)
+		}
+		if err := out.Close(); err != nil {
+			errorf("%v", err)
+		}
+	}
+}
+
+// isLocalSlashPath reports whether name is a relative slash-separated path
+// that doesn't escape the directory it's joined to.
+func isLocalSlashPath(name string) bool {
+	if name == "" || path.IsAbs(name) || strings.Contains(name, `\`) ||
+		strings.Contains(name, ":") {
+		return false
+	}
+	clean := path.Clean(name)
+	return clean != ".." && !strings.HasPrefix(clean, "../")
+}
@@ -0,0 +1,87 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"filippo.io/age"
+)
+
+// outputTemplateData is the data available to --output-template.
+type outputTemplateData struct {
+	// Input is the INPUT path, and Dir, Base, Stem, and Ext are its directory,
+	// its last element, and the latter without and with only its extension.
+	Input, Dir, Base, Stem, Ext string
+	// Recipients are the encodings of the recipients, or their type if they
+	// don't have one. It's empty when decrypting.
+	Recipients []string
+	// Time is the current local time.
+	Time time.Time
+}
+
+var outputTemplateFuncs = template.FuncMap{
+	// short returns a short fingerprint of one or more recipients, which
+	// doesn't depend on their order.
+	"short": func(v interface{}) (string, error) {
+		var recipients []string
+		switch v := v.(type) {
+		case string:
+			recipients = []string{v}
+		case []string:
+			recipients = append(recipients, v...)
+		default:
+			return "", fmt.Errorf("short: unexpected argument of type %T", v)
+		}
+		sort.Strings(recipients)
+		h := sha256.Sum256([]byte(strings.Join(recipients, "\n")))
+		return hex.EncodeToString(h[:4]), nil
+	},
+}
+
+// expandOutputTemplate returns the output path for input according to the
+// --output-template text.
+func expandOutputTemplate(text, input string, recipients []age.Recipient) (string, error) {
+	t, err := template.New("output").Funcs(outputTemplateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	base := filepath.Base(input)
+	ext := filepath.Ext(base)
+	data := outputTemplateData{
+		Input: input,
+		Dir:   filepath.Dir(input),
+		Base:  base,
+		Stem:  strings.TrimSuffix(base, ext),
+		Ext:   ext,
+		Time:  time.Now(),
+	}
+	for _, r := range recipients {
+		if s, ok := r.(fmt.Stringer); ok {
+			data.Recipients = append(data.Recipients, s.String())
+		} else {
+			data.Recipients = append(data.Recipients, fmt.Sprintf("%T", r))
+		}
+	}
+	b := &strings.Builder{}
+	if err := t.Execute(b, data); err != nil {
+		return "", err
+	}
+	out := b.String()
+	if out == "" || strings.ContainsAny(out, "\n\x00") {
+		return "", fmt.Errorf("invalid output path %q", out)
+	}
+	if filepath.Clean(out) == filepath.Clean(input) {
+		return "", fmt.Errorf("output path %q is the same as the input", out)
+	}
+	return out, nil
+}
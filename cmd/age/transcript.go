@@ -0,0 +1,62 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"strings"
+
+	"filippo.io/age/plugin"
+)
+
+// debugOptions parses the AGEDEBUG environment variable, a comma-separated
+// list of options. "transcript=PATH" records the plugin transcripts to PATH,
+// with secrets redacted unless "unredacted" is also specified. Any other
+// option enables debug logging.
+func debugOptions() (logging bool, transcript string, unredacted bool) {
+	for _, opt := range strings.Split(os.Getenv("AGEDEBUG"), ",") {
+		switch {
+		case opt == "":
+		case strings.HasPrefix(opt, "transcript="):
+			transcript = strings.TrimPrefix(opt, "transcript=")
+		case opt == "unredacted":
+			unredacted = true
+		default:
+			logging = true
+		}
+	}
+	return logging, transcript, unredacted
+}
+
+func init() {
+	_, path, unredacted := debugOptions()
+	if path == "" {
+		return
+	}
+	pluginTerminalUI.Transcript = plugin.NewTranscriptRecorder(
+		&transcriptFile{path: path}, !unredacted)
+}
+
+// transcriptFile opens the transcript file at the first write, so that it's
+// not created or truncated by age invocations that don't use plugins.
+type transcriptFile struct {
+	path string
+	f    *os.File
+	err  error
+}
+
+func (t *transcriptFile) Write(p []byte) (int, error) {
+	if t.f == nil && t.err == nil {
+		// The transcript might contain secrets, so it's only readable by the user.
+		t.f, t.err = os.OpenFile(t.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if t.err != nil {
+			warningf("failed to open plugin transcript: %v", t.err)
+		}
+	}
+	if t.err != nil {
+		return 0, t.err
+	}
+	return t.f.Write(p)
+}
@@ -6,22 +6,26 @@ package main
 
 // This file implements the terminal UI of cmd/age. The rules are:
 //
-//   - Anything that requires user interaction goes to the terminal,
-//     and is erased afterwards if possible. This UI would be possible
-//     to replace with a pinentry with no output or UX changes.
+//   - Anything that requires user interaction goes through the
+//     PromptProvider in prompt.go, by default to the terminal, and is
+//     erased afterwards if possible. This UI would be possible to replace
+//     with a pinentry with no output or UX changes.
 //
 //   - Everything else goes to standard error with an "age:" prefix.
 //     No capitalized initials and no periods at the end.
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
-	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
+	"filippo.io/age"
 	"filippo.io/age/armor"
 	"filippo.io/age/plugin"
 	"golang.org/x/term"
@@ -30,13 +34,38 @@ import (
 // l is a logger with no prefixes.
 var l = log.New(os.Stderr, "", 0)
 
+// batchMode is set by the --batch flag. In batch mode, age never prompts and
+// exits with one of the codes below instead, doesn't change its behavior based
+// on whether standard input and output are terminals, and prints only warnings
+// and errors, without hints.
+var batchMode bool
+
+// Exit codes used in batch mode when an interaction would be required.
+const (
+	exitPassphraseRequired  = 3
+	exitInteractionRequired = 4
+)
+
+// requireInteractive exits with code if prompts are disabled by batch mode.
+func requireInteractive(code int, format string, v ...interface{}) {
+	if batchMode {
+		l.Printf("age: error: "+format+", but prompts are disabled by --batch", v...)
+		exit(code)
+	}
+}
+
 func printf(format string, v ...interface{}) {
+	if batchMode {
+		return
+	}
 	l.Printf("age: "+format, v...)
 }
 
 func errorf(format string, v ...interface{}) {
 	l.Printf("age: error: "+format, v...)
-	l.Printf("age: report unexpected or unhelpful errors at https://filippo.io/age/report")
+	if !batchMode {
+		l.Printf("age: report unexpected or unhelpful errors at https://filippo.io/age/report")
+	}
 	exit(1)
 }
 
@@ -46,10 +75,12 @@ func warningf(format string, v ...interface{}) {
 
 func errorWithHint(error string, hints ...string) {
 	l.Printf("age: error: %s", error)
-	for _, hint := range hints {
-		l.Printf("age: hint: %s", hint)
+	if !batchMode {
+		for _, hint := range hints {
+			l.Printf("age: hint: %s", hint)
+		}
+		l.Printf("age: report unexpected or unhelpful errors at https://filippo.io/age/report")
 	}
-	l.Printf("age: report unexpected or unhelpful errors at https://filippo.io/age/report")
 	exit(1)
 }
 
@@ -64,6 +95,9 @@ func exit(code int) {
 		testOnlyDidExit = true
 		panic(code)
 	}
+	if code != 0 {
+		abortRemoteUploads()
+	}
 	os.Exit(code)
 }
 
@@ -86,73 +120,9 @@ func clearLine(out io.Writer) {
 	fmt.Fprintf(out, "\r\n"+CPL+EL)
 }
 
-// withTerminal runs f with the terminal input and output files, if available.
-// withTerminal does not open a non-terminal stdin, so the caller does not need
-// to check stdinInUse.
-func withTerminal(f func(in, out *os.File) error) error {
-	if runtime.GOOS == "windows" {
-		in, err := os.OpenFile("CONIN$", os.O_RDWR, 0)
-		if err != nil {
-			return err
-		}
-		defer in.Close()
-		out, err := os.OpenFile("CONOUT$", os.O_WRONLY, 0)
-		if err != nil {
-			return err
-		}
-		defer out.Close()
-		return f(in, out)
-	} else if tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0); err == nil {
-		defer tty.Close()
-		return f(tty, tty)
-	} else if term.IsTerminal(int(os.Stdin.Fd())) {
-		return f(os.Stdin, os.Stdin)
-	} else {
-		return fmt.Errorf("standard input is not a terminal, and /dev/tty is not available: %v", err)
-	}
-}
-
-func printfToTerminal(format string, v ...interface{}) error {
-	return withTerminal(func(_, out *os.File) error {
-		_, err := fmt.Fprintf(out, "age: "+format+"\n", v...)
-		return err
-	})
-}
-
-// readSecret reads a value from the terminal with no echo. The prompt is ephemeral.
-func readSecret(prompt string) (s []byte, err error) {
-	err = withTerminal(func(in, out *os.File) error {
-		fmt.Fprintf(out, "%s ", prompt)
-		defer clearLine(out)
-		s, err = term.ReadPassword(int(in.Fd()))
-		return err
-	})
-	return
-}
-
-// readCharacter reads a single character from the terminal with no echo. The
-// prompt is ephemeral.
-func readCharacter(prompt string) (c byte, err error) {
-	err = withTerminal(func(in, out *os.File) error {
-		fmt.Fprintf(out, "%s ", prompt)
-		defer clearLine(out)
-
-		oldState, err := term.MakeRaw(int(in.Fd()))
-		if err != nil {
-			return err
-		}
-		defer term.Restore(int(in.Fd()), oldState)
-
-		b := make([]byte, 1)
-		if _, err := in.Read(b); err != nil {
-			return err
-		}
-
-		c = b[0]
-		return nil
-	})
-	return
-}
+// debugLogger is set if the AGEDEBUG environment variable enables logging, on Go 1.21
+// and later. It's also used as pluginTerminalUI.Logger.
+var debugLogger age.Logger
 
 var pluginTerminalUI = &plugin.ClientUI{
 	DisplayMessage: func(name, message string) error {
@@ -160,6 +130,7 @@ var pluginTerminalUI = &plugin.ClientUI{
 		return nil
 	},
 	RequestValue: func(name, message string, _ bool) (s string, err error) {
+		requireInteractive(exitInteractionRequired, "age-plugin-%s requested a value", name)
 		defer func() {
 			if err != nil {
 				warningf("could not read value for age-plugin-%s: %v", name, err)
@@ -172,40 +143,27 @@ var pluginTerminalUI = &plugin.ClientUI{
 		return string(secret), nil
 	},
 	Confirm: func(name, message, yes, no string) (choseYes bool, err error) {
+		requireInteractive(exitInteractionRequired, "age-plugin-%s requested a confirmation", name)
 		defer func() {
 			if err != nil {
 				warningf("could not read value for age-plugin-%s: %v", name, err)
 			}
 		}()
-		if no == "" {
-			message += fmt.Sprintf(" (press enter for %q)", yes)
-			_, err := readSecret(message)
-			if err != nil {
-				return false, err
-			}
-			return true, nil
-		}
-		message += fmt.Sprintf(" (press [1] for %q or [2] for %q)", yes, no)
-		for {
-			selection, err := readCharacter(message)
-			if err != nil {
-				return false, err
-			}
-			switch selection {
-			case '1':
-				return true, nil
-			case '2':
-				return false, nil
-			case '\x03': // CTRL-C
-				return false, errors.New("user cancelled prompt")
-			default:
-				warningf("reading value for age-plugin-%s: invalid selection %q", name, selection)
-			}
-		}
+		return prompter.Confirm(message, yes, no)
 	},
 	WaitTimer: func(name string) {
 		printf("waiting on %s plugin...", name)
 	},
+	// If the plugin reports an incorrect PIN, warn the user about the
+	// remaining attempts, and let the plugin prompt again. The user can
+	// interrupt the prompt, and in batch mode nothing is retried.
+	PINRetry: func(name string, err *age.PINError) bool {
+		if batchMode {
+			return false
+		}
+		warningf("age-plugin-%s: %v", name, err)
+		return true
+	},
 }
 
 func bufferTerminalInput(in io.Reader) (io.Reader, error) {
@@ -224,3 +182,69 @@ func bufferTerminalInput(in io.Reader) (io.Reader, error) {
 type ReaderFunc func(p []byte) (n int, err error)
 
 func (f ReaderFunc) Read(p []byte) (n int, err error) { return f(p) }
+
+type progressSetter interface {
+	SetProgressFunc(func(processedBytes int64))
+}
+
+// progressPrinter prints the amount of data processed to standard error. If
+// standard error is a terminal, the count is updated in place a few times per
+// second, otherwise only the final count is printed by done.
+type progressPrinter struct {
+	n       int64
+	last    time.Time
+	printed bool
+}
+
+func (p *progressPrinter) update(n int64) {
+	p.n = n
+	if batchMode || !term.IsTerminal(int(os.Stderr.Fd())) || time.Since(p.last) < 200*time.Millisecond {
+		return
+	}
+	p.last = time.Now()
+	fmt.Fprintf(os.Stderr, "\rage: %s processed", formatSize(p.n))
+	p.printed = true
+}
+
+func (p *progressPrinter) done() {
+	if p.printed {
+		fmt.Fprintf(os.Stderr, "\r")
+	}
+	// Not printf, because the progress was explicitly requested even in batch mode.
+	l.Printf("age: %s processed", formatSize(p.n))
+}
+
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for n/div >= unit && exp < 4 {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTP"[exp])
+}
+
+// parseSize parses a size such as "512", "64K", or "10MiB". The K, M, G, and
+// T suffixes are powers of 1024, and can be followed by "B" or "iB".
+func parseSize(s string) (int64, error) {
+	num := strings.TrimRight(s, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz")
+	suffix := strings.ToUpper(s[len(num):])
+	suffix = strings.TrimSuffix(strings.TrimSuffix(suffix, "B"), "I")
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%q is not a positive size", s)
+	}
+	shift := strings.Index("KMGT", suffix) + 1
+	if suffix == "" {
+		shift = 0
+	} else if len(suffix) != 1 || shift == 0 {
+		return 0, fmt.Errorf("%q has an unknown unit", s)
+	}
+	if n > math.MaxInt64>>(10*shift) {
+		return 0, fmt.Errorf("%q is too large", s)
+	}
+	return n << (10 * shift), nil
+}
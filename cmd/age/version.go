@@ -0,0 +1,85 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"runtime"
+	"runtime/debug"
+
+	"filippo.io/age"
+)
+
+// version returns the version of age, from Version if set at link time, or
+// from the build info.
+func version() string {
+	if Version != "" {
+		return Version
+	}
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		// TODO: use buildInfo.Settings to prepare a pseudoversion such as
+		// v0.0.0-20210817164053-32db794688a5+dirty on Go 1.18+.
+		return buildInfo.Main.Version
+	}
+	return "(unknown)"
+}
+
+// versionInfo is the output of --version --json.
+type versionInfo struct {
+	Version        string          `json:"version"`
+	Commit         string          `json:"commit,omitempty"`
+	GoVersion      string          `json:"go_version"`
+	FormatVersions []string        `json:"format_versions"`
+	StanzaTypes    []string        `json:"stanza_types"`
+	PayloadCiphers []string        `json:"payload_ciphers"`
+	Integrations   map[string]bool `json:"integrations"`
+}
+
+// integrations reports which optional integrations are built into this binary.
+// Cloud KMS and FIDO2 support is provided by plugins, not built in, but it's
+// listed so that inventories can tell them apart from unknown capabilities.
+func integrations() map[string]bool {
+	return map[string]bool{
+		"plugins":           true,
+		"password-managers": true,
+		"remote-io":         true,
+		"clipboard":         true,
+		"keychain":          runtime.GOOS != "windows",
+		"cloud-kms":         false,
+		"fido2":             false,
+	}
+}
+
+func printVersionJSON() {
+	f := age.Features()
+	info := &versionInfo{
+		Version:        version(),
+		GoVersion:      runtime.Version(),
+		FormatVersions: f.Versions,
+		StanzaTypes:    f.StanzaTypes,
+		PayloadCiphers: f.PayloadCiphers,
+		Integrations:   integrations(),
+	}
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		var modified bool
+		for _, s := range buildInfo.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				info.Commit = s.Value
+			case "vcs.modified":
+				modified = s.Value == "true"
+			}
+		}
+		if modified && info.Commit != "" {
+			info.Commit += "+dirty"
+		}
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(info); err != nil {
+		errorf("failed to write version: %v", err)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"filippo.io/age/plugin"
+)
+
+const watchUsage = `Usage:
+    age watch --dir DIR --out DIR (-r RECIPIENT | -R PATH)... [--armor] [--delete] [--once]
+
+age watch encrypts the regular files that appear in the --dir directory to
+files with the same name and the .age extension in the --out directory.
+
+A file is encrypted once its size and modification time stop changing between
+two polls, which are --interval apart (default 1s). The encrypted file is
+written to a temporary file and moved into place atomically. Files for which
+an encrypted file already exists, and hidden files, are skipped.
+
+Options:
+    --delete    Delete each file after encrypting it.
+    --once      Encrypt the files currently in the directory, and exit.`
+
+// watchMain implements "age watch".
+func watchMain(args []string) {
+	flags := flag.NewFlagSet("age watch", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprintf(os.Stderr, "%s\n", watchUsage) }
+	var (
+		dirFlag, outFlag      string
+		armorFlag, deleteFlag bool
+		onceFlag              bool
+		intervalFlag          time.Duration
+		recipientFlags        multiFlag
+		recipientsFileFlags   multiFlag
+	)
+	flags.StringVar(&dirFlag, "dir", "", "watch `DIR` for new files")
+	flags.StringVar(&outFlag, "out", "", "write encrypted files to `DIR`")
+	flags.BoolVar(&armorFlag, "a", false, "generate armored files")
+	flags.BoolVar(&armorFlag, "armor", false, "generate armored files")
+	flags.BoolVar(&deleteFlag, "delete", false, "delete files after encrypting them")
+	flags.BoolVar(&onceFlag, "once", false, "encrypt the current files and exit")
+	flags.DurationVar(&intervalFlag, "interval", time.Second, "poll every `DURATION`")
+	flags.Var(&recipientFlags, "r", "recipient (can be repeated)")
+	flags.Var(&recipientFlags, "recipient", "recipient (can be repeated)")
+	flags.Var(&recipientsFileFlags, "R", "recipients file (can be repeated)")
+	flags.Var(&recipientsFileFlags, "recipients-file", "recipients file (can be repeated)")
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		errorWithHint("age watch doesn't take arguments",
+			"use --dir and --out to specify the directories")
+	}
+	if dirFlag == "" || outFlag == "" {
+		errorf("age watch requires --dir and --out")
+	}
+	if intervalFlag <= 0 {
+		errorf("--interval must be positive")
+	}
+	if len(recipientFlags)+len(recipientsFileFlags) == 0 {
+		errorWithHint("missing recipients",
+			"did you forget to specify -r/--recipient or -R/--recipients-file?")
+	}
+	recipients := plugin.GroupRecipients(parseRecipientFlags(recipientFlags, recipientsFileFlags, nil, nil))
+	if info, err := os.Stat(outFlag); err != nil || !info.IsDir() {
+		errorf("--out %q is not a directory", outFlag)
+	}
+
+	w := &watcher{dir: dirFlag, out: outFlag, recipients: recipients,
+		armor: armorFlag, delete: deleteFlag, seen: make(map[string]os.FileInfo)}
+	for {
+		w.poll(onceFlag)
+		if onceFlag {
+			return
+		}
+		time.Sleep(intervalFlag)
+	}
+}
+
+type watcher struct {
+	dir, out      string
+	recipients    []age.Recipient
+	armor, delete bool
+
+	// seen tracks the files observed by the previous poll that were not
+	// encrypted yet, to check whether they are still being written.
+	seen map[string]os.FileInfo
+}
+
+func (w *watcher) poll(all bool) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		errorf("failed to read --dir: %v", err)
+	}
+	seen := make(map[string]os.FileInfo)
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, ".") || !e.Type().IsRegular() {
+			continue
+		}
+		dst := filepath.Join(w.out, name+".age")
+		if _, err := os.Stat(dst); err == nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		prev, ok := w.seen[name]
+		if !all && (!ok || prev.Size() != info.Size() || !prev.ModTime().Equal(info.ModTime())) {
+			// The file is new or still changing, check again at the next poll.
+			seen[name] = info
+			continue
+		}
+		src := filepath.Join(w.dir, name)
+		if err := w.encryptFile(src, dst); err != nil {
+			warningf("failed to encrypt %q: %v", src, err)
+			continue
+		}
+		printf("encrypted %q to %q", src, dst)
+		if w.delete {
+			if err := os.Remove(src); err != nil {
+				warningf("failed to delete %q: %v", src, err)
+			}
+		}
+	}
+	w.seen = seen
+}
+
+// encryptFile encrypts src to a temporary file in the same directory as dst,
+// and then renames it to dst, so that dst never contains a partial file.
+func (w *watcher) encryptFile(src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	var out io.WriteCloser = tmp
+	if w.armor {
+		out = armor.NewWriter(tmp)
+	}
+	ew, err := age.Encrypt(out, w.recipients...)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(ew, in); err != nil {
+		return err
+	}
+	if err := ew.Close(); err != nil {
+		return err
+	}
+	if w.armor {
+		if err := out.Close(); err != nil {
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
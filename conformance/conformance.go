@@ -0,0 +1,271 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package conformance runs the age test vectors of the Community Cryptography
+// Test Vectors project (c2sp.org/CCTV/age) against external implementations,
+// such as rage or the age CLI, to track their compatibility. The vectors are
+// read with ReadVectors, for example from a checkout of the CCTV repository.
+//
+// Implementations are driven through a simple exec contract: for each vector,
+// the command is run with the arguments "-d -i PATH", where PATH is a file
+// containing the identities of the vector, one per line, and with the age file
+// (armored or not, as in the vector) on standard input. The command must write
+// the plaintext to standard output and exit with status zero on success, and
+// exit with a non-zero status on any failure. Writing a partial plaintext
+// before failing is allowed.
+//
+// Vectors that use a passphrase are skipped, as there is no portable way to
+// provide a passphrase to a command.
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A Vector is a test vector in the CCTV age format.
+type Vector struct {
+	Name string
+
+	// Expect is the expected outcome: "success", "HMAC failure", "header
+	// failure", "armor failure", "payload failure", or "no match".
+	Expect string
+
+	// PayloadHash is the SHA-256 hash of the plaintext, if known. For vectors
+	// that expect a payload failure, it's the hash of the partial plaintext.
+	PayloadHash *[32]byte
+
+	// FileKey is the file key, if specified by the vector. It might have an
+	// invalid length.
+	FileKey []byte
+
+	// Identities and Passphrases are the identities, in their string encoding,
+	// and the passphrases to decrypt the file with.
+	Identities  []string
+	Passphrases []string
+
+	Armored bool
+	Comment string
+
+	// File is the age file.
+	File []byte
+}
+
+// ReadVectors parses all the files in the root of fsys as test vectors, and
+// returns them sorted by name.
+func ReadVectors(fsys fs.FS) ([]*Vector, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	var vectors []*Vector
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		contents, err := fs.ReadFile(fsys, e.Name())
+		if err != nil {
+			return nil, err
+		}
+		v, err := ParseVector(e.Name(), contents)
+		if err != nil {
+			return nil, err
+		}
+		vectors = append(vectors, v)
+	}
+	sort.Slice(vectors, func(i, j int) bool { return vectors[i].Name < vectors[j].Name })
+	return vectors, nil
+}
+
+// ParseVector parses a test vector in the CCTV age format.
+func ParseVector(name string, contents []byte) (*Vector, error) {
+	v := &Vector{Name: name, File: contents}
+	for {
+		line, rest, ok := bytes.Cut(v.File, []byte("\n"))
+		if !ok {
+			return nil, fmt.Errorf("invalid vector %q: no payload", name)
+		}
+		v.File = rest
+		if len(line) == 0 {
+			break
+		}
+		key, value, _ := strings.Cut(string(line), ": ")
+		switch key {
+		case "expect":
+			switch value {
+			case "success", "HMAC failure", "header failure", "armor failure",
+				"payload failure", "no match":
+			default:
+				return nil, fmt.Errorf("invalid vector %q: unknown expect value %q", name, value)
+			}
+			v.Expect = value
+		case "payload":
+			h, err := hex.DecodeString(value)
+			if err != nil || len(h) != 32 {
+				return nil, fmt.Errorf("invalid vector %q: invalid payload hash", name)
+			}
+			v.PayloadHash = (*[32]byte)(h)
+		case "file key":
+			h, err := hex.DecodeString(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid vector %q: invalid file key", name)
+			}
+			v.FileKey = h
+		case "identity":
+			v.Identities = append(v.Identities, value)
+		case "passphrase":
+			v.Passphrases = append(v.Passphrases, value)
+		case "armored":
+			v.Armored = true
+		case "comment":
+			v.Comment = value
+		default:
+			return nil, fmt.Errorf("invalid vector %q: unknown header key %q", name, key)
+		}
+	}
+	if v.Expect == "" {
+		return nil, fmt.Errorf("invalid vector %q: missing expect", name)
+	}
+	return v, nil
+}
+
+// Status is the outcome of running a vector.
+type Status string
+
+const (
+	Pass Status = "PASS"
+	Fail Status = "FAIL"
+	Skip Status = "SKIP"
+)
+
+// A Result is the outcome of running a Vector against a Command.
+type Result struct {
+	Vector *Vector
+	Status Status
+
+	// Reason explains a Fail or Skip status.
+	Reason string
+}
+
+// A Command is an external implementation that follows the exec contract
+// described in the package documentation.
+type Command struct {
+	// Path is the path of the binary, and Args are arguments that are passed
+	// before the ones required by the contract.
+	Path string
+	Args []string
+
+	// Timeout is the maximum time for a single vector. If zero, ten seconds.
+	Timeout time.Duration
+}
+
+// Run runs v against c.
+func (c *Command) Run(v *Vector) *Result {
+	res := &Result{Vector: v}
+	if len(v.Passphrases) > 0 {
+		res.Status, res.Reason = Skip, "passphrase vectors are not supported"
+		return res
+	}
+
+	dir, err := os.MkdirTemp("", "age-conformance-")
+	if err != nil {
+		res.Status, res.Reason = Fail, err.Error()
+		return res
+	}
+	defer os.RemoveAll(dir)
+	identities := filepath.Join(dir, "identities.txt")
+	if err := os.WriteFile(identities, []byte(strings.Join(v.Identities, "\n")+"\n"), 0600); err != nil {
+		res.Status, res.Reason = Fail, err.Error()
+		return res
+	}
+
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	args := append(append([]string{}, c.Args...), "-d", "-i", identities)
+	cmd := exec.CommandContext(ctx, c.Path, args...)
+	cmd.Stdin = bytes.NewReader(v.File)
+	h := sha256.New()
+	cmd.Stdout = h
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	cmd.Dir = dir
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		res.Status, res.Reason = Fail, "timed out"
+		return res
+	}
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		res.Status, res.Reason = Fail, fmt.Sprintf("failed to run command: %v", err)
+		return res
+	}
+
+	switch {
+	case v.Expect == "success" && err != nil:
+		res.Status, res.Reason = Fail, fmt.Sprintf("expected success, got %v: %s",
+			err, firstLine(stderr.String()))
+	case v.Expect == "success" && v.PayloadHash != nil && !bytes.Equal(h.Sum(nil), v.PayloadHash[:]):
+		res.Status, res.Reason = Fail, "plaintext hash mismatch"
+	case v.Expect != "success" && err == nil:
+		res.Status, res.Reason = Fail, fmt.Sprintf("expected %s, got success", v.Expect)
+	default:
+		res.Status = Pass
+	}
+	return res
+}
+
+func firstLine(s string) string {
+	s, _, _ = strings.Cut(strings.TrimSpace(s), "\n")
+	return s
+}
+
+// RunAll runs all vectors against c, in order.
+func (c *Command) RunAll(vectors []*Vector) []*Result {
+	var results []*Result
+	for _, v := range vectors {
+		results = append(results, c.Run(v))
+	}
+	return results
+}
+
+// WriteReport writes a line for each result and a summary to w, and returns
+// the number of failed vectors.
+func WriteReport(w io.Writer, results []*Result) (failed int, err error) {
+	var passed, skipped int
+	for _, r := range results {
+		line := fmt.Sprintf("%-5s %s", r.Status, r.Vector.Name)
+		if r.Reason != "" {
+			line += ": " + r.Reason
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return 0, err
+		}
+		switch r.Status {
+		case Pass:
+			passed++
+		case Fail:
+			failed++
+		case Skip:
+			skipped++
+		}
+	}
+	_, err = fmt.Fprintf(w, "%d passed, %d failed, %d skipped\n", passed, failed, skipped)
+	return failed, err
+}
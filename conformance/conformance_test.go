@@ -0,0 +1,155 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package conformance_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"filippo.io/age/conformance"
+
+	agetest "c2sp.org/CCTV/age"
+)
+
+// TestMain turns the test binary into a fake implementation if
+// AGE_CONFORMANCE_FAKE is set, so that it can be run through the exec contract.
+func TestMain(m *testing.M) {
+	switch os.Getenv("AGE_CONFORMANCE_FAKE") {
+	case "":
+		os.Exit(m.Run())
+	case "ok":
+		// Always succeeds without output, which must fail the conformance.
+		os.Exit(0)
+	case "decrypt":
+		if len(os.Args) != 4 || os.Args[1] != "-d" || os.Args[2] != "-i" {
+			os.Exit(2)
+		}
+		f, err := os.Open(os.Args[3])
+		if err != nil {
+			os.Exit(2)
+		}
+		identities, err := age.ParseIdentities(f)
+		if err != nil {
+			os.Exit(1)
+		}
+		// Detect armor after any leading whitespace, which is allowed.
+		stdin, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			os.Exit(1)
+		}
+		var in io.Reader = bytes.NewReader(stdin)
+		if bytes.HasPrefix(bytes.TrimLeft(stdin, " \t\r\n"), []byte(armor.Header)) {
+			in = armor.NewReader(in)
+		}
+		r, err := age.Decrypt(in, identities...)
+		if err != nil {
+			os.Exit(1)
+		}
+		if _, err := io.Copy(os.Stdout, r); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+}
+
+func TestVectors(t *testing.T) {
+	vectors, err := conformance.ReadVectors(agetest.Vectors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vectors) == 0 {
+		t.Fatal("no vectors")
+	}
+	for _, v := range vectors {
+		if v.Expect == "success" && v.PayloadHash == nil {
+			t.Errorf("%s: success vector without payload hash", v.Name)
+		}
+	}
+}
+
+func TestParseVector(t *testing.T) {
+	v, err := conformance.ParseVector("test", []byte("expect: no match\n"+
+		"identity: AGE-SECRET-KEY-1XXX\nidentity: AGE-SECRET-KEY-1YYY\narmored: yes\n\nFILE"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Expect != "no match" || len(v.Identities) != 2 || !v.Armored || string(v.File) != "FILE" {
+		t.Errorf("unexpected vector: %+v", v)
+	}
+	for _, bad := range []string{
+		"expect: success\n",
+		"identity: AGE-SECRET-KEY-1XXX\n\nFILE",
+		"expect: maybe\n\nFILE",
+		"expect: success\nfoo: bar\n\nFILE",
+		"expect: success\npayload: 00\n\nFILE",
+	} {
+		if _, err := conformance.ParseVector("test", []byte(bad)); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func testRun(t *testing.T, fake string) (results []*conformance.Result, failed int, report string) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows support is TODO")
+	}
+	t.Setenv("AGE_CONFORMANCE_FAKE", fake)
+	vectors, err := conformance.ReadVectors(agetest.Vectors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &conformance.Command{Path: exe}
+	results = c.RunAll(vectors)
+	buf := &bytes.Buffer{}
+	failed, err = conformance.WriteReport(buf, results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return results, failed, buf.String()
+}
+
+func TestCommand(t *testing.T) {
+	results, failed, report := testRun(t, "decrypt")
+	if failed != 0 {
+		t.Errorf("%d vectors failed:\n%s", failed, report)
+	}
+	var passed int
+	for _, r := range results {
+		switch {
+		case r.Status == conformance.Pass:
+			passed++
+		case r.Status == conformance.Skip && len(r.Vector.Passphrases) == 0:
+			t.Errorf("%s: unexpectedly skipped", r.Vector.Name)
+		}
+	}
+	if passed == 0 {
+		t.Error("no vectors passed")
+	}
+}
+
+func TestCommandFailures(t *testing.T) {
+	results, failed, report := testRun(t, "ok")
+	if failed == 0 {
+		t.Fatalf("no vectors failed:\n%s", report)
+	}
+	for _, r := range results {
+		if r.Status == conformance.Pass && r.Vector.Expect != "success" {
+			t.Errorf("%s: expected failure, got pass", r.Vector.Name)
+		}
+	}
+	if !strings.Contains(report, "FAIL  ") || !strings.Contains(report, " failed, ") {
+		t.Errorf("unexpected report:\n%s", report)
+	}
+}
@@ -0,0 +1,303 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"filippo.io/age/armor"
+	"filippo.io/age/internal/format"
+	"filippo.io/age/stream"
+	"golang.org/x/crypto/poly1305"
+)
+
+// Diagnosis is the result of Diagnose.
+type Diagnosis struct {
+	// Armored is true if the file was ASCII armored. Offsets are relative to
+	// the decoded binary file.
+	Armored bool
+	// Version is the version line of the file, if it was recognized.
+	Version string
+	// Stanzas are the types of the intact stanzas in the header.
+	Stanzas []string
+	// HeaderComplete is true if the header closing line was found and valid.
+	HeaderComplete bool
+	// FileKeyFound is true if one of the identities unwrapped the file key.
+	FileKeyFound bool
+	// MACValid is true if the header MAC was checked and found valid.
+	MACValid bool
+	// Chunks is the number of payload chunks found. If the file key was
+	// found, it's the number of chunks that were successfully authenticated.
+	Chunks int
+	// Problems is a list of human-readable descriptions of the issues found.
+	Problems []string
+}
+
+func (d *Diagnosis) problemf(format string, a ...interface{}) {
+	d.Problems = append(d.Problems, fmt.Sprintf(format, a...))
+}
+
+// String returns a multi-line human-readable report.
+func (d *Diagnosis) String() string {
+	b := &strings.Builder{}
+	if d.Armored {
+		fmt.Fprintf(b, "encoding: armored\n")
+	} else {
+		fmt.Fprintf(b, "encoding: binary\n")
+	}
+	if d.Version != "" {
+		fmt.Fprintf(b, "version line: %s\n", d.Version)
+	} else {
+		fmt.Fprintf(b, "version line: not recognized\n")
+	}
+	fmt.Fprintf(b, "intact stanzas: %d", len(d.Stanzas))
+	if len(d.Stanzas) > 0 {
+		fmt.Fprintf(b, " (%s)", strings.Join(d.Stanzas, ", "))
+	}
+	fmt.Fprintf(b, "\n")
+	switch {
+	case !d.HeaderComplete:
+		fmt.Fprintf(b, "header: incomplete\n")
+	case d.MACValid:
+		fmt.Fprintf(b, "header: complete, MAC valid\n")
+	case d.FileKeyFound:
+		fmt.Fprintf(b, "header: complete, MAC invalid\n")
+	default:
+		fmt.Fprintf(b, "header: complete, MAC not checked\n")
+	}
+	if d.MACValid {
+		fmt.Fprintf(b, "payload: %d authenticated chunks\n", d.Chunks)
+	} else {
+		fmt.Fprintf(b, "payload: %d chunks\n", d.Chunks)
+	}
+	if len(d.Problems) == 0 {
+		fmt.Fprintf(b, "no problems found\n")
+	} else {
+		fmt.Fprintf(b, "problems:\n")
+		for _, p := range d.Problems {
+			fmt.Fprintf(b, "  - %s\n", p)
+		}
+	}
+	return b.String()
+}
+
+// maxDiagnoseHeaderSize is the maximum size of a header Diagnose will read
+// before giving up on finding the closing line.
+const maxDiagnoseHeaderSize = 1 << 20
+
+// Diagnose parses as much as possible of a possibly damaged age file read from
+// src, and reports what it found, to help triage recovery. Unlike Decrypt, it
+// doesn't stop at the first error.
+//
+// If identities are provided, Diagnose also tries to unwrap the file key, and
+// uses it to check the header MAC and to authenticate the payload chunks. No
+// plaintext is returned.
+func Diagnose(src io.Reader, identities ...Identity) *Diagnosis {
+	d := &Diagnosis{}
+
+	rr := bufio.NewReader(src)
+	if start, _ := rr.Peek(len(armor.Header)); string(start) == armor.Header {
+		d.Armored = true
+		rr = bufio.NewReader(armor.NewReader(rr))
+	}
+
+	hdr, offset, ok := diagnoseHeader(d, rr)
+	if !ok {
+		return d
+	}
+
+	var fileKey []byte
+	if len(identities) > 0 && hdr != nil {
+		k, _, err := decryptHdr(hdr, nil, identities...)
+		var errNoMatch *NoIdentityMatchError
+		var errMAC *HeaderMACError
+		switch {
+		case errors.As(err, &errNoMatch):
+			d.problemf("none of the identities matched any of the stanzas")
+		case errors.As(err, &errMAC):
+			d.FileKeyFound = true
+			d.problemf("header MAC mismatch (closing line at offset %d)", offset.mac)
+		case err != nil:
+			d.problemf("failed to unwrap the file key: %v", err)
+		default:
+			d.FileKeyFound = true
+			d.MACValid = true
+			fileKey = k
+		}
+	}
+
+	// If the header is damaged, assume the default chunk size.
+	chunkSize := stream.ChunkSize
+	if hdr != nil {
+		if n, err := payloadChunkSize(hdr); err != nil {
+			d.problemf("%v", err)
+		} else {
+			chunkSize = n
+		}
+	}
+
+	diagnosePayload(d, rr, offset.payload, fileKey, chunkSize)
+	return d
+}
+
+type headerOffsets struct {
+	mac, payload int64
+}
+
+// diagnoseHeader reads the header from rr, recording what it finds in d. It
+// returns the parsed header if it was entirely intact, and whether the payload
+// start was found.
+func diagnoseHeader(d *Diagnosis, rr *bufio.Reader) (*format.Header, headerOffsets, bool) {
+	var off headerOffsets
+	var offset int64
+	readLine := func() (string, error) {
+		line, err := rr.ReadString('\n')
+		offset += int64(len(line))
+		if err == io.EOF && line != "" {
+			err = io.ErrUnexpectedEOF
+		}
+		return line, err
+	}
+
+	line, err := readLine()
+	if err != nil {
+		d.problemf("file ends before the end of the version line")
+		return nil, off, false
+	}
+	for _, v := range format.Versions() {
+		if line == v+"\n" {
+			d.Version = v
+		}
+	}
+	intact := d.Version != ""
+	switch {
+	case intact:
+	case strings.HasPrefix(line, "age-encryption.org/v1\r"):
+		d.problemf("version line ends with CRLF, the file was likely mangled by a text conversion")
+	case strings.HasPrefix(line, "\xff\xfe"):
+		d.problemf("file is UTF-16 encoded, it was likely mangled by PowerShell redirection")
+	default:
+		d.problemf("unrecognized version line %q", strings.TrimSuffix(line, "\n"))
+	}
+
+	hdr := &format.Header{}
+	var stanza []byte
+	var stanzaOffset int64
+	var n int
+	endStanza := func() {
+		if stanza == nil {
+			return
+		}
+		n++
+		sr := format.NewStanzaReader(bufio.NewReader(bytes.NewReader(stanza)))
+		s, err := sr.ReadStanza()
+		if err != nil {
+			intact = false
+			d.problemf("stanza #%d at offset %d is malformed: %v", n, stanzaOffset, err)
+		} else {
+			d.Stanzas = append(d.Stanzas, s.Type)
+			hdr.Recipients = append(hdr.Recipients, s)
+		}
+		stanza = nil
+	}
+
+	for {
+		if offset > maxDiagnoseHeaderSize {
+			d.problemf("no header closing line found in the first %d bytes", maxDiagnoseHeaderSize)
+			return nil, off, false
+		}
+		lineOffset := offset
+		line, err := readLine()
+		if err != nil {
+			endStanza()
+			d.problemf("header is truncated at offset %d", lineOffset)
+			return nil, off, false
+		}
+		switch {
+		case strings.HasPrefix(line, "---"):
+			endStanza()
+			off.mac = lineOffset
+			mac, err := format.DecodeString(strings.TrimSuffix(strings.TrimPrefix(line, "--- "), "\n"))
+			if !strings.HasPrefix(line, "--- ") || err != nil || len(mac) != 32 {
+				d.problemf("closing line at offset %d is malformed", lineOffset)
+				intact = false
+			} else {
+				d.HeaderComplete = true
+				hdr.MAC = mac
+			}
+			off.payload = offset
+			if !intact {
+				return nil, off, true
+			}
+			return hdr, off, true
+		case strings.HasPrefix(line, "->"):
+			endStanza()
+			stanza = []byte(line)
+			stanzaOffset = lineOffset
+		case stanza != nil:
+			stanza = append(stanza, line...)
+			if len(strings.TrimSuffix(line, "\n")) < format.ColumnsPerLine {
+				endStanza()
+			}
+		default:
+			intact = false
+			d.problemf("unexpected line outside of any stanza at offset %d", lineOffset)
+		}
+	}
+}
+
+func diagnosePayload(d *Diagnosis, rr *bufio.Reader, offset int64, fileKey []byte, chunkSize int) {
+	encChunkSize := int64(chunkSize + poly1305.TagSize)
+
+	nonce := make([]byte, streamNonceSize)
+	if _, err := io.ReadFull(rr, nonce); err != nil {
+		d.problemf("payload is truncated at offset %d, before the end of the nonce", offset)
+		return
+	}
+	offset += streamNonceSize
+
+	if fileKey == nil {
+		n, err := io.Copy(io.Discard, rr)
+		if err != nil {
+			d.problemf("failed to read payload: %v", err)
+		}
+		d.Chunks = int((n + encChunkSize - 1) / encChunkSize)
+		if err := checkPayloadSize(n+streamNonceSize, chunkSize); err != nil {
+			d.problemf("%v (%d bytes after offset %d)", err, n, offset)
+		}
+		return
+	}
+
+	r, err := stream.NewReaderSize(streamKey(fileKey, nonce), rr, chunkSize)
+	if err != nil {
+		d.problemf("internal error: %v", err)
+		return
+	}
+	buf := make([]byte, chunkSize)
+	var n int64
+	for {
+		nn, err := r.Read(buf)
+		n += int64(nn)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			chunk := int(n / int64(chunkSize))
+			d.problemf("payload chunk #%d at offset %d: %v",
+				chunk+1, offset+int64(chunk)*encChunkSize, err)
+			d.Chunks = chunk
+			return
+		}
+	}
+	d.Chunks = int((n + int64(chunkSize) - 1) / int64(chunkSize))
+	if d.Chunks == 0 {
+		d.Chunks = 1
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"crypto/rand"
+	"errors"
+	"strconv"
+
+	"filippo.io/age/internal/format"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const dualFactorLabel = "age-encryption.org/v1/dualfactor"
+
+// DualFactorRecipient is a recipient that requires both an X25519 key and a
+// passphrase to decrypt the file.
+//
+// The file key is first wrapped to an X25519Recipient, and then the resulting
+// wrapped key is encrypted again with a key derived from the passphrase with
+// scrypt. The two are nested, not alternatives: a DualFactorIdentity needs both
+// the X25519 private key and the passphrase to recover the file key.
+//
+// The stanza has type "dualfactor", and arguments the X25519 ephemeral share,
+// the scrypt salt, and the scrypt work factor.
+//
+// Unlike ScryptRecipient, a DualFactorRecipient can be mixed with other
+// recipients, as the file is not authenticated by the passphrase alone.
+type DualFactorRecipient struct {
+	x *X25519Recipient
+	s *ScryptRecipient
+}
+
+var _ Recipient = &DualFactorRecipient{}
+
+// NewDualFactorRecipient returns a new DualFactorRecipient which wraps the
+// file key to r and then to password.
+func NewDualFactorRecipient(r *X25519Recipient, password string) (*DualFactorRecipient, error) {
+	s, err := NewScryptRecipient(password)
+	if err != nil {
+		return nil, err
+	}
+	return &DualFactorRecipient{x: r, s: s}, nil
+}
+
+// SetWorkFactor sets the scrypt work factor to 2^logN.
+// It must be called before Wrap.
+//
+// If SetWorkFactor is not called, a reasonable default is used.
+func (r *DualFactorRecipient) SetWorkFactor(logN int) {
+	r.s.SetWorkFactor(logN)
+}
+
+func (r *DualFactorRecipient) Wrap(fileKey []byte) ([]*Stanza, error) {
+	inner, err := r.x.Wrap(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(inner) != 1 || len(inner[0].Args) != 1 { // unreachable
+		return nil, errors.New("internal error: unexpected X25519 stanza")
+	}
+
+	salt, err := newPassphraseSalt(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	logN := r.s.workFactor
+	k, err := scryptKDF{}.deriveKey(dualFactorLabel, r.s.password, salt, logN)
+	if err != nil {
+		return nil, err
+	}
+	wrappedKey, err := aeadEncrypt(k, inner[0].Body)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Stanza{
+		Type: "dualfactor",
+		Args: []string{inner[0].Args[0], format.EncodeToString(salt), strconv.Itoa(logN)},
+		Body: wrappedKey,
+	}
+	return []*Stanza{l}, nil
+}
+
+// DualFactorIdentity is the identity corresponding to a DualFactorRecipient,
+// made of an X25519Identity and a passphrase.
+type DualFactorIdentity struct {
+	x *X25519Identity
+	s *ScryptIdentity
+}
+
+var _ Identity = &DualFactorIdentity{}
+
+// NewDualFactorIdentity returns a new DualFactorIdentity which requires both i
+// and password to unwrap the file key.
+func NewDualFactorIdentity(i *X25519Identity, password string) (*DualFactorIdentity, error) {
+	s, err := NewScryptIdentity(password)
+	if err != nil {
+		return nil, err
+	}
+	return &DualFactorIdentity{x: i, s: s}, nil
+}
+
+// SetMaxWorkFactor sets the maximum accepted scrypt work factor to 2^logN.
+// It must be called before Unwrap.
+//
+// If SetMaxWorkFactor is not called, the ScryptIdentity default is used.
+func (i *DualFactorIdentity) SetMaxWorkFactor(logN int) {
+	i.s.SetMaxWorkFactor(logN)
+}
+
+func (i *DualFactorIdentity) Unwrap(stanzas []*Stanza) ([]byte, error) {
+	return multiUnwrap(i.unwrap, stanzas)
+}
+
+func (i *DualFactorIdentity) unwrap(block *Stanza) ([]byte, error) {
+	if block.Type != "dualfactor" {
+		return nil, ErrIncorrectIdentity
+	}
+	if len(block.Args) != 3 {
+		return nil, errors.New("invalid dualfactor recipient block")
+	}
+	k, err := i.s.policy.deriveKey(scryptKDF{}, dualFactorLabel, i.s.password, block.Args[1], block.Args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	// The inner body is the X25519 wrapped file key, which is the file key
+	// plus the ChaCha20Poly1305 tag.
+	innerBody, err := aeadDecrypt(k, fileKeySize+chacha20poly1305.Overhead, block.Body)
+	if err == errIncorrectCiphertextSize {
+		return nil, errors.New("invalid dualfactor recipient block: incorrect file key size")
+	} else if err != nil {
+		return nil, ErrIncorrectIdentity
+	}
+
+	return i.x.unwrap(&Stanza{
+		Type: "X25519",
+		Args: []string{block.Args[0]},
+		Body: innerBody,
+	})
+}
@@ -0,0 +1,40 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.20
+
+package age
+
+import (
+	"crypto/ecdh"
+	"errors"
+)
+
+// X25519RecipientFromECDH returns an X25519Recipient for pk, which must be a
+// [crypto/ecdh.X25519] public key.
+func X25519RecipientFromECDH(pk *ecdh.PublicKey) (*X25519Recipient, error) {
+	if pk.Curve() != ecdh.X25519() {
+		return nil, errors.New("ECDH public key is not on the X25519 curve")
+	}
+	return newX25519RecipientFromPoint(pk.Bytes())
+}
+
+// ECDH returns r as a [crypto/ecdh.X25519] public key.
+func (r *X25519Recipient) ECDH() (*ecdh.PublicKey, error) {
+	return ecdh.X25519().NewPublicKey(r.theirPublicKey)
+}
+
+// X25519IdentityFromECDH returns an X25519Identity for k, which must be a
+// [crypto/ecdh.X25519] private key.
+func X25519IdentityFromECDH(k *ecdh.PrivateKey) (*X25519Identity, error) {
+	if k.Curve() != ecdh.X25519() {
+		return nil, errors.New("ECDH private key is not on the X25519 curve")
+	}
+	return newX25519IdentityFromScalar(k.Bytes())
+}
+
+// ECDH returns i as a [crypto/ecdh.X25519] private key.
+func (i *X25519Identity) ECDH() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().NewPrivateKey(i.secretKey)
+}
@@ -0,0 +1,59 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.20
+
+package age_test
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func TestECDH(t *testing.T) {
+	k, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := age.X25519IdentityFromECDH(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := age.X25519RecipientFromECDH(k.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !i.Recipient().Equal(r) {
+		t.Error("identity and recipient don't match")
+	}
+
+	k1, err := i.ECDH()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !k1.Equal(k) {
+		t.Error("ECDH private key round-trip failed")
+	}
+	pk, err := r.ECDH()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pk.Equal(k.PublicKey()) {
+		t.Error("ECDH public key round-trip failed")
+	}
+
+	p256, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.X25519IdentityFromECDH(p256); err == nil {
+		t.Error("expected P-256 private key to fail")
+	}
+	if _, err := age.X25519RecipientFromECDH(p256.PublicKey()); err == nil {
+		t.Error("expected P-256 public key to fail")
+	}
+}
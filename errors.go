@@ -0,0 +1,213 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"filippo.io/age/internal/format"
+	"filippo.io/age/stream"
+)
+
+// ErrPayloadTooLarge is returned by DecryptWithOptions, or by the Reader it
+// returns, if the plaintext is larger than Options.MaxPayloadSize.
+var ErrPayloadTooLarge = errors.New("payload is larger than the maximum size")
+
+// ErrNotSigned is returned by VerifySigner if the file has no signature.
+var ErrNotSigned = errors.New("file is not signed")
+
+// ErrBadSignature is returned by DecryptWithOptions and VerifySigner if the
+// header signature is invalid.
+var ErrBadSignature = errors.New("invalid header signature")
+
+// ErrWrongSigner is returned by VerifySigner if the file was signed by a key
+// other than the expected one.
+var ErrWrongSigner = errors.New("file was signed by a different key")
+
+// A HeaderMACError is returned by Decrypt when an identity unwrapped a file
+// key, but the header MAC doesn't match it. The header was modified after
+// encryption, or the identity returned an incorrect file key.
+type HeaderMACError struct {
+	// Identity is the identity that unwrapped the file key, and IdentityIndex
+	// is its zero-based position in the arguments to Decrypt.
+	Identity      Identity
+	IdentityIndex int
+}
+
+func (e *HeaderMACError) Error() string {
+	return "bad header MAC"
+}
+
+// A PayloadTruncatedError is returned by the Reader returned by Decrypt when
+// the payload ends at a chunk boundary before the last chunk. It wraps
+// io.ErrUnexpectedEOF.
+//
+// A payload truncated in the middle of a chunk can't be told apart from a
+// corrupted one, and is reported as a PayloadCorruptError.
+type PayloadTruncatedError struct {
+	// Chunk is the zero-based index of the first missing chunk.
+	Chunk int64
+}
+
+func (e *PayloadTruncatedError) Error() string {
+	return "payload is truncated"
+}
+
+func (e *PayloadTruncatedError) Unwrap() error {
+	return io.ErrUnexpectedEOF
+}
+
+// A PayloadCorruptError is returned by the Reader returned by Decrypt when a
+// payload chunk fails to authenticate. The plaintext returned before the error
+// is authentic, but it's not the whole file.
+type PayloadCorruptError struct {
+	// Chunk is the zero-based index of the chunk that failed to authenticate.
+	Chunk int64
+	// Err is the underlying error, such as stream.ErrInvalidChunk.
+	Err error
+}
+
+func (e *PayloadCorruptError) Error() string {
+	return fmt.Sprintf("payload chunk #%d: %v", e.Chunk, e.Err)
+}
+
+func (e *PayloadCorruptError) Unwrap() error {
+	return e.Err
+}
+
+// payloadError returns err as a PayloadTruncatedError or PayloadCorruptError,
+// if it's one of the errors returned by stream.Reader for an invalid payload,
+// after n bytes of plaintext with chunks of chunkSize bytes.
+func payloadError(err error, n int64, chunkSize int) error {
+	chunk := n / int64(chunkSize)
+	switch {
+	case err == io.ErrUnexpectedEOF:
+		return &PayloadTruncatedError{Chunk: chunk}
+	case err == stream.ErrInvalidChunk, err == stream.ErrEmptyLastChunk, err == stream.ErrTrailingData:
+		return &PayloadCorruptError{Chunk: chunk, Err: err}
+	default:
+		return err
+	}
+}
+
+// A StanzaError is returned by Decrypt when a stanza in the header is
+// malformed, and wrapped in an IdentityError when an identity fails to unwrap
+// a specific stanza with an error other than ErrIncorrectIdentity.
+type StanzaError struct {
+	// Index is the zero-based position of the stanza in the header.
+	Index int
+	// Type is the stanza type, or empty if it couldn't be parsed.
+	Type string
+	Err  error
+}
+
+func (e *StanzaError) Error() string {
+	if e.Type == "" {
+		return fmt.Sprintf("stanza #%d: %v", e.Index, e.Err)
+	}
+	return fmt.Sprintf("stanza #%d (%s): %v", e.Index, e.Type, e.Err)
+}
+
+func (e *StanzaError) Unwrap() error {
+	return e.Err
+}
+
+// An IdentityError is returned by Decrypt when the Unwrap method of one of the
+// identities fails with an error other than ErrIncorrectIdentity.
+type IdentityError struct {
+	// Index is the zero-based position of the identity in the arguments to
+	// Decrypt.
+	Index    int
+	Identity Identity
+	Err      error
+}
+
+func (e *IdentityError) Error() string {
+	return fmt.Sprintf("identity #%d (%T): %v", e.Index, e.Identity, e.Err)
+}
+
+func (e *IdentityError) Unwrap() error {
+	return e.Err
+}
+
+// A RecipientError is returned by Encrypt when the Wrap method of one of the
+// recipients fails.
+type RecipientError struct {
+	// Index is the zero-based position of the recipient in the arguments to
+	// Encrypt.
+	Index     int
+	Recipient Recipient
+	Err       error
+}
+
+func (e *RecipientError) Error() string {
+	return fmt.Sprintf("failed to wrap key for recipient #%d (%T): %v", e.Index, e.Recipient, e.Err)
+}
+
+func (e *RecipientError) Unwrap() error {
+	return e.Err
+}
+
+// A PolicyError is returned by DecryptWithOptions when Options.Policy rejects
+// the header of a file.
+type PolicyError struct {
+	Err error
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("rejected by policy: %v", e.Err)
+}
+
+func (e *PolicyError) Unwrap() error {
+	return e.Err
+}
+
+// A PINError is returned, possibly wrapped, by identities backed by hardware
+// tokens, including plugins, when the PIN is incorrect or blocked. UIs can use
+// it to warn the user before the token locks itself.
+type PINError struct {
+	// Remaining is the number of attempts left before the PIN is blocked, or
+	// -1 if it's not known.
+	Remaining int
+	// Blocked is true if no attempts are left, and the PIN must be reset,
+	// usually with a PUK or admin PIN, before the token can be used again.
+	Blocked bool
+	// Err is the underlying error, if any.
+	Err error
+}
+
+func (e *PINError) Error() string {
+	var msg string
+	switch {
+	case e.Blocked:
+		msg = "PIN is blocked"
+	case e.Remaining == 1:
+		msg = "incorrect PIN, 1 attempt remaining"
+	case e.Remaining >= 0:
+		msg = fmt.Sprintf("incorrect PIN, %d attempts remaining", e.Remaining)
+	default:
+		msg = "incorrect PIN"
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *PINError) Unwrap() error {
+	return e.Err
+}
+
+// headerError returns err with any format.StanzaError replaced by a
+// StanzaError, for errors returned by format.Parse.
+func headerError(err error) error {
+	var se *format.StanzaError
+	if errors.As(err, &se) {
+		return &StanzaError{Index: se.Index, Type: se.Type, Err: se.Err}
+	}
+	return err
+}
@@ -0,0 +1,66 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import "errors"
+
+// ErrUnavailable can be wrapped by the errors returned by Recipient.Wrap and
+// Identity.Unwrap to signal that the recipient or identity can't be used in
+// the current environment, for example because a plugin is not installed or a
+// hardware token is not connected, as opposed to being invalid or failing.
+//
+// FallbackRecipient and FallbackIdentity fall back only on these errors.
+var ErrUnavailable = errors.New("recipient or identity unavailable")
+
+// FallbackRecipient returns a Recipient that wraps the file key to primary, or
+// to secondary if primary fails with an error wrapping ErrUnavailable.
+//
+// For example, it can be used to encrypt to a hardware token plugin when it's
+// connected, and to a backup key otherwise. Note that in the latter case the
+// file can be decrypted only by the backup identity. To always encrypt to both,
+// pass them both to Encrypt instead.
+func FallbackRecipient(primary, secondary Recipient) Recipient {
+	return &fallbackRecipient{primary, secondary}
+}
+
+type fallbackRecipient struct {
+	primary, secondary Recipient
+}
+
+var _ RecipientWithLabels = &fallbackRecipient{}
+
+func (r *fallbackRecipient) Wrap(fileKey []byte) ([]*Stanza, error) {
+	s, _, err := r.WrapWithLabels(fileKey)
+	return s, err
+}
+
+func (r *fallbackRecipient) WrapWithLabels(fileKey []byte) ([]*Stanza, []string, error) {
+	s, l, err := wrapWithLabels(r.primary, fileKey, nil)
+	if errors.Is(err, ErrUnavailable) {
+		return wrapWithLabels(r.secondary, fileKey, nil)
+	}
+	return s, l, err
+}
+
+// FallbackIdentity returns an Identity that unwraps the file key with primary,
+// or with secondary if primary fails with an error wrapping ErrUnavailable.
+//
+// Unlike passing both identities to Decrypt, secondary is not tried if primary
+// is available but fails, or doesn't match the file.
+func FallbackIdentity(primary, secondary Identity) Identity {
+	return &fallbackIdentity{primary, secondary}
+}
+
+type fallbackIdentity struct {
+	primary, secondary Identity
+}
+
+func (i *fallbackIdentity) Unwrap(stanzas []*Stanza) ([]byte, error) {
+	fileKey, err := i.primary.Unwrap(stanzas)
+	if errors.Is(err, ErrUnavailable) {
+		return i.secondary.Unwrap(stanzas)
+	}
+	return fileKey, err
+}
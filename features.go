@@ -0,0 +1,62 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"sort"
+
+	"filippo.io/age/internal/format"
+)
+
+// FeatureSet describes the format features supported by this build of the
+// package, which can depend on the Go version and build tags. It's returned
+// by Features.
+type FeatureSet struct {
+	// Versions are the header version lines that can be decrypted, in order
+	// of preference, like SupportedVersions.
+	Versions []string
+	// StanzaTypes are the stanza types implemented by this module, including
+	// the filippo.io/age/agessh package, sorted. Plugins can implement more.
+	StanzaTypes []string
+	// Labels are the fixed labels that recipients in this module can return
+	// from WrapWithLabels, sorted. ScryptRecipient also returns a random label.
+	Labels []string
+	// PayloadCiphers are the payload encryption schemes, in the format of the
+	// header version that uses them.
+	PayloadCiphers []string
+}
+
+// knownStanzaTypes are the stanza types implemented by this module. Files with
+// build constraints register their own in an init function.
+var knownStanzaTypes = map[string]bool{
+	"X25519": true, "X25519-compact": true, "scrypt": true, "X448": true,
+	"hpke": true, "dualfactor": true, "threshold": true,
+	"ssh-ed25519": true, "ssh-rsa": true, "nacl-box": true, "nacl-secretbox": true,
+	metadataStanzaType: true, signatureStanzaType: true, chunkSizeStanzaType: true,
+}
+
+// knownLabels are the fixed labels returned by recipients in this module.
+var knownLabels = map[string]bool{}
+
+// Features returns the format features supported by this build of the package,
+// so that applications can check compatibility before sharing files with other
+// systems that might run different builds.
+func Features() *FeatureSet {
+	return &FeatureSet{
+		Versions:       format.Versions(),
+		StanzaTypes:    sortedKeys(knownStanzaTypes),
+		Labels:         sortedKeys(knownLabels),
+		PayloadCiphers: []string{"ChaCha20-Poly1305 STREAM with 64 KiB chunks, or up to 16 MiB with a chunk-size stanza"},
+	}
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,253 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"filippo.io/age/internal/format"
+	"filippo.io/age/stream"
+)
+
+// OpenFS returns a file system that serves decrypted views of the age files
+// in fsys. Opening "name" opens "name.age" in fsys and decrypts it with the
+// first matching identity. Directories are passed through, and list their age
+// files without the ".age" suffix. Other files in fsys are not visible, so that
+// plaintext files are never mistaken for decrypted ones.
+//
+// If the files of fsys implement io.ReaderAt, like those of embed.FS and
+// os.DirFS, the returned files implement io.ReaderAt and io.Seeker, and only
+// decrypt the chunks that are read. Otherwise, they can only be read
+// sequentially. Armored files are not supported.
+//
+// The header of a file is decrypted when it is opened, and the Info method of
+// the entries returned by ReadDir parses it to compute the plaintext size.
+func OpenFS(fsys fs.FS, identities ...Identity) fs.FS {
+	return &decryptFS{fsys: fsys, identities: identities}
+}
+
+const ageFileSuffix = ".age"
+
+type decryptFS struct {
+	fsys       fs.FS
+	identities []Identity
+}
+
+func (d *decryptFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if f, err := d.fsys.Open(name); err == nil {
+		st, err := f.Stat()
+		if err == nil && st.IsDir() {
+			return &decryptedDir{File: f, fsys: d, name: name}, nil
+		}
+		f.Close()
+	}
+	if name == "." {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	f, err := d.fsys.Open(name + ageFileSuffix)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = fs.ErrNotExist
+		}
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	file, err := d.decrypt(f, name)
+	if err != nil {
+		f.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return file, nil
+}
+
+func (d *decryptFS) decrypt(f fs.File, name string) (fs.File, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !st.Mode().IsRegular() {
+		return nil, fs.ErrNotExist
+	}
+	info := &decryptedFileInfo{FileInfo: st, name: path.Base(name)}
+
+	ra, ok := f.(io.ReaderAt)
+	if !ok {
+		r, res, err := DecryptWithOptions(f, &Options{SourceSize: st.Size()}, d.identities...)
+		if err != nil {
+			return nil, err
+		}
+		info.size = res.PayloadSize
+		return &decryptedStream{f: f, r: r, info: info}, nil
+	}
+
+	size := st.Size()
+	hdr, payload, err := format.Parse(io.NewSectionReader(ra, 0, size))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", headerError(err))
+	}
+	if len(d.identities) == 0 {
+		return nil, errors.New("no identities specified")
+	}
+	fileKey, _, err := decryptHdr(hdr, nil, d.identities...)
+	if err != nil {
+		return nil, err
+	}
+	chunkSize, err := payloadChunkSize(hdr)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, streamNonceSize)
+	if _, err := io.ReadFull(payload, nonce); err != nil {
+		return nil, fmt.Errorf("failed to read nonce: %w", err)
+	}
+
+	// The header encoding is not malleable, so we can recompute its length.
+	hdrBuf := &bytes.Buffer{}
+	if err := hdr.Marshal(hdrBuf); err != nil {
+		return nil, fmt.Errorf("internal error: %v", err)
+	}
+	offset := int64(hdrBuf.Len() + streamNonceSize)
+
+	sr, err := stream.NewReaderAtSize(streamKey(fileKey, nonce),
+		io.NewSectionReader(ra, offset, size-offset), size-offset, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	info.size = sr.Size()
+	return &decryptedFile{f: f, SectionReader: io.NewSectionReader(sr, 0, sr.Size()), info: info}, nil
+}
+
+// stat returns the FileInfo of the decrypted file name, parsing the header
+// of the age file to compute its size without unwrapping the file key.
+func (d *decryptFS) stat(name string) (fs.FileInfo, error) {
+	f, err := d.fsys.Open(name + ageFileSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	hdr, _, err := format.Parse(f)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name,
+			Err: fmt.Errorf("failed to read header: %w", headerError(err))}
+	}
+	chunkSize, err := payloadChunkSize(hdr)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return &decryptedFileInfo{FileInfo: st, name: path.Base(name), size: payloadSize(st.Size(), hdr, chunkSize)}, nil
+}
+
+// decryptedFile is a file opened by decryptFS with random access.
+type decryptedFile struct {
+	*io.SectionReader
+	f    fs.File
+	info fs.FileInfo
+}
+
+func (f *decryptedFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *decryptedFile) Close() error               { return f.f.Close() }
+
+// decryptedStream is a file opened by decryptFS that can only be read
+// sequentially, because the underlying file doesn't implement io.ReaderAt.
+type decryptedStream struct {
+	f    fs.File
+	r    io.Reader
+	info fs.FileInfo
+}
+
+func (f *decryptedStream) Read(p []byte) (int, error) { return f.r.Read(p) }
+func (f *decryptedStream) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *decryptedStream) Close() error               { return f.f.Close() }
+
+type decryptedFileInfo struct {
+	fs.FileInfo
+	name string
+	size int64
+}
+
+func (fi *decryptedFileInfo) Name() string { return fi.name }
+func (fi *decryptedFileInfo) Size() int64  { return fi.size }
+
+// decryptedDir is a directory opened by decryptFS.
+type decryptedDir struct {
+	fs.File
+	fsys    *decryptFS
+	name    string
+	entries []fs.DirEntry // remaining entries, once read is true
+	read    bool
+}
+
+func (d *decryptedDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		entries, err := fs.ReadDir(d.fsys.fsys, d.name)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: d.name, Err: err}
+		}
+		dirs := make(map[string]bool)
+		for _, e := range entries {
+			if e.IsDir() {
+				dirs[e.Name()] = true
+			}
+		}
+		for _, e := range entries {
+			switch {
+			case e.IsDir():
+				d.entries = append(d.entries, e)
+			case e.Type().IsRegular() && strings.HasSuffix(e.Name(), ageFileSuffix) &&
+				len(e.Name()) > len(ageFileSuffix) &&
+				!dirs[strings.TrimSuffix(e.Name(), ageFileSuffix)]:
+				d.entries = append(d.entries, &decryptedDirEntry{DirEntry: e, fsys: d.fsys, dir: d.name})
+			}
+		}
+		// Stripping the suffix can change the order of the entries.
+		sort.Slice(d.entries, func(i, j int) bool {
+			return d.entries[i].Name() < d.entries[j].Name()
+		})
+		d.read = true
+	}
+
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+type decryptedDirEntry struct {
+	fs.DirEntry
+	fsys *decryptFS
+	dir  string
+}
+
+func (e *decryptedDirEntry) Name() string {
+	return strings.TrimSuffix(e.DirEntry.Name(), ageFileSuffix)
+}
+
+func (e *decryptedDirEntry) Info() (fs.FileInfo, error) {
+	return e.fsys.stat(path.Join(e.dir, e.Name()))
+}
@@ -0,0 +1,144 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package fuzz provides the Go native fuzz targets for the age parsers, so
+// that they can be run from other modules, such as forks or distribution
+// packaging, against the same code and seeds used by the project.
+//
+// Each target is a function that takes a *testing.F, and can be called from a
+// fuzz test in any module:
+//
+//	func FuzzHeader(f *testing.F) {
+//		if err := fuzz.AddVectors(f, agetest.Vectors); err != nil {
+//			f.Fatal(err)
+//		}
+//		fuzz.Header(f)
+//	}
+//
+// where agetest is the c2sp.org/CCTV/age test vectors package.
+package fuzz
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+
+	"filippo.io/age/armor"
+	"filippo.io/age/bech32"
+	"filippo.io/age/internal/format"
+)
+
+// AddVectors adds seeds to f from a directory of test vectors in the CCTV age
+// format: the age file of each vector, the same file without the version line,
+// and the encoding of its identities.
+// All targets in this package accept the same seeds.
+func AddVectors(f *testing.F, vectors fs.FS) error {
+	return fs.WalkDir(vectors, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		contents, err := fs.ReadFile(vectors, path)
+		if err != nil {
+			return err
+		}
+		metadata, file, ok := bytes.Cut(contents, []byte("\n\n"))
+		if !ok {
+			return nil
+		}
+		f.Add(file)
+		// Also add the file without the version line, for the stanza parser.
+		if _, rest, ok := bytes.Cut(file, []byte("\n")); ok {
+			f.Add(rest)
+		}
+		for _, line := range strings.Split(string(metadata), "\n") {
+			if strings.HasPrefix(line, "identity: ") {
+				f.Add([]byte(strings.TrimPrefix(line, "identity: ")))
+			}
+		}
+		return nil
+	})
+}
+
+// Header fuzzes the header parser. Headers that parse successfully must
+// re-encode to the same bytes, since the encoding is not malleable.
+func Header(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h, _, err := format.Parse(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		buf := &bytes.Buffer{}
+		if err := h.Marshal(buf); err != nil {
+			t.Fatalf("failed to marshal parsed header: %v", err)
+		}
+		if !bytes.HasPrefix(data, buf.Bytes()) {
+			t.Errorf("header re-encoded differently:\n%q\n%q", data, buf.Bytes())
+		}
+	})
+}
+
+// Stanza fuzzes the stanza parser. Stanzas that parse successfully must
+// re-encode to the same bytes.
+func Stanza(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		s, err := format.NewStanzaReader(bufio.NewReader(bytes.NewReader(data))).ReadStanza()
+		if err != nil {
+			return
+		}
+		buf := &bytes.Buffer{}
+		if err := s.Marshal(buf); err != nil {
+			t.Fatalf("failed to marshal parsed stanza: %v", err)
+		}
+		if !bytes.HasPrefix(data, buf.Bytes()) {
+			t.Errorf("stanza re-encoded differently:\n%q\n%q", data, buf.Bytes())
+		}
+	})
+}
+
+// Armor fuzzes the armor decoder. Decoded contents must round-trip through
+// the armor encoder.
+func Armor(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		out, err := io.ReadAll(armor.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			return
+		}
+		buf := &bytes.Buffer{}
+		w := armor.NewWriter(buf)
+		if _, err := w.Write(out); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		again, err := io.ReadAll(armor.NewReader(buf))
+		if err != nil {
+			t.Fatalf("failed to decode re-encoded armor: %v", err)
+		}
+		if !bytes.Equal(out, again) {
+			t.Errorf("armor round-trip mismatch")
+		}
+	})
+}
+
+// Bech32 fuzzes the Bech32 decoder. Strings that decode successfully must
+// re-encode to the same string.
+func Bech32(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		hrp, b, err := bech32.Decode(string(data))
+		if err != nil {
+			return
+		}
+		s, err := bech32.Encode(hrp, b)
+		if err != nil {
+			t.Fatalf("failed to re-encode decoded string: %v", err)
+		}
+		if s != string(data) {
+			t.Errorf("Bech32 string re-encoded differently: %q, %q", data, s)
+		}
+	})
+}
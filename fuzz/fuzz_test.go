@@ -0,0 +1,43 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuzz_test
+
+import (
+	"os"
+	"testing"
+
+	"filippo.io/age/fuzz"
+
+	agetest "c2sp.org/CCTV/age"
+)
+
+func addSeeds(f *testing.F) {
+	if err := fuzz.AddVectors(f, agetest.Vectors); err != nil {
+		f.Fatal(err)
+	}
+	if err := fuzz.AddVectors(f, os.DirFS("../testdata/testkit")); err != nil {
+		f.Fatal(err)
+	}
+}
+
+func FuzzHeader(f *testing.F) {
+	addSeeds(f)
+	fuzz.Header(f)
+}
+
+func FuzzStanza(f *testing.F) {
+	addSeeds(f)
+	fuzz.Stanza(f)
+}
+
+func FuzzArmor(f *testing.F) {
+	addSeeds(f)
+	fuzz.Armor(f)
+}
+
+func FuzzBech32(f *testing.F) {
+	addSeeds(f)
+	fuzz.Bech32(f)
+}
@@ -0,0 +1,40 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"io"
+
+	"filippo.io/age/internal/format"
+)
+
+// greaseStanza returns a stanza of a random unknown type, with random
+// arguments and body, like TLS GREASE values (RFC 8701). Identities must
+// ignore stanzas they don't recognize, and injecting these keeps third-party
+// implementations from accidentally depending on a fixed set of types.
+func greaseStanza(rand io.Reader) (*format.Stanza, error) {
+	// The first byte selects the number of arguments and the body length.
+	params := make([]byte, 2)
+	if _, err := io.ReadFull(rand, params); err != nil {
+		return nil, err
+	}
+	typ := make([]byte, 6)
+	if _, err := io.ReadFull(rand, typ); err != nil {
+		return nil, err
+	}
+	s := &format.Stanza{Type: format.EncodeToString(typ) + "-grease"}
+	for n := int(params[0] % 3); n > 0; n-- {
+		arg := make([]byte, 3+int(params[0]%10))
+		if _, err := io.ReadFull(rand, arg); err != nil {
+			return nil, err
+		}
+		s.Args = append(s.Args, format.EncodeToString(arg))
+	}
+	s.Body = make([]byte, int(params[1]%100))
+	if _, err := io.ReadFull(rand, s.Body); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
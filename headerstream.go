@@ -0,0 +1,289 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"filippo.io/age/internal/format"
+)
+
+// decryptedHeader is a header with the file key unwrapped and the MAC checked.
+type decryptedHeader struct {
+	hdr     *format.Header
+	payload io.Reader
+	fileKey []byte
+	// matched is the index of the identity that unwrapped the file key.
+	matched int
+	// size is the encoded size of the header, or -1 if it was not measured.
+	size int64
+	// signedHash is the result of signedHeaderHash, if it was computed while
+	// reading the header, or nil.
+	signedHash []byte
+}
+
+// stanzaUnwrapper is implemented by the native identities, which unwrap each
+// stanza independently of the others.
+type stanzaUnwrapper interface {
+	unwrap(s *Stanza) ([]byte, error)
+}
+
+// canStreamHeader reports whether the header can be processed by streamHeader,
+// rather than parsed in full and passed to decryptHdr. That's the case if all
+// identities unwrap each stanza independently, and no policy needs to see the
+// whole header before any identity is invoked.
+func canStreamHeader(opts *Options, identities []Identity) bool {
+	if opts.Policy != nil {
+		return false
+	}
+	for _, id := range identities {
+		// ScryptIdentity checks that its stanza is alone in the header.
+		if _, ok := id.(*ScryptIdentity); ok {
+			return false
+		}
+		if _, ok := id.(stanzaUnwrapper); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// macWriter holds the MAC input until the file key is known, and then writes
+// it and the rest of the input to the HMAC.
+type macWriter struct {
+	buf *bytes.Buffer
+	key []byte
+	h   hash.Hash
+}
+
+func (w *macWriter) Write(p []byte) (int, error) {
+	if w.h != nil {
+		return w.h.Write(p)
+	}
+	if w.buf != nil {
+		return w.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+// setKey starts computing the HMAC with the key derived from fileKey, if it
+// wasn't started already.
+func (w *macWriter) setKey(fileKey []byte) {
+	if w.h != nil {
+		return
+	}
+	w.key = fileKey
+	w.h = newHeaderMAC(fileKey)
+	if w.buf != nil {
+		w.h.Write(w.buf.Bytes())
+		w.buf = nil
+	}
+}
+
+// streamHeader reads the header from src one stanza at a time, unwrapping each
+// stanza as soon as it's parsed and then dropping its body and arguments, so
+// that files encrypted to thousands of recipients can be decrypted without
+// holding more than a few words of memory per stanza.
+//
+// It picks the same identity as decryptHdr, the first one that matches any
+// stanza, and returns the same errors. To check the MAC, if src is an
+// io.Seeker the header is read a second time, otherwise the stanzas preceding
+// the first match are held in encoded form.
+//
+// The Recipients of the returned header only have the Type set, except for
+// the metadata, signature, and chunk-size stanzas, which are kept whole. Since the other
+// stanzas are gone, the hash covered by the signature is computed as they
+// are read.
+func streamHeader(src io.Reader, opts *Options, identities []Identity) (*decryptedHeader, error) {
+	start := int64(-1)
+	if s, ok := src.(io.Seeker); ok {
+		if off, err := s.Seek(0, io.SeekCurrent); err == nil {
+			start = off
+		}
+	}
+	mw := &macWriter{}
+	if start < 0 {
+		mw.buf = &bytes.Buffer{}
+	}
+
+	span := opts.startSpan("age.ParseHeader")
+	hr, err := format.NewHeaderReader(src, mw)
+	if err != nil {
+		span.End(err)
+		return nil, fmt.Errorf("failed to read header: %w", headerError(err))
+	}
+
+	hdr := &format.Header{Version: hr.Header.Version}
+	signedHash := sha256.New()
+	io.WriteString(signedHash, hdr.Version.Name+"\n")
+	// types interns the stanza types, which would otherwise keep the whole
+	// stanza line alive.
+	types := make(map[string]string)
+	var metadata, recipients int
+
+	// best is the index of the first identity that matched or failed so far.
+	// Identities after it don't need to be tried anymore.
+	best := len(identities)
+	var fileKey []byte
+	var bestErr error
+	spans := make([]Span, len(identities))
+	for n := 0; ; n++ {
+		s, err := hr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			span.End(err)
+			return nil, fmt.Errorf("failed to read header: %w", headerError(err))
+		}
+
+		// Metadata, signature, and chunk-size stanzas are not recipient
+		// stanzas, and are not passed to the identities, like in decryptHdr.
+		if s.Type == signatureStanzaType {
+			hdr.Recipients = append(hdr.Recipients, s)
+			continue
+		}
+		if err := s.Marshal(signedHash); err != nil {
+			span.End(err)
+			return nil, err
+		}
+		if s.Type == metadataStanzaType {
+			metadata++
+			hdr.Recipients = append(hdr.Recipients, s)
+			continue
+		}
+		if s.Type == chunkSizeStanzaType {
+			hdr.Recipients = append(hdr.Recipients, s)
+			continue
+		}
+		recipients++
+		t, ok := types[s.Type]
+		if !ok {
+			t = string([]byte(s.Type))
+			types[t] = t
+		}
+		hdr.Recipients = append(hdr.Recipients, &format.Stanza{Type: t})
+
+		for i := 0; i < best; i++ {
+			if spans[i] == nil {
+				spans[i] = opts.startSpan("age.Unwrap", "identity", i, "type", typeName(identities[i]))
+			}
+			key, err := identities[i].(stanzaUnwrapper).unwrap((*Stanza)(s))
+			if errors.Is(err, ErrIncorrectIdentity) {
+				continue
+			}
+			best, fileKey, bestErr = i, key, nil
+			if err != nil {
+				fileKey, bestErr = nil, &StanzaError{Index: n, Type: s.Type, Err: err}
+			}
+			break
+		}
+		if fileKey != nil && start < 0 {
+			mw.setKey(fileKey)
+		}
+	}
+	span.End(nil)
+	io.WriteString(signedHash, "---")
+
+	opts.debug("parsed header", "stanzas", stanzaTypes(hdr.Recipients))
+	if metadata > 1 {
+		return nil, errors.New("multiple metadata stanzas")
+	}
+
+	var stanzas []*Stanza
+	if opts != nil && opts.Audit != nil {
+		stanzas = make([]*Stanza, 0, recipients)
+		for _, s := range hdr.Recipients {
+			if s.Type != metadataStanzaType && s.Type != signatureStanzaType && s.Type != chunkSizeStanzaType {
+				stanzas = append(stanzas, (*Stanza)(s))
+			}
+		}
+	}
+	errNoMatch := &NoIdentityMatchError{}
+	for _, s := range hdr.Recipients {
+		if s.Type != metadataStanzaType && s.Type != signatureStanzaType && s.Type != chunkSizeStanzaType {
+			errNoMatch.StanzaTypes = append(errNoMatch.StanzaTypes, s.Type)
+		}
+	}
+	for i, id := range identities {
+		if i == best {
+			break
+		}
+		if spans[i] == nil {
+			spans[i] = opts.startSpan("age.Unwrap", "identity", i, "type", typeName(id))
+		}
+		spans[i].End(ErrIncorrectIdentity)
+		opts.audit(i, id, stanzas, ErrIncorrectIdentity)
+		opts.debug("identity didn't match", "identity", i, "type", typeName(id))
+		errNoMatch.Errors = append(errNoMatch.Errors, ErrIncorrectIdentity)
+	}
+	for i := best + 1; i < len(identities); i++ {
+		if spans[i] != nil {
+			spans[i].End(nil)
+		}
+	}
+	if best == len(identities) {
+		return nil, errNoMatch
+	}
+	spans[best].End(bestErr)
+	opts.audit(best, identities[best], stanzas, bestErr)
+	if bestErr != nil {
+		opts.debug("identity failed", "identity", best, "type", typeName(identities[best]), "error", bestErr)
+		return nil, &IdentityError{Index: best, Identity: identities[best], Err: bestErr}
+	}
+	opts.debug("identity matched", "identity", best, "type", typeName(identities[best]))
+
+	if start >= 0 {
+		// Read the header again, this time computing the MAC.
+		if _, err := src.(io.Seeker).Seek(start, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("failed to read header: %w", err)
+		}
+		mw = &macWriter{}
+		mw.setKey(fileKey)
+		hr, err = format.NewHeaderReader(src, mw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read header: %w", headerError(err))
+		}
+		for {
+			_, err := hr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to read header: %w", headerError(err))
+			}
+		}
+	}
+	hdr.MAC = hr.Header.MAC
+
+	// If a later stanza unwrapped a different file key for an earlier
+	// identity, the held MAC input is gone. That can only happen with a
+	// maliciously crafted header, so just reject it.
+	if !hmac.Equal(mw.key, fileKey) || !hmac.Equal(mw.h.Sum(nil), hdr.MAC) {
+		opts.debug("header MAC mismatch")
+		return nil, &HeaderMACError{Identity: identities[best], IdentityIndex: best}
+	}
+	opts.debug("header MAC verified")
+
+	payload, err := hr.Payload()
+	if err != nil {
+		return nil, err
+	}
+	return &decryptedHeader{
+		hdr:     hdr,
+		payload: payload,
+		fileKey: fileKey,
+		matched: best,
+		size:    hr.Size(),
+
+		signedHash: signedHash.Sum(nil),
+	}, nil
+}
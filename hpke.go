@@ -0,0 +1,275 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"filippo.io/age/bech32"
+	"filippo.io/age/internal/format"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// hpkeInfo is the HPKE info parameter used for the hpke stanza.
+const hpkeInfo = "age-encryption.org/v1/hpke"
+
+// HPKE algorithm identifiers, from RFC 9180, Section 7.
+const (
+	hpkeKEMX25519HKDFSHA256  = 0x0020
+	hpkeKDFHKDFSHA256        = 0x0001
+	hpkeAEADChaCha20Poly1305 = 0x0003
+)
+
+// HPKERecipient is a recipient that wraps the file key with HPKE (RFC 9180) in
+// base mode, with DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, and
+// ChaCha20Poly1305. The HPKE info parameter is "age-encryption.org/v1/hpke",
+// and the associated data is empty.
+//
+// The stanza has type "hpke", a single argument which is the encapsulated key
+// (the ephemeral X25519 public key), and a body which is the sealed file key.
+//
+// It's meant for interoperability with systems that standardize on HPKE key
+// encapsulation. Otherwise, X25519Recipient should be preferred. Like
+// X25519Recipient, this recipient is anonymous.
+type HPKERecipient struct {
+	theirPublicKey []byte
+}
+
+var _ Recipient = &HPKERecipient{}
+
+// NewHPKERecipient returns a new HPKERecipient from a raw X25519 public key,
+// serialized as specified by RFC 9180, Section 7.1.1.
+func NewHPKERecipient(publicKey []byte) (*HPKERecipient, error) {
+	if len(publicKey) != curve25519.PointSize {
+		return nil, errors.New("invalid X25519 public key")
+	}
+	r := &HPKERecipient{
+		theirPublicKey: make([]byte, curve25519.PointSize),
+	}
+	copy(r.theirPublicKey, publicKey)
+	return r, nil
+}
+
+// ParseHPKERecipient returns a new HPKERecipient from a Bech32 public key
+// encoding with the "age1hpke1" prefix.
+func ParseHPKERecipient(s string) (*HPKERecipient, error) {
+	t, k, err := bech32.Decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("malformed recipient %q: %v", s, err)
+	}
+	if t != "age1hpke" {
+		return nil, fmt.Errorf("malformed recipient %q: invalid type %q", s, t)
+	}
+	r, err := NewHPKERecipient(k)
+	if err != nil {
+		return nil, fmt.Errorf("malformed recipient %q: %v", s, err)
+	}
+	return r, nil
+}
+
+func (r *HPKERecipient) Wrap(fileKey []byte) ([]*Stanza, error) {
+	ephemeral := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(ephemeral); err != nil {
+		return nil, err
+	}
+	enc, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	dh, err := curve25519.X25519(ephemeral, r.theirPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, nonce, err := hpkeKeySchedule(dh, enc, r.theirPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	l := &Stanza{
+		Type: "hpke",
+		Args: []string{format.EncodeToString(enc)},
+		Body: aead.Seal(nil, nonce, fileKey, nil),
+	}
+	return []*Stanza{l}, nil
+}
+
+// Bytes returns the raw X25519 public key.
+func (r *HPKERecipient) Bytes() []byte {
+	return append([]byte{}, r.theirPublicKey...)
+}
+
+// String returns the Bech32 public key encoding of r.
+func (r *HPKERecipient) String() string {
+	s, _ := bech32.Encode("age1hpke", r.theirPublicKey)
+	return s
+}
+
+// HPKEIdentity is the private key corresponding to an HPKERecipient.
+type HPKEIdentity struct {
+	secretKey, ourPublicKey []byte
+}
+
+var _ Identity = &HPKEIdentity{}
+
+// NewHPKEIdentity returns a new HPKEIdentity from a raw X25519 private key,
+// serialized as specified by RFC 9180, Section 7.1.2.
+func NewHPKEIdentity(secretKey []byte) (*HPKEIdentity, error) {
+	if len(secretKey) != curve25519.ScalarSize {
+		return nil, errors.New("invalid X25519 secret key")
+	}
+	i := &HPKEIdentity{
+		secretKey: make([]byte, curve25519.ScalarSize),
+	}
+	copy(i.secretKey, secretKey)
+	i.ourPublicKey, _ = curve25519.X25519(i.secretKey, curve25519.Basepoint)
+	return i, nil
+}
+
+// GenerateHPKEIdentity randomly generates a new HPKEIdentity.
+func GenerateHPKEIdentity() (*HPKEIdentity, error) {
+	secretKey := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(secretKey); err != nil {
+		return nil, fmt.Errorf("internal error: %v", err)
+	}
+	return NewHPKEIdentity(secretKey)
+}
+
+// ParseHPKEIdentity returns a new HPKEIdentity from a Bech32 private key
+// encoding with the "AGE-SECRET-KEY-HPKE-1" prefix.
+func ParseHPKEIdentity(s string) (*HPKEIdentity, error) {
+	t, k, err := bech32.Decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("malformed secret key: %v", err)
+	}
+	if t != "AGE-SECRET-KEY-HPKE-" {
+		return nil, fmt.Errorf("malformed secret key: unknown type %q", t)
+	}
+	i, err := NewHPKEIdentity(k)
+	if err != nil {
+		return nil, fmt.Errorf("malformed secret key: %v", err)
+	}
+	return i, nil
+}
+
+func (i *HPKEIdentity) Unwrap(stanzas []*Stanza) ([]byte, error) {
+	return multiUnwrap(i.unwrap, stanzas)
+}
+
+func (i *HPKEIdentity) unwrap(block *Stanza) ([]byte, error) {
+	if block.Type != "hpke" {
+		return nil, ErrIncorrectIdentity
+	}
+	if len(block.Args) != 1 {
+		return nil, errors.New("invalid hpke recipient block")
+	}
+	enc, err := format.DecodeString(block.Args[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse hpke recipient: %v", err)
+	}
+	if len(enc) != curve25519.PointSize {
+		return nil, errors.New("invalid hpke recipient block")
+	}
+
+	dh, err := curve25519.X25519(i.secretKey, enc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hpke recipient: %v", err)
+	}
+
+	aead, nonce, err := hpkeKeySchedule(dh, enc, i.ourPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(block.Body) != fileKeySize+aead.Overhead() {
+		return nil, errors.New("invalid hpke recipient block: incorrect file key size")
+	}
+	fileKey, err := aead.Open(nil, nonce, block.Body, nil)
+	if err != nil {
+		return nil, ErrIncorrectIdentity
+	}
+	return fileKey, nil
+}
+
+// Recipient returns the public HPKERecipient value corresponding to i.
+func (i *HPKEIdentity) Recipient() *HPKERecipient {
+	r := &HPKERecipient{}
+	r.theirPublicKey = i.ourPublicKey
+	return r
+}
+
+// Bytes returns the raw X25519 private key.
+func (i *HPKEIdentity) Bytes() []byte {
+	return append([]byte{}, i.secretKey...)
+}
+
+// String returns the Bech32 private key encoding of i.
+func (i *HPKEIdentity) String() string {
+	s, _ := bech32.Encode("AGE-SECRET-KEY-HPKE-", i.secretKey)
+	return strings.ToUpper(s)
+}
+
+// hpkeKeySchedule implements the DHKEM ExtractAndExpand step and the base mode
+// KeySchedule of RFC 9180, returning the AEAD and the nonce for the first (and
+// only) message of the context.
+func hpkeKeySchedule(dh, enc, pkR []byte) (aead cipher.AEAD, nonce []byte, err error) {
+	kemSuite := binary.BigEndian.AppendUint16([]byte("KEM"), hpkeKEMX25519HKDFSHA256)
+	kemContext := append(append([]byte{}, enc...), pkR...)
+	eaePRK := hpkeLabeledExtract(kemSuite, nil, "eae_prk", dh)
+	sharedSecret, err := hpkeLabeledExpand(kemSuite, eaePRK, "shared_secret", kemContext, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	suite := []byte("HPKE")
+	suite = binary.BigEndian.AppendUint16(suite, hpkeKEMX25519HKDFSHA256)
+	suite = binary.BigEndian.AppendUint16(suite, hpkeKDFHKDFSHA256)
+	suite = binary.BigEndian.AppendUint16(suite, hpkeAEADChaCha20Poly1305)
+	const modeBase = 0x00
+	ksContext := []byte{modeBase}
+	ksContext = append(ksContext, hpkeLabeledExtract(suite, nil, "psk_id_hash", nil)...)
+	ksContext = append(ksContext, hpkeLabeledExtract(suite, nil, "info_hash", []byte(hpkeInfo))...)
+	secret := hpkeLabeledExtract(suite, sharedSecret, "secret", nil)
+	key, err := hpkeLabeledExpand(suite, secret, "key", ksContext, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce, err = hpkeLabeledExpand(suite, secret, "base_nonce", ksContext, chacha20poly1305.NonceSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err = chacha20poly1305.New(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, nonce, nil
+}
+
+func hpkeLabeledExtract(suite, salt []byte, label string, ikm []byte) []byte {
+	labeledIKM := append([]byte("HPKE-v1"), suite...)
+	labeledIKM = append(labeledIKM, label...)
+	labeledIKM = append(labeledIKM, ikm...)
+	return hkdf.Extract(sha256.New, labeledIKM, salt)
+}
+
+func hpkeLabeledExpand(suite, prk []byte, label string, info []byte, length uint16) ([]byte, error) {
+	labeledInfo := binary.BigEndian.AppendUint16(nil, length)
+	labeledInfo = append(labeledInfo, "HPKE-v1"...)
+	labeledInfo = append(labeledInfo, suite...)
+	labeledInfo = append(labeledInfo, label...)
+	labeledInfo = append(labeledInfo, info...)
+	out := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, labeledInfo), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
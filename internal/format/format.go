@@ -16,10 +16,58 @@ import (
 )
 
 type Header struct {
+	// Version is the format version of the header. If nil, it's V1.
+	Version    *Version
 	Recipients []*Stanza
 	MAC        []byte
 }
 
+// Version is a version of the age format, identified by the first line of the
+// header, and the grammar of the rest of the header.
+type Version struct {
+	// Name is the first line of the header, without the trailing newline.
+	Name string
+
+	// parse reads the header lines after the intro into h, up to and including
+	// the line carrying the MAC.
+	parse func(rr *bufio.Reader, h *Header) error
+	// next reads the next stanza after the intro, or the line carrying the MAC
+	// into h and returns io.EOF. n is the index of the stanza. If nil, the
+	// version can't be read by a HeaderReader.
+	next func(rr *bufio.Reader, sr *StanzaReader, h *Header, n int) (*Stanza, error)
+	// marshalWithoutMAC writes the header lines after the intro, up to the
+	// point where the MAC would be.
+	marshalWithoutMAC func(w io.Writer, h *Header) error
+}
+
+// V1 is the age-encryption.org/v1 format.
+var V1 = &Version{
+	Name:              "age-encryption.org/v1",
+	parse:             parseV1,
+	next:              nextV1,
+	marshalWithoutMAC: marshalV1WithoutMAC,
+}
+
+// versions is the registry of versions that Parse accepts, in order of
+// preference. New versions are added here along with their grammar.
+var versions = []*Version{V1}
+
+// Versions returns the names of the supported versions, in order of preference.
+func Versions() []string {
+	var names []string
+	for _, v := range versions {
+		names = append(names, v.Name)
+	}
+	return names
+}
+
+func (h *Header) version() *Version {
+	if h.Version == nil {
+		return V1
+	}
+	return h.Version
+}
+
 // Stanza is assignable to age.Stanza, and if this package is made public,
 // age.Stanza can be made a type alias of this type.
 type Stanza struct {
@@ -105,7 +153,7 @@ func (w *WrappedBase64Encoder) LastLineIsEmpty() bool {
 	return w.written%ColumnsPerLine == 0
 }
 
-const intro = "age-encryption.org/v1\n"
+const versionPrefix = "age-encryption.org/"
 
 var stanzaPrefix = []byte("->")
 var footerPrefix = []byte("---")
@@ -134,9 +182,14 @@ func (r *Stanza) Marshal(w io.Writer) error {
 }
 
 func (h *Header) MarshalWithoutMAC(w io.Writer) error {
-	if _, err := io.WriteString(w, intro); err != nil {
+	v := h.version()
+	if _, err := io.WriteString(w, v.Name+"\n"); err != nil {
 		return err
 	}
+	return v.marshalWithoutMAC(w, h)
+}
+
+func marshalV1WithoutMAC(w io.Writer, h *Header) error {
 	for _, r := range h.Recipients {
 		if err := r.Marshal(w); err != nil {
 			return err
@@ -164,6 +217,9 @@ func NewStanzaReader(r *bufio.Reader) *StanzaReader {
 	return &StanzaReader{r: r}
 }
 
+// ReadStanza reads the next stanza. If the error happened after the opening
+// line was parsed, the returned Stanza is not nil, and has the Type and Args
+// set, for error reporting.
 func (r *StanzaReader) ReadStanza() (s *Stanza, err error) {
 	// Read errors are unrecoverable.
 	if r.err != nil {
@@ -195,18 +251,18 @@ func (r *StanzaReader) ReadStanza() (s *Stanza, err error) {
 	for {
 		line, err := r.r.ReadBytes('\n')
 		if err != nil {
-			return nil, fmt.Errorf("failed to read line: %w", err)
+			return s, fmt.Errorf("failed to read line: %w", err)
 		}
 
 		b, err := DecodeString(strings.TrimSuffix(string(line), "\n"))
 		if err != nil {
 			if bytes.HasPrefix(line, footerPrefix) || bytes.HasPrefix(line, stanzaPrefix) {
-				return nil, fmt.Errorf("malformed body line %q: stanza ended without a short line\nNote: this might be a file encrypted with an old beta version of age or rage. Use age v1.0.0-beta6 or rage to decrypt it.", line)
+				return s, fmt.Errorf("malformed body line %q: stanza ended without a short line\nNote: this might be a file encrypted with an old beta version of age or rage. Use age v1.0.0-beta6 or rage to decrypt it.", line)
 			}
-			return nil, errorf("malformed body line %q: %v", line, err)
+			return s, errorf("malformed body line %q: %v", line, err)
 		}
 		if len(b) > BytesPerLine {
-			return nil, errorf("malformed body line %q: too long", line)
+			return s, errorf("malformed body line %q: too long", line)
 		}
 		s.Body = append(s.Body, b...)
 		if len(b) < BytesPerLine {
@@ -228,68 +284,230 @@ func (e *ParseError) Unwrap() error {
 	return e.err
 }
 
+// StanzaError is returned by Parse when a stanza is malformed.
+type StanzaError struct {
+	// Index is the zero-based position of the stanza in the header.
+	Index int
+	// Type is the stanza type, or empty if the opening line was malformed.
+	Type string
+	Err  error
+}
+
+func (e *StanzaError) Error() string {
+	if e.Type == "" {
+		return fmt.Sprintf("stanza #%d: %v", e.Index, e.Err)
+	}
+	return fmt.Sprintf("stanza #%d (%s): %v", e.Index, e.Type, e.Err)
+}
+
+func (e *StanzaError) Unwrap() error {
+	return e.Err
+}
+
 func errorf(format string, a ...interface{}) error {
 	return &ParseError{fmt.Errorf(format, a...)}
 }
 
 // Parse returns the header and a Reader that begins at the start of the
-// payload.
+// payload. The header can be of any of the supported versions, and its Version
+// field is set accordingly.
 func Parse(input io.Reader) (*Header, io.Reader, error) {
 	h := &Header{}
 	rr := bufio.NewReader(input)
 
+	v, err := readIntro(rr)
+	if err != nil {
+		return nil, nil, err
+	}
+	h.Version = v
+
+	if err := h.Version.parse(rr, h); err != nil {
+		return nil, nil, err
+	}
+
+	payload, err := unwindPayload(rr, input)
+	if err != nil {
+		return nil, nil, err
+	}
+	return h, payload, nil
+}
+
+func readIntro(rr *bufio.Reader) (*Version, error) {
 	line, err := rr.ReadString('\n')
 	if err != nil {
-		return nil, nil, errorf("failed to read intro: %w", err)
+		return nil, errorf("failed to read intro: %w", err)
+	}
+	for _, v := range versions {
+		if line == v.Name+"\n" {
+			return v, nil
+		}
 	}
-	if line != intro {
-		return nil, nil, errorf("unexpected intro: %q", line)
+	if strings.HasPrefix(line, versionPrefix) {
+		return nil, errorf("unsupported version: %q", line)
 	}
+	return nil, errorf("unexpected intro: %q", line)
+}
 
-	sr := NewStanzaReader(rr)
-	for {
-		peek, err := rr.Peek(len(footerPrefix))
+// unwindPayload returns a Reader that begins at the current position of rr,
+// which reads from input.
+func unwindPayload(rr *bufio.Reader, input io.Reader) (io.Reader, error) {
+	// If input is a bufio.Reader, rr might be equal to input because
+	// bufio.NewReader short-circuits. In this case we can just return it (and
+	// we would end up reading the buffer twice if we prepended the peek below).
+	if rr == input {
+		return rr, nil
+	}
+	// Otherwise, unwind the bufio overread and return the unbuffered input.
+	buf, err := rr.Peek(rr.Buffered())
+	if err != nil {
+		return nil, errorf("internal error: %v", err)
+	}
+	return io.MultiReader(bytes.NewReader(buf), input), nil
+}
+
+// HeaderReader reads a header one stanza at a time, so that the stanzas don't
+// need to be held in memory all at once, like they are by Parse.
+type HeaderReader struct {
+	// Header has the Version set when the HeaderReader is created, and the MAC
+	// set once Next returns io.EOF. Recipients is not populated.
+	Header *Header
+
+	input    *countingReader
+	rr       *bufio.Reader
+	sr       *StanzaReader
+	macInput io.Writer
+	n        int
+	done     bool
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// NewHeaderReader reads the intro line of the header from input, and returns
+// a HeaderReader that reads the rest.
+//
+// If macInput is not nil, the encoding of the header that is covered by the
+// MAC is written to it as the header is read, as MarshalWithoutMAC would.
+func NewHeaderReader(input io.Reader, macInput io.Writer) (*HeaderReader, error) {
+	cr := &countingReader{r: input}
+	rr := bufio.NewReader(cr)
+	v, err := readIntro(rr)
+	if err != nil {
+		return nil, err
+	}
+	if v.next == nil {
+		return nil, errorf("version %q can't be read one stanza at a time", v.Name)
+	}
+	if macInput == nil {
+		macInput = io.Discard
+	}
+	if _, err := io.WriteString(macInput, v.Name+"\n"); err != nil {
+		return nil, err
+	}
+	return &HeaderReader{
+		Header:   &Header{Version: v},
+		input:    cr,
+		rr:       rr,
+		sr:       NewStanzaReader(rr),
+		macInput: macInput,
+	}, nil
+}
+
+// Next returns the next stanza of the header. At the end of the header, it
+// sets Header.MAC and returns io.EOF.
+func (r *HeaderReader) Next() (*Stanza, error) {
+	if r.done {
+		return nil, io.EOF
+	}
+	s, err := r.Header.Version.next(r.rr, r.sr, r.Header, r.n)
+	if err == io.EOF {
+		r.done = true
+		_, err := r.macInput.Write(footerPrefix)
 		if err != nil {
-			return nil, nil, errorf("failed to read header: %w", err)
+			return nil, err
 		}
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The header encoding is not malleable, so re-encoding the stanza
+	// produces the bytes that were read.
+	if err := s.Marshal(r.macInput); err != nil {
+		return nil, err
+	}
+	r.n++
+	return s, nil
+}
 
-		if bytes.Equal(peek, footerPrefix) {
-			line, err := rr.ReadBytes('\n')
-			if err != nil {
-				return nil, nil, fmt.Errorf("failed to read header: %w", err)
-			}
+// Size returns the number of bytes of the header read so far.
+func (r *HeaderReader) Size() int64 {
+	return r.input.n - int64(r.rr.Buffered())
+}
 
-			prefix, args := splitArgs(line)
-			if prefix != string(footerPrefix) || len(args) != 1 {
-				return nil, nil, errorf("malformed closing line: %q", line)
-			}
-			h.MAC, err = DecodeString(args[0])
-			if err != nil || len(h.MAC) != 32 {
-				return nil, nil, errorf("malformed closing line %q: %v", line, err)
-			}
-			break
-		}
+// Payload returns a Reader that begins at the start of the payload. It must
+// be called only after Next returned io.EOF.
+func (r *HeaderReader) Payload() (io.Reader, error) {
+	if !r.done {
+		return nil, errors.New("internal error: header not fully read")
+	}
+	return unwindPayload(r.rr, r.input)
+}
 
-		s, err := sr.ReadStanza()
+func parseV1(rr *bufio.Reader, h *Header) error {
+	sr := NewStanzaReader(rr)
+	for {
+		s, err := nextV1(rr, sr, h, len(h.Recipients))
+		if err == io.EOF {
+			return nil
+		}
 		if err != nil {
-			return nil, nil, fmt.Errorf("failed to parse header: %w", err)
+			return err
 		}
 		h.Recipients = append(h.Recipients, s)
 	}
+}
 
-	// If input is a bufio.Reader, rr might be equal to input because
-	// bufio.NewReader short-circuits. In this case we can just return it (and
-	// we would end up reading the buffer twice if we prepended the peek below).
-	if rr == input {
-		return h, rr, nil
+func nextV1(rr *bufio.Reader, sr *StanzaReader, h *Header, n int) (*Stanza, error) {
+	peek, err := rr.Peek(len(footerPrefix))
+	if err != nil {
+		return nil, errorf("failed to read header: %w", err)
 	}
-	// Otherwise, unwind the bufio overread and return the unbuffered input.
-	buf, err := rr.Peek(rr.Buffered())
+
+	if bytes.Equal(peek, footerPrefix) {
+		line, err := rr.ReadBytes('\n')
+		if err != nil {
+			return nil, fmt.Errorf("failed to read header: %w", err)
+		}
+
+		prefix, args := splitArgs(line)
+		if prefix != string(footerPrefix) || len(args) != 1 {
+			return nil, errorf("malformed closing line: %q", line)
+		}
+		h.MAC, err = DecodeString(args[0])
+		if err != nil || len(h.MAC) != 32 {
+			return nil, errorf("malformed closing line %q: %v", line, err)
+		}
+		return nil, io.EOF
+	}
+
+	s, err := sr.ReadStanza()
 	if err != nil {
-		return nil, nil, errorf("internal error: %v", err)
+		e := &StanzaError{Index: n, Err: err}
+		if s != nil {
+			e.Type = s.Type
+		}
+		return nil, fmt.Errorf("failed to parse header: %w", e)
 	}
-	payload := io.MultiReader(bytes.NewReader(buf), input)
-	return h, payload, nil
+	return s, nil
 }
 
 func splitArgs(line []byte) (string, []string) {
@@ -9,9 +9,11 @@ package format_test
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"filippo.io/age/internal/format"
@@ -44,6 +46,31 @@ func TestStanzaMarshal(t *testing.T) {
 	}
 }
 
+func TestParseVersion(t *testing.T) {
+	if v := format.Versions(); len(v) != 1 || v[0] != "age-encryption.org/v1" {
+		t.Errorf("unexpected versions: %q", v)
+	}
+
+	h := &format.Header{MAC: make([]byte, 32)}
+	buf := &bytes.Buffer{}
+	if err := h.Marshal(buf); err != nil {
+		t.Fatal(err)
+	}
+	h, _, err := format.Parse(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Version != format.V1 {
+		t.Errorf("unexpected version: %v", h.Version)
+	}
+
+	v2 := bytes.Replace(buf.Bytes(), []byte("/v1\n"), []byte("/v2\n"), 1)
+	if _, _, err := format.Parse(bytes.NewReader(v2)); err == nil ||
+		!strings.Contains(err.Error(), "unsupported version") {
+		t.Errorf("expected unsupported version error, got %v", err)
+	}
+}
+
 func FuzzMalleability(f *testing.F) {
 	tests, err := filepath.Glob("../../testdata/testkit/*")
 	if err != nil {
@@ -83,3 +110,25 @@ func FuzzMalleability(f *testing.F) {
 		}
 	})
 }
+
+func TestParseStanzaError(t *testing.T) {
+	for _, tc := range []struct {
+		hdr   string
+		index int
+		typ   string
+	}{
+		{"-> X25519 a\nAAAA\n-> X25519 b\nnot base64!\n", 1, "X25519"},
+		{"-> X25519 a\n\n->\n\n", 1, ""},
+		{"-> foo\n", 0, "foo"},
+	} {
+		_, _, err := format.Parse(strings.NewReader("age-encryption.org/v1\n" + tc.hdr))
+		var se *format.StanzaError
+		if !errors.As(err, &se) {
+			t.Errorf("%q: expected StanzaError, got %v", tc.hdr, err)
+			continue
+		}
+		if se.Index != tc.index || se.Type != tc.typ {
+			t.Errorf("%q: got stanza #%d (%q), want #%d (%q)", tc.hdr, se.Index, se.Type, tc.index, tc.typ)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package keychain stores and fetches age identities in the OS credential
+// store, by running the command line tool of the platform: security for the
+// macOS Keychain, and secret-tool for the Secret Service on other systems.
+package keychain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// service is the service name the identities are stored under.
+const service = "age"
+
+// CheckName returns an error if name can't be used as an entry name.
+func CheckName(name string) error {
+	if name == "" {
+		return errors.New("empty keychain entry name")
+	}
+	if strings.ContainsAny(name, " \t\r\n\"'\\") {
+		return fmt.Errorf("invalid keychain entry name %q: must not contain spaces or quotes", name)
+	}
+	return nil
+}
+
+// LookupCommand returns the command that prints the secret stored as name.
+func LookupCommand(name string) *exec.Cmd {
+	if runtime.GOOS == "darwin" {
+		return exec.Command("security", "find-generic-password", "-s", service, "-a", name, "-w")
+	}
+	return exec.Command("secret-tool", "lookup", "service", service, "account", name)
+}
+
+// Store stores secret as name, replacing any existing entry. The secret is
+// passed to the tool on standard input, not as an argument.
+func Store(name string, secret []byte) error {
+	if err := CheckName(name); err != nil {
+		return err
+	}
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		// In interactive mode, security reads commands from standard input.
+		cmd = exec.Command("security", "-i")
+		cmd.Stdin = strings.NewReader(fmt.Sprintf(
+			"add-generic-password -U -s %s -a %s -l \"age identity %s\" -w %s\n",
+			service, name, name, secret))
+	} else {
+		cmd = exec.Command("secret-tool", "store", "--label", "age identity "+name,
+			"service", service, "account", name)
+		cmd.Stdin = bytes.NewReader(secret)
+	}
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		if stderr.Len() > 0 {
+			return fmt.Errorf("failed to run %q: %v: %s", cmd.Args[0], err, strings.TrimSpace(stderr.String()))
+		}
+		return fmt.Errorf("failed to run %q: %v", cmd.Args[0], err)
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package x448 implements the X448 function from RFC 7748.
+//
+// The field arithmetic uses sixteen 28-bit limbs and is constant time. It's
+// written for clarity rather than performance.
+package x448
+
+import (
+	"crypto/subtle"
+	"errors"
+)
+
+const (
+	// ScalarSize is the size of the scalar input to X448.
+	ScalarSize = 56
+	// PointSize is the size of the point input to X448.
+	PointSize = 56
+)
+
+// Basepoint is the canonical X448 generator.
+var Basepoint []byte
+
+func init() {
+	Basepoint = make([]byte, PointSize)
+	Basepoint[0] = 5
+}
+
+// X448 returns the result of the scalar multiplication (scalar * point),
+// according to RFC 7748, Section 5. scalar and point must be 56 bytes long.
+//
+// If the result is the all-zero value, X448 returns an error, like
+// golang.org/x/crypto/curve25519.X25519.
+func X448(scalar, point []byte) ([]byte, error) {
+	if len(scalar) != ScalarSize {
+		return nil, errors.New("x448: bad scalar length")
+	}
+	if len(point) != PointSize {
+		return nil, errors.New("x448: bad point length")
+	}
+
+	var k [ScalarSize]byte
+	copy(k[:], scalar)
+	k[0] &= 252
+	k[55] |= 128
+
+	var u fe
+	u.setBytes(point)
+	out := ladder(&k, &u)
+
+	var zero [PointSize]byte
+	if subtle.ConstantTimeCompare(out, zero[:]) == 1 {
+		return nil, errors.New("x448: bad input point: low order point")
+	}
+	return out, nil
+}
+
+func ladder(k *[ScalarSize]byte, u *fe) []byte {
+	x1 := *u
+	var x2, z2, x3, z3 fe
+	x2[0] = 1
+	x3 = *u
+	z3[0] = 1
+
+	var a, aa, b, bb, e, c, d, da, cb, t fe
+	swap := uint64(0)
+	for i := 447; i >= 0; i-- {
+		bit := uint64(k[i/8]>>(i%8)) & 1
+		swap ^= bit
+		x2.condSwap(&x3, swap)
+		z2.condSwap(&z3, swap)
+		swap = bit
+
+		a.add(&x2, &z2)
+		aa.mul(&a, &a)
+		b.sub(&x2, &z2)
+		bb.mul(&b, &b)
+		e.sub(&aa, &bb)
+		c.add(&x3, &z3)
+		d.sub(&x3, &z3)
+		da.mul(&d, &a)
+		cb.mul(&c, &b)
+
+		t.add(&da, &cb)
+		x3.mul(&t, &t)
+		t.sub(&da, &cb)
+		t.mul(&t, &t)
+		z3.mul(&x1, &t)
+		x2.mul(&aa, &bb)
+		t.mulSmall(&e, 39081)
+		t.add(&aa, &t)
+		z2.mul(&e, &t)
+	}
+	x2.condSwap(&x3, swap)
+	z2.condSwap(&z3, swap)
+
+	z2.invert(&z2)
+	x2.mul(&x2, &z2)
+	return x2.bytes()
+}
+
+const mask28 = 1<<28 - 1
+
+// fe is a field element modulo p = 2^448 - 2^224 - 1, as sixteen little-endian
+// 28-bit limbs. Limbs are kept at most 2^28 between operations.
+type fe [16]uint64
+
+// setBytes sets v to the 56-byte little-endian value x. Values above p are
+// accepted and reduced, as required by RFC 7748.
+func (v *fe) setBytes(x []byte) {
+	for j := 0; j < 8; j++ {
+		var w uint64
+		for i := 6; i >= 0; i-- {
+			w = w<<8 | uint64(x[7*j+i])
+		}
+		v[2*j] = w & mask28
+		v[2*j+1] = w >> 28
+	}
+}
+
+// bytes returns the canonical 56-byte little-endian encoding of v.
+func (v *fe) bytes() []byte {
+	t := *v
+	t.carry()
+
+	// Normalize the limbs to 28 bits, keeping the top carry separately. The
+	// value is now below 2^448 + 2^29, which is less than 2p.
+	for i := 0; i < 15; i++ {
+		t[i+1] += t[i] >> 28
+		t[i] &= mask28
+	}
+	top := t[15] >> 28
+	t[15] &= mask28
+
+	// Subtract p once if the value is at least p. The limbs of p are all
+	// 2^28 - 1, except limb 8 which is 2^28 - 2.
+	var s fe
+	var borrow uint64
+	for i := range s {
+		pi := uint64(mask28)
+		if i == 8 {
+			pi--
+		}
+		d := t[i] - pi - borrow
+		s[i] = d & mask28
+		borrow = d >> 63
+	}
+	borrow = (top - borrow) >> 63
+	t.condSwap(&s, 1-borrow)
+
+	out := make([]byte, PointSize)
+	for j := 0; j < 8; j++ {
+		w := t[2*j] | t[2*j+1]<<28
+		for i := 0; i < 7; i++ {
+			out[7*j+i] = byte(w >> (8 * i))
+		}
+	}
+	return out
+}
+
+// carry reduces the limbs of v to 28 bits, folding the top carry as
+// 2^448 = 2^224 + 1 mod p. Limbs 0 and 8 might be left one above 2^28 - 1.
+func (v *fe) carry() {
+	for pass := 0; pass < 2; pass++ {
+		for i := 0; i < 15; i++ {
+			v[i+1] += v[i] >> 28
+			v[i] &= mask28
+		}
+		c := v[15] >> 28
+		v[15] &= mask28
+		v[0] += c
+		v[8] += c
+	}
+}
+
+func (v *fe) add(a, b *fe) {
+	for i := range v {
+		v[i] = a[i] + b[i]
+	}
+	v.carry()
+}
+
+// sub sets v = a - b, adding 4p to avoid underflow.
+func (v *fe) sub(a, b *fe) {
+	for i := range v {
+		fourP := uint64(4 * mask28)
+		if i == 8 {
+			fourP -= 4
+		}
+		v[i] = a[i] + fourP - b[i]
+	}
+	v.carry()
+}
+
+func (v *fe) mulSmall(a *fe, s uint64) {
+	for i := range v {
+		v[i] = a[i] * s
+	}
+	v.carry()
+}
+
+func (v *fe) mul(a, b *fe) {
+	// Each product is at most 2^56, so each column sum is below 2^61.
+	var c [32]uint64
+	for i := 0; i < 16; i++ {
+		for j := 0; j < 16; j++ {
+			c[i+j] += a[i] * b[j]
+		}
+	}
+	for i := 0; i < 31; i++ {
+		c[i+1] += c[i] >> 28
+		c[i] &= mask28
+	}
+	// Fold limbs 16 and up, since 2^448 = 2^224 + 1 mod p. Going from the top
+	// ensures limbs folded into the upper half are folded again.
+	for i := 31; i >= 16; i-- {
+		c[i-16] += c[i]
+		c[i-8] += c[i]
+	}
+	copy(v[:], c[:16])
+	v.carry()
+}
+
+// condSwap swaps v and u if cond is 1, and leaves them unchanged if it's 0.
+func (v *fe) condSwap(u *fe, cond uint64) {
+	m := -cond
+	for i := range v {
+		t := m & (v[i] ^ u[i])
+		v[i] ^= t
+		u[i] ^= t
+	}
+}
+
+// invert sets v = a^(p-2). The exponent p - 2 = 2^448 - 2^224 - 3 has all bits
+// set except bits 224 and 1.
+func (v *fe) invert(a *fe) {
+	x := *a
+	var r fe
+	r[0] = 1
+	for i := 447; i >= 0; i-- {
+		r.mul(&r, &r)
+		if i != 224 && i != 1 {
+			r.mul(&r, &x)
+		}
+	}
+	*v = r
+}
@@ -0,0 +1,129 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"time"
+
+	"filippo.io/age/internal/format"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// A passphraseKDF derives wrapping keys from passphrases for a type of
+// passphrase stanza.
+//
+// Passphrase stanzas have two arguments, a random salt and the decimal base-2
+// logarithm of the work factor, and the file key wrapped with the derived key
+// as the body. To preserve the authentication properties of passphrases, they
+// must be the only stanza in the header.
+type passphraseKDF interface {
+	// stanzaType returns the stanza type, such as "scrypt".
+	stanzaType() string
+
+	// deriveKey derives a ChaCha20Poly1305 key from password and salt, with
+	// label for domain separation and a work factor of 2^logN.
+	deriveKey(label string, password, salt []byte, logN int) ([]byte, error)
+
+	// duration estimates how long deriveKey takes with a work factor of 2^logN
+	// on a modern machine.
+	duration(logN int) time.Duration
+}
+
+// passphraseKDFs are the implemented passphrase stanza types.
+var passphraseKDFs = map[string]passphraseKDF{
+	"scrypt": scryptKDF{},
+}
+
+// checkPassphraseAlone returns an error if stanzas include a passphrase
+// stanza alongside any other stanza.
+func checkPassphraseAlone(stanzas []*Stanza) error {
+	for _, s := range stanzas {
+		if _, ok := passphraseKDFs[s.Type]; ok && len(stanzas) != 1 {
+			return fmt.Errorf("an %s recipient must be the only one", s.Type)
+		}
+	}
+	return nil
+}
+
+const passphraseSaltSize = 16
+
+// newPassphraseSalt reads a new salt from rand.
+func newPassphraseSalt(rand io.Reader) ([]byte, error) {
+	salt := make([]byte, passphraseSaltSize)
+	if _, err := io.ReadFull(rand, salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// passphrasePolicy is the work factor policy applied by passphrase identities.
+type passphrasePolicy struct {
+	maxWorkFactor int
+
+	confirmWorkFactor int
+	confirm           func(logN int, estimate time.Duration) bool
+}
+
+var digitsRe = regexp.MustCompile(`^[1-9][0-9]*$`)
+
+// deriveKey parses the salt and work factor arguments of a passphrase stanza,
+// checks the work factor against the policy, and derives the corresponding
+// wrapping key from the password and label with kdf.
+func (p *passphrasePolicy) deriveKey(kdf passphraseKDF, label string, password []byte, saltArg, logNArg string) ([]byte, error) {
+	name := kdf.stanzaType()
+	salt, err := format.DecodeString(saltArg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s salt: %v", name, err)
+	}
+	if len(salt) != passphraseSaltSize {
+		return nil, fmt.Errorf("invalid %s recipient block", name)
+	}
+	if !digitsRe.MatchString(logNArg) {
+		return nil, fmt.Errorf("%s work factor encoding invalid: %q", name, logNArg)
+	}
+	logN, err := strconv.Atoi(logNArg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s work factor: %v", name, err)
+	}
+	if logN > p.maxWorkFactor {
+		return nil, fmt.Errorf("%s work factor too large: %v", name, logN)
+	}
+	if logN <= 0 { // unreachable
+		return nil, fmt.Errorf("invalid %s work factor: %v", name, logN)
+	}
+	if p.confirm != nil && logN > p.confirmWorkFactor {
+		if !p.confirm(logN, kdf.duration(logN)) {
+			return nil, fmt.Errorf("%s work factor %v not confirmed", name, logN)
+		}
+	}
+	return kdf.deriveKey(label, password, salt, logN)
+}
+
+// scryptKDF implements the "scrypt" passphrase stanza.
+type scryptKDF struct{}
+
+func (scryptKDF) stanzaType() string { return "scrypt" }
+
+func (scryptKDF) deriveKey(label string, password, salt []byte, logN int) ([]byte, error) {
+	salt = append([]byte(label), salt...)
+	k, err := scrypt.Key(password, salt, 1<<logN, 8, 1, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate scrypt hash: %v", err)
+	}
+	return k, nil
+}
+
+// duration is based on 2^18 taking about one second.
+func (scryptKDF) duration(logN int) time.Duration {
+	if logN >= 18 {
+		return time.Second << (logN - 18)
+	}
+	return time.Second >> (18 - logN)
+}
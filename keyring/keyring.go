@@ -0,0 +1,178 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package keyring implements a set of identities loaded from files on disk,
+// which can be reloaded without restarting long-running processes.
+package keyring
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"filippo.io/age"
+)
+
+// A Watcher holds the identities listed in a set of identity files and
+// directories, and reloads them when the files change.
+//
+// A Watcher is itself an age.Identity, so it can be passed directly to
+// age.Decrypt. Each call to Unwrap uses a consistent set of identities, even if
+// a reload happens concurrently.
+type Watcher struct {
+	paths []string
+
+	mu   sync.Mutex // serializes reloads
+	keys atomic.Pointer[keySet]
+}
+
+var _ age.Identity = &Watcher{}
+
+type keySet struct {
+	identities []age.Identity
+	state      string
+}
+
+// NewWatcher returns a Watcher for the identity files and directories at paths,
+// and loads them for the first time.
+//
+// Files are parsed with age.ParseIdentities. Directories are not recursed into,
+// and all the regular files inside them are loaded, except those with names
+// starting with ".", which allows replacing files atomically with a rename.
+func NewWatcher(paths ...string) (*Watcher, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("no paths specified")
+	}
+	w := &Watcher{paths: paths}
+	if err := w.Reload(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Identities returns the current set of identities.
+func (w *Watcher) Identities() []age.Identity {
+	return w.keys.Load().identities
+}
+
+// Unwrap implements age.Identity by trying each of the current identities in
+// turn, like age.Decrypt.
+func (w *Watcher) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	for _, id := range w.Identities() {
+		fileKey, err := id.Unwrap(stanzas)
+		if errors.Is(err, age.ErrIncorrectIdentity) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return fileKey, nil
+	}
+	return nil, age.ErrIncorrectIdentity
+}
+
+// Reload checks if any of the files changed, and if so reloads all of them and
+// swaps the set of identities used by the Watcher.
+//
+// If any file fails to load, the previous set of identities is retained and
+// the error is returned.
+func (w *Watcher) Reload() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	files, state, err := w.scan()
+	if err != nil {
+		return err
+	}
+	if old := w.keys.Load(); old != nil && old.state == state {
+		return nil
+	}
+
+	var ids []age.Identity
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			return fmt.Errorf("failed to open identity file: %v", err)
+		}
+		i, err := age.ParseIdentities(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to parse %q: %v", name, err)
+		}
+		ids = append(ids, i...)
+	}
+	if len(ids) == 0 {
+		return errors.New("no identities found")
+	}
+
+	w.keys.Store(&keySet{identities: ids, state: state})
+	return nil
+}
+
+// scan returns the list of files to load, and a string summarizing their
+// names, sizes, and modification times.
+func (w *Watcher) scan() (files []string, state string, err error) {
+	var buf bytes.Buffer
+	add := func(name string, fi os.FileInfo) {
+		files = append(files, name)
+		fmt.Fprintf(&buf, "%q %d %d\n", name, fi.Size(), fi.ModTime().UnixNano())
+	}
+	for _, p := range w.paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, "", err
+		}
+		if !fi.IsDir() {
+			add(p, fi)
+			continue
+		}
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return nil, "", err
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Name() < entries[j].Name()
+		})
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			name := filepath.Join(p, e.Name())
+			// Follow symlinks, like os.Stat above.
+			fi, err := os.Stat(name)
+			if err != nil {
+				return nil, "", err
+			}
+			if fi.Mode().IsRegular() {
+				add(name, fi)
+			}
+		}
+	}
+	return files, buf.String(), nil
+}
+
+// Watch calls Reload every interval until ctx is canceled. If Reload fails,
+// onError is invoked, if not nil, and the previous identities stay in use.
+func (w *Watcher) Watch(ctx context.Context, interval time.Duration, onError func(error)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := w.Reload(); err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
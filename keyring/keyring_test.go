@@ -0,0 +1,93 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package keyring_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/keyring"
+)
+
+func encryptTo(t *testing.T, r age.Recipient) []byte {
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func writeKey(t *testing.T, name string, i *age.X25519Identity, mtime time.Time) {
+	if err := os.WriteFile(name, []byte(i.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(name, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatcherReload(t *testing.T) {
+	dir := t.TempDir()
+	i1, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	i2, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file1, file2 := encryptTo(t, i1.Recipient()), encryptTo(t, i2.Recipient())
+
+	name := filepath.Join(dir, "keys.txt")
+	writeKey(t, name, i1, time.Unix(1000, 0))
+	if err := os.WriteFile(filepath.Join(dir, ".hidden"), []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := keyring.NewWatcher(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.Decrypt(bytes.NewReader(file1), w); err != nil {
+		t.Errorf("expected first key to work, got %v", err)
+	}
+	if _, err := age.Decrypt(bytes.NewReader(file2), w); err == nil {
+		t.Error("expected second key to fail before reload")
+	}
+
+	writeKey(t, name, i2, time.Unix(2000, 0))
+	if err := w.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.Decrypt(bytes.NewReader(file2), w); err != nil {
+		t.Errorf("expected second key to work after reload, got %v", err)
+	}
+	if _, err := age.Decrypt(bytes.NewReader(file1), w); err == nil {
+		t.Error("expected first key to fail after reload")
+	}
+
+	// A broken file must not replace the working set.
+	if err := os.WriteFile(name, []byte("AGE-SECRET-KEY-1XXX\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Reload(); err == nil {
+		t.Error("expected broken file to fail to reload")
+	}
+	if _, err := age.Decrypt(bytes.NewReader(file2), w); err != nil {
+		t.Errorf("expected previous key to still work, got %v", err)
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"fmt"
+
+	"filippo.io/age/internal/format"
+)
+
+// A Logger receives debug events, such as the types of the stanzas written or
+// parsed, and the outcome of each identity match attempt. File keys, secret
+// keys, and stanza bodies are never logged.
+//
+// A *log/slog.Logger can be used as a Logger.
+type Logger interface {
+	Debug(msg string, args ...any)
+}
+
+func (opts *Options) debug(msg string, args ...any) {
+	if opts != nil && opts.Logger != nil {
+		opts.Logger.Debug(msg, args...)
+	}
+}
+
+func stanzaTypes(stanzas []*format.Stanza) []string {
+	types := make([]string, 0, len(stanzas))
+	for _, s := range stanzas {
+		types = append(types, s.Type)
+	}
+	return types
+}
+
+func typeName(v any) string {
+	return fmt.Sprintf("%T", v)
+}
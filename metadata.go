@@ -0,0 +1,107 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"filippo.io/age/internal/format"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Metadata is optional information about the plaintext, stored encrypted in
+// the header of a file. It's only included if set in Options.Metadata, since
+// file names and timestamps can be sensitive.
+//
+// The metadata is encrypted with a key derived from the file key, in a stanza
+// of type "metadata". Decrypt ignores it, and DecryptWithResult returns it in
+// DecryptResult.Metadata.
+//
+// Note that versions of age that don't support metadata will refuse to
+// decrypt passphrase-encrypted files that include it, since the scrypt stanza
+// is required to be the only one.
+type Metadata struct {
+	// Name is the original file name, without any directory component.
+	Name string
+	// ModTime is the modification time of the original file. It's stored with
+	// a precision of one second.
+	ModTime time.Time
+	// ContentType is the MIME type of the plaintext.
+	ContentType string
+}
+
+type metadataJSON struct {
+	Name        string `json:"name,omitempty"`
+	ModTime     int64  `json:"mtime,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+const metadataStanzaType = "metadata"
+
+// maxMetadataSize is the maximum size of the encoded metadata.
+const maxMetadataSize = 4096
+
+func metadataKey(fileKey []byte) []byte {
+	h := hkdf.New(sha256.New, fileKey, nil, []byte("metadata"))
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(h, key); err != nil {
+		panic("age: internal error: failed to read from HKDF: " + err.Error())
+	}
+	return key
+}
+
+func (m *Metadata) stanza(fileKey []byte) (*format.Stanza, error) {
+	mj := &metadataJSON{Name: m.Name, ContentType: m.ContentType}
+	if !m.ModTime.IsZero() {
+		mj.ModTime = m.ModTime.Unix()
+	}
+	plaintext, err := json.Marshal(mj)
+	if err != nil {
+		return nil, err
+	}
+	if len(plaintext) > maxMetadataSize {
+		return nil, errors.New("metadata too large")
+	}
+	body, err := aeadEncrypt(metadataKey(fileKey), plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return &format.Stanza{Type: metadataStanzaType, Body: body}, nil
+}
+
+// parseMetadata returns the metadata in s, which must be a metadata stanza from
+// a header authenticated with fileKey.
+func parseMetadata(s *format.Stanza, fileKey []byte) (*Metadata, error) {
+	if len(s.Args) != 0 {
+		return nil, errors.New("invalid metadata stanza")
+	}
+	if len(s.Body) > maxMetadataSize+chacha20poly1305.Overhead {
+		return nil, errors.New("invalid metadata stanza: too large")
+	}
+	aead, err := chacha20poly1305.New(metadataKey(fileKey))
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	plaintext, err := aead.Open(nil, nonce, s.Body, nil)
+	if err != nil {
+		return nil, errors.New("failed to decrypt metadata")
+	}
+	mj := &metadataJSON{}
+	if err := json.Unmarshal(plaintext, mj); err != nil {
+		return nil, fmt.Errorf("malformed metadata: %v", err)
+	}
+	m := &Metadata{Name: mj.Name, ContentType: mj.ContentType}
+	if mj.ModTime != 0 {
+		m.ModTime = time.Unix(mj.ModTime, 0)
+	}
+	return m, nil
+}
@@ -0,0 +1,195 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.24 && age_mlkem
+
+package age
+
+import (
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"filippo.io/age/bech32"
+	"filippo.io/age/internal/format"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const mlkemLabel = "age-encryption.org/v1/mlkem1024"
+
+func init() {
+	knownStanzaTypes["mlkem1024"] = true
+	knownLabels["postquantum"] = true
+	identityParsers = append(identityParsers, struct {
+		prefix string
+		parse  func(string) (Identity, error)
+	}{"AGE-SECRET-KEY-MLKEM-1", func(s string) (Identity, error) { return ParseMLKEMIdentity(s) }})
+}
+
+// MLKEMRecipient is an EXPERIMENTAL pure post-quantum recipient, which wraps
+// the file key with ML-KEM-1024 (FIPS 203) and no classical component. It's
+// only available when building with the "age_mlkem" build tag, and it's meant
+// for research and interoperability testing with other implementations. Its
+// format might change or be removed in future versions.
+//
+// Files encrypted to an MLKEMRecipient always carry the "postquantum" label, so
+// they can't be encrypted to classical recipients at the same time.
+type MLKEMRecipient struct {
+	ek *mlkem.EncapsulationKey1024
+}
+
+var _ Recipient = &MLKEMRecipient{}
+var _ RecipientWithLabels = &MLKEMRecipient{}
+
+// ParseMLKEMRecipient returns a new MLKEMRecipient from a Bech32 public key
+// encoding with the "age1mlkem1" prefix.
+func ParseMLKEMRecipient(s string) (*MLKEMRecipient, error) {
+	t, k, err := bech32.Decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("malformed recipient %q: %v", s, err)
+	}
+	if t != "age1mlkem" {
+		return nil, fmt.Errorf("malformed recipient %q: invalid type %q", s, t)
+	}
+	ek, err := mlkem.NewEncapsulationKey1024(k)
+	if err != nil {
+		return nil, fmt.Errorf("malformed recipient %q: %v", s, err)
+	}
+	return &MLKEMRecipient{ek: ek}, nil
+}
+
+func (r *MLKEMRecipient) Wrap(fileKey []byte) ([]*Stanza, error) {
+	stanzas, _, err := r.WrapWithLabels(fileKey)
+	return stanzas, err
+}
+
+// WrapWithLabels implements [age.RecipientWithLabels], returning the
+// "postquantum" label.
+func (r *MLKEMRecipient) WrapWithLabels(fileKey []byte) (stanzas []*Stanza, labels []string, err error) {
+	sharedKey, ciphertext := r.ek.Encapsulate()
+	wrappingKey, err := mlkemWrappingKey(sharedKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	wrappedKey, err := aeadEncrypt(wrappingKey, fileKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	l := &Stanza{
+		Type: "mlkem1024",
+		Args: []string{format.EncodeToString(ciphertext)},
+		Body: wrappedKey,
+	}
+	return []*Stanza{l}, []string{"postquantum"}, nil
+}
+
+// String returns the Bech32 public key encoding of r.
+func (r *MLKEMRecipient) String() string {
+	s, _ := bech32.Encode("age1mlkem", r.ek.Bytes())
+	return s
+}
+
+// MLKEMIdentity is the EXPERIMENTAL private key corresponding to an
+// MLKEMRecipient. It's only available when building with the "age_mlkem"
+// build tag.
+type MLKEMIdentity struct {
+	dk *mlkem.DecapsulationKey1024
+}
+
+var _ Identity = &MLKEMIdentity{}
+
+// GenerateMLKEMIdentity randomly generates a new MLKEMIdentity.
+func GenerateMLKEMIdentity() (*MLKEMIdentity, error) {
+	seed := make([]byte, mlkem.SeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, fmt.Errorf("internal error: %v", err)
+	}
+	dk, err := mlkem.NewDecapsulationKey1024(seed)
+	if err != nil {
+		return nil, fmt.Errorf("internal error: %v", err)
+	}
+	return &MLKEMIdentity{dk: dk}, nil
+}
+
+// ParseMLKEMIdentity returns a new MLKEMIdentity from a Bech32 private key
+// encoding with the "AGE-SECRET-KEY-MLKEM-1" prefix, which encodes the 64-byte
+// ML-KEM seed.
+func ParseMLKEMIdentity(s string) (*MLKEMIdentity, error) {
+	t, k, err := bech32.Decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("malformed secret key: %v", err)
+	}
+	if t != "AGE-SECRET-KEY-MLKEM-" {
+		return nil, fmt.Errorf("malformed secret key: unknown type %q", t)
+	}
+	dk, err := mlkem.NewDecapsulationKey1024(k)
+	if err != nil {
+		return nil, fmt.Errorf("malformed secret key: %v", err)
+	}
+	return &MLKEMIdentity{dk: dk}, nil
+}
+
+func (i *MLKEMIdentity) Unwrap(stanzas []*Stanza) ([]byte, error) {
+	return multiUnwrap(i.unwrap, stanzas)
+}
+
+func (i *MLKEMIdentity) unwrap(block *Stanza) ([]byte, error) {
+	if block.Type != "mlkem1024" {
+		return nil, ErrIncorrectIdentity
+	}
+	if len(block.Args) != 1 {
+		return nil, errors.New("invalid mlkem1024 recipient block")
+	}
+	ciphertext, err := format.DecodeString(block.Args[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse mlkem1024 recipient: %v", err)
+	}
+	if len(ciphertext) != mlkem.CiphertextSize1024 {
+		return nil, errors.New("invalid mlkem1024 recipient block")
+	}
+
+	// ML-KEM uses implicit rejection, so a ciphertext for a different key
+	// produces a random shared key, and the AEAD decryption below fails.
+	sharedKey, err := i.dk.Decapsulate(ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mlkem1024 recipient: %v", err)
+	}
+	wrappingKey, err := mlkemWrappingKey(sharedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	fileKey, err := aeadDecrypt(wrappingKey, fileKeySize, block.Body)
+	if err == errIncorrectCiphertextSize {
+		return nil, errors.New("invalid mlkem1024 recipient block: incorrect file key size")
+	} else if err != nil {
+		return nil, ErrIncorrectIdentity
+	}
+	return fileKey, nil
+}
+
+// Recipient returns the public MLKEMRecipient value corresponding to i.
+func (i *MLKEMIdentity) Recipient() *MLKEMRecipient {
+	return &MLKEMRecipient{ek: i.dk.EncapsulationKey()}
+}
+
+// String returns the Bech32 private key encoding of i.
+func (i *MLKEMIdentity) String() string {
+	s, _ := bech32.Encode("AGE-SECRET-KEY-MLKEM-", i.dk.Bytes())
+	return strings.ToUpper(s)
+}
+
+func mlkemWrappingKey(sharedKey []byte) ([]byte, error) {
+	h := hkdf.New(sha256.New, sharedKey, nil, []byte(mlkemLabel))
+	wrappingKey := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(h, wrappingKey); err != nil {
+		return nil, err
+	}
+	return wrappingKey, nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.24 && age_mlkem
+
+package age_test
+
+import (
+	"bytes"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func TestMLKEMRoundTrip(t *testing.T) {
+	i, err := age.GenerateMLKEMIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := i.Recipient()
+
+	if r1, err := age.ParseMLKEMRecipient(r.String()); err != nil {
+		t.Fatal(err)
+	} else if r1.String() != r.String() {
+		t.Errorf("recipient did not round-trip through parsing")
+	}
+	if i1, err := age.ParseMLKEMIdentity(i.String()); err != nil {
+		t.Fatal(err)
+	} else if i1.String() != i.String() {
+		t.Errorf("identity did not round-trip through parsing")
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := age.Decrypt(buf, i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outBytes, err := io.ReadAll(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(outBytes) != helloWorld {
+		t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+	}
+
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.Encrypt(io.Discard, r, other.Recipient()); err == nil {
+		t.Error("expected mlkem1024 mixed with x25519 to fail")
+	}
+}
+
+func TestMLKEMFeatures(t *testing.T) {
+	f := age.Features()
+	if !slices.Contains(f.StanzaTypes, "mlkem1024") || !slices.Contains(f.Labels, "postquantum") {
+		t.Errorf("ML-KEM missing from features: %+v", f)
+	}
+}
+
+func TestMLKEMParseIdentities(t *testing.T) {
+	i, err := age.GenerateMLKEMIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := age.ParseIdentities(strings.NewReader("# ML-KEM\n" + i.String() + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 {
+		t.Fatalf("got %d identities, want 1", len(ids))
+	}
+	if id, ok := ids[0].(*age.MLKEMIdentity); !ok || id.String() != i.String() {
+		t.Errorf("got %T, want the generated *age.MLKEMIdentity", ids[0])
+	}
+}
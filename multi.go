@@ -0,0 +1,104 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+
+	"filippo.io/age/internal/format"
+	"filippo.io/age/stream"
+)
+
+// MultiDecryptor decrypts a sequence of binary age files concatenated in a
+// single stream, for example records appended to a log file by independent
+// Encrypt operations. Files are read sequentially, like with archive/tar.
+//
+// Each file is decrypted and authenticated independently, and might be
+// encrypted to different recipients, as long as one of the identities matches
+// each file. Note that the sequence as a whole is not authenticated: files can
+// be dropped, reordered, or duplicated without detection.
+type MultiDecryptor struct {
+	src        *bufio.Reader
+	identities []Identity
+	cur        io.Reader
+	err        error
+}
+
+// NewMultiDecryptor returns a MultiDecryptor reading concatenated age files
+// from src. All identities will be tried until one successfully decrypts each
+// file.
+func NewMultiDecryptor(src io.Reader, identities ...Identity) *MultiDecryptor {
+	return &MultiDecryptor{
+		src:        bufio.NewReaderSize(src, 2*stream.ChunkSize),
+		identities: identities,
+	}
+}
+
+// Next returns a Reader reading the decrypted plaintext of the next file in
+// the stream, or io.EOF if there are no more files.
+//
+// If the Reader returned by the previous call was not read until EOF, Next
+// reads and authenticates the rest of it. Any error, including a decryption
+// error of a previous file, is returned by all subsequent calls.
+func (d *MultiDecryptor) Next() (io.Reader, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	r, err := d.next()
+	if err != nil {
+		d.err = err
+		return nil, err
+	}
+	return r, nil
+}
+
+func (d *MultiDecryptor) next() (io.Reader, error) {
+	if len(d.identities) == 0 {
+		return nil, errors.New("no identities specified")
+	}
+	if d.cur != nil {
+		if _, err := io.Copy(io.Discard, d.cur); err != nil {
+			return nil, err
+		}
+		d.cur = nil
+	}
+	if _, err := d.src.Peek(1); err == io.EOF {
+		return nil, io.EOF
+	}
+
+	// Parse will use d.src directly, without additional buffering, since its
+	// buffer is already large enough.
+	hdr, _, err := format.Parse(d.src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", headerError(err))
+	}
+	fileKey, _, err := decryptHdr(hdr, nil, d.identities...)
+	if err != nil {
+		return nil, err
+	}
+	// The end of each file is found by peeking at a whole chunk and the
+	// following version line, so the buffer is sized for the default.
+	if chunkSize, err := payloadChunkSize(hdr); err != nil {
+		return nil, err
+	} else if chunkSize != stream.ChunkSize {
+		return nil, fmt.Errorf("files with a chunk size of %d bytes are not supported", chunkSize)
+	}
+	nonce := make([]byte, streamNonceSize)
+	if _, err := io.ReadFull(d.src, nonce); err != nil {
+		return nil, fmt.Errorf("failed to read nonce: %w", err)
+	}
+
+	// The next file, if any, starts with the version line.
+	delim := []byte(format.V1.Name + "\n")
+	r, err := stream.NewDelimitedReader(streamKey(fileKey, nonce), d.src, delim)
+	if err != nil {
+		return nil, err
+	}
+	d.cur = r
+	return r, nil
+}
@@ -0,0 +1,292 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+
+	"filippo.io/age/stream"
+)
+
+// A ParallelWriter encrypts a payload of known size into an io.WriterAt, one
+// 64KiB chunk (or Options.ChunkSize) at a time, possibly concurrently and out
+// of order. It's returned by EncryptAt.
+type ParallelWriter struct {
+	dst       io.WriterAt
+	sealer    *stream.ChunkSealer
+	size      int64
+	start     int64 // offset of the first payload chunk in dst
+	chunks    int64
+	chunkSize int64
+
+	mu      sync.Mutex
+	written []uint64 // bitmap of the chunks that were written or attempted
+	count   int64    // number of chunks successfully written
+	closed  bool
+}
+
+// EncryptAt encrypts a file to one or more recipients, writing the header
+// to dst at offset zero, and returns a ParallelWriter to encrypt the size bytes
+// of plaintext at their offsets in dst. This allows multiple workers to seal
+// and write chunks concurrently, for example as parts of an object store
+// multipart upload, with the same result as Encrypt.
+//
+// The header is written before EncryptAt returns, since its size is known
+// before encrypting the payload. opts may be nil. The output is not armored.
+func EncryptAt(dst io.WriterAt, size int64, opts *Options, recipients ...Recipient) (*ParallelWriter, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if size < 0 {
+		return nil, errors.New("negative payload size")
+	}
+	prefix, sealer, err := encryptPrefix(opts, recipients)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dst.WriteAt(prefix, 0); err != nil {
+		return nil, fmt.Errorf("failed to write header: %v", err)
+	}
+	chunks := chunkCount(size, opts.chunkSize())
+	return &ParallelWriter{
+		dst: dst, sealer: sealer, size: size,
+		start: int64(len(prefix)), chunks: chunks, chunkSize: int64(opts.chunkSize()),
+		written: make([]uint64, (chunks+63)/64),
+	}, nil
+}
+
+// encryptPrefix generates a file key, and returns the encoded header followed
+// by the payload nonce, and a ChunkSealer for the payload.
+func encryptPrefix(opts *Options, recipients []Recipient) ([]byte, *stream.ChunkSealer, error) {
+	if len(recipients) == 0 {
+		return nil, nil, errors.New("no recipients specified")
+	}
+	fileKey := make([]byte, fileKeySize)
+	if _, err := io.ReadFull(opts.rand(), fileKey); err != nil {
+		return nil, nil, err
+	}
+	hdr, err := encryptHdr(fileKey, opts, recipients...)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, streamNonceSize)
+	if _, err := io.ReadFull(opts.rand(), nonce); err != nil {
+		return nil, nil, err
+	}
+	if opts.SigningKey != nil {
+		if err := signHeader(hdr, fileKey, nonce, opts.SigningKey); err != nil {
+			return nil, nil, fmt.Errorf("failed to sign header: %v", err)
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := hdr.Marshal(buf); err != nil {
+		return nil, nil, fmt.Errorf("failed to write header: %v", err)
+	}
+	buf.Write(nonce)
+	sealer, err := stream.NewChunkSealerSize(streamKey(fileKey, nonce), opts.chunkSize())
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), sealer, nil
+}
+
+// chunkCount returns the number of chunks of chunkSize bytes of a payload of
+// size bytes. An empty payload is encrypted as a single empty chunk.
+func chunkCount(size int64, chunkSize int) int64 {
+	if size == 0 {
+		return 1
+	}
+	return (size + int64(chunkSize) - 1) / int64(chunkSize)
+}
+
+// EncryptedSize returns the total size of the encrypted file, including the
+// header.
+func (w *ParallelWriter) EncryptedSize() int64 {
+	overhead := int64(stream.EncryptedChunkSize - stream.ChunkSize)
+	return w.start + w.size + w.chunks*overhead
+}
+
+// WriteAt encrypts p, which is the plaintext at offset off, and writes it to
+// the corresponding offset in the destination. off must be a multiple of the
+// chunk size, 64KiB unless Options.ChunkSize was set, and the length of p must
+// be a multiple of the chunk size, unless p ends at the end of the plaintext.
+//
+// WriteAt can be called concurrently, but each chunk can only be written once,
+// as rewriting it would reuse the same nonce. If WriteAt returns an error, the
+// whole file must be discarded.
+func (w *ParallelWriter) WriteAt(p []byte, off int64) (n int, err error) {
+	end := off + int64(len(p))
+	switch {
+	case off < 0 || end > w.size:
+		return 0, errors.New("write outside the payload")
+	case off%w.chunkSize != 0:
+		return 0, errors.New("write offset is not a multiple of the chunk size")
+	case int64(len(p))%w.chunkSize != 0 && end != w.size:
+		return 0, errors.New("write length is not a multiple of the chunk size")
+	}
+
+	overhead := int64(stream.EncryptedChunkSize - stream.ChunkSize)
+	buf := make([]byte, 0, w.chunkSize+overhead)
+	for len(p) > 0 {
+		i := off / w.chunkSize
+		chunk := p
+		if int64(len(chunk)) > w.chunkSize {
+			chunk = chunk[:w.chunkSize]
+		}
+		if err := w.writeChunk(buf, chunk, i); err != nil {
+			return n, err
+		}
+		p = p[len(chunk):]
+		off += int64(len(chunk))
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+func (w *ParallelWriter) writeChunk(buf, p []byte, i int64) error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return errors.New("ParallelWriter is closed")
+	}
+	if w.written[i/64]&(1<<(i%64)) != 0 {
+		w.mu.Unlock()
+		return fmt.Errorf("chunk %d was already written", i)
+	}
+	w.written[i/64] |= 1 << (i % 64)
+	w.mu.Unlock()
+
+	last := i == w.chunks-1
+	buf = w.sealer.Seal(buf[:0], p, uint64(i), last)
+	overhead := int64(stream.EncryptedChunkSize - stream.ChunkSize)
+	if _, err := w.dst.WriteAt(buf, w.start+i*(w.chunkSize+overhead)); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	w.count++
+	w.mu.Unlock()
+	return nil
+}
+
+// Close checks that the whole plaintext was written, and writes the final
+// chunk if the plaintext is empty. It does not close the destination.
+func (w *ParallelWriter) Close() error {
+	if w.size == 0 {
+		if err := w.writeChunk(nil, nil, 0); err != nil {
+			return err
+		}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return errors.New("ParallelWriter is already closed")
+	}
+	w.closed = true
+	if w.count != w.chunks {
+		return fmt.Errorf("%d of %d chunks were not written", w.chunks-w.count, w.chunks)
+	}
+	return nil
+}
+
+// EncryptFrom encrypts the size bytes of plaintext read from src to one or more
+// recipients, and writes the file to dst. Chunks are read from src and
+// encrypted concurrently, and written to dst in order, which speeds up the
+// encryption of large files on high-latency storage. The output is the same as
+// that of Encrypt.
+//
+// opts may be nil. The output is not armored, and dst is not closed.
+func EncryptFrom(dst io.Writer, src io.ReaderAt, size int64, opts *Options, recipients ...Recipient) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if size < 0 {
+		return errors.New("negative payload size")
+	}
+	prefix, sealer, err := encryptPrefix(opts, recipients)
+	if err != nil {
+		return err
+	}
+	if _, err := dst.Write(prefix); err != nil {
+		return fmt.Errorf("failed to write header: %v", err)
+	}
+
+	type result struct {
+		buf []byte
+		err error
+	}
+	type job struct {
+		index  int64
+		result chan result
+	}
+	workers := runtime.GOMAXPROCS(0)
+	if opts.Concurrency > 0 {
+		workers = opts.Concurrency
+	}
+	chunkSize := int64(opts.chunkSize())
+	overhead := int64(stream.EncryptedChunkSize - stream.ChunkSize)
+	chunks := chunkCount(size, opts.chunkSize())
+	jobs := make(chan job)
+	// pending holds the result channels of the chunks being processed, in
+	// order, and its capacity bounds the number of chunks in memory.
+	pending := make(chan chan result, 2*workers)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		defer close(jobs)
+		defer close(pending)
+		for i := int64(0); i < chunks; i++ {
+			j := job{index: i, result: make(chan result, 1)}
+			select {
+			case pending <- j.result:
+			case <-done:
+				return
+			}
+			select {
+			case jobs <- j:
+			case <-done:
+				return
+			}
+		}
+	}()
+	for w := 0; w < workers; w++ {
+		go func() {
+			for j := range jobs {
+				off := j.index * chunkSize
+				n := size - off
+				if n > chunkSize {
+					n = chunkSize
+				}
+				buf := make([]byte, n, chunkSize+overhead)
+				if m, err := src.ReadAt(buf, off); err != nil && !(err == io.EOF && m == len(buf)) {
+					if err == io.EOF {
+						err = io.ErrUnexpectedEOF
+					}
+					j.result <- result{err: fmt.Errorf("failed to read chunk %d: %w", j.index, err)}
+					continue
+				}
+				last := j.index == chunks-1
+				j.result <- result{buf: sealer.Seal(buf[:0], buf, uint64(j.index), last)}
+			}
+		}()
+	}
+
+	for c := range pending {
+		r := <-c
+		if r.err != nil {
+			return r.err
+		}
+		if _, err := dst.Write(r.buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
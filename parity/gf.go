@@ -0,0 +1,105 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package parity
+
+import "errors"
+
+// Arithmetic in GF(2^8) with the polynomial x^8 + x^4 + x^3 + x^2 + 1 (0x11d)
+// and generator 2, as used by most Reed-Solomon implementations.
+
+var (
+	gfExp [512]byte
+	gfLog [256]byte
+	// gfMul is the full multiplication table, so that multiplying a block by
+	// a constant is a table lookup per byte.
+	gfMul [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMul[a][b] = gfExp[int(gfLog[a])+int(gfLog[b])]
+		}
+	}
+}
+
+func gfInv(a byte) byte {
+	if a == 0 {
+		panic("parity: internal error: inverse of zero")
+	}
+	return gfExp[255-int(gfLog[a])]
+}
+
+// mulAdd sets dst to dst + c * src, element-wise.
+func mulAdd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	t := &gfMul[c]
+	src = src[:len(dst)]
+	for i, b := range src {
+		dst[i] ^= t[b]
+	}
+}
+
+// cauchy returns the coefficient of data block j in parity block i, for a
+// stripe of k data blocks. Every square submatrix of a Cauchy matrix is
+// invertible, so any k of the data and parity blocks determine the rest.
+func cauchy(k, i, j int) byte {
+	return gfInv(byte(k+i) ^ byte(j))
+}
+
+// invert inverts the n x n matrix m in place, with Gauss-Jordan elimination.
+func invert(m [][]byte) error {
+	n := len(m)
+	inv := make([][]byte, n)
+	for i := range inv {
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for row := col; row < n; row++ {
+			if m[row][col] != 0 {
+				pivot = row
+				break
+			}
+		}
+		if pivot < 0 {
+			return errors.New("singular matrix")
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+		c := gfInv(m[col][col])
+		for j := 0; j < n; j++ {
+			m[col][j] = gfMul[c][m[col][j]]
+			inv[col][j] = gfMul[c][inv[col][j]]
+		}
+		for row := 0; row < n; row++ {
+			if row == col || m[row][col] == 0 {
+				continue
+			}
+			f := m[row][col]
+			for j := 0; j < n; j++ {
+				m[row][j] ^= gfMul[f][m[col][j]]
+				inv[row][j] ^= gfMul[f][inv[col][j]]
+			}
+		}
+	}
+	copy(m, inv)
+	return nil
+}
@@ -0,0 +1,411 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package parity implements Reed-Solomon parity files, which can repair
+// limited damage to another file, such as bit rot in archived age files.
+//
+// A single flipped bit makes a whole chunk of an age file fail authentication,
+// and since the payload can't be decrypted past a bad chunk, the rest of the
+// file is lost too. A parity file, stored next to the age file, allows
+// reconstructing the damaged parts before decryption.
+//
+// The protected file is split into blocks of Options.BlockSize bytes, and each
+// stripe of Options.DataBlocks consecutive blocks gets Options.ParityBlocks
+// parity blocks, computed with a Cauchy Reed-Solomon code over GF(2^8). The
+// parity file stores a CRC-32C checksum of every data and parity block, which
+// is used to find the damaged blocks, and then any DataBlocks intact blocks
+// of a stripe are enough to reconstruct the others.
+//
+// The parity file is separate from the age file, so the age file stays
+// readable by any implementation. The checksums are not cryptographic: the
+// repaired file is authenticated as usual when it's decrypted.
+package parity
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Options are the parameters of a parity file. The zero value of each field
+// selects its default.
+type Options struct {
+	// BlockSize is the size in bytes of the units damage is detected and
+	// repaired in. The default is 4096. Smaller blocks tolerate more scattered
+	// damage, at the cost of more checksums.
+	BlockSize int
+
+	// DataBlocks is the number of data blocks in a stripe. The default is 32.
+	DataBlocks int
+
+	// ParityBlocks is the number of parity blocks for each stripe, which is
+	// also the number of damaged blocks that can be repaired in each stripe.
+	// The default is 4, for a parity file about 12.5% the size of the file.
+	ParityBlocks int
+}
+
+const (
+	defaultBlockSize    = 4096
+	defaultDataBlocks   = 32
+	defaultParityBlocks = 4
+
+	maxBlockSize = 1 << 24
+)
+
+const magic = "age-parity-v1\n"
+
+// headerSize is the size of the magic string, followed by the block size,
+// data blocks, and parity blocks as big-endian uint32, uint16, and uint16.
+const headerSize = len(magic) + 4 + 2 + 2
+
+// trailerSize is the size of the trailer, which is the size of the protected
+// file as a big-endian uint64, followed by the CRC-32C of the header and
+// the size.
+const trailerSize = 8 + 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func (o *Options) withDefaults() (Options, error) {
+	var opts Options
+	if o != nil {
+		opts = *o
+	}
+	if opts.BlockSize == 0 {
+		opts.BlockSize = defaultBlockSize
+	}
+	if opts.DataBlocks == 0 {
+		opts.DataBlocks = defaultDataBlocks
+	}
+	if opts.ParityBlocks == 0 {
+		opts.ParityBlocks = defaultParityBlocks
+	}
+	if err := opts.check(); err != nil {
+		return Options{}, err
+	}
+	return opts, nil
+}
+
+func (o Options) check() error {
+	if o.BlockSize < 1 || o.BlockSize > maxBlockSize {
+		return fmt.Errorf("invalid block size %d", o.BlockSize)
+	}
+	if o.DataBlocks < 1 || o.ParityBlocks < 1 || o.DataBlocks+o.ParityBlocks > 256 {
+		return fmt.Errorf("invalid number of blocks %d+%d, the total must be at most 256",
+			o.DataBlocks, o.ParityBlocks)
+	}
+	return nil
+}
+
+func (o Options) header() []byte {
+	b := make([]byte, 0, headerSize)
+	b = append(b, magic...)
+	b = binary.BigEndian.AppendUint32(b, uint32(o.BlockSize))
+	b = binary.BigEndian.AppendUint16(b, uint16(o.DataBlocks))
+	return binary.BigEndian.AppendUint16(b, uint16(o.ParityBlocks))
+}
+
+// stripeSize is the size of the checksums and parity blocks of a stripe in
+// the parity file.
+func (o Options) stripeSize() int64 {
+	return int64(o.DataBlocks+o.ParityBlocks)*4 + int64(o.ParityBlocks)*int64(o.BlockSize)
+}
+
+// stripes returns the number of stripes for a file of the given size.
+func (o Options) stripes(size int64) int64 {
+	stripe := int64(o.DataBlocks) * int64(o.BlockSize)
+	return (size + stripe - 1) / stripe
+}
+
+// Size returns the size of the parity file for a file of the given size.
+func Size(size int64, opts *Options) (int64, error) {
+	o, err := opts.withDefaults()
+	if err != nil {
+		return 0, err
+	}
+	return int64(headerSize) + o.stripes(size)*o.stripeSize() + trailerSize, nil
+}
+
+// A Writer computes the parity file for the data written to it.
+type Writer struct {
+	w    io.Writer
+	opts Options
+	hdr  []byte
+	buf  []byte
+	n    int
+	size int64
+	err  error
+
+	// wroteHeader is set once the header was written, which is delayed until
+	// the first stripe, so that nothing is written to dst if no data is.
+	wroteHeader bool
+}
+
+// NewWriter returns a Writer that writes to dst the parity file for the data
+// written to it. The parity file is complete only once Close is called.
+// opts may be nil to use the defaults.
+func NewWriter(dst io.Writer, opts *Options) (*Writer, error) {
+	o, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{w: dst, opts: o, hdr: o.header()}
+	w.buf = make([]byte, o.DataBlocks*o.BlockSize)
+	return w, nil
+}
+
+// Write processes p, writing a stripe of the parity file each time enough
+// data is available.
+func (w *Writer) Write(p []byte) (n int, err error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	for len(p) > 0 {
+		c := copy(w.buf[w.n:], p)
+		w.n += c
+		w.size += int64(c)
+		n += c
+		p = p[c:]
+		if w.n == len(w.buf) {
+			if err := w.flushStripe(); err != nil {
+				w.err = err
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close writes the last stripe and the trailer. It doesn't close the
+// underlying Writer.
+func (w *Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.n > 0 {
+		if err := w.flushStripe(); err != nil {
+			w.err = err
+			return err
+		}
+	}
+	w.err = errors.New("parity.Writer is closed")
+	trailer := binary.BigEndian.AppendUint64(nil, uint64(w.size))
+	crc := crc32.Update(crc32.Checksum(w.hdr, castagnoli), castagnoli, trailer)
+	trailer = binary.BigEndian.AppendUint32(trailer, crc)
+	return w.write(trailer)
+}
+
+func (w *Writer) write(b []byte) error {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		b = append(w.hdr[:len(w.hdr):len(w.hdr)], b...)
+	}
+	_, err := w.w.Write(b)
+	return err
+}
+
+// flushStripe writes the checksums and parity blocks for the buffered stripe,
+// padding it with zeroes.
+func (w *Writer) flushStripe() error {
+	for i := w.n; i < len(w.buf); i++ {
+		w.buf[i] = 0
+	}
+	w.n = 0
+	data := splitBlocks(w.buf, w.opts.BlockSize)
+	parity := splitBlocks(make([]byte, w.opts.ParityBlocks*w.opts.BlockSize), w.opts.BlockSize)
+	for i := range parity {
+		for j := range data {
+			mulAdd(parity[i], data[j], cauchy(w.opts.DataBlocks, i, j))
+		}
+	}
+	out := make([]byte, 0, w.opts.stripeSize())
+	for _, b := range append(data, parity...) {
+		out = binary.BigEndian.AppendUint32(out, crc32.Checksum(b, castagnoli))
+	}
+	for _, b := range parity {
+		out = append(out, b...)
+	}
+	return w.write(out)
+}
+
+func splitBlocks(b []byte, size int) [][]byte {
+	var blocks [][]byte
+	for len(b) > 0 {
+		blocks = append(blocks, b[:size:size])
+		b = b[size:]
+	}
+	return blocks
+}
+
+// Result reports the outcome of Repair.
+type Result struct {
+	// Size is the size of the protected file, as recorded in the parity file.
+	Size int64
+	// Damaged is the number of data blocks that didn't match their checksum,
+	// or were missing, and were reconstructed.
+	Damaged int
+	// DamagedParity is the number of damaged parity blocks, which don't
+	// affect the output, but reduce the damage that can be repaired.
+	DamagedParity int
+}
+
+// Repair writes to dst the contents of src, with any damaged blocks
+// reconstructed using the parity file par of size paritySize. src may be
+// shorter than the original file, in which case the missing blocks are
+// reconstructed too.
+//
+// If a stripe has more damaged blocks than its intact parity blocks, Repair
+// returns an error, after writing the stripes before it to dst.
+func Repair(dst io.Writer, src, par io.ReaderAt, paritySize int64) (*Result, error) {
+	hdr := make([]byte, headerSize)
+	if _, err := par.ReadAt(hdr, 0); err != nil {
+		return nil, fmt.Errorf("failed to read parity file header: %w", err)
+	}
+	if !bytes.HasPrefix(hdr, []byte(magic)) {
+		return nil, errors.New("not a parity file")
+	}
+	p := hdr[len(magic):]
+	o := Options{
+		BlockSize:    int(binary.BigEndian.Uint32(p[0:4])),
+		DataBlocks:   int(binary.BigEndian.Uint16(p[4:6])),
+		ParityBlocks: int(binary.BigEndian.Uint16(p[6:8])),
+	}
+	if err := o.check(); err != nil {
+		return nil, fmt.Errorf("malformed parity file: %v", err)
+	}
+	if paritySize < int64(headerSize+trailerSize) {
+		return nil, errors.New("malformed parity file: truncated")
+	}
+	trailer := make([]byte, trailerSize)
+	if _, err := par.ReadAt(trailer, paritySize-trailerSize); err != nil {
+		return nil, fmt.Errorf("failed to read parity file trailer: %w", err)
+	}
+	crc := crc32.Update(crc32.Checksum(hdr, castagnoli), castagnoli, trailer[:8])
+	if binary.BigEndian.Uint32(trailer[8:]) != crc {
+		return nil, errors.New("parity file header or trailer is damaged")
+	}
+	size := int64(binary.BigEndian.Uint64(trailer[:8]))
+	stripes := paritySize - int64(headerSize+trailerSize)
+	if stripes%o.stripeSize() != 0 || size < 0 || o.stripes(size) != stripes/o.stripeSize() {
+		return nil, errors.New("malformed parity file: size doesn't match the number of stripes")
+	}
+
+	res := &Result{Size: size}
+	r := &repairer{opts: o, src: src, par: par, size: size, res: res}
+	stripeData := int64(o.DataBlocks) * int64(o.BlockSize)
+	for s := int64(0); s < o.stripes(size); s++ {
+		data, err := r.stripe(s)
+		if err != nil {
+			return res, fmt.Errorf("stripe %d: %w", s, err)
+		}
+		if rest := size - s*stripeData; rest < int64(len(data)) {
+			data = data[:rest]
+		}
+		if _, err := dst.Write(data); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+type repairer struct {
+	opts     Options
+	src, par io.ReaderAt
+	size     int64
+	res      *Result
+}
+
+// stripe returns the repaired data blocks of stripe s, padded with zeroes.
+func (r *repairer) stripe(s int64) ([]byte, error) {
+	k, m, bs := r.opts.DataBlocks, r.opts.ParityBlocks, r.opts.BlockSize
+	off := int64(headerSize) + s*r.opts.stripeSize()
+	sums := make([]byte, (k+m)*4)
+	if _, err := r.par.ReadAt(sums, off); err != nil {
+		return nil, fmt.Errorf("failed to read parity file: %w", err)
+	}
+	sum := func(i int) uint32 { return binary.BigEndian.Uint32(sums[i*4:]) }
+
+	buf := make([]byte, k*bs)
+	data := splitBlocks(buf, bs)
+	var damaged []int
+	for j, b := range data {
+		start := (s*int64(k) + int64(j)) * int64(bs)
+		if start >= r.size {
+			// Past the end of the file, the blocks are known to be zero.
+			continue
+		}
+		if !readBlock(r.src, b, start) || crc32.Checksum(b, castagnoli) != sum(j) {
+			damaged = append(damaged, j)
+		}
+	}
+	if len(damaged) == 0 {
+		return buf, nil
+	}
+
+	// Collect as many intact parity blocks as there are damaged data blocks.
+	var rows []int
+	var parity [][]byte
+	for i := 0; i < m && len(rows) < len(damaged); i++ {
+		b := make([]byte, bs)
+		if !readBlock(r.par, b, off+int64(len(sums))+int64(i)*int64(bs)) ||
+			crc32.Checksum(b, castagnoli) != sum(k+i) {
+			r.res.DamagedParity++
+			continue
+		}
+		rows = append(rows, i)
+		parity = append(parity, b)
+	}
+	if len(rows) < len(damaged) {
+		return nil, fmt.Errorf("%d damaged data blocks, but only %d intact parity blocks",
+			len(damaged), len(rows))
+	}
+
+	// Subtract the intact data blocks from the parity blocks, leaving in
+	// each the combination of the damaged ones, and solve for them.
+	isDamaged := make(map[int]bool)
+	for _, j := range damaged {
+		isDamaged[j] = true
+	}
+	for row, i := range rows {
+		for j := range data {
+			if !isDamaged[j] {
+				mulAdd(parity[row], data[j], cauchy(k, i, j))
+			}
+		}
+	}
+	mat := make([][]byte, len(rows))
+	for row, i := range rows {
+		mat[row] = make([]byte, len(damaged))
+		for c, j := range damaged {
+			mat[row][c] = cauchy(k, i, j)
+		}
+	}
+	if err := invert(mat); err != nil {
+		return nil, fmt.Errorf("internal error: %v", err)
+	}
+	for c, j := range damaged {
+		b := data[j]
+		for i := range b {
+			b[i] = 0
+		}
+		for row := range rows {
+			mulAdd(b, parity[row], mat[c][row])
+		}
+	}
+	r.res.Damaged += len(damaged)
+	return buf, nil
+}
+
+// readBlock reads the block at off into b, padding it with zeroes if the
+// end of the file is reached. It returns false if the block couldn't be read
+// at all.
+func readBlock(f io.ReaderAt, b []byte, off int64) bool {
+	n, err := f.ReadAt(b, off)
+	for i := n; i < len(b); i++ {
+		b[i] = 0
+	}
+	return n > 0 || err == nil
+}
@@ -0,0 +1,157 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package parity_test
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"filippo.io/age/parity"
+)
+
+func makeParity(t *testing.T, data []byte, opts *parity.Options) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	w, err := parity.NewWriter(buf, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Write in odd sizes to exercise the buffering.
+	for p := data; len(p) > 0; {
+		n := 1000
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	size, err := parity.Size(int64(len(data)), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(buf.Len()) != size {
+		t.Errorf("parity file is %d bytes, Size returned %d", buf.Len(), size)
+	}
+	return buf.Bytes()
+}
+
+func repair(t *testing.T, damaged, par []byte) ([]byte, *parity.Result, error) {
+	t.Helper()
+	out := &bytes.Buffer{}
+	res, err := parity.Repair(out, bytes.NewReader(damaged), bytes.NewReader(par), int64(len(par)))
+	return out.Bytes(), res, err
+}
+
+func TestRepair(t *testing.T) {
+	opts := &parity.Options{BlockSize: 64, DataBlocks: 8, ParityBlocks: 3}
+	for _, size := range []int{0, 1, 64, 500, 512, 513, 5000} {
+		data := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(data)
+		par := makeParity(t, data, opts)
+
+		out, res, err := repair(t, data, par)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(out, data) || res.Damaged != 0 || res.Size != int64(size) {
+			t.Errorf("size %d: intact file was not returned unchanged: %+v", size, res)
+		}
+
+		if size < 64*3 {
+			continue
+		}
+		// Flip bits in three blocks of every stripe.
+		damaged := append([]byte(nil), data...)
+		for off := 0; off < size; off += 64 * 8 {
+			for _, b := range []int{0, 2, 7} {
+				if i := off + b*64 + 5; i < size {
+					damaged[i] ^= 1 << (b % 8)
+				}
+			}
+		}
+		out, res, err = repair(t, damaged, par)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("size %d: file was not repaired", size)
+		}
+		if res.Damaged == 0 {
+			t.Errorf("size %d: no damage reported", size)
+		}
+	}
+}
+
+func TestRepairTruncated(t *testing.T) {
+	opts := &parity.Options{BlockSize: 100, DataBlocks: 10, ParityBlocks: 2}
+	data := make([]byte, 950)
+	rand.New(rand.NewSource(1)).Read(data)
+	par := makeParity(t, data, opts)
+
+	out, res, err := repair(t, data[:900], par)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) || res.Damaged != 1 {
+		t.Errorf("truncated file was not repaired: %+v", res)
+	}
+
+	if _, _, err := repair(t, data[:700], par); err == nil {
+		t.Error("file missing three blocks was repaired with two parity blocks")
+	}
+}
+
+func TestRepairDamagedParity(t *testing.T) {
+	opts := &parity.Options{BlockSize: 16, DataBlocks: 4, ParityBlocks: 2}
+	data := make([]byte, 64)
+	rand.New(rand.NewSource(2)).Read(data)
+	par := makeParity(t, data, opts)
+
+	damaged := append([]byte(nil), data...)
+	damaged[20] ^= 0xff
+	// The first parity block follows the header and the six checksums.
+	badPar := append([]byte(nil), par...)
+	badPar[22+6*4+3] ^= 0xff
+
+	out, res, err := repair(t, damaged, badPar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) || res.Damaged != 1 || res.DamagedParity != 1 {
+		t.Errorf("file was not repaired with the second parity block: %+v", res)
+	}
+
+	damaged[40] ^= 0xff
+	if _, _, err := repair(t, damaged, badPar); err == nil {
+		t.Error("two damaged blocks were repaired with one intact parity block")
+	}
+
+	badPar = append([]byte(nil), par...)
+	badPar[len(badPar)-5] ^= 1
+	if _, _, err := repair(t, data, badPar); err == nil {
+		t.Error("damaged trailer was accepted")
+	}
+}
+
+func TestOptions(t *testing.T) {
+	for _, opts := range []*parity.Options{
+		{BlockSize: -1},
+		{DataBlocks: 200, ParityBlocks: 57},
+		{BlockSize: 1 << 25},
+	} {
+		if _, err := parity.NewWriter(&bytes.Buffer{}, opts); err == nil {
+			t.Errorf("invalid options %+v were accepted", opts)
+		}
+	}
+	if _, err := parity.NewWriter(&bytes.Buffer{}, &parity.Options{DataBlocks: 200, ParityBlocks: 56}); err != nil {
+		t.Error(err)
+	}
+}
@@ -6,8 +6,10 @@ package age
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"os/exec"
 	"strings"
 )
 
@@ -18,8 +20,9 @@ import (
 // the CLI also accepts SSH private keys, which are not recommended for the
 // average application.
 //
-// Currently, all returned values are of type *X25519Identity, but different
-// types might be returned in the future.
+// The returned values are of type *X25519Identity, *X25519SubkeyIdentity,
+// *X448Identity, *HPKEIdentity, or, with the "age_mlkem" build tag,
+// *MLKEMIdentity, but different types might be returned in the future.
 func ParseIdentities(f io.Reader) ([]Identity, error) {
 	const privateKeySizeLimit = 1 << 24 // 16 MiB
 	var ids []Identity
@@ -31,7 +34,7 @@ func ParseIdentities(f io.Reader) ([]Identity, error) {
 		if strings.HasPrefix(line, "#") || line == "" {
 			continue
 		}
-		i, err := ParseX25519Identity(line)
+		i, err := parseIdentity(line)
 		if err != nil {
 			return nil, fmt.Errorf("error at line %d: %v", n, err)
 		}
@@ -46,6 +49,29 @@ func ParseIdentities(f io.Reader) ([]Identity, error) {
 	return ids, nil
 }
 
+// identityParsers are the parsers of the native identity encodings other than
+// X25519, by prefix.
+var identityParsers = []struct {
+	prefix string
+	parse  func(string) (Identity, error)
+}{
+	{"AGE-SECRET-KEY-SUB-1", func(s string) (Identity, error) { return ParseX25519SubkeyIdentity(s) }},
+	{"AGE-SECRET-KEY-X448-1", func(s string) (Identity, error) { return ParseX448Identity(s) }},
+	{"AGE-SECRET-KEY-HPKE-1", func(s string) (Identity, error) { return ParseHPKEIdentity(s) }},
+}
+
+func parseIdentity(s string) (Identity, error) {
+	if strings.HasPrefix(s, "AGE-PLUGIN-") {
+		return nil, fmt.Errorf("plugin identities are not supported")
+	}
+	for _, p := range identityParsers {
+		if strings.HasPrefix(s, p.prefix) {
+			return p.parse(s)
+		}
+	}
+	return ParseX25519Identity(s)
+}
+
 // ParseRecipients parses a file with one or more public key encodings, one per
 // line. Empty lines and lines starting with "#" are ignored.
 //
@@ -82,3 +108,31 @@ func ParseRecipients(f io.Reader) ([]Recipient, error) {
 	}
 	return recs, nil
 }
+
+// ParseRecipientsFromCommand runs cmd, and parses its standard output with
+// ParseRecipients. It can be used to fetch a dynamic set of recipients from a
+// secret store, without writing them to a temporary file.
+//
+// If cmd.Stdout is already set, ParseRecipientsFromCommand returns an error.
+// If cmd.Stderr is nil, the standard error of the command is included in the
+// error returned if the command fails.
+func ParseRecipientsFromCommand(cmd *exec.Cmd) ([]Recipient, error) {
+	if cmd.Stdout != nil {
+		return nil, fmt.Errorf("exec: Stdout already set")
+	}
+	stdout := &bytes.Buffer{}
+	cmd.Stdout = stdout
+	var stderr *bytes.Buffer
+	if cmd.Stderr == nil {
+		stderr = &bytes.Buffer{}
+		cmd.Stderr = stderr
+	}
+	if err := cmd.Run(); err != nil {
+		if stderr != nil && stderr.Len() > 0 {
+			return nil, fmt.Errorf("failed to run recipients command: %v: %s",
+				err, strings.TrimSpace(stderr.String()))
+		}
+		return nil, fmt.Errorf("failed to run recipients command: %v", err)
+	}
+	return ParseRecipients(stdout)
+}
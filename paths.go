@@ -0,0 +1,60 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// DefaultIdentityPaths returns the paths, in order of preference, where a
+// user's identity file is conventionally stored. The files might not exist.
+//
+// The file is named "keys.txt", and is located in an "age" directory inside
+// $XDG_CONFIG_HOME (if set) or inside the operating system's user
+// configuration directory, which is ~/.config on Linux and other Unix systems,
+// ~/Library/Application Support on macOS, and %AppData% on Windows.
+//
+// The files are in the format accepted by ParseIdentities and by the CLI.
+// Applications should only use these paths to locate keys that belong to the
+// user, rather than to store application-specific keys.
+func DefaultIdentityPaths() []string {
+	return defaultPaths("keys.txt")
+}
+
+// DefaultRecipientPaths returns the paths, in order of preference, where a
+// user's default recipients file is conventionally stored. The files might not
+// exist.
+//
+// The file is named "recipients.txt", and is located in the same directories
+// as the files returned by DefaultIdentityPaths. The files are in the format
+// accepted by ParseRecipients and by the CLI.
+func DefaultRecipientPaths() []string {
+	return defaultPaths("recipients.txt")
+}
+
+func defaultPaths(name string) []string {
+	var dirs []string
+	// os.UserConfigDir already honors XDG_CONFIG_HOME on Unix systems other
+	// than macOS, but users of XDG-aware tools set it on macOS and Windows, too.
+	if dir := os.Getenv("XDG_CONFIG_HOME"); filepath.IsAbs(dir) {
+		dirs = append(dirs, dir)
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		dirs = append(dirs, dir)
+	}
+
+	var paths []string
+	seen := make(map[string]bool)
+	for _, dir := range dirs {
+		p := filepath.Join(dir, "age", name)
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		paths = append(paths, p)
+	}
+	return paths
+}
@@ -0,0 +1,119 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"sync"
+	"time"
+)
+
+// A SecretCache remembers the secret values (such as PINs) provided by the
+// user to plugins through ClientUI.RequestValue, so that a PIN entered once
+// can cover a batch operation involving multiple plugin invocations.
+//
+// Values are cached per plugin name and prompt, and expire after a maximum
+// duration or number of uses, whichever comes first. Each value is stored in
+// its own page-aligned allocation, locked against swapping where supported,
+// and zeroed when evicted.
+//
+// If a plugin requests the same secret twice in the same session, the cached
+// value is assumed to be wrong, and it's evicted before asking the user.
+//
+// A SecretCache is safe for concurrent use.
+type SecretCache struct {
+	maxAge  time.Duration
+	maxUses int
+
+	mu      sync.Mutex
+	entries map[cacheKey]*cacheEntry
+}
+
+type cacheKey struct {
+	name, prompt string
+}
+
+type cacheEntry struct {
+	value   *lockedBuffer
+	expires time.Time
+	uses    int
+}
+
+// NewSecretCache returns a SecretCache where each value expires after maxAge
+// or after having been used maxUses times. If maxUses is zero, values are only
+// evicted based on maxAge.
+func NewSecretCache(maxAge time.Duration, maxUses int) *SecretCache {
+	if maxAge <= 0 || maxUses < 0 {
+		panic("plugin: NewSecretCache called with illegal values")
+	}
+	return &SecretCache{
+		maxAge:  maxAge,
+		maxUses: maxUses,
+		entries: make(map[cacheKey]*cacheEntry),
+	}
+}
+
+// Flush evicts and zeroes all cached values.
+func (c *SecretCache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		e.value.wipe()
+		delete(c.entries, k)
+	}
+}
+
+// get returns a copy of the cached value, or nil if there is none. The caller
+// must call wipe on it when done.
+func (c *SecretCache) get(name, prompt string) *lockedBuffer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := cacheKey{name, prompt}
+	e, ok := c.entries[k]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(e.expires) {
+		e.value.wipe()
+		delete(c.entries, k)
+		return nil
+	}
+	e.uses++
+	v := newLockedBuffer(e.value.bytes())
+	if c.maxUses != 0 && e.uses >= c.maxUses {
+		e.value.wipe()
+		delete(c.entries, k)
+	}
+	return v
+}
+
+// put stores a copy of value.
+func (c *SecretCache) put(name, prompt string, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := cacheKey{name, prompt}
+	if e, ok := c.entries[k]; ok {
+		e.value.wipe()
+	}
+	// A maxUses of one means the value is never reused.
+	if c.maxUses == 1 {
+		delete(c.entries, k)
+		return
+	}
+	c.entries[k] = &cacheEntry{
+		value:   newLockedBuffer(value),
+		expires: time.Now().Add(c.maxAge),
+		uses:    1,
+	}
+}
+
+func (c *SecretCache) evict(name, prompt string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := cacheKey{name, prompt}
+	if e, ok := c.entries[k]; ok {
+		e.value.wipe()
+		delete(c.entries, k)
+	}
+}
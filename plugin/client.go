@@ -10,12 +10,18 @@ package plugin
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	exec "golang.org/x/sys/execabs"
@@ -28,6 +34,7 @@ type Recipient struct {
 	name     string
 	encoding string
 	ui       *ClientUI
+	session  *Session
 
 	// identity is true when encoding is an identity string.
 	identity bool
@@ -53,31 +60,149 @@ func (r *Recipient) Name() string {
 	return r.name
 }
 
+// String returns the recipient encoding ("age1name1..."). If r was returned by
+// Identity.Recipient, it has no recipient encoding and String returns an empty
+// string, to avoid leaking the identity.
+func (r *Recipient) String() string {
+	if r.identity {
+		return ""
+	}
+	return r.encoding
+}
+
+// Equal reports whether r and other have the same encoding, regardless of
+// their ClientUI. It runs in constant time, since r might wrap an identity.
+func (r *Recipient) Equal(other *Recipient) bool {
+	return subtle.ConstantTimeCompare([]byte(r.encoding), []byte(other.encoding)) == 1 &&
+		r.identity == other.identity
+}
+
+// MarshalText implements encoding.TextMarshaler, returning the recipient
+// encoding. It returns an error if r was returned by Identity.Recipient, to
+// avoid leaking the identity.
+func (r *Recipient) MarshalText() ([]byte, error) {
+	if r.identity {
+		return nil, errors.New("can't marshal a recipient derived from an identity")
+	}
+	return []byte(r.encoding), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, parsing the encoding like
+// NewRecipient. The unmarshaled Recipient has a nil ClientUI, so the plugin
+// can't interact with the user. Use NewRecipient to provide one.
+func (r *Recipient) UnmarshalText(text []byte) error {
+	parsed, err := NewRecipient(string(text), nil)
+	if err != nil {
+		return err
+	}
+	*r = *parsed
+	return nil
+}
+
 func (r *Recipient) Wrap(fileKey []byte) (stanzas []*age.Stanza, err error) {
 	stanzas, _, err = r.WrapWithLabels(fileKey)
 	return
 }
 
 func (r *Recipient) WrapWithLabels(fileKey []byte) (stanzas []*age.Stanza, labels []string, err error) {
+	return r.WrapWithLabelsContext(context.Background(), fileKey)
+}
+
+// WrapContext is like Wrap, but the plugin is killed if ctx is canceled or
+// its deadline expires before the plugin is done. In the latter case, the
+// returned error is a *TimeoutError.
+//
+// ctx is also passed to ClientUI.RequestValueContext and
+// ClientUI.ConfirmContext.
+func (r *Recipient) WrapContext(ctx context.Context, fileKey []byte) (stanzas []*age.Stanza, err error) {
+	stanzas, _, err = r.WrapWithLabelsContext(ctx, fileKey)
+	return
+}
+
+// WrapWithLabelsContext is like WrapWithLabels, but takes a context like
+// WrapContext.
+func (r *Recipient) WrapWithLabelsContext(ctx context.Context, fileKey []byte) (stanzas []*age.Stanza, labels []string, err error) {
+	return wrapWithLabels(ctx, r.name, r.ui, r.session, []*Recipient{r}, fileKey)
+}
+
+// GroupRecipients returns recipients with the *Recipient values for the same
+// plugin, ClientUI, and Session replaced by a single age.Recipient, at the position of
+// the first of them, which wraps the file key for all of them in a single
+// plugin session. This avoids starting the plugin, and potentially prompting
+// the user, once per recipient. Other recipients are returned unchanged.
+func GroupRecipients(recipients []age.Recipient) []age.Recipient {
+	type key struct {
+		name    string
+		ui      *ClientUI
+		session *Session
+	}
+	groups := make(map[key]*recipientGroup)
+	var grouped []age.Recipient
+	for _, r := range recipients {
+		pr, ok := r.(*Recipient)
+		if !ok {
+			grouped = append(grouped, r)
+			continue
+		}
+		k := key{pr.name, pr.ui, pr.session}
+		if g, ok := groups[k]; ok {
+			g.recipients = append(g.recipients, pr)
+			continue
+		}
+		g := &recipientGroup{recipients: []*Recipient{pr}}
+		groups[k] = g
+		grouped = append(grouped, g)
+	}
+	for i, r := range grouped {
+		if g, ok := r.(*recipientGroup); ok && len(g.recipients) == 1 {
+			grouped[i] = g.recipients[0]
+		}
+	}
+	return grouped
+}
+
+// A recipientGroup is a set of recipients for the same plugin, returned by
+// GroupRecipients.
+type recipientGroup struct {
+	recipients []*Recipient
+}
+
+var _ age.RecipientWithLabels = &recipientGroup{}
+
+func (g *recipientGroup) Wrap(fileKey []byte) (stanzas []*age.Stanza, err error) {
+	stanzas, _, err = g.WrapWithLabels(fileKey)
+	return
+}
+
+func (g *recipientGroup) WrapWithLabels(fileKey []byte) (stanzas []*age.Stanza, labels []string, err error) {
+	r := g.recipients[0]
+	return wrapWithLabels(context.Background(), r.name, r.ui, r.session, g.recipients, fileKey)
+}
+
+// wrapWithLabels runs a recipient-v1 session with the named plugin, to wrap
+// fileKey for all recipients at once.
+func wrapWithLabels(ctx context.Context, name string, ui *ClientUI, session *Session, recipients []*Recipient, fileKey []byte) (stanzas []*age.Stanza, labels []string, err error) {
 	defer func() {
 		if err != nil {
-			err = fmt.Errorf("%s plugin: %w", r.name, err)
+			err = fmt.Errorf("%s plugin: %w", name, err)
 		}
 	}()
 
-	conn, err := openClientConnection(r.name, "recipient-v1")
+	conn, err := session.open(ctx, name, "recipient-v1", ui)
 	if err != nil {
-		return nil, nil, fmt.Errorf("couldn't start plugin: %v", err)
+		return nil, nil, fmt.Errorf("couldn't start plugin: %w", err)
 	}
-	defer conn.Close()
+	defer conn.release()
 
-	// Phase 1: client sends recipient or identity and file key
-	addType := "add-recipient"
-	if r.identity {
-		addType = "add-identity"
-	}
-	if err := writeStanza(conn, addType, r.encoding); err != nil {
-		return nil, nil, err
+	// Phase 1: client sends recipients or identities and file key
+	for _, r := range recipients {
+		addType := "add-recipient"
+		if r.identity {
+			addType = "add-identity"
+		}
+		if err := writeStanza(conn, addType, r.encoding); err != nil {
+			return nil, nil, err
+		}
 	}
 	if err := writeStanza(conn, fmt.Sprintf("grease-%x", rand.Int())); err != nil {
 		return nil, nil, err
@@ -85,7 +210,11 @@ func (r *Recipient) WrapWithLabels(fileKey []byte) (stanzas []*age.Stanza, label
 	if err := writeStanzaWithBody(conn, "wrap-file-key", fileKey); err != nil {
 		return nil, nil, err
 	}
-	if err := writeStanza(conn, "extension-labels"); err != nil {
+	extensions := []string{"labels"}
+	if len(recipients) > 1 {
+		extensions = append(extensions, "batch")
+	}
+	if err := conn.writeExtensions(extensions...); err != nil {
 		return nil, nil, err
 	}
 	if err := writeStanza(conn, "done"); err != nil {
@@ -93,10 +222,12 @@ func (r *Recipient) WrapWithLabels(fileKey []byte) (stanzas []*age.Stanza, label
 	}
 
 	// Phase 2: plugin responds with stanzas
-	sr := format.NewStanzaReader(bufio.NewReader(conn))
+	maxStanzas, maxBytes := ui.stanzaLimits(len(recipients))
+	var stanzaBytes int
+	sr := conn.stanzaReader()
 ReadLoop:
 	for {
-		s, err := r.ui.readStanza(r.name, sr)
+		s, err := ui.readStanza(name, sr)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -120,6 +251,17 @@ ReadLoop:
 				Args: s.Args[2:],
 				Body: s.Body,
 			})
+			for _, a := range s.Args[1:] {
+				stanzaBytes += len(a)
+			}
+			stanzaBytes += len(s.Body)
+			if len(stanzas) > maxStanzas || stanzaBytes > maxBytes {
+				ui.debug("plugin exceeded stanza limits", "plugin", name,
+					"stanzas", len(stanzas), "bytes", stanzaBytes)
+				return nil, nil, &StanzaLimitError{Plugin: name,
+					Stanzas: len(stanzas), Bytes: stanzaBytes,
+					MaxStanzas: maxStanzas, MaxBytes: maxBytes}
+			}
 
 			if err := writeStanza(conn, "ok"); err != nil {
 				return nil, nil, err
@@ -138,11 +280,32 @@ ReadLoop:
 				return nil, nil, err
 			}
 
-			return nil, nil, fmt.Errorf("%s", s.Body)
+			if isUnavailable(s) {
+				return nil, nil, pluginError(s)
+			}
+			// With more than one recipient in the session, report which one
+			// failed. The index counts add-recipient or add-identity stanzas,
+			// and identities are not printed, as they may be secret.
+			if len(recipients) > 1 && len(s.Args) == 2 && s.Args[0] == "recipient" {
+				var recs []*Recipient
+				for _, r := range recipients {
+					if !r.identity {
+						recs = append(recs, r)
+					}
+				}
+				if n, err := strconv.Atoi(s.Args[1]); err == nil && n >= 0 && n < len(recs) {
+					return nil, nil, fmt.Errorf("recipient %s: %s", recs[n].encoding, s.Body)
+				}
+			}
+			if len(recipients) > 1 && len(s.Args) == 2 && s.Args[0] == "identity" {
+				return nil, nil, fmt.Errorf("identity #%s: %s", s.Args[1], s.Body)
+			}
+			return nil, nil, pluginError(s)
 		case "done":
+			conn.endRun()
 			break ReadLoop
 		default:
-			if ok, err := r.ui.handle(r.name, conn, s); err != nil {
+			if ok, err := ui.handle(name, conn, s); err != nil {
 				return nil, nil, err
 			} else if !ok {
 				if err := writeStanza(conn, "unsupported"); err != nil {
@@ -163,6 +326,12 @@ type Identity struct {
 	name     string
 	encoding string
 	ui       *ClientUI
+	session  *Session
+
+	// unlockToken is the token returned by the plugin in the unlock-v1 state
+	// machine, and is sent in phase 1 of the following sessions.
+	unlockMu    sync.Mutex
+	unlockToken []byte
 }
 
 var _ age.Identity = &Identity{}
@@ -191,6 +360,39 @@ func (i *Identity) Name() string {
 	return i.name
 }
 
+// String returns the identity encoding ("AGE-PLUGIN-NAME-1...").
+func (i *Identity) String() string {
+	return i.encoding
+}
+
+// Equal reports whether i and other have the same encoding, regardless of
+// their ClientUI. It runs in constant time.
+func (i *Identity) Equal(other *Identity) bool {
+	return subtle.ConstantTimeCompare([]byte(i.encoding), []byte(other.encoding)) == 1
+}
+
+// MarshalText implements encoding.TextMarshaler, returning the identity
+// encoding. Note that this makes the identity part of any encoding of values
+// containing i, such as JSON.
+func (i *Identity) MarshalText() ([]byte, error) {
+	return []byte(i.encoding), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, parsing the encoding like
+// NewIdentity. The unmarshaled Identity has a nil ClientUI, so the plugin can't
+// interact with the user. Use NewIdentity to provide one.
+func (i *Identity) UnmarshalText(text []byte) error {
+	name, _, err := ParseIdentity(string(text))
+	if err != nil {
+		return err
+	}
+	i.name, i.encoding, i.ui, i.session = name, string(text), nil, nil
+	i.unlockMu.Lock()
+	i.unlockToken = nil
+	i.unlockMu.Unlock()
+	return nil
+}
+
 // Recipient returns a Recipient wrapping this identity. When that Recipient is
 // used to encrypt a file key, the identity encoding is provided as-is to the
 // plugin, which is expected to support encrypting to identities.
@@ -200,26 +402,304 @@ func (i *Identity) Recipient() *Recipient {
 		encoding: i.encoding,
 		identity: true,
 		ui:       i.ui,
+		session:  i.session,
 	}
 }
 
-func (i *Identity) Unwrap(stanzas []*age.Stanza) (fileKey []byte, err error) {
+// DeriveRecipient returns the native recipient encoding ("age1name1...")
+// corresponding to this identity, for example to print the public half of a
+// hardware-backed key.
+//
+// The age plugin protocol has no state machine to derive a recipient from an
+// identity, so DeriveRecipient looks for the identity among the ones reported
+// by the plugin to ListIdentities, and returns the recipient reported with it.
+// It fails if the plugin doesn't implement identity-list-v1, or doesn't report
+// the identity or its recipient.
+//
+// Any interaction requested by the plugin is handled by ui, which is also
+// attached to the returned Recipient.
+func (i *Identity) DeriveRecipient(ui *ClientUI) (*Recipient, error) {
+	ids, err := ListIdentities(i.name, ui)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if !strings.EqualFold(id.Identity.encoding, i.encoding) {
+			continue
+		}
+		if id.Recipient == nil {
+			return nil, fmt.Errorf("%s plugin: no recipient reported for the identity", i.name)
+		}
+		return id.Recipient, nil
+	}
+	return nil, fmt.Errorf("%s plugin: identity not reported by the plugin", i.name)
+}
+
+// Unlock runs the unlock-v1 state machine, for plugins that keep identities in
+// storage that needs to be unlocked, for example with a PIN, before it can be
+// used. The plugin can request secrets from the user in phase 2 through ui,
+// before returning an opaque unlock token, which is then sent to the plugin in
+// phase 1 of the following Unwrap sessions of i.
+//
+// In phase 1, the client sends the identity string with "add-identity". In
+// phase 2, the plugin sends "unlocked" with the token as the body, or "error".
+//
+// The unlock-v1 state machine and the "unlock-token" phase 1 command are NOT
+// part of the age plugin protocol specification, and are only implemented by
+// this package. They are used only if Unlock is called explicitly, and plugins
+// that follow the specification never see them. Plugins that don't implement
+// unlock-v1 are assumed not to need unlocking: if the plugin exits without
+// sending any command, Unlock returns nil. The plugin process exits at the end
+// of the state machine, so plugins are responsible for bounding the validity
+// of the tokens they return.
+//
+// If the plugin reports an incorrect PIN, Unlock is retried as long as
+// ui.PINRetry returns true.
+func (i *Identity) Unlock(ui *ClientUI) error {
+	for {
+		err := i.unlock(ui)
+		if !ui.retryPIN(i.name, err) {
+			return err
+		}
+	}
+}
+
+func (i *Identity) unlock(ui *ClientUI) (err error) {
 	defer func() {
 		if err != nil {
 			err = fmt.Errorf("%s plugin: %w", i.name, err)
 		}
 	}()
 
-	conn, err := openClientConnection(i.name, "identity-v1")
+	conn, err := openClientConnection(context.Background(), i.name, "unlock-v1", ui)
+	if err != nil {
+		return fmt.Errorf("couldn't start plugin: %w", err)
+	}
+	defer conn.Close()
+
+	// Phase 1: client sends the plugin the identity string
+	if err := writeStanza(conn, "add-identity", i.encoding); err != nil {
+		return err
+	}
+	if err := writeStanza(conn, fmt.Sprintf("grease-%x", rand.Int())); err != nil {
+		return err
+	}
+	if err := conn.writeExtensions(); err != nil {
+		return err
+	}
+	if err := writeStanza(conn, "done"); err != nil {
+		return err
+	}
+
+	// Phase 2: plugin responds with various commands and an unlock token
+	var token []byte
+	sr := format.NewStanzaReader(bufio.NewReader(conn))
+	for first := true; ; first = false {
+		s, err := ui.readStanza(i.name, sr)
+		if first && errors.Is(err, io.EOF) {
+			ui.debug("plugin doesn't support unlocking", "plugin", i.name)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch s.Type {
+		case "unlocked":
+			if len(s.Args) != 0 {
+				return fmt.Errorf("malformed unlocked stanza: unexpected arguments count")
+			}
+			if token != nil {
+				return fmt.Errorf("received duplicated unlocked stanza")
+			}
+			token = s.Body
+
+			if err := writeStanza(conn, "ok"); err != nil {
+				return err
+			}
+		case "error":
+			if err := writeStanza(conn, "ok"); err != nil {
+				return err
+			}
+
+			return ui.identityError(i.name, conn, s)
+		case "done":
+			if token == nil {
+				return fmt.Errorf("plugin didn't unlock the identity")
+			}
+			i.unlockMu.Lock()
+			i.unlockToken = token
+			i.unlockMu.Unlock()
+			return nil
+		default:
+			if ok, err := ui.handle(i.name, conn, s); err != nil {
+				return err
+			} else if !ok {
+				if err := writeStanza(conn, "unsupported"); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// writeUnlockToken sends the token returned by Unlock, if any.
+func (i *Identity) writeUnlockToken(conn *clientConnection) error {
+	i.unlockMu.Lock()
+	token := i.unlockToken
+	i.unlockMu.Unlock()
+	if token == nil {
+		return nil
+	}
+	return writeStanzaWithBody(conn, "unlock-token", token)
+}
+
+// A ListedIdentity is an identity reported by ListIdentities.
+type ListedIdentity struct {
+	Identity *Identity
+
+	// Recipient is the corresponding recipient, if reported by the plugin.
+	Recipient *Recipient
+
+	// Description is a human-readable description of the identity, such as
+	// the hardware slot it refers to, or an empty string.
+	Description string
+}
+
+// ListIdentities asks the named plugin for the identities it can use, for
+// example the keys stored in the slots of the connected hardware tokens.
+//
+// ListIdentities uses the identity-list-v1 state machine, which is NOT part of
+// the age plugin protocol specification, and is only implemented by this
+// package. It's used only if ListIdentities is called explicitly. In phase 2,
+// the plugin sends an "identity IDENTITY [RECIPIENT]" command for each
+// identity, with an optional UTF-8 description as the body. Plugins that don't
+// implement it exit without sending any command, and ListIdentities returns an
+// error.
+func ListIdentities(name string, ui *ClientUI) (identities []*ListedIdentity, err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("%s plugin: %w", name, err)
+		}
+	}()
+
+	conn, err := openClientConnection(context.Background(), name, "identity-list-v1", ui)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't start plugin: %v", err)
+		return nil, fmt.Errorf("couldn't start plugin: %w", err)
 	}
 	defer conn.Close()
 
+	// Phase 1: client sends no data
+	if err := writeStanza(conn, fmt.Sprintf("grease-%x", rand.Int())); err != nil {
+		return nil, err
+	}
+	if err := conn.writeExtensions(); err != nil {
+		return nil, err
+	}
+	if err := writeStanza(conn, "done"); err != nil {
+		return nil, err
+	}
+
+	// Phase 2: plugin responds with various commands and the identities
+	sr := format.NewStanzaReader(bufio.NewReader(conn))
+ReadLoop:
+	for {
+		s, err := ui.readStanza(name, sr)
+		if err != nil {
+			return nil, err
+		}
+
+		switch s.Type {
+		case "identity":
+			if len(s.Args) != 1 && len(s.Args) != 2 {
+				return nil, fmt.Errorf("malformed identity stanza: unexpected argument count")
+			}
+			i, err := NewIdentity(s.Args[0], ui)
+			if err != nil {
+				return nil, fmt.Errorf("malformed identity stanza: %v", err)
+			}
+			if i.name != name {
+				return nil, fmt.Errorf("malformed identity stanza: identity is for plugin %q", i.name)
+			}
+			id := &ListedIdentity{Identity: i, Description: string(s.Body)}
+			if len(s.Args) == 2 {
+				r, err := NewRecipient(s.Args[1], ui)
+				if err != nil {
+					return nil, fmt.Errorf("malformed identity stanza: %v", err)
+				}
+				if r.name != name {
+					return nil, fmt.Errorf("malformed identity stanza: recipient is for plugin %q", r.name)
+				}
+				id.Recipient = r
+			}
+			identities = append(identities, id)
+
+			if err := writeStanza(conn, "ok"); err != nil {
+				return nil, err
+			}
+		case "error":
+			if err := writeStanza(conn, "ok"); err != nil {
+				return nil, err
+			}
+
+			return nil, pluginError(s)
+		case "done":
+			break ReadLoop
+		default:
+			if ok, err := ui.handle(name, conn, s); err != nil {
+				return nil, err
+			} else if !ok {
+				if err := writeStanza(conn, "unsupported"); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return identities, nil
+}
+
+// Unwrap implements age.Identity. If the plugin reports an incorrect PIN,
+// Unwrap is retried as long as ClientUI.PINRetry returns true.
+func (i *Identity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	return i.UnwrapContext(context.Background(), stanzas)
+}
+
+// UnwrapContext is like Unwrap, but the plugin is killed if ctx is canceled or
+// its deadline expires before the plugin is done. In the latter case, the
+// returned error is a *TimeoutError.
+//
+// ctx is also passed to ClientUI.RequestValueContext and
+// ClientUI.ConfirmContext.
+func (i *Identity) UnwrapContext(ctx context.Context, stanzas []*age.Stanza) ([]byte, error) {
+	for {
+		fileKey, err := i.unwrap(ctx, stanzas)
+		if !i.ui.retryPIN(i.name, err) {
+			return fileKey, err
+		}
+	}
+}
+
+func (i *Identity) unwrap(ctx context.Context, stanzas []*age.Stanza) (fileKey []byte, err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("%s plugin: %w", i.name, err)
+		}
+	}()
+
+	conn, err := i.session.open(ctx, i.name, "identity-v1", i.ui)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't start plugin: %w", err)
+	}
+	defer conn.release()
+
 	// Phase 1: client sends the plugin the identity string and the stanzas
 	if err := writeStanza(conn, "add-identity", i.encoding); err != nil {
 		return nil, err
 	}
+	if err := i.writeUnlockToken(conn); err != nil {
+		return nil, err
+	}
 	if err := writeStanza(conn, fmt.Sprintf("grease-%x", rand.Int())); err != nil {
 		return nil, err
 	}
@@ -229,16 +709,19 @@ func (i *Identity) Unwrap(stanzas []*age.Stanza) (fileKey []byte, err error) {
 			Args: append([]string{"0", rs.Type}, rs.Args...),
 			Body: rs.Body,
 		}
-		if err := s.Marshal(conn); err != nil {
+		if err := conn.writeStanza(s); err != nil {
 			return nil, err
 		}
 	}
+	if err := conn.writeExtensions(); err != nil {
+		return nil, err
+	}
 	if err := writeStanza(conn, "done"); err != nil {
 		return nil, err
 	}
 
 	// Phase 2: plugin responds with various commands and a file key
-	sr := format.NewStanzaReader(bufio.NewReader(conn))
+	sr := conn.stanzaReader()
 ReadLoop:
 	for {
 		s, err := i.ui.readStanza(i.name, sr)
@@ -273,8 +756,9 @@ ReadLoop:
 				return nil, err
 			}
 
-			return nil, fmt.Errorf("%s", s.Body)
+			return nil, i.ui.identityError(i.name, conn, s)
 		case "done":
+			conn.endRun()
 			break ReadLoop
 		default:
 			if ok, err := i.ui.handle(i.name, conn, s); err != nil {
@@ -311,15 +795,95 @@ type ClientUI struct {
 	// value indicates whether the user selected the yes or no option.
 	Confirm func(name, prompt, yes, no string) (choseYes bool, err error)
 
+	// RequestValueContext and ConfirmContext, if not nil, are used instead of
+	// RequestValue and Confirm. They are still invoked synchronously, but ctx
+	// is canceled if the plugin exits while they are running, or if the
+	// context passed to WrapContext or UnwrapContext is done, so that
+	// applications can run a non-blocking dialog, wait for it or for ctx to be
+	// done, and close the dialog if the plugin goes away.
+	//
+	// If they return an error wrapping context.Canceled, for example because
+	// the user dismissed the dialog, the plugin is stopped and (Un)Wrap returns
+	// the error, instead of reporting the failure to the plugin.
+	RequestValueContext func(ctx context.Context, name, prompt string, secret bool) (string, error)
+	ConfirmContext      func(ctx context.Context, name, prompt, yes, no string) (choseYes bool, err error)
+
 	// WaitTimer is invoked once (Un)Wrap has been waiting for 5 seconds on the
 	// plugin, for example because the plugin is waiting for an external event
 	// (e.g. a hardware token touch). Unlike the other callbacks, WaitTimer runs
 	// in a separate goroutine, and if missing it's simply ignored.
 	WaitTimer func(name string)
+
+	// SecretCache, if not nil, is consulted before invoking RequestValue for
+	// secret values, and stores the values it returns.
+	SecretCache *SecretCache
+
+	// Logger, if not nil, receives debug events about the plugin lifecycle
+	// and the types of the stanzas exchanged with it. Stanza arguments and
+	// bodies, which can include file keys and secrets, are not logged, but
+	// anything the plugin writes to its standard error is.
+	Logger age.Logger
+
+	// Tracer, if not nil, is used to start an "age.Plugin" span for the
+	// lifetime of each plugin process.
+	Tracer age.Tracer
+
+	// Limits, if not nil, are enforced on each plugin process.
+	Limits *Limits
+
+	// Timeout, if not zero, is the maximum time the client waits for the
+	// plugin to send each message, or to accept one. The time spent in the
+	// other callbacks is not counted, but the time the plugin spends waiting
+	// for an external event, such as a hardware token touch, is. If the
+	// plugin doesn't respond in time, it's killed, and the operation fails
+	// with a *TimeoutError.
+	Timeout time.Duration
+
+	// MaxStanzas and MaxStanzaBytes limit the number of stanzas, and the total
+	// size of their arguments and bodies, that a plugin can return for each
+	// recipient when wrapping a file key. If zero, DefaultMaxStanzas and
+	// DefaultMaxStanzaBytes are used. If a limit is exceeded, the session is
+	// aborted with a *StanzaLimitError.
+	MaxStanzas     int
+	MaxStanzaBytes int
+
+	// Transcript, if not nil, records the full transcript of each plugin
+	// session.
+	Transcript *TranscriptRecorder
+
+	// Replay, if not nil, replaces the plugin processes with the sessions of a
+	// recorded transcript. It's meant for tests.
+	Replay *TranscriptReplayer
+
+	// Connect, if not nil, replaces the plugin processes with the connections
+	// it returns for each session, which are read from and written to as the
+	// plugin's standard output and input. Close is called at the end of the
+	// session, and its error is treated like the exit status of the plugin.
+	// Limits are not enforced. It's meant for tests, see package
+	// filippo.io/age/testkit/pluginsim.
+	Connect func(name, protocol string) (io.ReadWriteCloser, error)
+
+	// PINRetry, if not nil, is invoked when Unwrap or Unlock fail because the
+	// plugin reported an incorrect PIN. If it returns true, the operation is
+	// retried from the start, and the plugin will prompt for the PIN again.
+	// It's not invoked if the PIN is blocked.
+	//
+	// Implementations should show err.Remaining to the user, and should not
+	// retry without user interaction, to avoid locking the token.
+	PINRetry func(name string, err *age.PINError) bool
 }
 
 func (c *ClientUI) handle(name string, conn *clientConnection, s *format.Stanza) (ok bool, err error) {
 	switch s.Type {
+	case "extension":
+		// Only the non-standard session extension is acknowledged, see Session.
+		if len(s.Args) != 1 || s.Args[0] != "session" || !conn.extensions["session"] {
+			c.debug("plugin acknowledged an extension that was not offered", "plugin", name)
+			return false, nil
+		}
+		c.debug("plugin accepted the session extension", "plugin", name)
+		conn.sessionAccepted = true
+		return true, writeStanza(conn, "ok")
 	case "msg":
 		if c.DisplayMessage == nil {
 			return true, writeStanza(conn, "fail")
@@ -329,19 +893,60 @@ func (c *ClientUI) handle(name string, conn *clientConnection, s *format.Stanza)
 		}
 		return true, writeStanza(conn, "ok")
 	case "request-secret", "request-public":
-		if c.RequestValue == nil {
+		if c.RequestValue == nil && c.RequestValueContext == nil {
 			return true, writeStanza(conn, "fail")
 		}
-		secret, err := c.RequestValue(name, string(s.Body), s.Type == "request-secret")
+		prompt, isSecret := string(s.Body), s.Type == "request-secret"
+		cache := c.SecretCache
+		if !isSecret {
+			cache = nil
+		}
+		if cache != nil {
+			if conn.secretPrompts == nil {
+				conn.secretPrompts = make(map[string]bool)
+			}
+			conn.secretPrompts[prompt] = true
+			if conn.servedFromCache[prompt] {
+				// The plugin is asking again, the cached value must be wrong.
+				cache.evict(name, prompt)
+			} else if v := cache.get(name, prompt); v != nil {
+				defer v.wipe()
+				if conn.servedFromCache == nil {
+					conn.servedFromCache = make(map[string]bool)
+				}
+				conn.servedFromCache[prompt] = true
+				return true, writeStanzaWithBody(conn, "ok", v.bytes())
+			}
+		}
+		var value string
+		if c.RequestValueContext != nil {
+			value, err = c.RequestValueContext(conn.ctx, name, prompt, isSecret)
+		} else {
+			value, err = c.RequestValue(name, prompt, isSecret)
+		}
+		if errors.Is(err, context.Canceled) {
+			return true, err
+		}
 		if err != nil {
 			return true, writeStanza(conn, "fail")
 		}
-		return true, writeStanzaWithBody(conn, "ok", []byte(secret))
+		body := []byte(value)
+		if isSecret {
+			defer func() {
+				for i := range body {
+					body[i] = 0
+				}
+			}()
+		}
+		if cache != nil {
+			cache.put(name, prompt, body)
+		}
+		return true, writeStanzaWithBody(conn, "ok", body)
 	case "confirm":
 		if len(s.Args) != 1 && len(s.Args) != 2 {
 			return true, fmt.Errorf("malformed confirm stanza: unexpected number of arguments")
 		}
-		if c.Confirm == nil {
+		if c.Confirm == nil && c.ConfirmContext == nil {
 			return true, writeStanza(conn, "fail")
 		}
 		yes, err := format.DecodeString(s.Args[0])
@@ -355,7 +960,15 @@ func (c *ClientUI) handle(name string, conn *clientConnection, s *format.Stanza)
 				return true, fmt.Errorf("malformed confirm stanza: invalid NO option encoding")
 			}
 		}
-		choseYes, err := c.Confirm(name, string(s.Body), string(yes), string(no))
+		var choseYes bool
+		if c.ConfirmContext != nil {
+			choseYes, err = c.ConfirmContext(conn.ctx, name, string(s.Body), string(yes), string(no))
+		} else {
+			choseYes, err = c.Confirm(name, string(s.Body), string(yes), string(no))
+		}
+		if errors.Is(err, context.Canceled) {
+			return true, err
+		}
 		if err != nil {
 			return true, writeStanza(conn, "fail")
 		}
@@ -375,37 +988,266 @@ func (c *ClientUI) readStanza(name string, r *format.StanzaReader) (*format.Stan
 	if c.WaitTimer != nil {
 		defer time.AfterFunc(5*time.Second, func() { c.WaitTimer(name) }).Stop()
 	}
-	return r.ReadStanza()
+	s, err := r.ReadStanza()
+	if err != nil {
+		c.debug("failed to read stanza from plugin", "plugin", name, "error", err)
+		return nil, err
+	}
+	c.debug("received stanza from plugin", "plugin", name, "type", s.Type,
+		"args", len(s.Args), "body", len(s.Body))
+	return s, nil
+}
+
+type noopSpan struct{}
+
+func (noopSpan) End(error) {}
+
+func (c *ClientUI) startSpan(name string, attrs ...any) age.Span {
+	if c == nil || c.Tracer == nil {
+		return noopSpan{}
+	}
+	return c.Tracer.StartSpan(name, attrs...)
+}
+
+func (c *ClientUI) debugEnabled() bool {
+	return c != nil && c.Logger != nil
+}
+
+func (c *ClientUI) debug(msg string, args ...any) {
+	if c.debugEnabled() {
+		c.Logger.Debug(msg, args...)
+	}
 }
 
 type clientConnection struct {
 	cmd       *exec.Cmd
+	name      string
+	ui        *ClientUI
 	io.Reader // stdout
 	io.Writer // stdin
 	stderr    bytes.Buffer
 	close     func()
+	span      age.Span
+
+	// ctx is canceled when the plugin exits, at which point waitErr is set, or
+	// when the current operation ends, at which point stopWatch is called.
+	ctx       context.Context
+	stopWatch func()
+	exited    chan struct{}
+	waitErr   error
+
+	// limits are enforced by the lifetimeTimer and by the operating system,
+	// and limitErr is set if the plugin is killed for exceeding them, or by
+	// abort, for example because it timed out.
+	limits        *Limits
+	lifetimeTimer *time.Timer
+	releaseLimits func()
+	limitMu       sync.Mutex
+	limitErr      error
+
+	// kill stops the plugin, making pending reads and writes fail. It's nil
+	// for replayed sessions, which can't be aborted.
+	kill func()
+
+	// servedFromCache tracks the prompts answered from ClientUI.SecretCache
+	// during this session, and secretPrompts all the secret prompts.
+	servedFromCache map[string]bool
+	secretPrompts   map[string]bool
+
+	// extensions are the optional features offered to the plugin in phase 1.
+	extensions map[string]bool
+
+	// session, if not nil, is the Session the connection is returned to at the
+	// end of the state machine, if the plugin set sessionAccepted and reusable
+	// is set, and idle is set while it's kept there, until idleTimer fires.
+	// started is when the plugin was started, and sr is kept across the state
+	// machines run on the connection.
+	session         *Session
+	key             sessionKey
+	sessionAccepted bool
+	reusable        bool
+	idle            bool
+	idleTimer       *time.Timer
+	started         time.Time
+	sr              *format.StanzaReader
+
+	// transcript, if not nil, records the data exchanged with the plugin.
+	transcript *transcriptSession
 }
 
 var testOnlyPluginPath string
 
-func openClientConnection(name, protocol string) (*clientConnection, error) {
+// DefaultMaxStanzas and DefaultMaxStanzaBytes are the default values of
+// ClientUI.MaxStanzas and ClientUI.MaxStanzaBytes.
+const (
+	DefaultMaxStanzas     = 16
+	DefaultMaxStanzaBytes = 64 << 10
+)
+
+func (c *ClientUI) stanzaLimits(recipients int) (maxStanzas, maxBytes int) {
+	maxStanzas, maxBytes = DefaultMaxStanzas, DefaultMaxStanzaBytes
+	if c != nil && c.MaxStanzas > 0 {
+		maxStanzas = c.MaxStanzas
+	}
+	if c != nil && c.MaxStanzaBytes > 0 {
+		maxBytes = c.MaxStanzaBytes
+	}
+	return maxStanzas * recipients, maxBytes * recipients
+}
+
+// A StanzaLimitError is returned when a plugin returns more stanzas for a file
+// key than allowed by ClientUI.MaxStanzas or ClientUI.MaxStanzaBytes, which
+// are multiplied by the number of recipients in the session.
+type StanzaLimitError struct {
+	Plugin string
+
+	// Stanzas and Bytes are the number and total size of the stanzas
+	// received, including the one that exceeded the limit.
+	Stanzas, Bytes int
+
+	MaxStanzas, MaxBytes int
+}
+
+func (e *StanzaLimitError) Error() string {
+	if e.Stanzas > e.MaxStanzas {
+		return fmt.Sprintf("plugin returned more than %d stanzas", e.MaxStanzas)
+	}
+	return fmt.Sprintf("plugin returned more than %d bytes of stanzas", e.MaxBytes)
+}
+
+// A TimeoutError is returned when a plugin is killed because it didn't
+// respond within ClientUI.Timeout, or before the deadline of the context
+// passed to WrapContext or UnwrapContext. It matches context.DeadlineExceeded.
+type TimeoutError struct {
+	Plugin string
+
+	// Timeout is ClientUI.Timeout, or the time between the start of the plugin
+	// and the context deadline.
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("plugin timed out after %v", e.Timeout)
+}
+
+func (e *TimeoutError) Is(target error) bool { return target == context.DeadlineExceeded }
+
+// An unavailableError wraps an error that makes a plugin recipient or identity
+// unusable in the current environment, and matches age.ErrUnavailable.
+type unavailableError struct {
+	err error
+}
+
+func (e *unavailableError) Error() string        { return e.err.Error() }
+func (e *unavailableError) Unwrap() error        { return e.err }
+func (e *unavailableError) Is(target error) bool { return target == age.ErrUnavailable }
+
+// isUnavailable reports whether an error stanza is "error unavailable", which
+// plugins send when the recipient or identity can't be used right now, for
+// example because the hardware token is not connected.
+func isUnavailable(s *format.Stanza) bool {
+	return len(s.Args) == 1 && s.Args[0] == "unavailable"
+}
+
+// pluginError returns the error reported by the plugin with an error stanza.
+//
+// Plugins backed by hardware tokens can send "error pin-incorrect [REMAINING]"
+// or "error pin-blocked" to report the state of the PIN, which is returned as
+// an *age.PINError.
+func pluginError(s *format.Stanza) error {
+	err := fmt.Errorf("%s", s.Body)
+	switch {
+	case isUnavailable(s):
+		return &unavailableError{err}
+	case len(s.Args) == 1 && s.Args[0] == "pin-blocked":
+		return &age.PINError{Blocked: true, Err: err}
+	case len(s.Args) >= 1 && len(s.Args) <= 2 && s.Args[0] == "pin-incorrect":
+		remaining := -1
+		if len(s.Args) == 2 {
+			if n, err := strconv.Atoi(s.Args[1]); err == nil && n >= 0 {
+				remaining = n
+			}
+		}
+		return &age.PINError{Remaining: remaining, Err: err}
+	}
+	return err
+}
+
+// identityError returns the error reported by the plugin with an error stanza
+// in an identity session. If it's a PIN error, the secrets provided in the
+// session are evicted from the SecretCache, as they must be wrong.
+func (c *ClientUI) identityError(name string, conn *clientConnection, s *format.Stanza) error {
+	err := pluginError(s)
+	var pe *age.PINError
+	if c != nil && c.SecretCache != nil && errors.As(err, &pe) {
+		for prompt := range conn.secretPrompts {
+			c.SecretCache.evict(name, prompt)
+		}
+	}
+	return err
+}
+
+// retryPIN reports whether an operation that failed with err should be retried,
+// according to PINRetry. Blocked PINs are never retried.
+func (c *ClientUI) retryPIN(name string, err error) bool {
+	var pe *age.PINError
+	if c == nil || c.PINRetry == nil || !errors.As(err, &pe) || pe.Blocked {
+		return false
+	}
+	c.debug("plugin reported incorrect PIN", "plugin", name, "remaining", pe.Remaining)
+	return c.PINRetry(name, pe)
+}
+
+// Command returns a command that runs the age-plugin-NAME binary with args,
+// found the same way as when encrypting and decrypting. It can be used to
+// invoke plugin-specific functionality, such as key generation.
+func Command(name string, args ...string) *exec.Cmd {
+	return exec.Command(pluginPath(name), args...)
+}
+
+func pluginPath(name string) string {
 	path := "age-plugin-" + name
 	if testOnlyPluginPath != "" {
 		path = filepath.Join(testOnlyPluginPath, path)
 	}
+	return path
+}
+
+func openClientConnection(ctx context.Context, name, protocol string, ui *ClientUI) (*clientConnection, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ui != nil && ui.Replay != nil {
+		return ui.Replay.open(name, protocol, ui)
+	}
+	if ui != nil && ui.Connect != nil {
+		return connectClientConnection(ctx, name, protocol, ui)
+	}
+	if err := checkVersion(name); err != nil {
+		ui.debug("plugin version check failed", "plugin", name, "error", err)
+		return nil, err
+	}
+	path := pluginPath(name)
 	cmd := exec.Command(path, "--age-plugin="+protocol)
 
-	stdout, err := cmd.StdoutPipe()
+	// Use an os.Pipe rather than StdoutPipe, so that the plugin output can
+	// still be read after it exits and Wait returns.
+	stdout, stdoutW, err := os.Pipe()
 	if err != nil {
 		return nil, err
 	}
+	cmd.Stdout = stdoutW
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
+		stdout.Close()
+		stdoutW.Close()
 		return nil, err
 	}
 
 	cc := &clientConnection{
 		cmd:    cmd,
+		name:   name,
+		ui:     ui,
 		Reader: stdout,
 		Writer: stdin,
 		close: func() {
@@ -414,10 +1256,8 @@ func openClientConnection(name, protocol string) (*clientConnection, error) {
 		},
 	}
 
-	if os.Getenv("AGEDEBUG") == "plugin" {
-		cc.Reader = io.TeeReader(cc.Reader, os.Stderr)
-		cc.Writer = io.MultiWriter(cc.Writer, os.Stderr)
-		cmd.Stderr = os.Stderr
+	if ui.debugEnabled() {
+		cmd.Stderr = &cc.stderr
 	}
 
 	// We don't want the plugins to rely on the working directory for anything
@@ -425,27 +1265,211 @@ func openClientConnection(name, protocol string) (*clientConnection, error) {
 	// temporary directory.
 	cmd.Dir = os.TempDir()
 
-	if err := cmd.Start(); err != nil {
+	cc.span = ui.startSpan("age.Plugin", "plugin", name, "protocol", protocol)
+	err = cmd.Start()
+	stdoutW.Close()
+	if err != nil {
+		ui.debug("failed to start plugin", "plugin", name, "path", path, "error", err)
+		cc.span.End(err)
+		cc.close()
+		if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+			return nil, &unavailableError{err}
+		}
 		return nil, err
 	}
+	cc.exited = make(chan struct{})
+	cc.kill = func() { cmd.Process.Kill() }
+	go func() {
+		cc.waitErr = cmd.Wait()
+		close(cc.exited)
+	}()
+	cc.stopWatch = cc.watchContext(ctx)
+	if ui != nil && ui.Limits != nil {
+		if err := cc.enforceLimits(ui.Limits); err != nil {
+			ui.debug("failed to enforce plugin limits", "plugin", name, "error", err)
+			cmd.Process.Kill()
+			cc.Close()
+			return nil, err
+		}
+	}
+	if ui != nil && ui.Transcript != nil {
+		cc.transcript = ui.Transcript.startSession(name, protocol)
+	}
+	ui.debug("started plugin", "plugin", name, "path", path, "protocol", protocol,
+		"pid", cmd.Process.Pid)
 
 	return cc, nil
 }
 
+// connectClientConnection opens a session with ClientUI.Connect instead of
+// starting a plugin process.
+func connectClientConnection(ctx context.Context, name, protocol string, ui *ClientUI) (*clientConnection, error) {
+	conn, err := ui.Connect(name, protocol)
+	if err != nil {
+		ui.debug("failed to connect to plugin", "plugin", name, "error", err)
+		return nil, err
+	}
+	cc := &clientConnection{
+		name:   name,
+		ui:     ui,
+		Reader: conn,
+		Writer: conn,
+		span:   ui.startSpan("age.Plugin", "plugin", name, "protocol", protocol),
+		exited: make(chan struct{}),
+	}
+	var closeOnce sync.Once
+	cc.close = func() {
+		closeOnce.Do(func() {
+			cc.waitErr = conn.Close()
+			close(cc.exited)
+		})
+	}
+	// Closing the connection is the closest thing to killing the plugin. It's
+	// done in a separate goroutine, since Close waits for the session to end.
+	cc.kill = func() { go cc.close() }
+	cc.stopWatch = cc.watchContext(ctx)
+	if ui.Transcript != nil {
+		cc.transcript = ui.Transcript.startSession(name, protocol)
+	}
+	ui.debug("connected to plugin", "plugin", name, "protocol", protocol)
+	return cc, nil
+}
+
 func (cc *clientConnection) Close() error {
 	// Close stdin and stdout and send SIGINT (if supported) to the plugin,
-	// then wait for it to cleanup and exit.
+	// then wait for it to cleanup and exit. Idle plugins kept by a Session
+	// are given some time to exit on their own first.
 	cc.close()
-	cc.cmd.Process.Signal(os.Interrupt)
-	return cc.cmd.Wait()
+	if cc.cmd != nil {
+		if cc.idle {
+			select {
+			case <-cc.exited:
+			case <-time.After(time.Second):
+			}
+		}
+		cc.cmd.Process.Signal(os.Interrupt)
+	}
+	<-cc.exited
+	err := cc.waitErr
+	if cc.transcript != nil {
+		cc.transcript.end()
+	}
+	if cc.lifetimeTimer != nil {
+		cc.lifetimeTimer.Stop()
+	}
+	if cc.releaseLimits != nil {
+		cc.releaseLimits()
+	}
+	cc.span.End(err)
+	if cc.ui.debugEnabled() {
+		cc.ui.debug("plugin exited", "plugin", cc.name, "error", err, "stderr", cc.stderr.String())
+	}
+	return err
+}
+
+// watchContext sets cc.ctx to a context derived from ctx that is canceled when
+// the plugin exits, or when the returned function is called at the end of the
+// operation. If ctx is done first, the session is aborted.
+func (cc *clientConnection) watchContext(ctx context.Context) (stop func()) {
+	cctx, cancel := context.WithCancel(ctx)
+	cc.ctx = cctx
+	stopped := make(chan struct{})
+	start := time.Now()
+	go func() {
+		defer cancel()
+		select {
+		case <-ctx.Done():
+		case <-cc.exited:
+			return
+		case <-stopped:
+			return
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			timeout := time.Since(start).Round(time.Millisecond)
+			if deadline, ok := ctx.Deadline(); ok {
+				timeout = deadline.Sub(start).Round(time.Millisecond)
+			}
+			cc.abort(&TimeoutError{Plugin: cc.name, Timeout: timeout})
+		} else {
+			cc.abort(fmt.Errorf("plugin was stopped: %w", ctx.Err()))
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(stopped) }) }
+}
+
+// abort kills the plugin, so that the pending and following operations on
+// the connection fail with err.
+func (cc *clientConnection) abort(err error) {
+	cc.ui.debug("aborting plugin session", "plugin", cc.name, "error", err)
+	cc.setLimitError(err)
+	cc.kill()
+}
+
+// startTimeout starts a timer that aborts the session if an operation takes
+// longer than ClientUI.Timeout, and returns a function that stops it.
+func (cc *clientConnection) startTimeout() (stop func()) {
+	if cc.ui == nil || cc.ui.Timeout <= 0 || cc.kill == nil {
+		return func() {}
+	}
+	t := time.AfterFunc(cc.ui.Timeout, func() {
+		cc.abort(&TimeoutError{Plugin: cc.name, Timeout: cc.ui.Timeout})
+	})
+	return func() { t.Stop() }
+}
+
+func (cc *clientConnection) Read(p []byte) (int, error) {
+	defer cc.startTimeout()()
+	n, err := cc.Reader.Read(p)
+	if cc.transcript != nil {
+		cc.transcript.plugin(p[:n])
+	}
+	if err != nil {
+		err = cc.limitError(err)
+	}
+	return n, err
+}
+
+func (cc *clientConnection) Write(p []byte) (int, error) {
+	defer cc.startTimeout()()
+	n, err := cc.Writer.Write(p)
+	if cc.transcript != nil {
+		cc.transcript.client(p[:n])
+	}
+	if err != nil {
+		err = cc.limitError(err)
+	}
+	return n, err
+}
+
+func (cc *clientConnection) writeStanza(s *format.Stanza) error {
+	cc.ui.debug("sending stanza to plugin", "plugin", cc.name, "type", s.Type,
+		"args", len(s.Args), "body", len(s.Body))
+	return s.Marshal(cc)
+}
+
+// writeExtensions offers the optional protocol features supported by the
+// client with an extension-NAME stanza each, and "session" if the connection
+// belongs to a Session.
+func (cc *clientConnection) writeExtensions(names ...string) error {
+	if cc.session != nil {
+		names = append(names, "session")
+	}
+	cc.extensions = make(map[string]bool)
+	cc.sessionAccepted = false
+	for _, name := range names {
+		cc.extensions[name] = true
+		if err := writeStanza(cc, "extension-"+name); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func writeStanza(conn io.Writer, t string, args ...string) error {
-	s := &format.Stanza{Type: t, Args: args}
-	return s.Marshal(conn)
+func writeStanza(conn *clientConnection, t string, args ...string) error {
+	return conn.writeStanza(&format.Stanza{Type: t, Args: args})
 }
 
-func writeStanzaWithBody(conn io.Writer, t string, body []byte) error {
-	s := &format.Stanza{Type: t, Body: body}
-	return s.Marshal(conn)
+func writeStanzaWithBody(conn *clientConnection, t string, body []byte) error {
+	return conn.writeStanza(&format.Stanza{Type: t, Body: body})
 }
@@ -8,14 +8,25 @@ package plugin
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
+	"unsafe"
 
 	"filippo.io/age"
-	"filippo.io/age/internal/bech32"
+	"filippo.io/age/bech32"
+	"filippo.io/age/testkit/pluginsim"
 )
 
 func TestMain(m *testing.M) {
@@ -42,6 +53,21 @@ func TestMain(m *testing.M) {
 			scanner.Scan() // body
 			os.Stdout.WriteString("-> done\n\n")
 			os.Exit(0)
+		case "--version":
+			os.Stdout.WriteString("age-plugin-test v1.2.3\n")
+			os.Exit(0)
+		case "--age-plugin=identity-list-v1":
+			scanner := bufio.NewScanner(os.Stdin)
+			readPhase1(scanner)
+			os.Stdout.WriteString("-> identity " + EncodeIdentity("test", []byte{1}) + " age1test10qdmzv9q\n")
+			os.Stdout.WriteString("U2xvdCAx\n") // "Slot 1"
+			scanner.Scan()                      // ok
+			scanner.Scan()                      // body
+			os.Stdout.WriteString("-> identity " + EncodeIdentity("test", []byte{2}) + "\n\n")
+			scanner.Scan() // ok
+			scanner.Scan() // body
+			os.Stdout.WriteString("-> done\n\n")
+			os.Exit(0)
 		default:
 			panic(os.Args[1])
 		}
@@ -72,11 +98,229 @@ func TestMain(m *testing.M) {
 		default:
 			panic(os.Args[1])
 		}
+	case "age-plugin-testext":
+		switch os.Args[1] {
+		case "--age-plugin=recipient-v1":
+			scanner := bufio.NewScanner(os.Stdin)
+			phase1 := readPhase1(scanner)
+			fileKey := phase1["wrap-file-key"]
+			if _, ok := phase1["extension-labels"]; !ok {
+				fail("labels extension not offered")
+			}
+			os.Stdout.WriteString("-> confirm eWVz\nQ29udGludWU/\n")
+			scanner.Scan() // ok or fail
+			got := scanner.Text()
+			scanner.Scan() // body
+			if got != "-> ok yes" && got != "-> fail" {
+				fail("confirm: " + got)
+			}
+			os.Stdout.WriteString("-> recipient-stanza 0 test\n")
+			os.Stdout.WriteString(fileKey + "\n")
+			scanner.Scan() // ok
+			scanner.Scan() // body
+			os.Stdout.WriteString("-> done\n\n")
+			os.Exit(0)
+		default:
+			panic(os.Args[1])
+		}
+	case "age-plugin-testbatch":
+		switch os.Args[1] {
+		case "--age-plugin=recipient-v1":
+			// Wrap the file key for each recipient, with a stanza per
+			// recipient that echoes it back.
+			scanner := bufio.NewScanner(os.Stdin)
+			var recipients []string
+			var fileKey string
+			var batch bool
+			for scanner.Scan() {
+				f := strings.Fields(scanner.Text())
+				scanner.Scan() // body
+				if f[1] == "done" {
+					break
+				}
+				switch f[1] {
+				case "add-recipient":
+					recipients = append(recipients, f[2])
+				case "wrap-file-key":
+					fileKey = scanner.Text()
+				case "extension-batch":
+					batch = true
+				}
+			}
+			if batch != (len(recipients) > 1) {
+				fail("batch extension offered incorrectly")
+			}
+			for _, r := range recipients {
+				os.Stdout.WriteString("-> recipient-stanza 0 test " + r + "\n")
+				os.Stdout.WriteString(fileKey + "\n")
+				scanner.Scan() // ok
+				scanner.Scan() // body
+			}
+			os.Stdout.WriteString("-> done\n\n")
+			os.Exit(0)
+		default:
+			panic(os.Args[1])
+		}
+	case "age-plugin-testprompt":
+		switch os.Args[1] {
+		case "--age-plugin=recipient-v1":
+			scanner := bufio.NewScanner(os.Stdin)
+			fileKey := readPhase1(scanner)["wrap-file-key"]
+			os.Stdout.WriteString("-> request-secret\nUElOOg\n") // "PIN:"
+			if os.Getenv("AGE_TEST_PROMPT_EXIT") != "" {
+				os.Exit(1)
+			}
+			scanner.Scan() // ok
+			if scanner.Text() != "-> ok" {
+				fail("request-secret: " + scanner.Text())
+			}
+			scanner.Scan() // body, "1234"
+			if scanner.Text() != "MTIzNA" {
+				fail("request-secret: wrong value")
+			}
+			os.Stdout.WriteString("-> recipient-stanza 0 test\n")
+			os.Stdout.WriteString(fileKey + "\n")
+			scanner.Scan() // ok
+			scanner.Scan() // body
+			os.Stdout.WriteString("-> done\n\n")
+			os.Exit(0)
+		default:
+			panic(os.Args[1])
+		}
+	case "age-plugin-testhang":
+		switch os.Args[1] {
+		case "--age-plugin=recipient-v1":
+			scanner := bufio.NewScanner(os.Stdin)
+			readPhase1(scanner)
+			if os.Getenv("AGE_TEST_HANG_ALLOC") != "" {
+				// Grow the address space past the limit in small steps, without
+				// touching the memory.
+				var chunks [][]byte
+				for i := 0; i < 64; i++ {
+					chunks = append(chunks, make([]byte, 64<<20))
+				}
+				runtime.KeepAlive(chunks)
+			}
+			time.Sleep(time.Minute)
+			os.Exit(0)
+		default:
+			panic(os.Args[1])
+		}
+	case "age-plugin-testflood":
+		switch os.Args[1] {
+		case "--age-plugin=recipient-v1":
+			scanner := bufio.NewScanner(os.Stdin)
+			readPhase1(scanner)
+			for i := 0; i < 100; i++ {
+				os.Stdout.WriteString("-> recipient-stanza 0 flood\n")
+				os.Stdout.WriteString(base64.RawStdEncoding.EncodeToString(make([]byte, 40)) + "\n")
+				if !scanner.Scan() || !scanner.Scan() { // ok, body
+					os.Exit(1)
+				}
+			}
+			os.Stdout.WriteString("-> done\n\n")
+			os.Exit(0)
+		default:
+			panic(os.Args[1])
+		}
+	case "age-plugin-testlock":
+		token := base64.RawStdEncoding.EncodeToString([]byte("token"))
+		switch os.Args[1] {
+		case "--age-plugin=unlock-v1":
+			scanner := bufio.NewScanner(os.Stdin)
+			readPhase1(scanner)
+			os.Stdout.WriteString("-> request-secret\n")
+			os.Stdout.WriteString(base64.RawStdEncoding.EncodeToString([]byte("PIN")) + "\n")
+			scanner.Scan() // ok
+			scanner.Scan() // body
+			if pin, _ := base64.RawStdEncoding.DecodeString(scanner.Text()); string(pin) != "1234" {
+				os.Stdout.WriteString("-> error identity 0\n")
+				os.Stdout.WriteString(base64.RawStdEncoding.EncodeToString([]byte("wrong PIN")) + "\n")
+				scanner.Scan() // ok
+				scanner.Scan() // body
+				os.Exit(0)
+			}
+			os.Stdout.WriteString("-> unlocked\n")
+			os.Stdout.WriteString(token + "\n")
+			scanner.Scan() // ok
+			scanner.Scan() // body
+			os.Stdout.WriteString("-> done\n\n")
+			os.Exit(0)
+		case "--age-plugin=identity-v1":
+			scanner := bufio.NewScanner(os.Stdin)
+			phase1 := readPhase1(scanner)
+			if phase1["unlock-token"] != token {
+				fail("locked")
+			}
+			os.Stdout.WriteString("-> file-key 0\n")
+			os.Stdout.WriteString(phase1["recipient-stanza"] + "\n")
+			scanner.Scan() // ok
+			scanner.Scan() // body
+			os.Stdout.WriteString("-> done\n\n")
+			os.Exit(0)
+		default:
+			panic(os.Args[1])
+		}
+	case "age-plugin-testpin":
+		switch os.Args[1] {
+		case "--age-plugin=identity-v1":
+			scanner := bufio.NewScanner(os.Stdin)
+			phase1 := readPhase1(scanner)
+			os.Stdout.WriteString("-> request-secret\n")
+			os.Stdout.WriteString(base64.RawStdEncoding.EncodeToString([]byte("PIN")) + "\n")
+			scanner.Scan() // ok
+			scanner.Scan() // body
+			switch pin, _ := base64.RawStdEncoding.DecodeString(scanner.Text()); string(pin) {
+			case "1234":
+			case "9999":
+				os.Stdout.WriteString("-> error pin-blocked\n")
+				os.Stdout.WriteString(base64.RawStdEncoding.EncodeToString([]byte("token locked")) + "\n")
+				scanner.Scan() // ok
+				scanner.Scan() // body
+				os.Exit(0)
+			default:
+				os.Stdout.WriteString("-> error pin-incorrect 2\n")
+				os.Stdout.WriteString(base64.RawStdEncoding.EncodeToString([]byte("wrong PIN")) + "\n")
+				scanner.Scan() // ok
+				scanner.Scan() // body
+				os.Exit(0)
+			}
+			os.Stdout.WriteString("-> file-key 0\n")
+			os.Stdout.WriteString(phase1["recipient-stanza"] + "\n")
+			scanner.Scan() // ok
+			scanner.Scan() // body
+			os.Stdout.WriteString("-> done\n\n")
+			os.Exit(0)
+		default:
+			panic(os.Args[1])
+		}
 	default:
 		os.Exit(m.Run())
 	}
 }
 
+// readPhase1 reads the stanzas sent by the client until "done", and returns
+// the last body line of each stanza type.
+func readPhase1(scanner *bufio.Scanner) map[string]string {
+	stanzas := make(map[string]string)
+	for scanner.Scan() {
+		t := strings.Fields(scanner.Text())[1]
+		scanner.Scan() // body
+		if t == "done" {
+			break
+		}
+		stanzas[t] = scanner.Text()
+	}
+	return stanzas
+}
+
+// fail makes the fake plugin return an internal error to the client.
+func fail(msg string) {
+	os.Stdout.WriteString("-> error internal\n")
+	os.Stdout.WriteString(base64.RawStdEncoding.EncodeToString([]byte(msg)) + "\n")
+	os.Exit(0)
+}
+
 func TestLabels(t *testing.T) {
 	if runtime.GOOS == "windows" {
 		t.Skip("Windows support is TODO")
@@ -131,3 +375,1078 @@ func TestLabels(t *testing.T) {
 		t.Errorf("expected one pqc and one normal to fail")
 	}
 }
+
+func TestExtensions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows support is TODO")
+	}
+	temp := t.TempDir()
+	testOnlyPluginPath = temp
+	t.Cleanup(func() { testOnlyPluginPath = "" })
+	ex, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(ex, filepath.Join(temp, "age-plugin-testext")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(temp, "age-plugin-testext"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	name, err := bech32.Encode("age1testext", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a Confirm callback, the plugin gets a fail reply.
+	r, err := NewRecipient(name, &ClientUI{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.Encrypt(io.Discard, r); err != nil {
+		t.Errorf("without Confirm: %v", err)
+	}
+
+	var confirmed bool
+	r, err = NewRecipient(name, &ClientUI{
+		Confirm: func(name, prompt, yes, no string) (bool, error) {
+			confirmed = prompt == "Continue?" && yes == "yes"
+			return true, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.Encrypt(io.Discard, r); err != nil {
+		t.Errorf("with Confirm: %v", err)
+	}
+	if !confirmed {
+		t.Errorf("Confirm was not called")
+	}
+}
+
+func TestRequestValueContext(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows support is TODO")
+	}
+	temp := t.TempDir()
+	testOnlyPluginPath = temp
+	t.Cleanup(func() { testOnlyPluginPath = "" })
+	ex, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(ex, filepath.Join(temp, "age-plugin-testprompt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(temp, "age-plugin-testprompt"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	name, err := bech32.Encode("age1testprompt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewRecipient(name, &ClientUI{
+		RequestValueContext: func(ctx context.Context, name, prompt string, secret bool) (string, error) {
+			if prompt != "PIN:" || !secret {
+				return "", errors.New("unexpected prompt")
+			}
+			return "1234", nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Wrap(make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A dismissed dialog stops the plugin, and is returned as an error.
+	r, err = NewRecipient(name, &ClientUI{
+		RequestValueContext: func(ctx context.Context, name, prompt string, secret bool) (string, error) {
+			return "", fmt.Errorf("dialog dismissed: %w", context.Canceled)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Wrap(make([]byte, 16)); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	// If the plugin exits while the dialog is open, ctx is canceled.
+	t.Setenv("AGE_TEST_PROMPT_EXIT", "1")
+	r, err = NewRecipient(name, &ClientUI{
+		RequestValueContext: func(ctx context.Context, name, prompt string, secret bool) (string, error) {
+			select {
+			case <-ctx.Done():
+				return "", ctx.Err()
+			case <-time.After(10 * time.Second):
+				return "", errors.New("context was not canceled")
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Wrap(make([]byte, 16)); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestGroupRecipients(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows support is TODO")
+	}
+	temp := t.TempDir()
+	testOnlyPluginPath = temp
+	t.Cleanup(func() { testOnlyPluginPath = "" })
+	ex, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(ex, filepath.Join(temp, "age-plugin-testbatch")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(temp, "age-plugin-testbatch"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ui := &ClientUI{}
+	var encodings []string
+	var recipients []age.Recipient
+	for i := byte(0); i < 3; i++ {
+		s, err := bech32.Encode("age1testbatch", []byte{i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewRecipient(s, ui)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encodings = append(encodings, s)
+		recipients = append(recipients, r)
+	}
+	x, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewRecipient(encodings[0], &ClientUI{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xr := x.Recipient()
+
+	grouped := GroupRecipients([]age.Recipient{recipients[0], xr,
+		recipients[1], other, recipients[2]})
+	if len(grouped) != 3 {
+		t.Fatalf("got %d recipients, expected 3", len(grouped))
+	}
+	if grouped[1] != xr {
+		t.Errorf("X25519 recipient was not preserved")
+	}
+	if grouped[2] != other {
+		t.Errorf("recipient with a different ClientUI was grouped")
+	}
+
+	stanzas, err := grouped[0].Wrap(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stanzas) != 3 {
+		t.Fatalf("got %d stanzas, expected 3", len(stanzas))
+	}
+	for i, s := range stanzas {
+		if s.Args[0] != encodings[i] {
+			t.Errorf("stanza %d is for %q, expected %q", i, s.Args[0], encodings[i])
+		}
+	}
+
+	if _, err := grouped[2].Wrap(make([]byte, 16)); err != nil {
+		t.Errorf("single recipient: %v", err)
+	}
+	if _, err := age.Encrypt(io.Discard, grouped...); err != nil {
+		t.Errorf("Encrypt: %v", err)
+	}
+}
+
+func TestDeriveRecipient(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows support is TODO")
+	}
+	temp := t.TempDir()
+	testOnlyPluginPath = temp
+	t.Cleanup(func() { testOnlyPluginPath = "" })
+	ex, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(ex, filepath.Join(temp, "age-plugin-test")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(temp, "age-plugin-test"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	identity := func(data byte) *Identity {
+		i, err := NewIdentity(EncodeIdentity("test", []byte{data}), &ClientUI{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return i
+	}
+	i := identity(1)
+	r, err := i.DeriveRecipient(&ClientUI{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Name() != "test" {
+		t.Errorf("unexpected plugin name: %q", r.Name())
+	}
+	if r.String() != "age1test10qdmzv9q" {
+		t.Errorf("unexpected recipient: %q", r.String())
+	}
+	if i.Recipient().String() != "" {
+		t.Errorf("identity-based recipient exposed an encoding")
+	}
+
+	// Identity 2 is listed without a recipient, and identity 42 is not listed.
+	if _, err := identity(2).DeriveRecipient(&ClientUI{}); err == nil {
+		t.Error("expected identity without recipient to fail")
+	}
+	if _, err := identity(42).DeriveRecipient(&ClientUI{}); err == nil {
+		t.Error("expected unlisted identity to fail")
+	}
+}
+
+func TestListIdentities(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows support is TODO")
+	}
+	temp := t.TempDir()
+	testOnlyPluginPath = temp
+	t.Cleanup(func() { testOnlyPluginPath = "" })
+	ex, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(ex, filepath.Join(temp, "age-plugin-test")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(temp, "age-plugin-test"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := ListIdentities("test", &ClientUI{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 {
+		t.Fatalf("got %d identities, expected 2", len(ids))
+	}
+	if ids[0].Identity.String() != EncodeIdentity("test", []byte{1}) {
+		t.Errorf("unexpected identity: %q", ids[0].Identity)
+	}
+	if ids[0].Recipient == nil || ids[0].Recipient.String() != "age1test10qdmzv9q" {
+		t.Errorf("unexpected recipient: %v", ids[0].Recipient)
+	}
+	if ids[0].Description != "Slot 1" {
+		t.Errorf("unexpected description: %q", ids[0].Description)
+	}
+	if ids[1].Recipient != nil || ids[1].Description != "" {
+		t.Errorf("unexpected recipient or description for second identity")
+	}
+}
+
+func TestRequireVersion(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows support is TODO")
+	}
+	temp := t.TempDir()
+	testOnlyPluginPath = temp
+	t.Cleanup(func() { testOnlyPluginPath = "" })
+	t.Cleanup(func() { RequireVersion("test", "") })
+	ex, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(ex, filepath.Join(temp, "age-plugin-test")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(temp, "age-plugin-test"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := Version("test"); err != nil || v != "v1.2.3" {
+		t.Fatalf("Version = %q, %v", v, err)
+	}
+
+	if err := RequireVersion("test", ">=1.2.0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ListIdentities("test", &ClientUI{}); err != nil {
+		t.Errorf("required older version: %v", err)
+	}
+	if err := RequireVersion("test", "v1.3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ListIdentities("test", &ClientUI{}); err == nil || !strings.Contains(err.Error(), "upgrade") {
+		t.Errorf("required newer version: %v", err)
+	}
+	if err := RequireVersion("test", "latest"); err == nil {
+		t.Errorf("invalid constraint was accepted")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows support is TODO")
+	}
+	temp := t.TempDir()
+	testOnlyPluginPath = temp
+	t.Cleanup(func() { testOnlyPluginPath = "" })
+	ex, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(ex, filepath.Join(temp, "age-plugin-testhang")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(temp, "age-plugin-testhang"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	name, err := bech32.Encode("age1testhang", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewRecipient(name, &ClientUI{Limits: &Limits{MaxLifetime: 100 * time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := r.Wrap(make([]byte, 16)); err == nil || !strings.Contains(err.Error(), "maximum lifetime") {
+		t.Errorf("expected lifetime error, got %v", err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("plugin was killed after %v", d)
+	}
+
+	if runtime.GOOS != "linux" {
+		return
+	}
+	t.Setenv("AGE_TEST_HANG_ALLOC", "1")
+	r, err = NewRecipient(name, &ClientUI{Limits: &Limits{
+		MaxMemory: 2 << 30, MaxLifetime: time.Minute}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Wrap(make([]byte, 16)); err == nil || !strings.Contains(err.Error(), "resource limits") {
+		t.Errorf("expected resource limits error, got %v", err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	sim := pluginsim.New()
+	gate := make(chan struct{})
+	defer close(gate)
+	sim.Handle("sim", "recipient-v1", pluginsim.ReadPhase1(), pluginsim.Wait(gate))
+	sim.Handle("sim", "identity-v1", pluginsim.ReadPhase1(), pluginsim.Wait(gate))
+	ui := &ClientUI{Connect: sim.Connect, Timeout: 50 * time.Millisecond}
+	r, err := NewRecipient(EncodeRecipient("sim", nil), ui)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var te *TimeoutError
+	if _, err := r.Wrap(make([]byte, 16)); !errors.As(err, &te) ||
+		!strings.Contains(err.Error(), "plugin timed out after 50ms") {
+		t.Errorf("expected TimeoutError, got %v", err)
+	}
+	i, err := NewIdentity(EncodeIdentity("sim", nil), ui)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.Unwrap([]*age.Stanza{{Type: "sim"}}); !errors.As(err, &te) {
+		t.Errorf("expected TimeoutError, got %v", err)
+	}
+
+	ui.Timeout = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := r.WrapContext(ctx, make([]byte, 16)); !errors.As(err, &te) ||
+		!errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected TimeoutError, got %v", err)
+	}
+	if _, err := r.WrapContext(ctx, make([]byte, 16)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := i.UnwrapContext(ctx, []*age.Stanza{{Type: "sim"}}); !errors.Is(err, context.Canceled) ||
+		errors.As(err, &te) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	// The time spent in the callbacks doesn't count towards the timeout.
+	sim.HandleDefaults("sim")
+	sim.Handle("sim", "recipient-v1", pluginsim.ReadPhase1(),
+		pluginsim.Send("request-secret", nil, []byte("PIN:")), pluginsim.Expect("ok"),
+		pluginsim.WrapFileKeys("sim"), pluginsim.Done())
+	ui.Timeout = 50 * time.Millisecond
+	ui.RequestValue = func(name, prompt string, secret bool) (string, error) {
+		time.Sleep(200 * time.Millisecond)
+		return "1234", nil
+	}
+	if _, err := r.Wrap(make([]byte, 16)); err != nil {
+		t.Errorf("slow callback: %v", err)
+	}
+	if err := sim.Err(); err != nil {
+		t.Error(err)
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	temp := t.TempDir()
+	testOnlyPluginPath = temp
+	t.Cleanup(func() { testOnlyPluginPath = "" })
+	ex, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(ex, filepath.Join(temp, "age-plugin-testhang")); err != nil {
+		t.Fatal(err)
+	}
+	r, err = NewRecipient(EncodeRecipient("testhang", nil), &ClientUI{Timeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := r.Wrap(make([]byte, 16)); !errors.As(err, &te) {
+		t.Errorf("expected TimeoutError, got %v", err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("plugin was killed after %v", d)
+	}
+}
+
+func TestVersionLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+		less bool
+	}{
+		{"1.2.3", "1.2.3", false},
+		{"v1.2.3", "1.2.3", false},
+		{"1.2", "1.2.0", false},
+		{"1.2.3", "1.10.0", true},
+		{"1.10.0", "1.9.9", false},
+		{"1.2.0-rc.1", "1.2.0", true},
+		{"1.2.0", "1.2.0-rc.1", false},
+		{"1.2.0-rc.1", "1.2.0-rc.2", true},
+		{"0.4.0", "1", true},
+	}
+	for _, tt := range tests {
+		less, err := versionLess(tt.a, tt.b)
+		if err != nil {
+			t.Errorf("versionLess(%q, %q): %v", tt.a, tt.b, err)
+		} else if less != tt.less {
+			t.Errorf("versionLess(%q, %q) = %v, want %v", tt.a, tt.b, less, tt.less)
+		}
+	}
+}
+
+func TestUnavailable(t *testing.T) {
+	testOnlyPluginPath = t.TempDir()
+	t.Cleanup(func() { testOnlyPluginPath = "" })
+
+	name, err := bech32.Encode("age1missing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRecipient(name, &ClientUI{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Wrap(make([]byte, 16)); !errors.Is(err, age.ErrUnavailable) {
+		t.Errorf("expected ErrUnavailable, got %v", err)
+	}
+
+	backup, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.Encrypt(io.Discard, age.FallbackRecipient(r, backup.Recipient())); err != nil {
+		t.Errorf("fallback failed: %v", err)
+	}
+}
+
+func TestSecretCache(t *testing.T) {
+	c := NewSecretCache(time.Hour, 3)
+	if v := c.get("test", "PIN:"); v != nil {
+		t.Fatal("unexpected value in empty cache")
+	}
+	c.put("test", "PIN:", []byte("1234"))
+	for i := 0; i < 2; i++ {
+		v := c.get("test", "PIN:")
+		if v == nil || string(v.bytes()) != "1234" {
+			t.Fatalf("use %d: got %v", i, v)
+		}
+		v.wipe()
+		if v.bytes() != nil {
+			t.Errorf("use %d: value was not wiped", i)
+		}
+	}
+	if v := c.get("test", "PIN:"); v != nil {
+		t.Error("value was not evicted after max uses")
+	}
+
+	c.put("test", "PIN:", []byte("1234"))
+	if v := c.get("other", "PIN:"); v != nil {
+		t.Error("value was shared across plugins")
+	}
+	c.Flush()
+	if v := c.get("test", "PIN:"); v != nil {
+		t.Error("value was not evicted by Flush")
+	}
+
+	c = NewSecretCache(time.Nanosecond, 0)
+	c.put("test", "PIN:", []byte("1234"))
+	time.Sleep(time.Millisecond)
+	if v := c.get("test", "PIN:"); v != nil {
+		t.Error("value was not evicted after max age")
+	}
+}
+
+func TestLockedBuffer(t *testing.T) {
+	page := uintptr(os.Getpagesize())
+	var bufs []*lockedBuffer
+	for _, n := range []int{0, 4, int(page), int(page) + 1} {
+		b := newLockedBuffer(bytes.Repeat([]byte{'x'}, n))
+		bufs = append(bufs, b)
+		if len(b.bytes()) != n || bytes.Count(b.bytes(), []byte{'x'}) != n {
+			t.Errorf("%d bytes: got %q", n, b.bytes())
+		}
+		if p := uintptr(unsafe.Pointer(&b.mem[0])); p%page != 0 || uintptr(len(b.mem))%page != 0 {
+			t.Errorf("%d bytes: allocation at %#x of %d bytes is not page-aligned", n, p, len(b.mem))
+		}
+	}
+	// Each buffer has its own pages.
+	for i, a := range bufs {
+		for _, b := range bufs[i+1:] {
+			start, end := uintptr(unsafe.Pointer(&a.mem[0])), uintptr(unsafe.Pointer(&a.mem[0]))+uintptr(len(a.mem))
+			if p := uintptr(unsafe.Pointer(&b.mem[0])); p >= start && p < end {
+				t.Errorf("buffers share pages")
+			}
+		}
+	}
+	for _, b := range bufs {
+		b.wipe()
+		b.wipe()
+	}
+}
+
+func TestTranscript(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows support is TODO")
+	}
+	temp := t.TempDir()
+	testOnlyPluginPath = temp
+	t.Cleanup(func() { testOnlyPluginPath = "" })
+	ex, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(ex, filepath.Join(temp, "age-plugin-test")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(temp, "age-plugin-test"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	name, err := bech32.Encode("age1test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileKey := []byte(strings.Repeat("K", 16))
+
+	buf := &strings.Builder{}
+	ui := &ClientUI{Transcript: NewTranscriptRecorder(buf, true)}
+	r, err := NewRecipient(name, ui)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Wrap(fileKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ListIdentities("test", ui); err != nil {
+		t.Fatal(err)
+	}
+	transcript := buf.String()
+	if !strings.Contains(transcript, "1 > -> wrap-file-key\n1 > "+strings.Repeat("A", 22)+"\n") {
+		t.Errorf("file key was not redacted:\n%s", transcript)
+	}
+	if strings.Contains(transcript, EncodeIdentity("test", []byte{1})) ||
+		!strings.Contains(transcript, EncodeIdentity("test", []byte{0})) {
+		t.Errorf("identity was not redacted:\n%s", transcript)
+	}
+
+	// Replay the transcript without the plugin.
+	testOnlyPluginPath = t.TempDir()
+	replay, err := NewTranscriptReplayer(strings.NewReader(transcript))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ui = &ClientUI{Replay: replay}
+	r, err = NewRecipient(name, ui)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stanzas, err := r.Wrap(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stanzas) != 1 || string(stanzas[0].Body) != string(fileKey) {
+		t.Errorf("unexpected replayed stanzas: %v", stanzas)
+	}
+	ids, err := ListIdentities("test", ui)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 || ids[0].Identity.String() != EncodeIdentity("test", []byte{0}) {
+		t.Errorf("unexpected replayed identities: %v", ids)
+	}
+	if err := replay.Err(); err != nil {
+		t.Errorf("replay failed: %v", err)
+	}
+
+	// A different client message fails the replay.
+	replay, err = NewTranscriptReplayer(strings.NewReader(transcript))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := bech32.Encode("age1test", []byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = NewRecipient(other, &ClientUI{Replay: replay})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Wrap(fileKey); err == nil {
+		t.Errorf("expected replay mismatch")
+	}
+	if err := replay.Err(); err == nil || !strings.Contains(err.Error(), "add-recipient") {
+		t.Errorf("expected add-recipient mismatch, got %v", err)
+	}
+}
+
+func TestUnlock(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows support is TODO")
+	}
+	temp := t.TempDir()
+	testOnlyPluginPath = temp
+	t.Cleanup(func() { testOnlyPluginPath = "" })
+	ex, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"age-plugin-test", "age-plugin-testlock"} {
+		if err := os.Link(ex, filepath.Join(temp, name)); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(filepath.Join(temp, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stanzas := []*age.Stanza{{Type: "test", Body: []byte(strings.Repeat("K", 16))}}
+	var pin string
+	ui := &ClientUI{
+		RequestValue: func(name, prompt string, secret bool) (string, error) {
+			if prompt != "PIN" || !secret {
+				t.Errorf("unexpected prompt %q", prompt)
+			}
+			return pin, nil
+		},
+	}
+	id, err := NewIdentity(EncodeIdentity("testlock", []byte{1}), ui)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := id.Unwrap(stanzas); err == nil || !strings.Contains(err.Error(), "locked") {
+		t.Errorf("expected locked error, got %v", err)
+	}
+
+	pin = "0000"
+	if err := id.Unlock(ui); err == nil || !strings.Contains(err.Error(), "wrong PIN") {
+		t.Errorf("expected wrong PIN error, got %v", err)
+	}
+	pin = "1234"
+	if err := id.Unlock(ui); err != nil {
+		t.Fatal(err)
+	}
+	fileKey, err := id.Unwrap(stanzas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(fileKey) != strings.Repeat("K", 16) {
+		t.Errorf("unexpected file key %q", fileKey)
+	}
+
+	// Plugins that don't support unlock-v1 don't need unlocking.
+	other, err := NewIdentity(EncodeIdentity("test", []byte{1}), ui)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Unlock(ui); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestPINRetry(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows support is TODO")
+	}
+	temp := t.TempDir()
+	testOnlyPluginPath = temp
+	t.Cleanup(func() { testOnlyPluginPath = "" })
+	ex, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(ex, filepath.Join(temp, "age-plugin-testpin")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(temp, "age-plugin-testpin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	stanzas := []*age.Stanza{{Type: "test", Body: []byte(strings.Repeat("K", 16))}}
+	var pins []string
+	var retries []*age.PINError
+	ui := &ClientUI{
+		RequestValue: func(name, prompt string, secret bool) (string, error) {
+			pin := pins[0]
+			pins = pins[1:]
+			return pin, nil
+		},
+		SecretCache: NewSecretCache(time.Minute, 0),
+	}
+	id, err := NewIdentity(EncodeIdentity("testpin", []byte{1}), ui)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without PINRetry, the error is returned.
+	pins = []string{"0000"}
+	_, err = id.Unwrap(stanzas)
+	var pe *age.PINError
+	if !errors.As(err, &pe) || pe.Remaining != 2 || pe.Blocked ||
+		!strings.Contains(err.Error(), "wrong PIN") {
+		t.Errorf("expected incorrect PIN error, got %v", err)
+	}
+
+	// The wrong PIN is evicted from the cache before retrying.
+	ui.PINRetry = func(name string, err *age.PINError) bool {
+		retries = append(retries, err)
+		return true
+	}
+	pins = []string{"0000", "1234"}
+	fileKey, err := id.Unwrap(stanzas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(fileKey) != strings.Repeat("K", 16) {
+		t.Errorf("unexpected file key %q", fileKey)
+	}
+	if len(retries) != 1 || retries[0].Remaining != 2 || len(pins) != 0 {
+		t.Errorf("unexpected retries: %v, remaining PINs %q", retries, pins)
+	}
+
+	// A blocked PIN is never retried.
+	ui.SecretCache.Flush()
+	retries = nil
+	pins = []string{"9999"}
+	_, err = id.Unwrap(stanzas)
+	if !errors.As(err, &pe) || !pe.Blocked {
+		t.Errorf("expected blocked PIN error, got %v", err)
+	}
+	if len(retries) != 0 {
+		t.Errorf("blocked PIN was retried")
+	}
+}
+
+func TestStanzaLimits(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows support is TODO")
+	}
+	temp := t.TempDir()
+	testOnlyPluginPath = temp
+	t.Cleanup(func() { testOnlyPluginPath = "" })
+	ex, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(ex, filepath.Join(temp, "age-plugin-testflood")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(temp, "age-plugin-testflood"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	name, err := bech32.Encode("age1testflood", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		ui      *ClientUI
+		stanzas int // expected stanzas, or zero for a StanzaLimitError
+	}{
+		{&ClientUI{}, 0},
+		{&ClientUI{MaxStanzas: 100}, 100},
+		{&ClientUI{MaxStanzas: 100, MaxStanzaBytes: 1000}, 0},
+	} {
+		r, err := NewRecipient(name, tc.ui)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stanzas, err := r.Wrap(make([]byte, 16))
+		if tc.stanzas != 0 {
+			if err != nil {
+				t.Errorf("MaxStanzas %d: %v", tc.ui.MaxStanzas, err)
+			} else if len(stanzas) != tc.stanzas {
+				t.Errorf("MaxStanzas %d: got %d stanzas", tc.ui.MaxStanzas, len(stanzas))
+			}
+			continue
+		}
+		var e *StanzaLimitError
+		if !errors.As(err, &e) {
+			t.Errorf("MaxStanzas %d: expected StanzaLimitError, got %v", tc.ui.MaxStanzas, err)
+		}
+	}
+}
+
+func TestEqual(t *testing.T) {
+	i1, err := NewIdentity(EncodeIdentity("test", []byte{1}), &ClientUI{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i2, err := NewIdentity(EncodeIdentity("test", []byte{1}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i3, err := NewIdentity(EncodeIdentity("test", []byte{2}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !i1.Equal(i2) || i1.Equal(i3) {
+		t.Error("wrong Identity.Equal result")
+	}
+	if !i1.Recipient().Equal(i2.Recipient()) || i1.Recipient().Equal(i3.Recipient()) {
+		t.Error("wrong Recipient.Equal result for identity recipients")
+	}
+
+	r1, err := NewRecipient("age1test10qdmzv9q", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := NewRecipient("age1test10qdmzv9q", &ClientUI{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r1.Equal(r2) || r1.Equal(i1.Recipient()) {
+		t.Error("wrong Recipient.Equal result")
+	}
+}
+
+func TestTextMarshaling(t *testing.T) {
+	type config struct {
+		Identity  *Identity
+		Recipient *Recipient
+	}
+	id := EncodeIdentity("test", []byte{1})
+	in := fmt.Sprintf(`{"Identity":%q,"Recipient":"age1test10qdmzv9q"}`, id)
+	var c config
+	if err := json.Unmarshal([]byte(in), &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Identity.Name() != "test" || c.Recipient.Name() != "test" {
+		t.Errorf("unexpected plugin names")
+	}
+	out, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != in {
+		t.Errorf("got %s, expected %s", out, in)
+	}
+	if _, err := json.Marshal(c.Identity.Recipient()); err == nil {
+		t.Error("expected marshaling an identity recipient to fail")
+	}
+}
+
+func TestReferencePlugin(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows support is TODO")
+	}
+	if testing.Short() {
+		t.Skip("skipping build of cmd/age-plugin-test in short mode")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go tool not available")
+	}
+	temp := t.TempDir()
+	testOnlyPluginPath = temp
+	t.Cleanup(func() { testOnlyPluginPath = "" })
+	cmd := exec.Command(goTool, "build", "-o", filepath.Join(temp, "age-plugin-test"),
+		"filippo.io/age/cmd/age-plugin-test")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("failed to build age-plugin-test: %v\n%s", err, out)
+	}
+
+	newIdentity := func(t *testing.T, args ...string) string {
+		out, err := Command("test", args...).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+		if len(lines) != 2 || lines[0] != "# recipient: age1test1dzqdan" {
+			t.Fatalf("unexpected output: %q", out)
+		}
+		return lines[1]
+	}
+
+	r, err := NewRecipient("age1test1dzqdan", &ClientUI{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileKey := make([]byte, 16)
+	fileKey[0] = 42
+	stanzas, err := r.Wrap(fileKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stanzas) != 1 || stanzas[0].Type != "test" {
+		t.Fatalf("unexpected stanzas: %v", stanzas)
+	}
+
+	t.Run("plain", func(t *testing.T) {
+		i, err := NewIdentity(newIdentity(t), &ClientUI{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := i.Unwrap(stanzas)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(fileKey) {
+			t.Errorf("got file key %x, want %x", got, fileKey)
+		}
+	})
+
+	t.Run("interactive", func(t *testing.T) {
+		var events []string
+		ui := &ClientUI{
+			DisplayMessage: func(name, message string) error {
+				events = append(events, "msg")
+				return nil
+			},
+			RequestValue: func(name, prompt string, secret bool) (string, error) {
+				if !secret {
+					return "", errors.New("unexpected public request")
+				}
+				events = append(events, "secret")
+				return "age-plugin-test", nil
+			},
+			Confirm: func(name, prompt, yes, no string) (bool, error) {
+				events = append(events, "confirm")
+				return true, nil
+			},
+		}
+		i, err := NewIdentity(newIdentity(t, "--msg", "--confirm", "--prompt"), ui)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := i.Unwrap(stanzas)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(fileKey) {
+			t.Errorf("got file key %x, want %x", got, fileKey)
+		}
+		if want := "msg confirm secret"; strings.Join(events, " ") != want {
+			t.Errorf("got events %q, want %q", events, want)
+		}
+	})
+
+	t.Run("confirm fallback", func(t *testing.T) {
+		// Without a Confirm callback, the client fails the confirm command,
+		// and the plugin falls back to request-public.
+		ui := &ClientUI{
+			RequestValue: func(name, prompt string, secret bool) (string, error) {
+				if secret {
+					return "", errors.New("unexpected secret request")
+				}
+				return "no", nil
+			},
+		}
+		i, err := NewIdentity(newIdentity(t, "--confirm"), ui)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := i.Unwrap(stanzas); !errors.Is(err, age.ErrIncorrectIdentity) {
+			t.Errorf("expected ErrIncorrectIdentity, got %v", err)
+		}
+	})
+
+	t.Run("session", func(t *testing.T) {
+		s := NewSession()
+		i, err := NewIdentity(newIdentity(t), &ClientUI{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		i = i.WithSession(s)
+		for n := 0; n < 3; n++ {
+			got, err := i.Unwrap(stanzas)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(fileKey) {
+				t.Errorf("got file key %x, want %x", got, fileKey)
+			}
+		}
+		if err := s.Close(); err != nil {
+			t.Errorf("plugin failed: %v", err)
+		}
+	})
+
+	t.Run("wrong passphrase", func(t *testing.T) {
+		ui := &ClientUI{
+			RequestValue: func(name, prompt string, secret bool) (string, error) {
+				return "wrong", nil
+			},
+		}
+		i, err := NewIdentity(newIdentity(t, "--prompt"), ui)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := i.Unwrap(stanzas); err == nil || !strings.Contains(err.Error(), "incorrect passphrase") {
+			t.Errorf("expected incorrect passphrase error, got %v", err)
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		i, err := NewIdentity(newIdentity(t, "--fail"), &ClientUI{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := i.Unwrap(stanzas); err == nil || errors.Is(err, age.ErrIncorrectIdentity) {
+			t.Errorf("expected plugin error, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,96 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	exec "golang.org/x/sys/execabs"
+)
+
+// Limits are resource limits enforced on each plugin process, so that a buggy
+// plugin can't wedge or exhaust the resources of the client, for example in a
+// server-side decryption service.
+//
+// A plugin that exceeds MaxLifetime is killed. MaxMemory and MaxCPUTime are
+// enforced by the operating system, with setrlimit on Linux and with a job
+// object on Windows, and starting a plugin fails if they are set on other
+// platforms. In all cases, the operation fails with an error that reports the
+// exceeded limit, when it can be determined.
+type Limits struct {
+	// MaxLifetime, if not zero, is the maximum wall-clock duration of a plugin
+	// process, including the time spent waiting for user interaction.
+	MaxLifetime time.Duration
+
+	// MaxMemory, if not zero, is the maximum size in bytes of the virtual
+	// address space (RLIMIT_AS) of a plugin process on Linux, or of its
+	// committed memory on Windows. Note that some runtimes reserve large
+	// amounts of address space at startup.
+	MaxMemory uint64
+
+	// MaxCPUTime, if not zero, is the maximum CPU time a plugin process can
+	// consume, rounded up to a whole second on Linux.
+	MaxCPUTime time.Duration
+}
+
+// enforceLimits applies the limits to the started plugin process.
+func (cc *clientConnection) enforceLimits(l *Limits) error {
+	cc.limits = l
+	if l.MaxMemory != 0 || l.MaxCPUTime != 0 {
+		release, err := applyLimits(cc.cmd.Process, l)
+		if err != nil {
+			return fmt.Errorf("failed to apply resource limits: %v", err)
+		}
+		cc.releaseLimits = release
+	}
+	if l.MaxLifetime != 0 {
+		cc.lifetimeTimer = time.AfterFunc(l.MaxLifetime, func() {
+			cc.setLimitError(fmt.Errorf("plugin exceeded the maximum lifetime of %v and was killed", l.MaxLifetime))
+			cc.cmd.Process.Kill()
+		})
+	}
+	return nil
+}
+
+func (cc *clientConnection) setLimitError(err error) {
+	cc.limitMu.Lock()
+	defer cc.limitMu.Unlock()
+	if cc.limitErr == nil {
+		cc.limitErr = err
+	}
+}
+
+// limitError returns an error describing the limit exceeded by the plugin, if
+// any, to replace err, which occurred communicating with it.
+func (cc *clientConnection) limitError(err error) error {
+	cc.limitMu.Lock()
+	limitErr := cc.limitErr
+	cc.limitMu.Unlock()
+	if limitErr != nil {
+		return limitErr
+	}
+	if cc.limits == nil {
+		return err
+	}
+	// The plugin is probably exiting, wait briefly to learn why.
+	var exited bool
+	select {
+	case <-cc.exited:
+		exited = true
+	case <-time.After(time.Second):
+	}
+	cc.limitMu.Lock()
+	defer cc.limitMu.Unlock()
+	if cc.limitErr != nil {
+		return cc.limitErr
+	}
+	var exitErr *exec.ExitError
+	if exited && (cc.limits.MaxMemory != 0 || cc.limits.MaxCPUTime != 0) && errors.As(cc.waitErr, &exitErr) {
+		return fmt.Errorf("plugin failed (%v), possibly for exceeding its resource limits", exitErr)
+	}
+	return err
+}
@@ -0,0 +1,31 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func applyLimits(p *os.Process, l *Limits) (release func(), err error) {
+	if l.MaxMemory != 0 {
+		rlim := &unix.Rlimit{Cur: l.MaxMemory, Max: l.MaxMemory}
+		if err := unix.Prlimit(p.Pid, unix.RLIMIT_AS, rlim, nil); err != nil {
+			return nil, err
+		}
+	}
+	if l.MaxCPUTime != 0 {
+		secs := uint64((l.MaxCPUTime + time.Second - 1) / time.Second)
+		// The plugin receives SIGXCPU at the soft limit, and SIGKILL one
+		// second later at the hard limit.
+		rlim := &unix.Rlimit{Cur: secs, Max: secs + 1}
+		if err := unix.Prlimit(p.Pid, unix.RLIMIT_CPU, rlim, nil); err != nil {
+			return nil, err
+		}
+	}
+	return func() {}, nil
+}
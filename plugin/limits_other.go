@@ -0,0 +1,17 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux && !windows
+
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+func applyLimits(p *os.Process, l *Limits) (release func(), err error) {
+	return nil, fmt.Errorf("MaxMemory and MaxCPUTime are not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,62 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"os"
+	"unsafe"
+)
+
+// A lockedBuffer holds a secret value in its own page-aligned allocation, not
+// shared with any other value, and locked against swapping where supported.
+// That way it can be unlocked and released without affecting other values.
+type lockedBuffer struct {
+	mem     []byte // a multiple of the page size
+	n       int
+	release func()
+}
+
+// newLockedBuffer returns a lockedBuffer holding a copy of b. The caller must
+// call wipe when done with it.
+func newLockedBuffer(b []byte) *lockedBuffer {
+	page := os.Getpagesize()
+	size := (len(b) + page - 1) / page * page
+	if size == 0 {
+		size = page
+	}
+	mem, release := allocPages(size)
+	copy(mem, b)
+	return &lockedBuffer{mem: mem, n: len(b), release: release}
+}
+
+// bytes returns the value. It must not be used after wipe.
+func (l *lockedBuffer) bytes() []byte {
+	return l.mem[:l.n]
+}
+
+// wipe zeroes and releases the buffer. It's safe to call multiple times.
+func (l *lockedBuffer) wipe() {
+	if l.mem == nil {
+		return
+	}
+	for i := range l.mem {
+		l.mem[i] = 0
+	}
+	l.release()
+	l.mem, l.n = nil, 0
+}
+
+// alignedPages returns size bytes of page-aligned memory from the Go heap. The
+// pages are not shared with any other allocation, since they are inside a
+// larger one, and the Go garbage collector doesn't move heap objects.
+func alignedPages(size int) []byte {
+	page := os.Getpagesize()
+	buf := make([]byte, size+page)
+	off := 0
+	if r := int(uintptr(unsafe.Pointer(&buf[0])) % uintptr(page)); r != 0 {
+		off = page - r
+	}
+	return buf[off : off+size : off+size]
+}
@@ -0,0 +1,11 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly && !windows
+
+package plugin
+
+func allocPages(size int) (mem []byte, release func()) {
+	return alignedPages(size), func() {}
+}
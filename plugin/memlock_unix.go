@@ -0,0 +1,25 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package plugin
+
+import "golang.org/x/sys/unix"
+
+// allocPages returns size bytes of zeroed, page-aligned memory in a dedicated
+// anonymous mapping, locked in memory if possible, and a function that unlocks
+// and unmaps it.
+func allocPages(size int) (mem []byte, release func()) {
+	mem, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return alignedPages(size), func() {}
+	}
+	// Best effort, for example RLIMIT_MEMLOCK might be too low.
+	unix.Mlock(mem)
+	return mem, func() {
+		unix.Munlock(mem)
+		unix.Munmap(mem)
+	}
+}
@@ -0,0 +1,25 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// allocPages returns size bytes of zeroed, page-aligned memory, locked in
+// memory if possible, and a function that unlocks it.
+func allocPages(size int) (mem []byte, release func()) {
+	mem = alignedPages(size)
+	addr := uintptr(unsafe.Pointer(&mem[0]))
+	// Best effort, for example the working set might be too small.
+	if err := windows.VirtualLock(addr, uintptr(size)); err != nil {
+		return mem, func() {}
+	}
+	return mem, func() {
+		windows.VirtualUnlock(addr, uintptr(size))
+	}
+}
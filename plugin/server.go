@@ -0,0 +1,492 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/internal/format"
+)
+
+// A Server implements the plugin side of the recipient-v1 and identity-v1
+// state machines, so that an age-plugin-NAME binary only needs to provide
+// age.Recipient and age.Identity implementations.
+//
+// A typical plugin registers its callbacks, and then runs the state machine
+// selected by the --age-plugin flag:
+//
+//	s, err := plugin.NewServer("example")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	s.HandleRecipient(func(data []byte) (age.Recipient, error) { ... })
+//	s.HandleIdentity(func(data []byte) (age.Identity, error) { ... })
+//	os.Exit(s.Run(stateMachineFlag))
+//
+// The Recipient and Identity implementations can interact with the user
+// through the DisplayMessage, RequestValue, and Confirm methods of the Server,
+// while their Wrap and Unwrap methods are running.
+//
+// If the client offers the non-standard "session" extension, the Server
+// acknowledges it, and after each state machine waits for the next one, until
+// the client closes the connection. The callbacks are invoked again for each
+// state machine, so plugins can keep state, such as an unlocked hardware
+// token, across them. See Session.
+//
+// A Server runs one session at a time, and is not safe for concurrent use.
+type Server struct {
+	name string
+
+	recipient           func(data []byte) (age.Recipient, error)
+	identityAsRecipient func(data []byte) (age.Recipient, error)
+	identity            func(data []byte) (age.Identity, error)
+
+	// The following fields are the state of the current session.
+	sr         *format.StanzaReader
+	w          *bufio.Writer
+	extensions map[string]bool
+	// runs is the number of state machines completed in the session, and
+	// again is set if the client accepted the session extension in this one.
+	runs  int
+	again bool
+}
+
+// errSessionEnd is returned by readPhase1 if the client closed the connection
+// between two state machines of a session.
+var errSessionEnd = errors.New("session ended")
+
+// NewServer returns a Server for the plugin name, which must be the NAME in
+// the age-plugin-NAME binary, and in the recipient and identity encodings.
+func NewServer(name string) (*Server, error) {
+	if EncodeRecipient(name, nil) == "" || name != strings.ToLower(name) {
+		return nil, fmt.Errorf("invalid plugin name %q", name)
+	}
+	return &Server{name: name}, nil
+}
+
+// Name returns the plugin name.
+func (s *Server) Name() string {
+	return s.name
+}
+
+// HandleRecipient registers f to parse the data of the plugin's recipient
+// encoding ("age1name1..."), in the recipient-v1 state machine. If it's not
+// called, the plugin doesn't support recipients.
+func (s *Server) HandleRecipient(f func(data []byte) (age.Recipient, error)) {
+	s.recipient = f
+}
+
+// HandleIdentityAsRecipient registers f to parse the data of the plugin's
+// identity encoding ("AGE-PLUGIN-NAME-1..."), in the recipient-v1 state
+// machine, where the client encrypts to the recipient corresponding to an
+// identity. If it's not called, the plugin doesn't support encrypting to
+// identities.
+func (s *Server) HandleIdentityAsRecipient(f func(data []byte) (age.Recipient, error)) {
+	s.identityAsRecipient = f
+}
+
+// HandleIdentity registers f to parse the data of the plugin's identity
+// encoding ("AGE-PLUGIN-NAME-1..."), in the identity-v1 state machine. If it's
+// not called, the plugin doesn't support decryption.
+func (s *Server) HandleIdentity(f func(data []byte) (age.Identity, error)) {
+	s.identity = f
+}
+
+// Run runs stateMachine, the value of the --age-plugin flag, on standard input
+// and output, and returns the exit code of the plugin. Errors that can't be
+// reported to the client are printed to standard error.
+func (s *Server) Run(stateMachine string) int {
+	if err := s.Serve(stateMachine, os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "age-plugin-%s: %v\n", s.name, err)
+		return 1
+	}
+	return 0
+}
+
+// Serve runs a session of stateMachine, such as "recipient-v1", reading the
+// client's messages from r and writing the plugin's to w.
+//
+// Errors returned by the callbacks, and by the Recipient and Identity they
+// return, are reported to the client, which ends the session successfully.
+// Errors reading from or writing to the client, and protocol violations, are
+// returned.
+func (s *Server) Serve(stateMachine string, r io.Reader, w io.Writer) error {
+	var run func() error
+	switch stateMachine {
+	case "recipient-v1":
+		run = s.recipientV1
+	case "identity-v1":
+		run = s.identityV1
+	default:
+		return fmt.Errorf("unsupported state machine %q", stateMachine)
+	}
+
+	s.sr = format.NewStanzaReader(bufio.NewReader(r))
+	s.w = bufio.NewWriter(w)
+	defer func() { s.sr, s.w, s.extensions = nil, nil, nil }()
+	for s.runs = 0; ; s.runs++ {
+		s.extensions = make(map[string]bool)
+		s.again = false
+		err := run()
+		if err == errSessionEnd {
+			return nil
+		}
+		if err != nil || !s.again {
+			return err
+		}
+	}
+}
+
+// Extension reports whether the client offered the named extension, such as
+// "labels", in phase 1 of the current session.
+func (s *Server) Extension(name string) bool {
+	return s.extensions[name]
+}
+
+// DisplayMessage asks the client to display message, which should have
+// lowercase initials and no final period.
+func (s *Server) DisplayMessage(message string) error {
+	r, err := s.send("msg", nil, []byte(message))
+	if err != nil {
+		return err
+	}
+	if r.Type != "ok" {
+		return errors.New("client failed to display the message")
+	}
+	return nil
+}
+
+// RequestValue asks the client to request a secret or public value from the
+// user, with the provided prompt.
+func (s *Server) RequestValue(prompt string, secret bool) (string, error) {
+	typ := "request-public"
+	if secret {
+		typ = "request-secret"
+	}
+	r, err := s.send(typ, nil, []byte(prompt))
+	if err != nil {
+		return "", err
+	}
+	if r.Type != "ok" {
+		return "", errors.New("client failed to request the value")
+	}
+	return string(r.Body), nil
+}
+
+// Confirm asks the client to request a confirmation from the user, with the
+// provided prompt and choices. no may be empty.
+//
+// Clients that can't request a confirmation make Confirm return an error, in
+// which case plugins can fall back to RequestValue.
+func (s *Server) Confirm(prompt, yes, no string) (choseYes bool, err error) {
+	args := []string{format.EncodeToString([]byte(yes))}
+	if no != "" {
+		args = append(args, format.EncodeToString([]byte(no)))
+	}
+	r, err := s.send("confirm", args, []byte(prompt))
+	if err != nil {
+		return false, err
+	}
+	if r.Type != "ok" || len(r.Args) != 1 {
+		return false, errors.New("client failed to request the confirmation")
+	}
+	return r.Args[0] == "yes", nil
+}
+
+// readPhase1 reads the stanzas sent by the client up to "done", recording the
+// offered extensions.
+func (s *Server) readPhase1() ([]*format.Stanza, error) {
+	var stanzas []*format.Stanza
+	for n := 0; ; n++ {
+		st, err := s.sr.ReadStanza()
+		if n == 0 && s.runs > 0 && errors.Is(err, io.EOF) {
+			return nil, errSessionEnd
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from the client: %w", err)
+		}
+		if st.Type == "done" {
+			return stanzas, nil
+		}
+		if name := strings.TrimPrefix(st.Type, "extension-"); name != st.Type {
+			s.extensions[name] = true
+			continue
+		}
+		stanzas = append(stanzas, st)
+	}
+}
+
+// write sends a stanza to the client, without reading a response.
+func (s *Server) write(typ string, args []string, body []byte) error {
+	if s.w == nil {
+		return errors.New("no active plugin session")
+	}
+	st := &format.Stanza{Type: typ, Args: args, Body: body}
+	if err := st.Marshal(s.w); err != nil {
+		return fmt.Errorf("failed to write to the client: %w", err)
+	}
+	if err := s.w.Flush(); err != nil {
+		return fmt.Errorf("failed to write to the client: %w", err)
+	}
+	return nil
+}
+
+// send sends a command to the client, and returns its response.
+func (s *Server) send(typ string, args []string, body []byte) (*format.Stanza, error) {
+	if err := s.write(typ, args, body); err != nil {
+		return nil, err
+	}
+	r, err := s.sr.ReadStanza()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from the client: %w", err)
+	}
+	return r, nil
+}
+
+// sendOK is like send, but fails if the response is not "ok".
+func (s *Server) sendOK(typ string, args []string, body []byte) error {
+	r, err := s.send(typ, args, body)
+	if err != nil {
+		return err
+	}
+	if r.Type != "ok" {
+		return fmt.Errorf("client responded to %q with %q", typ, r.Type)
+	}
+	return nil
+}
+
+// fail reports err to the client with an error command, which ends the
+// session. Errors wrapping age.ErrUnavailable and *age.PINError are reported
+// with the corresponding error kinds, and the others with args.
+func (s *Server) fail(err error, args ...string) error {
+	msg := err.Error()
+	var pe *age.PINError
+	switch {
+	case errors.Is(err, age.ErrUnavailable):
+		args = []string{"unavailable"}
+	case errors.As(err, &pe) && pe.Blocked:
+		args = []string{"pin-blocked"}
+	case errors.As(err, &pe):
+		args = []string{"pin-incorrect"}
+		if pe.Remaining >= 0 {
+			args = append(args, strconv.Itoa(pe.Remaining))
+		}
+	}
+	if pe != nil {
+		// The client prepends the description of the PIN state.
+		msg = ""
+		if pe.Err != nil {
+			msg = pe.Err.Error()
+		}
+	}
+	if _, err := s.send("error", args, []byte(msg)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) recipientV1() error {
+	phase1, err := s.readPhase1()
+	if err != nil {
+		return err
+	}
+
+	var recipients []age.Recipient
+	// errArgs are the arguments of the error command for each recipient,
+	// which counts add-recipient and add-identity stanzas separately.
+	var errArgs [][]string
+	var fileKeys [][]byte
+	var nRecipients, nIdentities int
+	for _, st := range phase1 {
+		switch st.Type {
+		case "add-recipient":
+			args := []string{"recipient", strconv.Itoa(nRecipients)}
+			nRecipients++
+			if len(st.Args) != 1 {
+				return s.fail(errors.New("malformed add-recipient stanza"), "internal")
+			}
+			if s.recipient == nil {
+				return s.fail(errors.New("recipients are not supported"), args...)
+			}
+			name, data, err := ParseRecipient(st.Args[0])
+			if err != nil {
+				return s.fail(err, args...)
+			}
+			if name != s.name {
+				return s.fail(fmt.Errorf("recipient is for plugin %q", name), args...)
+			}
+			r, err := s.recipient(data)
+			if err != nil {
+				return s.fail(err, args...)
+			}
+			recipients = append(recipients, r)
+			errArgs = append(errArgs, args)
+		case "add-identity":
+			args := []string{"identity", strconv.Itoa(nIdentities)}
+			nIdentities++
+			if len(st.Args) != 1 {
+				return s.fail(errors.New("malformed add-identity stanza"), "internal")
+			}
+			if s.identityAsRecipient == nil {
+				return s.fail(errors.New("encrypting to identities is not supported"), args...)
+			}
+			name, data, err := ParseIdentity(st.Args[0])
+			if err != nil {
+				return s.fail(err, args...)
+			}
+			if name != s.name {
+				return s.fail(fmt.Errorf("identity is for plugin %q", name), args...)
+			}
+			r, err := s.identityAsRecipient(data)
+			if err != nil {
+				return s.fail(err, args...)
+			}
+			recipients = append(recipients, r)
+			errArgs = append(errArgs, args)
+		case "wrap-file-key":
+			fileKeys = append(fileKeys, st.Body)
+		}
+	}
+	if len(recipients) == 0 {
+		return s.fail(errors.New("no recipients or identities"), "internal")
+	}
+
+	var labels []string
+	for n, fileKey := range fileKeys {
+		for i, r := range recipients {
+			stanzas, l, err := wrapForRecipient(r, fileKey)
+			if err != nil {
+				return s.fail(err, errArgs[i]...)
+			}
+			sort.Strings(l)
+			if n == 0 && i == 0 {
+				labels = l
+			} else if !stringsEqual(labels, l) {
+				return s.fail(errors.New("incompatible recipients"), "internal")
+			}
+			for _, st := range stanzas {
+				args := append([]string{strconv.Itoa(n), st.Type}, st.Args...)
+				if err := s.sendOK("recipient-stanza", args, st.Body); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if len(labels) > 0 && s.Extension("labels") {
+		if err := s.sendOK("labels", labels, nil); err != nil {
+			return err
+		}
+	}
+	return s.done()
+}
+
+// done ends phase 2, after acknowledging the session extension if offered.
+func (s *Server) done() error {
+	if s.Extension("session") {
+		r, err := s.send("extension", []string{"session"}, nil)
+		if err != nil {
+			return err
+		}
+		s.again = r.Type == "ok"
+	}
+	return s.write("done", nil, nil)
+}
+
+func wrapForRecipient(r age.Recipient, fileKey []byte) ([]*age.Stanza, []string, error) {
+	if r, ok := r.(age.RecipientWithLabels); ok {
+		return r.WrapWithLabels(fileKey)
+	}
+	stanzas, err := r.Wrap(fileKey)
+	return stanzas, nil, err
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) identityV1() error {
+	phase1, err := s.readPhase1()
+	if err != nil {
+		return err
+	}
+
+	var identities []age.Identity
+	// files are the file indexes, in order of first appearance, and stanzas
+	// the recipient stanzas of each file.
+	var files []int
+	stanzas := make(map[int][]*age.Stanza)
+	for _, st := range phase1 {
+		switch st.Type {
+		case "add-identity":
+			args := []string{"identity", strconv.Itoa(len(identities))}
+			if len(st.Args) != 1 {
+				return s.fail(errors.New("malformed add-identity stanza"), "internal")
+			}
+			if s.identity == nil {
+				return s.fail(errors.New("identities are not supported"), args...)
+			}
+			name, data, err := ParseIdentity(st.Args[0])
+			if err != nil {
+				return s.fail(err, args...)
+			}
+			if name != s.name {
+				return s.fail(fmt.Errorf("identity is for plugin %q", name), args...)
+			}
+			i, err := s.identity(data)
+			if err != nil {
+				return s.fail(err, args...)
+			}
+			identities = append(identities, i)
+		case "recipient-stanza":
+			if len(st.Args) < 2 {
+				return s.fail(errors.New("malformed recipient-stanza stanza"), "internal")
+			}
+			n, err := strconv.Atoi(st.Args[0])
+			if err != nil || n < 0 {
+				return s.fail(errors.New("malformed recipient-stanza stanza"), "internal")
+			}
+			if _, ok := stanzas[n]; !ok {
+				files = append(files, n)
+			}
+			stanzas[n] = append(stanzas[n], &age.Stanza{
+				Type: st.Args[1], Args: st.Args[2:], Body: st.Body,
+			})
+		}
+	}
+
+FilesLoop:
+	for _, n := range files {
+		for i, id := range identities {
+			fileKey, err := id.Unwrap(stanzas[n])
+			if errors.Is(err, age.ErrIncorrectIdentity) {
+				continue
+			}
+			if err != nil {
+				return s.fail(err, "identity", strconv.Itoa(i))
+			}
+			if err := s.sendOK("file-key", []string{strconv.Itoa(n)}, fileKey); err != nil {
+				return err
+			}
+			continue FilesLoop
+		}
+	}
+	return s.done()
+}
@@ -0,0 +1,311 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+// serverConn runs a session of the Server returned by newServer for each
+// connection, in process. It can be used as ClientUI.Connect.
+func serverConn(newServer func() *Server) func(name, protocol string) (io.ReadWriteCloser, error) {
+	return func(name, protocol string) (io.ReadWriteCloser, error) {
+		s := newServer()
+		clientR, pluginW := io.Pipe()
+		pluginR, clientW := io.Pipe()
+		c := &pipeConn{PipeReader: clientR, PipeWriter: clientW, done: make(chan struct{})}
+		go func() {
+			c.err = s.Serve(protocol, pluginR, pluginW)
+			pluginW.Close()
+			pluginR.CloseWithError(io.ErrClosedPipe)
+			close(c.done)
+		}()
+		return c, nil
+	}
+}
+
+type pipeConn struct {
+	*io.PipeReader
+	*io.PipeWriter
+	done chan struct{}
+	err  error
+}
+
+func (c *pipeConn) Close() error {
+	c.PipeReader.Close()
+	c.PipeWriter.Close()
+	<-c.done
+	return c.err
+}
+
+// labeledRecipient wraps an X25519Recipient, adding labels.
+type labeledRecipient struct {
+	*age.X25519Recipient
+	labels []string
+}
+
+func (r *labeledRecipient) WrapWithLabels(fileKey []byte) ([]*age.Stanza, []string, error) {
+	s, err := r.Wrap(fileKey)
+	return s, r.labels, err
+}
+
+// errorIdentity fails to unwrap with err.
+type errorIdentity struct{ err error }
+
+func (i errorIdentity) Unwrap([]*age.Stanza) ([]byte, error) { return nil, i.err }
+
+// newTestServer returns a Server for the "srvtest" plugin whose recipient and
+// identity data select one of ids, or fail with errs.
+func newTestServer(t *testing.T, ids []*age.X25519Identity, errs []error) *Server {
+	s, err := NewServer("srvtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.HandleRecipient(func(data []byte) (age.Recipient, error) {
+		if len(data) != 1 || int(data[0]) >= len(ids) {
+			return nil, errors.New("unknown recipient")
+		}
+		r := ids[data[0]].Recipient()
+		if data[0] == 1 {
+			return &labeledRecipient{r, []string{"postquantum"}}, nil
+		}
+		return r, nil
+	})
+	s.HandleIdentity(func(data []byte) (age.Identity, error) {
+		if len(data) == 2 {
+			return errorIdentity{errs[data[1]]}, nil
+		}
+		if len(data) != 1 || int(data[0]) >= len(ids) {
+			return nil, errors.New("unknown identity")
+		}
+		return ids[data[0]], nil
+	})
+	return s
+}
+
+func TestServer(t *testing.T) {
+	var ids []*age.X25519Identity
+	for i := 0; i < 3; i++ {
+		id, err := age.GenerateX25519Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	errs := []error{
+		fmt.Errorf("token not connected: %w", age.ErrUnavailable),
+		&age.PINError{Remaining: 2, Err: errors.New("wrong PIN")},
+		errors.New("token exploded"),
+		age.ErrIncorrectIdentity,
+	}
+	s := newTestServer(t, ids, errs)
+	ui := &ClientUI{Connect: serverConn(func() *Server { return s })}
+
+	recipient := func(n byte) *Recipient {
+		r, err := NewRecipient(EncodeRecipient("srvtest", []byte{n}), ui)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	identity := func(data ...byte) *Identity {
+		i, err := NewIdentity(EncodeIdentity("srvtest", data), ui)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return i
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, GroupRecipients([]age.Recipient{recipient(0), recipient(2)})...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+
+	for _, n := range []byte{0, 2} {
+		r, err := age.Decrypt(bytes.NewReader(file), identity(n))
+		if err != nil {
+			t.Fatalf("identity %d: %v", n, err)
+		}
+		if out, err := io.ReadAll(r); err != nil || string(out) != "hello" {
+			t.Errorf("identity %d: got %q, %v", n, out, err)
+		}
+		// The plugin identity is an X25519 identity, so it can decrypt the
+		// file directly too.
+		if _, err := age.Decrypt(bytes.NewReader(file), ids[n]); err != nil {
+			t.Errorf("identity %d: %v", n, err)
+		}
+	}
+
+	if _, err := age.Decrypt(bytes.NewReader(file), identity(1)); !errors.As(err, new(*age.NoIdentityMatchError)) {
+		t.Errorf("expected NoIdentityMatchError, got %v", err)
+	}
+	if _, err := age.Decrypt(bytes.NewReader(file), identity(0, 0)); !errors.Is(err, age.ErrUnavailable) {
+		t.Errorf("expected ErrUnavailable, got %v", err)
+	}
+	var pe *age.PINError
+	if _, err := age.Decrypt(bytes.NewReader(file), identity(0, 1)); !errors.As(err, &pe) ||
+		pe.Remaining != 2 || pe.Err == nil || pe.Err.Error() != "wrong PIN" {
+		t.Errorf("expected PINError, got %v", err)
+	}
+	if _, err := age.Decrypt(bytes.NewReader(file), identity(0, 2)); err == nil ||
+		!strings.Contains(err.Error(), "token exploded") {
+		t.Errorf("expected plugin error, got %v", err)
+	}
+	if _, err := age.Decrypt(bytes.NewReader(file), identity(0, 3)); !errors.As(err, new(*age.NoIdentityMatchError)) {
+		t.Errorf("expected NoIdentityMatchError, got %v", err)
+	}
+	if _, err := age.Decrypt(bytes.NewReader(file), identity(0, 3), identity(2)); err != nil {
+		t.Errorf("expected the second identity to match, got %v", err)
+	}
+
+	// Recipient 1 has the postquantum label, so it can't be mixed.
+	if _, err := age.Encrypt(io.Discard, recipient(1)); err != nil {
+		t.Errorf("expected labeled recipient to work, got %v", err)
+	}
+	if _, err := age.Encrypt(io.Discard, recipient(0), recipient(1)); err == nil {
+		t.Error("expected mixed labels to fail")
+	}
+	if _, err := age.Encrypt(io.Discard, GroupRecipients([]age.Recipient{recipient(0), recipient(1)})...); err == nil {
+		t.Error("expected mixed labels in one session to fail")
+	}
+
+	if _, err := age.Encrypt(io.Discard, recipient(5)); err == nil || !strings.Contains(err.Error(), "unknown recipient") {
+		t.Errorf("expected unknown recipient error, got %v", err)
+	}
+	// Encrypting to identities is not supported.
+	if _, err := age.Encrypt(io.Discard, identity(0).Recipient()); err == nil {
+		t.Error("expected encrypting to an identity to fail")
+	}
+	s.HandleIdentityAsRecipient(func(data []byte) (age.Recipient, error) {
+		return ids[data[0]].Recipient(), nil
+	})
+	if _, err := age.Encrypt(io.Discard, identity(0).Recipient()); err != nil {
+		t.Errorf("expected encrypting to an identity to work, got %v", err)
+	}
+
+	if _, err := NewServer("Upper"); err == nil {
+		t.Error("expected invalid name to fail")
+	}
+	if err := s.Serve("unlock-v1", strings.NewReader(""), io.Discard); err == nil {
+		t.Error("expected unsupported state machine to fail")
+	}
+}
+
+// interactiveIdentity exercises the Server interactions before unwrapping.
+type interactiveIdentity struct {
+	s  *Server
+	id *age.X25519Identity
+}
+
+func (i *interactiveIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	if err := i.s.DisplayMessage("touch your token"); err != nil {
+		return nil, err
+	}
+	ok, err := i.s.Confirm("Unwrap?", "Yes", "No")
+	if err != nil {
+		var v string
+		v, err = i.s.RequestValue("Unwrap? (yes/no)", false)
+		ok = v == "yes"
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, age.ErrIncorrectIdentity
+	}
+	if pin, err := i.s.RequestValue("PIN:", true); err != nil {
+		return nil, err
+	} else if pin != "1234" {
+		return nil, &age.PINError{Remaining: -1}
+	}
+	return i.id.Unwrap(stanzas)
+}
+
+func TestServerInteractions(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer("srvtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.HandleIdentity(func(data []byte) (age.Identity, error) {
+		return &interactiveIdentity{s, id}, nil
+	})
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, id.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []string
+	ui := &ClientUI{
+		Connect: serverConn(func() *Server { return s }),
+		DisplayMessage: func(name, message string) error {
+			events = append(events, "msg:"+message)
+			return nil
+		},
+		RequestValue: func(name, prompt string, secret bool) (string, error) {
+			events = append(events, "request:"+prompt)
+			if secret {
+				return "1234", nil
+			}
+			return "yes", nil
+		},
+	}
+	i, err := NewIdentity(EncodeIdentity("srvtest", nil), ui)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.Decrypt(bytes.NewReader(buf.Bytes()), i); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(events, ", "), "msg:touch your token, request:Unwrap? (yes/no), request:PIN:"; got != want {
+		t.Errorf("got events %q, want %q", got, want)
+	}
+
+	events = nil
+	ui.Confirm = func(name, prompt, yes, no string) (bool, error) {
+		events = append(events, "confirm:"+prompt+" "+yes+"/"+no)
+		return false, nil
+	}
+	if _, err := age.Decrypt(bytes.NewReader(buf.Bytes()), i); !errors.As(err, new(*age.NoIdentityMatchError)) {
+		t.Errorf("expected NoIdentityMatchError, got %v", err)
+	}
+	if got, want := strings.Join(events, ", "), "msg:touch your token, confirm:Unwrap? Yes/No"; got != want {
+		t.Errorf("got events %q, want %q", got, want)
+	}
+
+	ui.Confirm = nil
+	ui.RequestValue = func(name, prompt string, secret bool) (string, error) {
+		if secret {
+			return "0000", nil
+		}
+		return "yes", nil
+	}
+	var pe *age.PINError
+	if _, err := age.Decrypt(bytes.NewReader(buf.Bytes()), i); !errors.As(err, &pe) {
+		t.Errorf("expected PINError, got %v", err)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"sync"
+	"time"
+
+	"filippo.io/age/internal/format"
+)
+
+// A Session keeps plugin processes running across the Wrap and Unwrap
+// operations of the Recipients and Identities attached to it with
+// WithSession, so that for example encrypting many files to a hardware token
+// starts the plugin once, and lets it ask for the PIN or a touch once.
+//
+// Sessions use the "session" extension, which is NOT part of the age plugin
+// protocol specification, and is only implemented by this package. The client
+// offers it in phase 1 of the recipient-v1 and identity-v1 state machines of
+// the Recipients and Identities attached to a Session, and plugins opt in by
+// acknowledging it with an "extension session" command in phase 2. After a
+// state machine ends with "done", such a plugin waits for the phase 1 of the
+// next one, and exits when its standard input is closed. Plugins that don't
+// acknowledge the extension, like all plugins that follow the specification,
+// are started for each operation, as usual. A Server always acknowledges it.
+//
+// A plugin process is reused for the operations with the same plugin,
+// state machine, and ClientUI. Concurrent operations start separate
+// processes, and only one of them is kept. A process that fails is not reused.
+// Kept processes are stopped after IdleTimeout without operations, and are
+// not reused after MaxLifetime. Note that Limits.MaxLifetime, if set, applies
+// to the whole life of the process, and kills it even during an operation.
+//
+// A Session is safe for concurrent use, but its fields must not be modified
+// after it's first used.
+type Session struct {
+	// IdleTimeout is how long a plugin process is kept without being used
+	// before it's stopped. If zero, DefaultSessionIdleTimeout is used.
+	IdleTimeout time.Duration
+
+	// MaxLifetime is how long after it was started a plugin process can be
+	// reused. If zero, DefaultSessionMaxLifetime is used.
+	MaxLifetime time.Duration
+
+	mu     sync.Mutex
+	conns  map[sessionKey]*clientConnection
+	closed bool
+}
+
+// DefaultSessionIdleTimeout and DefaultSessionMaxLifetime are the default
+// values of Session.IdleTimeout and Session.MaxLifetime.
+const (
+	DefaultSessionIdleTimeout = 30 * time.Second
+	DefaultSessionMaxLifetime = 10 * time.Minute
+)
+
+type sessionKey struct {
+	name, protocol string
+	ui             *ClientUI
+}
+
+// NewSession returns a new Session. The caller must call Close when done.
+func NewSession() *Session {
+	return &Session{conns: make(map[sessionKey]*clientConnection)}
+}
+
+// Close stops the plugin processes kept by the Session. After Close, the
+// Recipients and Identities attached to the Session start the plugin for
+// each operation.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	conns := s.conns
+	s.conns, s.closed = nil, true
+	s.mu.Unlock()
+	var err error
+	for _, cc := range conns {
+		cc.idleTimer.Stop()
+		if e := cc.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// WithSession returns a copy of r that runs its Wrap operations in s.
+func (r *Recipient) WithSession(s *Session) *Recipient {
+	rr := *r
+	rr.session = s
+	return &rr
+}
+
+// WithSession returns a copy of i that runs its Unwrap operations in s. The
+// Recipient returned by the copy's Recipient method is attached to s, too.
+func (i *Identity) WithSession(s *Session) *Identity {
+	i.unlockMu.Lock()
+	token := i.unlockToken
+	i.unlockMu.Unlock()
+	return &Identity{
+		name: i.name, encoding: i.encoding, ui: i.ui,
+		session: s, unlockToken: token,
+	}
+}
+
+// open returns the connection kept by s for the plugin, state machine, and
+// ClientUI, or starts a new one. s may be nil, in which case the connection is
+// closed by release.
+func (s *Session) open(ctx context.Context, name, protocol string, ui *ClientUI) (*clientConnection, error) {
+	if s == nil {
+		return openClientConnection(ctx, name, protocol, ui)
+	}
+	k := sessionKey{name, protocol, ui}
+	s.mu.Lock()
+	cc := s.conns[k]
+	delete(s.conns, k)
+	s.mu.Unlock()
+	if cc != nil {
+		// If the timer already fired, expire will find cc gone and do nothing.
+		cc.idleTimer.Stop()
+	}
+
+	if cc != nil && cc.alive() {
+		if err := ctx.Err(); err != nil {
+			s.put(cc)
+			return nil, err
+		}
+		ui.debug("reusing plugin session", "plugin", name, "protocol", protocol)
+		cc.stopWatch = cc.watchContext(ctx)
+		cc.reusable, cc.idle = false, false
+		return cc, nil
+	}
+	if cc != nil {
+		cc.Close()
+	}
+	cc, err := openClientConnection(ctx, name, protocol, ui)
+	if err != nil {
+		return nil, err
+	}
+	cc.session, cc.key, cc.started = s, k, time.Now()
+	return cc, nil
+}
+
+// put returns cc to s, or closes it if s is closed or already has one, or if
+// cc exceeded the maximum lifetime.
+func (s *Session) put(cc *clientConnection) {
+	maxLifetime := s.MaxLifetime
+	if maxLifetime == 0 {
+		maxLifetime = DefaultSessionMaxLifetime
+	}
+	idleTimeout := s.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = DefaultSessionIdleTimeout
+	}
+	s.mu.Lock()
+	if s.closed || s.conns[cc.key] != nil || time.Since(cc.started) > maxLifetime {
+		s.mu.Unlock()
+		cc.Close()
+		return
+	}
+	s.conns[cc.key] = cc
+	cc.idleTimer = time.AfterFunc(idleTimeout, func() { s.expire(cc) })
+	s.mu.Unlock()
+}
+
+// expire stops cc after it was kept idle for Session.IdleTimeout, unless it
+// was taken by open in the meantime.
+func (s *Session) expire(cc *clientConnection) {
+	s.mu.Lock()
+	if s.conns[cc.key] != cc {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.conns, cc.key)
+	s.mu.Unlock()
+	cc.ui.debug("stopping idle plugin", "plugin", cc.name)
+	cc.Close()
+}
+
+// alive reports whether the plugin is still running, and the session was not
+// aborted.
+func (cc *clientConnection) alive() bool {
+	select {
+	case <-cc.exited:
+		return false
+	default:
+	}
+	cc.limitMu.Lock()
+	defer cc.limitMu.Unlock()
+	return cc.limitErr == nil
+}
+
+// endRun is called when the plugin ends a state machine with "done". If the
+// plugin acknowledged the session extension, the connection can be reused.
+func (cc *clientConnection) endRun() {
+	cc.reusable = cc.session != nil && cc.sessionAccepted
+}
+
+// release ends the operation on a connection returned by Session.open, and
+// returns it to the Session if it's reusable, or closes it.
+func (cc *clientConnection) release() {
+	if !cc.reusable {
+		cc.Close()
+		return
+	}
+	if cc.stopWatch != nil {
+		cc.stopWatch()
+	}
+	cc.idle = true
+	cc.session.put(cc)
+}
+
+// stanzaReader returns the reader for the stanzas sent by the plugin, which
+// is kept across the state machines run on the connection.
+func (cc *clientConnection) stanzaReader() *format.StanzaReader {
+	if cc.sr == nil {
+		cc.sr = format.NewStanzaReader(bufio.NewReader(cc))
+	}
+	return cc.sr
+}
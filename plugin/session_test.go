@@ -0,0 +1,198 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/testkit/pluginsim"
+)
+
+// pinIdentity asks for the PIN the first time it's used in a process, like a
+// hardware token that stays unlocked.
+type pinIdentity struct {
+	s        *Server
+	id       *age.X25519Identity
+	unlocked *bool
+}
+
+func (i *pinIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	if !*i.unlocked {
+		pin, err := i.s.RequestValue("PIN:", true)
+		if err != nil {
+			return nil, err
+		}
+		if pin != "1234" {
+			return nil, &age.PINError{Remaining: -1}
+		}
+		*i.unlocked = true
+	}
+	return i.id.Unwrap(stanzas)
+}
+
+func TestSession(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns, prompts int32
+	// Each connection is a new simulated process, with its own Server.
+	connect := serverConn(func() *Server {
+		atomic.AddInt32(&conns, 1)
+		srv, err := NewServer("srvtest")
+		if err != nil {
+			panic(err)
+		}
+		var unlocked bool
+		srv.HandleRecipient(func(data []byte) (age.Recipient, error) {
+			return id.Recipient(), nil
+		})
+		srv.HandleIdentity(func(data []byte) (age.Identity, error) {
+			if len(data) != 0 {
+				return nil, errors.New("unknown identity")
+			}
+			return &pinIdentity{srv, id, &unlocked}, nil
+		})
+		return srv
+	})
+	ui := &ClientUI{
+		Connect: connect,
+		RequestValue: func(name, prompt string, secret bool) (string, error) {
+			atomic.AddInt32(&prompts, 1)
+			return "1234", nil
+		},
+	}
+
+	r, err := NewRecipient(EncodeRecipient("srvtest", nil), ui)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := NewIdentity(EncodeIdentity("srvtest", nil), ui)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptDecrypt := func(r *Recipient, i *Identity) {
+		t.Helper()
+		buf := &bytes.Buffer{}
+		w, err := age.Encrypt(buf, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, "hello"); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		out, err := age.Decrypt(buf, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, err := io.ReadAll(out); err != nil || string(b) != "hello" {
+			t.Fatalf("got %q, %v", b, err)
+		}
+	}
+
+	for n := 0; n < 3; n++ {
+		encryptDecrypt(r, i)
+	}
+	if atomic.LoadInt32(&conns) != 6 || prompts != 3 {
+		t.Errorf("without a session: got %d connections and %d prompts, want 6 and 3", conns, prompts)
+	}
+
+	atomic.StoreInt32(&conns, 0)
+	prompts = 0
+	s := NewSession()
+	rs, is := r.WithSession(s), i.WithSession(s)
+	for n := 0; n < 3; n++ {
+		encryptDecrypt(rs, is)
+	}
+	if atomic.LoadInt32(&conns) != 2 || prompts != 1 {
+		t.Errorf("with a session: got %d connections and %d prompts, want 2 and 1", conns, prompts)
+	}
+	if !r.Equal(rs) || !i.Equal(is) {
+		t.Error("WithSession changed the encoding")
+	}
+
+	// A failed operation stops the process, which is restarted by the next
+	// operation.
+	bad, err := NewIdentity(EncodeIdentity("srvtest", []byte{1}), ui)
+	if err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&conns, 0)
+	if _, err := bad.WithSession(s).Unwrap([]*age.Stanza{{Type: "X25519"}}); err == nil {
+		t.Error("expected unknown identity to fail")
+	}
+	encryptDecrypt(rs, is)
+	if atomic.LoadInt32(&conns) != 1 {
+		t.Errorf("after a failure: got %d connections, want 1", conns)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&conns, 0)
+	encryptDecrypt(rs, is)
+	if atomic.LoadInt32(&conns) != 2 {
+		t.Errorf("after Close: got %d connections, want 2", conns)
+	}
+
+	// Idle processes are stopped, and old ones are not reused.
+	for _, s := range []*Session{
+		{IdleTimeout: time.Millisecond, conns: make(map[sessionKey]*clientConnection)},
+		{MaxLifetime: time.Nanosecond, conns: make(map[sessionKey]*clientConnection)},
+	} {
+		atomic.StoreInt32(&conns, 0)
+		prompts = 0
+		rs, is := r.WithSession(s), i.WithSession(s)
+		encryptDecrypt(rs, is)
+		time.Sleep(50 * time.Millisecond)
+		s.mu.Lock()
+		kept := len(s.conns)
+		s.mu.Unlock()
+		if kept != 0 {
+			t.Errorf("got %d kept processes, want 0", kept)
+		}
+		encryptDecrypt(rs, is)
+		if atomic.LoadInt32(&conns) != 4 || prompts != 2 {
+			t.Errorf("with expired processes: got %d connections and %d prompts, want 4 and 2", conns, prompts)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Plugins that don't acknowledge the session extension are started for
+	// each operation.
+	sim := pluginsim.New()
+	sim.HandleDefaults("sim")
+	s = NewSession()
+	defer s.Close()
+	simUI := &ClientUI{Connect: sim.Connect}
+	sr, err := NewRecipient(EncodeRecipient("sim", nil), simUI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	si, err := NewIdentity(EncodeIdentity("sim", nil), simUI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < 2; n++ {
+		encryptDecrypt(sr.WithSession(s), si.WithSession(s))
+	}
+	if n := sim.Sessions(); n != 4 {
+		t.Errorf("got %d plugin sessions, want 4", n)
+	}
+	if err := sim.Err(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,397 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Transcripts are line-oriented text files. The first line is the header,
+// followed by the lines of each plugin session, tagged with a session number
+// so that concurrent sessions can be interleaved:
+//
+//	age-plugin-transcript v1 redacted
+//	session 1 NAME STATE-MACHINE
+//	1 > line sent by the client
+//	1 < line sent by the plugin
+//	1 <| trailing data sent by the plugin without a final newline
+//	end 1
+
+const (
+	transcriptHeader = "age-plugin-transcript v1"
+	redactedTag      = "redacted"
+	unredactedTag    = "unredacted"
+)
+
+// A TranscriptRecorder records the full transcripts of the plugin sessions
+// that use it as their ClientUI.Transcript, for debugging and to build
+// regression tests with TranscriptReplayer.
+//
+// If redact is true, secrets are replaced with placeholders of the same
+// length and encoding: file keys, secret values sent to the plugin in
+// response to request-secret, unlock tokens, and plugin identities. Otherwise, transcripts
+// contain secrets that can be used to decrypt files.
+//
+// A TranscriptRecorder is safe for concurrent use. Write errors are ignored.
+type TranscriptRecorder struct {
+	mu       sync.Mutex
+	w        io.Writer
+	redact   bool
+	sessions int
+}
+
+// NewTranscriptRecorder returns a TranscriptRecorder writing to w.
+func NewTranscriptRecorder(w io.Writer, redact bool) *TranscriptRecorder {
+	return &TranscriptRecorder{w: w, redact: redact}
+}
+
+func (r *TranscriptRecorder) writeLine(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	io.WriteString(r.w, line+"\n")
+}
+
+func (r *TranscriptRecorder) startSession(name, protocol string) *transcriptSession {
+	r.mu.Lock()
+	if r.sessions == 0 {
+		tag := unredactedTag
+		if r.redact {
+			tag = redactedTag
+		}
+		io.WriteString(r.w, transcriptHeader+" "+tag+"\n")
+	}
+	r.sessions++
+	n := r.sessions
+	io.WriteString(r.w, fmt.Sprintf("session %d %s %s\n", n, name, protocol))
+	r.mu.Unlock()
+
+	return &transcriptSession{redact: r.redact, emit: func(dir string, line string) {
+		if dir == "end" {
+			r.writeLine(fmt.Sprintf("end %d", n))
+			return
+		}
+		r.writeLine(fmt.Sprintf("%d %s %s", n, dir, line))
+	}}
+}
+
+// A transcriptSession splits the data exchanged in a session into lines, and
+// optionally redacts them, before passing them to emit.
+type transcriptSession struct {
+	mu     sync.Mutex
+	redact bool
+	emit   func(dir, line string)
+
+	clientBuf, pluginBuf []byte
+
+	// clientType and pluginType are the types of the last stanzas sent by the
+	// client and by the plugin, to identify secret bodies.
+	clientType, pluginType string
+	// secretResponse is set if the last command from the plugin requested a
+	// secret, which will be the body of the next client stanza.
+	secretResponse bool
+}
+
+func (t *transcriptSession) client(p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.clientBuf = t.split(t.clientBuf, p, ">", t.redactClientLine)
+}
+
+func (t *transcriptSession) plugin(p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pluginBuf = t.split(t.pluginBuf, p, "<", t.redactPluginLine)
+}
+
+func (t *transcriptSession) split(buf, p []byte, dir string, redact func(string) string) []byte {
+	buf = append(buf, p...)
+	for {
+		i := strings.IndexByte(string(buf), '\n')
+		if i < 0 {
+			return buf
+		}
+		t.emit(dir, redact(string(buf[:i])))
+		buf = buf[i+1:]
+	}
+}
+
+func (t *transcriptSession) end() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.clientBuf) > 0 {
+		t.emit(">|", t.redactClientLine(string(t.clientBuf)))
+	}
+	if len(t.pluginBuf) > 0 {
+		t.emit("<|", t.redactPluginLine(string(t.pluginBuf)))
+	}
+	t.emit("end", "")
+}
+
+func (t *transcriptSession) redactClientLine(line string) string {
+	if strings.HasPrefix(line, "-> ") {
+		args := strings.Split(line, " ")[1:]
+		t.clientType = args[0]
+		if t.clientType == "ok" && t.secretResponse {
+			t.clientType = "secret"
+		}
+		t.secretResponse = false
+		if t.redact && t.clientType == "add-identity" && len(args) == 2 {
+			return "-> add-identity " + redactIdentity(args[1])
+		}
+		return line
+	}
+	if t.redact && (t.clientType == "wrap-file-key" || t.clientType == "secret" ||
+		t.clientType == "unlock-token") {
+		return strings.Repeat("A", len(line))
+	}
+	return line
+}
+
+func (t *transcriptSession) redactPluginLine(line string) string {
+	if strings.HasPrefix(line, "-> ") {
+		args := strings.Split(line, " ")[1:]
+		t.pluginType = args[0]
+		t.secretResponse = t.pluginType == "request-secret"
+		if t.redact && t.pluginType == "identity" && len(args) >= 2 {
+			args[1] = redactIdentity(args[1])
+			return "-> " + strings.Join(args, " ")
+		}
+		return line
+	}
+	if t.redact && (t.pluginType == "file-key" || t.pluginType == "unlocked") {
+		return strings.Repeat("A", len(line))
+	}
+	return line
+}
+
+// redactIdentity replaces the data of a plugin identity with zeroes, so that
+// the result is still a valid identity for the same plugin.
+func redactIdentity(s string) string {
+	name, data, err := ParseIdentity(s)
+	if err != nil {
+		return "REDACTED"
+	}
+	return EncodeIdentity(name, make([]byte, len(data)))
+}
+
+// A TranscriptReplayer plays back a transcript recorded by a
+// TranscriptRecorder, to test the client against the recorded plugin behavior
+// without running the plugin.
+//
+// When set as ClientUI.Replay, each plugin session is served from the next
+// session in the transcript, which must be for the same plugin and state
+// machine. The plugin output is replayed verbatim, and the client output is
+// compared with the recorded one after redaction, ignoring grease stanzas. The
+// first mismatch is returned by Err, and fails the session.
+//
+// A TranscriptReplayer is safe for concurrent use, but sessions are replayed
+// in the order they were started.
+type TranscriptReplayer struct {
+	mu       sync.Mutex
+	sessions []*replaySession
+	next     int
+	err      error
+}
+
+type replaySession struct {
+	name, protocol string
+	client         []string
+	plugin         strings.Builder
+}
+
+// NewTranscriptReplayer parses a transcript recorded by a TranscriptRecorder.
+func NewTranscriptReplayer(r io.Reader) (*TranscriptReplayer, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<24)
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("empty transcript")
+	}
+	header := scanner.Text()
+	if header != transcriptHeader+" "+redactedTag && header != transcriptHeader+" "+unredactedTag {
+		return nil, fmt.Errorf("invalid transcript header %q", header)
+	}
+
+	tr := &TranscriptReplayer{}
+	sessions := make(map[string]*replaySession)
+	redactors := make(map[string]*transcriptSession)
+	n := 1
+	for scanner.Scan() {
+		n++
+		line := scanner.Text()
+		if strings.HasPrefix(line, "session ") {
+			f := strings.Split(line, " ")
+			if len(f) != 4 || sessions[f[1]] != nil {
+				return nil, fmt.Errorf("line %d: invalid session line", n)
+			}
+			s := &replaySession{name: f[2], protocol: f[3]}
+			sessions[f[1]] = s
+			tr.sessions = append(tr.sessions, s)
+			// The client lines are redacted again, in case the transcript
+			// was recorded unredacted, to compare them with the redacted
+			// live output, as file keys and secrets change every time.
+			redactors[f[1]] = &transcriptSession{redact: true, emit: func(dir, line string) {
+				if dir == ">" || dir == ">|" {
+					s.client = append(s.client, line)
+				}
+			}}
+			continue
+		}
+		if strings.HasPrefix(line, "end ") {
+			if sessions[strings.TrimPrefix(line, "end ")] == nil {
+				return nil, fmt.Errorf("line %d: end of unknown session", n)
+			}
+			continue
+		}
+		id, rest, ok := strings.Cut(line, " ")
+		dir, data, ok2 := strings.Cut(rest, " ")
+		s, t := sessions[id], redactors[id]
+		if !ok || !ok2 || s == nil {
+			return nil, fmt.Errorf("line %d: invalid line", n)
+		}
+		switch dir {
+		case ">":
+			t.client([]byte(data + "\n"))
+		case ">|":
+			t.client([]byte(data))
+			t.end()
+		case "<":
+			s.plugin.WriteString(data + "\n")
+			t.plugin([]byte(data + "\n"))
+		case "<|":
+			s.plugin.WriteString(data)
+		default:
+			return nil, fmt.Errorf("line %d: invalid direction %q", n, dir)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return tr, nil
+}
+
+// Err returns the first mismatch between the replayed sessions and the
+// transcript, or an error if not all recorded sessions were replayed.
+func (tr *TranscriptReplayer) Err() error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.err != nil {
+		return tr.err
+	}
+	if tr.next < len(tr.sessions) {
+		return fmt.Errorf("transcript: %d sessions were not replayed", len(tr.sessions)-tr.next)
+	}
+	return nil
+}
+
+func (tr *TranscriptReplayer) fail(err error) error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.err == nil {
+		tr.err = err
+	}
+	return err
+}
+
+func (tr *TranscriptReplayer) open(name, protocol string, ui *ClientUI) (*clientConnection, error) {
+	tr.mu.Lock()
+	n := tr.next
+	if n >= len(tr.sessions) {
+		tr.mu.Unlock()
+		return nil, tr.fail(fmt.Errorf("transcript: unexpected session %d for %s %s", n+1, name, protocol))
+	}
+	s := tr.sessions[n]
+	tr.next++
+	tr.mu.Unlock()
+	if s.name != name || s.protocol != protocol {
+		return nil, tr.fail(fmt.Errorf("transcript: session %d is for %s %s, got %s %s",
+			n+1, s.name, s.protocol, name, protocol))
+	}
+
+	w := &replayWriter{tr: tr, session: n + 1, expected: s.client}
+	w.t = &transcriptSession{redact: true, emit: w.check}
+	ctx, cancel := context.WithCancel(context.Background())
+	exited := make(chan struct{})
+	cc := &clientConnection{
+		name:   name,
+		ui:     ui,
+		Reader: &replayReader{r: strings.NewReader(s.plugin.String()), t: w.t},
+		Writer: w,
+		close: func() {
+			w.t.end()
+			cancel()
+			close(exited)
+		},
+		span:   ui.startSpan("age.Plugin", "plugin", name, "protocol", protocol),
+		ctx:    ctx,
+		exited: exited,
+	}
+	return cc, nil
+}
+
+// A replayReader returns the recorded plugin output, and passes it to the
+// redactor of the client output, which needs it to identify secret replies.
+type replayReader struct {
+	r io.Reader
+	t *transcriptSession
+}
+
+func (r *replayReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.t.plugin(p[:n])
+	return n, err
+}
+
+// A replayWriter compares the client output with the recorded one.
+type replayWriter struct {
+	tr       *TranscriptReplayer
+	session  int
+	expected []string
+	t        *transcriptSession
+	err      error
+}
+
+func (w *replayWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.t.client(p)
+	if w.err != nil {
+		return 0, w.err
+	}
+	return len(p), nil
+}
+
+func (w *replayWriter) check(dir, line string) {
+	if dir != ">" && dir != ">|" || w.err != nil {
+		return
+	}
+	if isGreaseLine(line) {
+		return
+	}
+	for len(w.expected) > 0 && isGreaseLine(w.expected[0]) {
+		w.expected = w.expected[1:]
+	}
+	if len(w.expected) == 0 {
+		w.err = w.tr.fail(fmt.Errorf("transcript: session %d: unexpected client line %q", w.session, line))
+		return
+	}
+	if w.expected[0] != line {
+		w.err = w.tr.fail(fmt.Errorf("transcript: session %d: client sent %q, expected %q",
+			w.session, line, w.expected[0]))
+		return
+	}
+	w.expected = w.expected[1:]
+}
+
+// isGreaseLine reports whether line is the opening line of a grease stanza,
+// which has a random type. Grease stanzas are sent without a body.
+func isGreaseLine(line string) bool {
+	return strings.HasPrefix(line, "-> grease-")
+}
@@ -0,0 +1,172 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	exec "golang.org/x/sys/execabs"
+)
+
+var versions struct {
+	sync.Mutex
+	// required maps plugin names to the minimum version set by RequireVersion.
+	required map[string]string
+	// probed maps plugin paths to the version returned by Version.
+	probed map[string]string
+}
+
+// RequireVersion makes the client refuse to run the plugin with the given
+// name if its version, as reported by Version, is older than constraint.
+//
+// constraint is a minimum version, such as "1.2.0" or ">=v1.2.0". Versions
+// are compared numerically component by component, and a pre-release version
+// (such as "1.2.0-rc.1") is older than the corresponding release. Plugins that
+// don't report a version are refused.
+//
+// This can be used to avoid plugin binaries with known protocol bugs. The
+// requirement applies to all later plugin invocations in the process. An empty
+// constraint removes it.
+func RequireVersion(name, constraint string) error {
+	min := strings.TrimSpace(strings.TrimPrefix(constraint, ">="))
+	if min != "" {
+		if _, err := parseVersion(min); err != nil {
+			return fmt.Errorf("invalid version constraint %q: %v", constraint, err)
+		}
+	}
+	versions.Lock()
+	defer versions.Unlock()
+	if versions.required == nil {
+		versions.required = make(map[string]string)
+	}
+	if min == "" {
+		delete(versions.required, name)
+	} else {
+		versions.required[name] = min
+	}
+	return nil
+}
+
+var versionRe = regexp.MustCompile(`v?[0-9]+(\.[0-9]+)*(-[0-9A-Za-z.-]+)?`)
+
+// Version runs the plugin with the given name with the --version flag, and
+// returns the first version number in its output, such as "1.2.0" or "v0.4.0".
+// The result is cached for the lifetime of the process.
+func Version(name string) (string, error) {
+	path := pluginPath(name)
+	versions.Lock()
+	v, ok := versions.probed[path]
+	versions.Unlock()
+	if ok {
+		return v, nil
+	}
+
+	cmd := exec.Command(path, "--version")
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to run %s --version: %v", path, err)
+	}
+	line, _, _ := strings.Cut(string(bytes.TrimSpace(out)), "\n")
+	for _, field := range strings.Fields(line) {
+		if m := versionRe.FindString(field); m == field {
+			v = field
+			break
+		}
+	}
+	if v == "" {
+		return "", fmt.Errorf("%s --version didn't print a version", path)
+	}
+
+	versions.Lock()
+	defer versions.Unlock()
+	if versions.probed == nil {
+		versions.probed = make(map[string]string)
+	}
+	versions.probed[path] = v
+	return v, nil
+}
+
+// checkVersion returns an error if the plugin doesn't meet the requirement
+// set with RequireVersion, if any.
+func checkVersion(name string) error {
+	versions.Lock()
+	min, ok := versions.required[name]
+	versions.Unlock()
+	if !ok {
+		return nil
+	}
+	v, err := Version(name)
+	if err != nil {
+		return fmt.Errorf("version %s or later is required, but the version couldn't be checked: %v", min, err)
+	}
+	older, err := versionLess(v, min)
+	if err != nil {
+		return fmt.Errorf("version %s or later is required, but the reported version %q is invalid: %v", min, v, err)
+	}
+	if older {
+		return fmt.Errorf("version %s is too old, version %s or later is required; please upgrade age-plugin-%s", v, min, name)
+	}
+	return nil
+}
+
+type version struct {
+	parts      []int
+	prerelease string
+}
+
+func parseVersion(s string) (*version, error) {
+	s = strings.TrimPrefix(s, "v")
+	s, pre, _ := strings.Cut(s, "-")
+	v := &version{prerelease: pre}
+	for _, p := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid component %q", p)
+		}
+		v.parts = append(v.parts, n)
+	}
+	return v, nil
+}
+
+// versionLess reports whether version a is older than version b. Missing
+// components are treated as zero, and pre-release suffixes are compared as
+// strings.
+func versionLess(a, b string) (bool, error) {
+	va, err := parseVersion(a)
+	if err != nil {
+		return false, err
+	}
+	vb, err := parseVersion(b)
+	if err != nil {
+		return false, err
+	}
+	for i := 0; i < len(va.parts) || i < len(vb.parts); i++ {
+		var x, y int
+		if i < len(va.parts) {
+			x = va.parts[i]
+		}
+		if i < len(vb.parts) {
+			y = vb.parts[i]
+		}
+		if x != y {
+			return x < y, nil
+		}
+	}
+	switch {
+	case va.prerelease == vb.prerelease:
+		return false, nil
+	case va.prerelease == "":
+		return false, nil
+	case vb.prerelease == "":
+		return true, nil
+	default:
+		return va.prerelease < vb.prerelease, nil
+	}
+}
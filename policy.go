@@ -0,0 +1,71 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"strconv"
+
+	"filippo.io/age/internal/format"
+)
+
+// HeaderInfo describes the header of a file being decrypted. It's passed to
+// Options.Policy before any identity is tried.
+//
+// Note that the labels returned by RecipientWithLabels are not stored in the
+// file. To require, for example, post-quantum recipients, a policy can check
+// the stanza types instead.
+type HeaderInfo struct {
+	// Version is the header version line, such as "age-encryption.org/v1".
+	Version string
+
+	// Stanzas are the recipient stanzas in the header, in order, including
+	// grease and unknown stanzas but not the metadata, signature, and
+	// chunk-size stanzas. They must not be modified.
+	Stanzas []*Stanza
+
+	// Metadata is true if the header contains an encrypted metadata stanza.
+	Metadata bool
+
+	// Signed is true if the header contains a signature stanza. The signature
+	// is only checked after the file key is unwrapped.
+	Signed bool
+
+	// ScryptWorkFactor is the base-2 logarithm of the scrypt work factor, if
+	// the file is encrypted with a passphrase, or zero otherwise.
+	ScryptWorkFactor int
+
+	// ChunkSize is the size of the payload chunks, which is 64 KiB unless the
+	// file was encrypted with Options.ChunkSize. A whole chunk is held in
+	// memory while decrypting. It's zero if the chunk-size stanza is invalid,
+	// in which case decryption fails after the policy is checked.
+	ChunkSize int
+}
+
+func headerInfo(hdr *format.Header) HeaderInfo {
+	info := HeaderInfo{Version: format.V1.Name}
+	if hdr.Version != nil {
+		info.Version = hdr.Version.Name
+	}
+	info.ChunkSize, _ = payloadChunkSize(hdr)
+	for _, s := range hdr.Recipients {
+		if s.Type == metadataStanzaType {
+			info.Metadata = true
+			continue
+		}
+		if s.Type == signatureStanzaType {
+			info.Signed = true
+			continue
+		}
+		if s.Type == chunkSizeStanzaType {
+			continue
+		}
+		if s.Type == "scrypt" && len(s.Args) == 2 {
+			// A malformed work factor is rejected by ScryptIdentity later.
+			info.ScryptWorkFactor, _ = strconv.Atoi(s.Args[1])
+		}
+		info.Stanzas = append(info.Stanzas, (*Stanza)(s))
+	}
+	return info
+}
@@ -8,6 +8,7 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"errors"
+	"hash"
 	"io"
 
 	"filippo.io/age/internal/format"
@@ -25,7 +26,7 @@ func aeadEncrypt(key, plaintext []byte) ([]byte, error) {
 	// spec guarantees each key is only used once (by deriving it from values
 	// that include fresh randomness), allowing us to save the overhead.
 	// For the code that encrypts the actual payload, look at the
-	// filippo.io/age/internal/stream package.
+	// filippo.io/age/stream package.
 	nonce := make([]byte, chacha20poly1305.NonceSize)
 	return aead.Seal(nil, nonce, plaintext, nil), nil
 }
@@ -50,18 +51,24 @@ func aeadDecrypt(key []byte, size int, ciphertext []byte) ([]byte, error) {
 }
 
 func headerMAC(fileKey []byte, hdr *format.Header) ([]byte, error) {
-	h := hkdf.New(sha256.New, fileKey, nil, []byte("header"))
-	hmacKey := make([]byte, 32)
-	if _, err := io.ReadFull(h, hmacKey); err != nil {
-		return nil, err
-	}
-	hh := hmac.New(sha256.New, hmacKey)
+	hh := newHeaderMAC(fileKey)
 	if err := hdr.MarshalWithoutMAC(hh); err != nil {
 		return nil, err
 	}
 	return hh.Sum(nil), nil
 }
 
+// newHeaderMAC returns an HMAC to be computed over the header encoding up to
+// the MAC, as written by Header.MarshalWithoutMAC.
+func newHeaderMAC(fileKey []byte) hash.Hash {
+	h := hkdf.New(sha256.New, fileKey, nil, []byte("header"))
+	hmacKey := make([]byte, 32)
+	if _, err := io.ReadFull(h, hmacKey); err != nil {
+		panic("age: internal error: failed to read from HKDF: " + err.Error())
+	}
+	return hmac.New(sha256.New, hmacKey)
+}
+
 func streamKey(fileKey, nonce []byte) []byte {
 	h := hkdf.New(sha256.New, fileKey, nonce, []byte("payload"))
 	streamKey := make([]byte, chacha20poly1305.KeySize)
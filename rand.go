@@ -0,0 +1,48 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/hkdf"
+)
+
+// DeterministicRand returns a deterministic stream of pseudo-random bytes
+// derived from seed, for use as Options.Rand to produce reproducible files,
+// for example to let build systems verify encrypted artifacts.
+//
+// WARNING: encrypting two different plaintexts with the same seed reuses the
+// file key and the payload nonce, which completely breaks the confidentiality
+// of both files. The seed must be secret, and must be unique to the plaintext,
+// for example a MAC of the plaintext under a secret key. Never use a constant
+// or a predictable seed.
+func DeterministicRand(seed []byte) io.Reader {
+	h := hkdf.New(sha256.New, seed, nil, []byte("age-encryption.org/v1/deterministic"))
+	key := make([]byte, chacha20.KeySize)
+	if _, err := io.ReadFull(h, key); err != nil {
+		panic("age: internal error: failed to read from HKDF: " + err.Error())
+	}
+	nonce := make([]byte, chacha20.NonceSize)
+	c, err := chacha20.NewUnauthenticatedCipher(key, nonce)
+	if err != nil {
+		panic("age: internal error: " + err.Error())
+	}
+	return &chachaRand{c: c}
+}
+
+type chachaRand struct {
+	c *chacha20.Cipher
+}
+
+func (r *chachaRand) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	r.c.XORKeyStream(p, p)
+	return len(p), nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+
+	"filippo.io/age/armor"
+	"filippo.io/age/internal/format"
+	"golang.org/x/crypto/poly1305"
+)
+
+// Rearmor reads an age file from src, either binary or already armored, and
+// writes it to dst in the ASCII armored format of the filippo.io/age/armor
+// package.
+//
+// No key is needed: the header and the payload are only checked for structural
+// validity, and their authenticity is not verified. Since the file is
+// processed as a stream, some output might be written to dst before an error
+// is detected.
+func Rearmor(dst io.Writer, src io.Reader) error {
+	a := armor.NewWriter(dst)
+	if err := transcode(a, src); err != nil {
+		return err
+	}
+	return a.Close()
+}
+
+// Dearmor reads an age file from src, either armored or already binary, and
+// writes it to dst in the binary format.
+//
+// Like Rearmor, it doesn't need a key and only checks the file for structural
+// validity, and some output might be written to dst before an error is
+// detected.
+func Dearmor(dst io.Writer, src io.Reader) error {
+	return transcode(dst, src)
+}
+
+func transcode(dst io.Writer, src io.Reader) error {
+	rr := bufio.NewReader(src)
+	if start, _ := rr.Peek(len(armor.Header)); string(start) == armor.Header {
+		src = armor.NewReader(rr)
+	} else {
+		src = rr
+	}
+
+	hdr, payload, err := format.Parse(src)
+	if err != nil {
+		return fmt.Errorf("failed to read header: %w", headerError(err))
+	}
+	chunkSize, err := payloadChunkSize(hdr)
+	if err != nil {
+		return err
+	}
+	if err := hdr.Marshal(dst); err != nil {
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+	n, err := io.Copy(dst, payload)
+	if err != nil {
+		return fmt.Errorf("failed to copy payload: %w", err)
+	}
+	return checkPayloadSize(n, chunkSize)
+}
+
+// checkPayloadSize checks that a payload of n bytes, including the nonce, can
+// be made of a sequence of full chunks of chunkSize bytes of plaintext followed
+// by a non-empty final chunk, which might also be full. The only empty chunk
+// allowed is the first and only one of an empty plaintext.
+func checkPayloadSize(n int64, chunkSize int) error {
+	encChunkSize := int64(chunkSize + poly1305.TagSize)
+	n -= streamNonceSize
+	if n < poly1305.TagSize {
+		return errors.New("payload is truncated")
+	}
+	if n <= encChunkSize {
+		return nil
+	}
+	if last := n % encChunkSize; last != 0 && last <= poly1305.TagSize {
+		return errors.New("payload has an invalid length")
+	}
+	return nil
+}
+
+// plaintextSize returns the size of the plaintext of a payload of n bytes,
+// including the nonce, with chunks of chunkSize bytes of plaintext.
+func plaintextSize(n int64, chunkSize int) (int64, error) {
+	encChunkSize := int64(chunkSize + poly1305.TagSize)
+	if err := checkPayloadSize(n, chunkSize); err != nil {
+		return 0, err
+	}
+	n -= streamNonceSize
+	chunks := (n + encChunkSize - 1) / encChunkSize
+	return n - chunks*poly1305.TagSize, nil
+}
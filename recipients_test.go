@@ -6,10 +6,20 @@ package age_test
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"testing"
+	"time"
 
 	"filippo.io/age"
+	"filippo.io/age/bech32"
+	"filippo.io/edwards25519"
 )
 
 func TestX25519RoundTrip(t *testing.T) {
@@ -49,6 +59,184 @@ func TestX25519RoundTrip(t *testing.T) {
 	}
 }
 
+func TestX25519Compact(t *testing.T) {
+	var identities []*age.X25519Identity
+	var recipients []age.Recipient
+	for n := 0; n < 50; n++ {
+		i, err := age.GenerateX25519Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		identities = append(identities, i)
+		recipients = append(recipients, i.Recipient())
+	}
+	pw, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypt := func(opts *age.Options, recipients ...age.Recipient) ([]byte, error) {
+		buf := &bytes.Buffer{}
+		w, err := age.EncryptWithOptions(buf, opts, recipients...)
+		if err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	full, err := encrypt(nil, recipients...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact, err := encrypt(&age.Options{CompactX25519: true}, recipients...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compact)*2 > len(full) {
+		t.Errorf("compact header is not smaller: %d vs %d bytes", len(compact), len(full))
+	}
+
+	for _, i := range []*age.X25519Identity{identities[0], identities[25], identities[49]} {
+		if _, err := age.Decrypt(bytes.NewReader(compact), i); err != nil {
+			t.Error(err)
+		}
+	}
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.Decrypt(bytes.NewReader(compact), other); err == nil {
+		t.Error("expected decryption with another identity to fail")
+	}
+
+	if _, err := encrypt(&age.Options{CompactX25519: true}, recipients[0], pw); err == nil {
+		t.Error("expected mixing with scrypt to fail")
+	}
+}
+
+func TestX448RoundTrip(t *testing.T) {
+	i, err := age.GenerateX448Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := i.Recipient()
+
+	if r1, err := age.ParseX448Recipient(r.String()); err != nil {
+		t.Fatal(err)
+	} else if r1.String() != r.String() {
+		t.Errorf("recipient did not round-trip through parsing: got %q, want %q", r1, r)
+	}
+	if i1, err := age.ParseX448Identity(i.String()); err != nil {
+		t.Fatal(err)
+	} else if i1.String() != i.String() {
+		t.Errorf("identity did not round-trip through parsing: got %q, want %q", i1, i)
+	}
+
+	fileKey := make([]byte, 16)
+	if _, err := rand.Read(fileKey); err != nil {
+		t.Fatal(err)
+	}
+	stanzas, err := r.Wrap(fileKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := i.Unwrap(stanzas)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(fileKey, out) {
+		t.Errorf("invalid output: %x, expected %x", out, fileKey)
+	}
+}
+
+func TestX25519Subkey(t *testing.T) {
+	master, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := master.Subkey("backups/2024")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := master.Recipient().Subkey("backups/2024")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.String() != i.Recipient().String() {
+		t.Errorf("recipient and identity derivation mismatch: %v, %v", r, i.Recipient())
+	}
+	if r.String() == master.Recipient().String() {
+		t.Errorf("subkey recipient is the same as the master recipient")
+	}
+	if r1, err := master.Recipient().Subkey("ci"); err != nil {
+		t.Fatal(err)
+	} else if r1.String() == r.String() {
+		t.Errorf("different labels produced the same recipient")
+	}
+	if _, err := master.Subkey(""); err == nil {
+		t.Errorf("expected empty label to fail")
+	}
+
+	if i1, err := age.ParseX25519SubkeyIdentity(i.String()); err != nil {
+		t.Fatal(err)
+	} else if i1.String() != i.String() || i1.Label() != "backups/2024" {
+		t.Errorf("identity did not round-trip through parsing: got %q, want %q", i1, i)
+	}
+
+	fileKey := make([]byte, 16)
+	if _, err := rand.Read(fileKey); err != nil {
+		t.Fatal(err)
+	}
+	stanzas, err := r.Wrap(fileKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := i.Unwrap(stanzas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fileKey, out) {
+		t.Errorf("invalid output: %x, expected %x", out, fileKey)
+	}
+	if _, err := master.Unwrap(stanzas); !errors.Is(err, age.ErrIncorrectIdentity) {
+		t.Errorf("expected master identity without label to fail with ErrIncorrectIdentity, got %v", err)
+	}
+
+	ids, err := master.WithSubkeyLabels("ci", "backups/2024")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = ids.Unwrap(stanzas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fileKey, out) {
+		t.Errorf("invalid output: %x, expected %x", out, fileKey)
+	}
+	masterStanzas, err := master.Recipient().Wrap(fileKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := ids.Unwrap(masterStanzas); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(fileKey, out) {
+		t.Errorf("invalid output: %x, expected %x", out, fileKey)
+	}
+	if ids, err := master.WithSubkeyLabels("ci"); err != nil {
+		t.Fatal(err)
+	} else if _, err := ids.Unwrap(stanzas); !errors.Is(err, age.ErrIncorrectIdentity) {
+		t.Errorf("expected master identity with the wrong label to fail with ErrIncorrectIdentity, got %v", err)
+	}
+	if _, err := master.WithSubkeyLabels("ci", ""); err == nil {
+		t.Errorf("expected empty label to fail")
+	}
+}
+
 func TestScryptRoundTrip(t *testing.T) {
 	password := "twitch.tv/filosottile"
 
@@ -80,3 +268,375 @@ func TestScryptRoundTrip(t *testing.T) {
 		t.Errorf("invalid output: %x, expected %x", out, fileKey)
 	}
 }
+
+func TestScryptConfirmWorkFactor(t *testing.T) {
+	r, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetWorkFactor(12)
+	fileKey := make([]byte, 16)
+	stanzas, err := r.Wrap(fileKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := age.NewScryptIdentity("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var called int
+	i.SetConfirmWorkFactor(11, func(logN int, estimate time.Duration) bool {
+		called = logN
+		return false
+	})
+	if _, err := i.Unwrap(stanzas); err == nil {
+		t.Error("expected declined work factor to fail")
+	}
+	if called != 12 {
+		t.Errorf("confirm called with %d, expected 12", called)
+	}
+
+	called = 0
+	i.SetConfirmWorkFactor(12, func(int, time.Duration) bool {
+		called++
+		return false
+	})
+	if _, err := i.Unwrap(stanzas); err != nil {
+		t.Error(err)
+	}
+	if called != 0 {
+		t.Error("confirm called for a work factor below the threshold")
+	}
+}
+
+func TestDualFactorRoundTrip(t *testing.T) {
+	password := "twitch.tv/filosottile"
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := age.NewDualFactorRecipient(id.Recipient(), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetWorkFactor(10)
+	i, err := age.NewDualFactorIdentity(id, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fileKey := make([]byte, 16)
+	if _, err := rand.Read(fileKey); err != nil {
+		t.Fatal(err)
+	}
+	stanzas, err := r.Wrap(fileKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := i.Unwrap(stanzas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fileKey, out) {
+		t.Errorf("invalid output: %x, expected %x", out, fileKey)
+	}
+
+	wrongPassword, err := age.NewDualFactorIdentity(id, "wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wrongPassword.Unwrap(stanzas); !errors.Is(err, age.ErrIncorrectIdentity) {
+		t.Errorf("expected wrong passphrase to fail with ErrIncorrectIdentity, got %v", err)
+	}
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongKey, err := age.NewDualFactorIdentity(other, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wrongKey.Unwrap(stanzas); !errors.Is(err, age.ErrIncorrectIdentity) {
+		t.Errorf("expected wrong key to fail with ErrIncorrectIdentity, got %v", err)
+	}
+	if _, err := id.Unwrap(stanzas); !errors.Is(err, age.ErrIncorrectIdentity) {
+		t.Errorf("expected X25519 identity alone to fail with ErrIncorrectIdentity, got %v", err)
+	}
+}
+
+type unavailableRecipient struct{}
+
+func (unavailableRecipient) Wrap([]byte) ([]*age.Stanza, error) {
+	return nil, fmt.Errorf("token not connected: %w", age.ErrUnavailable)
+}
+
+func (unavailableRecipient) Unwrap([]*age.Stanza) ([]byte, error) {
+	return nil, fmt.Errorf("token not connected: %w", age.ErrUnavailable)
+}
+
+type failingRecipient struct{}
+
+func (failingRecipient) Wrap([]byte) ([]*age.Stanza, error) {
+	return nil, errors.New("failed")
+}
+
+func (failingRecipient) Unwrap([]*age.Stanza) ([]byte, error) {
+	return nil, errors.New("failed")
+}
+
+func TestFallback(t *testing.T) {
+	backup, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := age.FallbackRecipient(unavailableRecipient{}, backup.Recipient())
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	i := age.FallbackIdentity(unavailableRecipient{}, backup)
+	if _, err := age.Decrypt(bytes.NewReader(buf.Bytes()), i); err != nil {
+		t.Errorf("fallback identity failed: %v", err)
+	}
+
+	r = age.FallbackRecipient(failingRecipient{}, backup.Recipient())
+	if _, err := age.Encrypt(io.Discard, r); err == nil {
+		t.Errorf("fallback recipient fell back on an unrelated error")
+	}
+	i = age.FallbackIdentity(failingRecipient{}, backup)
+	if _, err := age.Decrypt(bytes.NewReader(buf.Bytes()), i); err == nil {
+		t.Errorf("fallback identity fell back on an unrelated error")
+	}
+}
+
+func TestThresholdRoundTrip(t *testing.T) {
+	var ids []*age.X25519Identity
+	var recs []age.Recipient
+	for i := 0; i < 3; i++ {
+		id, err := age.GenerateX25519Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+		recs = append(recs, id.Recipient())
+	}
+	r, err := age.NewThresholdRecipient(2, recs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fileKey := make([]byte, 16)
+	if _, err := rand.Read(fileKey); err != nil {
+		t.Fatal(err)
+	}
+	stanzas, err := r.Wrap(fileKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stanzas) != 3 {
+		t.Fatalf("expected 3 stanzas, got %d", len(stanzas))
+	}
+
+	for _, pair := range [][2]int{{0, 1}, {1, 2}, {2, 0}} {
+		i := age.NewThresholdIdentity(ids[pair[0]], ids[pair[1]])
+		out, err := i.Unwrap(stanzas)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(fileKey, out) {
+			t.Errorf("invalid output with identities %v: %x, expected %x", pair, out, fileKey)
+		}
+	}
+
+	i := age.NewThresholdIdentity(ids[0])
+	if _, err := i.Unwrap(stanzas); !errors.Is(err, age.ErrIncorrectIdentity) {
+		t.Errorf("expected a single share to fail with ErrIncorrectIdentity, got %v", err)
+	}
+	if _, err := ids[0].Unwrap(stanzas); !errors.Is(err, age.ErrIncorrectIdentity) {
+		t.Errorf("expected inner identity alone to fail with ErrIncorrectIdentity, got %v", err)
+	}
+}
+
+func TestHPKERoundTrip(t *testing.T) {
+	i, err := age.GenerateHPKEIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := i.Recipient()
+
+	if r1, err := age.ParseHPKERecipient(r.String()); err != nil {
+		t.Fatal(err)
+	} else if r1.String() != r.String() {
+		t.Errorf("recipient did not round-trip through parsing: got %q, want %q", r1, r)
+	}
+	if i1, err := age.ParseHPKEIdentity(i.String()); err != nil {
+		t.Fatal(err)
+	} else if i1.String() != i.String() {
+		t.Errorf("identity did not round-trip through parsing: got %q, want %q", i1, i)
+	}
+
+	fileKey := make([]byte, 16)
+	if _, err := rand.Read(fileKey); err != nil {
+		t.Fatal(err)
+	}
+	stanzas, err := r.Wrap(fileKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := i.Unwrap(stanzas)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(fileKey, out) {
+		t.Errorf("invalid output: %x, expected %x", out, fileKey)
+	}
+}
+
+// TestHPKEVector checks a stanza produced and verified with an independent
+// RFC 9180 implementation.
+func TestHPKEVector(t *testing.T) {
+	sk, _ := hex.DecodeString("4612c550263fc8ad58375df3f557aac531d26850903e55a9f23f21d8534e8ac8")
+	i, err := age.NewHPKEIdentity(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := i.Recipient().String(); r != "age1hpke189yvlc9drhdkjhtcpevswuv4mfk9v5rtqfejj722kq4u4qypt3xst0cu64" {
+		t.Errorf("unexpected recipient: %s", r)
+	}
+	body, _ := base64.RawStdEncoding.DecodeString("OeaZ0yA9NfwGG1vLVGI7HoUxMBjJW7HsI4/10Hy4s48")
+	out, err := i.Unwrap([]*age.Stanza{{
+		Type: "hpke",
+		Args: []string{"vb31yp3myKz5mDRWcFstEpjAePTWbQ2rDgvGA1if7SQ"},
+		Body: body,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(out) != "000102030405060708090a0b0c0d0e0f" {
+		t.Errorf("unexpected file key: %x", out)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a1, err := age.ParseX25519Identity(a.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.Equal(a1) || a.Equal(b) {
+		t.Error("wrong X25519Identity.Equal result")
+	}
+	if !a.Recipient().Equal(a1.Recipient()) || a.Recipient().Equal(b.Recipient()) {
+		t.Error("wrong X25519Recipient.Equal result")
+	}
+
+	s1, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := age.NewScryptRecipient("other password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s1.Equal(s2) || s1.Equal(other) {
+		t.Error("wrong ScryptRecipient.Equal result")
+	}
+	s2.SetWorkFactor(10)
+	if s1.Equal(s2) {
+		t.Error("ScryptRecipients with different work factors are equal")
+	}
+}
+
+func TestTextMarshaling(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	type config struct {
+		Identity  *age.X25519Identity
+		Recipient *age.X25519Recipient
+	}
+	b, err := json.Marshal(config{i, i.Recipient()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf(`{"Identity":%q,"Recipient":%q}`, i.String(), i.Recipient().String())
+	if string(b) != expected {
+		t.Errorf("got %s, expected %s", b, expected)
+	}
+	var c config
+	if err := json.Unmarshal(b, &c); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Identity.Equal(i) || !c.Recipient.Equal(i.Recipient()) {
+		t.Error("unmarshaled keys are different")
+	}
+	if err := json.Unmarshal([]byte(`{"Recipient":"age1invalid"}`), &c); err == nil {
+		t.Error("expected invalid recipient to fail")
+	}
+}
+
+func TestX25519IdentityFromEd25519Seed(t *testing.T) {
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		t.Fatal(err)
+	}
+	i, err := age.X25519IdentityFromEd25519Seed(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i1, err := age.X25519IdentityFromEd25519Seed(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !i.Equal(i1) {
+		t.Error("derivation is not deterministic")
+	}
+
+	// The recipient must be the Montgomery form of the Ed25519 public key.
+	pk := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+	p, err := new(edwards25519.Point).SetBytes(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := age.ParseX25519Recipient(mustEncode(t, "age", p.BytesMontgomery()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !i.Recipient().Equal(r) {
+		t.Error("recipient doesn't match the Ed25519 public key")
+	}
+
+	if _, err := age.X25519IdentityFromEd25519Seed(seed[:16]); err == nil {
+		t.Error("expected short seed to fail")
+	}
+}
+
+func mustEncode(t *testing.T, hrp string, data []byte) string {
+	s, err := bech32.Encode(hrp, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
@@ -0,0 +1,75 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"filippo.io/age/internal/format"
+)
+
+// Rekey reads an age file from src, unwraps its file key with the first
+// matching identity, and writes to dst a file with a new header that wraps the
+// same file key to newRecipients, followed by the unchanged payload.
+//
+// The payload is copied without being decrypted, so rekeying a large file is
+// as fast as copying it, but a corrupted or truncated payload is not detected
+// until the new file is decrypted. Some output might be written to dst before
+// an error reading the payload is detected.
+//
+// Metadata and the payload chunk size stored in the header are preserved. A
+// header signature is removed, since it covers the original recipients.
+//
+// Note that the file key doesn't change: anyone who could decrypt the
+// original file, and kept its header or file key, can still decrypt the new
+// file. To revoke access to the contents, decrypt and re-encrypt them instead.
+//
+// src must be a binary age file. To rekey an armored file, wrap src in an
+// armor.Reader and dst in an armor.Writer.
+func Rekey(dst io.Writer, src io.Reader, identities []Identity, newRecipients []Recipient) error {
+	if len(identities) == 0 {
+		return errors.New("no identities specified")
+	}
+	if len(newRecipients) == 0 {
+		return errors.New("no recipients specified")
+	}
+
+	hdr, payload, err := format.Parse(src)
+	if err != nil {
+		return fmt.Errorf("failed to read header: %w", headerError(err))
+	}
+	fileKey, _, err := decryptHdr(hdr, nil, identities...)
+	if err != nil {
+		return err
+	}
+
+	newHdr, err := encryptHdr(fileKey, &Options{}, newRecipients...)
+	if err != nil {
+		return err
+	}
+	// The metadata stanza is encrypted with the file key, so it can be reused,
+	// and the chunk-size stanza describes the unchanged payload.
+	for _, s := range hdr.Recipients {
+		if s.Type == metadataStanzaType || s.Type == chunkSizeStanzaType {
+			newHdr.Recipients = append(newHdr.Recipients, s)
+		}
+	}
+	newHdr.Version = hdr.Version
+	if mac, err := headerMAC(fileKey, newHdr); err != nil {
+		return fmt.Errorf("failed to compute header MAC: %v", err)
+	} else {
+		newHdr.MAC = mac
+	}
+
+	if err := newHdr.Marshal(dst); err != nil {
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+	if _, err := io.Copy(dst, payload); err != nil {
+		return fmt.Errorf("failed to copy payload: %w", err)
+	}
+	return nil
+}
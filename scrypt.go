@@ -6,15 +6,15 @@ package age
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
 	"errors"
-	"fmt"
-	"regexp"
+	"io"
 	"strconv"
+	"time"
 
 	"filippo.io/age/internal/format"
-	"golang.org/x/crypto/chacha20poly1305"
-	"golang.org/x/crypto/scrypt"
 )
 
 const scryptLabel = "age-encryption.org/v1/scrypt"
@@ -24,13 +24,14 @@ const scryptLabel = "age-encryption.org/v1/scrypt"
 //
 // If a ScryptRecipient is used, it must be the only recipient for the file: it
 // can't be mixed with other recipient types and can't be used multiple times
-// for the same file.
+// for the same file, unless AllowMixedRecipients is called.
 //
 // Its use is not recommended for automated systems, which should prefer
 // X25519Recipient.
 type ScryptRecipient struct {
 	password   []byte
 	workFactor int
+	mixed      bool
 }
 
 var _ Recipient = &ScryptRecipient{}
@@ -48,6 +49,13 @@ func NewScryptRecipient(password string) (*ScryptRecipient, error) {
 	return r, nil
 }
 
+// Equal reports whether r and other have the same password and work factor.
+// The passwords are compared in constant time, without leaking their length.
+func (r *ScryptRecipient) Equal(other *ScryptRecipient) bool {
+	h1, h2 := sha256.Sum256(r.password), sha256.Sum256(other.password)
+	return subtle.ConstantTimeCompare(h1[:], h2[:]) == 1 && r.workFactor == other.workFactor
+}
+
 // SetWorkFactor sets the scrypt work factor to 2^logN.
 // It must be called before Wrap.
 //
@@ -59,12 +67,15 @@ func (r *ScryptRecipient) SetWorkFactor(logN int) {
 	r.workFactor = logN
 }
 
-const scryptSaltSize = 16
-
 func (r *ScryptRecipient) Wrap(fileKey []byte) ([]*Stanza, error) {
-	salt := make([]byte, scryptSaltSize)
-	if _, err := rand.Read(salt[:]); err != nil {
-		return nil, err
+	s, _, err := r.wrapWithRand(fileKey, rand.Reader)
+	return s, err
+}
+
+func (r *ScryptRecipient) wrapWithRand(fileKey []byte, rand io.Reader) ([]*Stanza, []string, error) {
+	salt, err := newPassphraseSalt(rand)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	logN := r.workFactor
@@ -73,24 +84,42 @@ func (r *ScryptRecipient) Wrap(fileKey []byte) ([]*Stanza, error) {
 		Args: []string{format.EncodeToString(salt), strconv.Itoa(logN)},
 	}
 
-	salt = append([]byte(scryptLabel), salt...)
-	k, err := scrypt.Key(r.password, salt, 1<<logN, 8, 1, chacha20poly1305.KeySize)
+	k, err := scryptKDF{}.deriveKey(scryptLabel, r.password, salt, logN)
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate scrypt hash: %v", err)
+		return nil, nil, err
 	}
 
 	wrappedKey, err := aeadEncrypt(k, fileKey)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	l.Body = wrappedKey
 
-	return []*Stanza{l}, nil
+	if r.mixed {
+		return []*Stanza{l}, nil, nil
+	}
+	// The salt is unique to this file, so it works as the label.
+	return []*Stanza{l}, []string{hex.EncodeToString(salt)}, nil
+}
+
+// AllowMixedRecipients allows r to be used alongside other recipients,
+// including other ScryptRecipients, for example to add a recovery passphrase
+// to a file encrypted to a key. It must be called before Wrap.
+//
+// WARNING: files encrypted this way are not authenticated by the passphrase.
+// Anyone who can decrypt the file with one of the other recipients learns the
+// file key, and can use it to produce a different file that decrypts
+// successfully with the passphrase. Only use it if all the recipients are
+// trusted not to tamper with the file. The file can only be decrypted with the
+// passphrase by a ScryptIdentity on which AllowMixedRecipients was called.
+func (r *ScryptRecipient) AllowMixedRecipients() {
+	r.mixed = true
 }
 
 // WrapWithLabels implements [age.RecipientWithLabels], returning a random
 // label. This ensures a ScryptRecipient can't be mixed with other recipients
-// (including other ScryptRecipients).
+// (including other ScryptRecipients), unless AllowMixedRecipients was called,
+// in which case no labels are returned.
 //
 // Users reasonably expect files encrypted to a passphrase to be [authenticated]
 // by that passphrase, i.e. for it to be impossible to produce a file that
@@ -100,21 +129,14 @@ func (r *ScryptRecipient) Wrap(fileKey []byte) ([]*Stanza, error) {
 //
 // [authenticated]: https://words.filippo.io/dispatches/age-authentication/
 func (r *ScryptRecipient) WrapWithLabels(fileKey []byte) (stanzas []*Stanza, labels []string, err error) {
-	stanzas, err = r.Wrap(fileKey)
-
-	random := make([]byte, 16)
-	if _, err := rand.Read(random); err != nil {
-		return nil, nil, err
-	}
-	labels = []string{hex.EncodeToString(random)}
-
-	return
+	return r.wrapWithRand(fileKey, rand.Reader)
 }
 
 // ScryptIdentity is a password-based identity.
 type ScryptIdentity struct {
-	password      []byte
-	maxWorkFactor int
+	password []byte
+	policy   passphrasePolicy
+	mixed    bool
 }
 
 var _ Identity = &ScryptIdentity{}
@@ -125,8 +147,10 @@ func NewScryptIdentity(password string) (*ScryptIdentity, error) {
 		return nil, errors.New("passphrase can't be empty")
 	}
 	i := &ScryptIdentity{
-		password:      []byte(password),
-		maxWorkFactor: 22, // 15s on a modern machine
+		password: []byte(password),
+		policy: passphrasePolicy{
+			maxWorkFactor: 22, // 15s on a modern machine
+		},
 	}
 	return i, nil
 }
@@ -141,20 +165,48 @@ func (i *ScryptIdentity) SetMaxWorkFactor(logN int) {
 	if logN > 30 || logN < 1 {
 		panic("age: SetMaxWorkFactor called with illegal value")
 	}
-	i.maxWorkFactor = logN
+	i.policy.maxWorkFactor = logN
+}
+
+// SetConfirmWorkFactor sets a function that is called before running scrypt
+// with a work factor larger than 2^logN. It receives the work factor of the
+// stanza and a rough estimate of how long the key derivation will take on a
+// modern machine. If confirm returns false, Unwrap fails without running scrypt.
+// It must be called before Unwrap.
+//
+// This lets interactive applications warn the user or ask for confirmation,
+// instead of appearing to hang on files with a high work factor. Work factors
+// above the one set with SetMaxWorkFactor are rejected without calling confirm.
+func (i *ScryptIdentity) SetConfirmWorkFactor(logN int, confirm func(logN int, estimate time.Duration) bool) {
+	if logN > 30 || logN < 1 {
+		panic("age: SetConfirmWorkFactor called with illegal value")
+	}
+	i.policy.confirmWorkFactor = logN
+	i.policy.confirm = confirm
+}
+
+// AllowMixedRecipients allows i to unwrap files where the scrypt stanza is
+// not the only one, such as those encrypted with a ScryptRecipient on which
+// AllowMixedRecipients was called. It must be called before Unwrap.
+//
+// WARNING: a successful decryption of such a file doesn't prove that the file
+// was produced by someone who knows the passphrase, since it can be produced
+// by any of the other recipients. Also, each scrypt stanza in the header is
+// tried in turn, so a file with many of them can cost many key derivations,
+// each up to the work factor set with SetMaxWorkFactor.
+func (i *ScryptIdentity) AllowMixedRecipients() {
+	i.mixed = true
 }
 
 func (i *ScryptIdentity) Unwrap(stanzas []*Stanza) ([]byte, error) {
-	for _, s := range stanzas {
-		if s.Type == "scrypt" && len(stanzas) != 1 {
-			return nil, errors.New("an scrypt recipient must be the only one")
+	if !i.mixed {
+		if err := checkPassphraseAlone(stanzas); err != nil {
+			return nil, err
 		}
 	}
 	return multiUnwrap(i.unwrap, stanzas)
 }
 
-var digitsRe = regexp.MustCompile(`^[1-9][0-9]*$`)
-
 func (i *ScryptIdentity) unwrap(block *Stanza) ([]byte, error) {
 	if block.Type != "scrypt" {
 		return nil, ErrIncorrectIdentity
@@ -162,31 +214,9 @@ func (i *ScryptIdentity) unwrap(block *Stanza) ([]byte, error) {
 	if len(block.Args) != 2 {
 		return nil, errors.New("invalid scrypt recipient block")
 	}
-	salt, err := format.DecodeString(block.Args[0])
+	k, err := i.policy.deriveKey(scryptKDF{}, scryptLabel, i.password, block.Args[0], block.Args[1])
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse scrypt salt: %v", err)
-	}
-	if len(salt) != scryptSaltSize {
-		return nil, errors.New("invalid scrypt recipient block")
-	}
-	if w := block.Args[1]; !digitsRe.MatchString(w) {
-		return nil, fmt.Errorf("scrypt work factor encoding invalid: %q", w)
-	}
-	logN, err := strconv.Atoi(block.Args[1])
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse scrypt work factor: %v", err)
-	}
-	if logN > i.maxWorkFactor {
-		return nil, fmt.Errorf("scrypt work factor too large: %v", logN)
-	}
-	if logN <= 0 { // unreachable
-		return nil, fmt.Errorf("invalid scrypt work factor: %v", logN)
-	}
-
-	salt = append([]byte(scryptLabel), salt...)
-	k, err := scrypt.Key(i.password, salt, 1<<logN, 8, 1, chacha20poly1305.KeySize)
-	if err != nil { // unreachable
-		return nil, fmt.Errorf("failed to generate scrypt hash: %v", err)
+		return nil, err
 	}
 
 	// This AEAD is not robust, so an attacker could craft a message that
@@ -0,0 +1,150 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"filippo.io/age/internal/format"
+)
+
+// A header signature is an Ed25519 signature by the sender over the header and
+// the payload nonce, stored in a stanza of type "signature" with the public
+// key as its argument. It must be the last stanza, and it covers all the
+// others. It's not passed to the identities, and versions of age that don't
+// support it ignore it, except for passphrase-encrypted files, which they
+// refuse to decrypt, since the scrypt stanza is required to be the only one.
+//
+// The signed message is signatureLabel, a zero byte, the SHA-256 hash of the
+// header without the signature stanza and the MAC, as MarshalWithoutMAC would
+// encode it, and the payload nonce.
+const signatureStanzaType = "signature"
+
+const signatureLabel = "age-encryption.org/v1/signature"
+
+// signedHeaderHash returns the hash of hdr as covered by the signature, that
+// is, without the signature stanza, if it's the last one, and the MAC.
+func signedHeaderHash(hdr *format.Header) ([]byte, error) {
+	stanzas := hdr.Recipients
+	if n := len(stanzas); n > 0 && stanzas[n-1].Type == signatureStanzaType {
+		stanzas = stanzas[:n-1]
+	}
+	h := sha256.New()
+	unsigned := &format.Header{Version: hdr.Version, Recipients: stanzas}
+	if err := unsigned.MarshalWithoutMAC(h); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func signatureMessage(hdrHash, nonce []byte) []byte {
+	msg := make([]byte, 0, len(signatureLabel)+1+len(hdrHash)+len(nonce))
+	msg = append(msg, signatureLabel...)
+	msg = append(msg, 0)
+	msg = append(msg, hdrHash...)
+	return append(msg, nonce...)
+}
+
+// signHeader adds a signature stanza to hdr, and recomputes the MAC.
+func signHeader(hdr *format.Header, fileKey, nonce []byte, key ed25519.PrivateKey) error {
+	if len(key) != ed25519.PrivateKeySize {
+		return errors.New("invalid Ed25519 signing key")
+	}
+	hdrHash, err := signedHeaderHash(hdr)
+	if err != nil {
+		return err
+	}
+	pub := key.Public().(ed25519.PublicKey)
+	hdr.Recipients = append(hdr.Recipients, &format.Stanza{
+		Type: signatureStanzaType,
+		Args: []string{format.EncodeToString(pub)},
+		Body: ed25519.Sign(key, signatureMessage(hdrHash, nonce)),
+	})
+	mac, err := headerMAC(fileKey, hdr)
+	if err != nil {
+		return fmt.Errorf("failed to compute header MAC: %v", err)
+	}
+	hdr.MAC = mac
+	return nil
+}
+
+// verifySignature checks the signature stanza of hdr, if any, and returns the
+// public key that signed it, or nil if hdr is not signed. hdrHash is the
+// result of signedHeaderHash, or nil to compute it from hdr.
+func verifySignature(hdr *format.Header, hdrHash, nonce []byte) (ed25519.PublicKey, error) {
+	var s *format.Stanza
+	for i, r := range hdr.Recipients {
+		if r.Type != signatureStanzaType {
+			continue
+		}
+		if s != nil {
+			return nil, errors.New("multiple signature stanzas")
+		}
+		if i != len(hdr.Recipients)-1 {
+			return nil, errors.New("signature stanza is not the last stanza")
+		}
+		s = r
+	}
+	if s == nil {
+		return nil, nil
+	}
+	if len(s.Args) != 1 {
+		return nil, errors.New("invalid signature stanza")
+	}
+	pub, err := format.DecodeString(s.Args[0])
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid signature stanza: malformed public key")
+	}
+	if len(s.Body) != ed25519.SignatureSize {
+		return nil, errors.New("invalid signature stanza: malformed signature")
+	}
+	if hdrHash == nil {
+		hdrHash, err = signedHeaderHash(hdr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !ed25519.Verify(pub, signatureMessage(hdrHash, nonce), s.Body) {
+		return nil, ErrBadSignature
+	}
+	return pub, nil
+}
+
+// VerifySigner reads the header and payload nonce of the age file from src,
+// and checks that it was signed by signer with Options.SigningKey. It returns
+// ErrNotSigned if the file is not signed, ErrWrongSigner if it was signed by a
+// different key, and ErrBadSignature if the signature is invalid.
+//
+// VerifySigner doesn't need an identity, and doesn't unwrap the file key or
+// check the header MAC, so it can be used by anyone who knows the public key
+// of the sender. Since any recipient knows the file key, it doesn't prove
+// that the payload was not replaced by another recipient. See
+// Options.SigningKey for details.
+func VerifySigner(src io.Reader, signer ed25519.PublicKey) error {
+	hdr, payload, err := format.Parse(src)
+	if err != nil {
+		return fmt.Errorf("failed to read header: %w", headerError(err))
+	}
+	nonce := make([]byte, streamNonceSize)
+	if _, err := io.ReadFull(payload, nonce); err != nil {
+		return fmt.Errorf("failed to read nonce: %w", err)
+	}
+	pub, err := verifySignature(hdr, nil, nonce)
+	if err != nil {
+		return err
+	}
+	if pub == nil {
+		return ErrNotSigned
+	}
+	if !bytes.Equal(pub, signer) {
+		return ErrWrongSigner
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stream
+
+import (
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// A chunkJob is a chunk being sealed or opened by its own goroutine. Each
+// goroutine only runs the AEAD, and exits when done is closed, so abandoning
+// a Writer or Reader doesn't leak goroutines.
+type chunkJob struct {
+	in, out []byte
+	nonce   [chacha20poly1305.NonceSize]byte
+	last    bool
+	done    chan struct{}
+	err     error
+
+	// trailing is set if the chunk was read as a full chunk followed by more
+	// data, but it turned out to be the last one.
+	trailing bool
+}
+
+// SetConcurrency sets the maximum number of chunks that are encrypted
+// concurrently. If n is greater than one, each full chunk is sealed by its own
+// goroutine, and the chunks are written to the destination in order, by the
+// goroutine calling Write or Close, as they complete. Up to n chunks are
+// buffered. The default is one, which seals each chunk when it's flushed.
+//
+// The output is the same for any concurrency.
+func (w *Writer) SetConcurrency(n int) {
+	w.workers = n
+}
+
+func (w *Writer) flushChunkConcurrent(last bool) error {
+	j := &chunkJob{nonce: w.nonce, last: last, done: make(chan struct{})}
+	if n := len(w.free); n > 0 {
+		j.in, w.free = w.free[n-1], w.free[:n-1]
+	} else {
+		j.in = make([]byte, 0, len(w.buf))
+	}
+	j.in = append(j.in[:0], w.unwritten...)
+	w.unwritten = w.buf[:0]
+	if last {
+		setLastChunkFlag(&j.nonce)
+	}
+	incNonce(&w.nonce)
+	go func() {
+		j.out = w.a.Seal(j.in[:0], j.nonce[:], j.in, nil)
+		close(j.done)
+	}()
+	w.pending = append(w.pending, j)
+
+	for len(w.pending) >= w.workers || last && len(w.pending) > 0 {
+		j := w.pending[0]
+		w.pending = w.pending[1:]
+		<-j.done
+		_, err := w.dst.Write(j.out)
+		w.free = append(w.free, j.out)
+		if err != nil {
+			return err
+		}
+		w.processed += int64(len(j.out) - w.a.Overhead())
+		if w.progress != nil {
+			w.progress(w.processed)
+		}
+	}
+	return nil
+}
+
+// SetConcurrency sets the maximum number of chunks that are decrypted
+// concurrently. If n is greater than one, Read reads up to n chunks ahead of
+// the caller, and authenticates and decrypts each of them in its own
+// goroutine. Chunks are still returned in order, and errors are returned at
+// the same point in the stream as they would be without concurrency. The
+// default is one, which decrypts each chunk when it's needed.
+//
+// SetConcurrency has no effect on Readers returned by NewDelimitedReader.
+func (r *Reader) SetConcurrency(n int) {
+	r.workers = n
+}
+
+// readChunkConcurrent is like readChunk, for Readers with SetConcurrency.
+func (r *Reader) readChunkConcurrent() (last bool, err error) {
+	for r.srcErr == nil && (len(r.pending) == 0 || len(r.pending) < r.workers) {
+		r.readAhead()
+	}
+	if len(r.pending) == 0 {
+		return false, r.srcErr
+	}
+
+	j := r.pending[0]
+	r.pending = r.pending[1:]
+	<-j.done
+	r.free = append(r.free, j.in)
+	if j.err != nil {
+		return false, j.err
+	}
+	// unread is backed by buf, which is free now that unread is empty, so
+	// replace it with the buffer of the chunk.
+	r.free = append(r.free, r.buf[:0])
+	r.buf = j.out[:cap(j.out)]
+	r.unread = j.out
+	r.trailing = j.trailing
+	return j.last, nil
+}
+
+// readAhead reads the next chunk from r.src. Since a chunk can be the last
+// one even if it's full, a full chunk is held until the next read shows
+// whether it's followed by more data. Read errors are stored in r.srcErr, and
+// returned after the pending chunks.
+func (r *Reader) readAhead() {
+	var in []byte
+	if n := len(r.free); n > 0 {
+		in, r.free = r.free[n-1], r.free[:n-1]
+	} else {
+		in = make([]byte, 0, len(r.buf))
+	}
+	in = in[:len(r.buf)]
+	n, err := io.ReadFull(r.src, in)
+	switch {
+	case err == io.EOF:
+		if r.held == nil {
+			// A message can't end without a marked chunk.
+			r.srcErr = io.ErrUnexpectedEOF
+			return
+		}
+		r.dispatch(r.held, true)
+		r.held = nil
+		r.srcErr = io.EOF
+	case err == io.ErrUnexpectedEOF:
+		if r.held != nil {
+			r.dispatch(r.held, false)
+			r.held = nil
+		}
+		// The last chunk can be short, but not empty unless it's the first and
+		// only chunk.
+		if !nonceIsZero(&r.nonce) && n == r.a.Overhead() {
+			r.srcErr = ErrEmptyLastChunk
+			return
+		}
+		r.dispatch(in[:n], true)
+		r.srcErr = io.EOF
+	case err != nil:
+		r.srcErr = err
+	default:
+		if r.held != nil {
+			r.dispatch(r.held, false)
+		}
+		r.held = in
+	}
+}
+
+func (r *Reader) dispatch(in []byte, last bool) {
+	j := &chunkJob{in: in, nonce: r.nonce, last: last, done: make(chan struct{})}
+	if n := len(r.free); n > 0 {
+		j.out, r.free = r.free[n-1], r.free[:n-1]
+	} else {
+		j.out = make([]byte, 0, len(r.buf))
+	}
+	if last {
+		setLastChunkFlag(&j.nonce)
+	}
+	incNonce(&r.nonce)
+	go func() {
+		defer close(j.done)
+		out, err := r.a.Open(j.out[:0], j.nonce[:], j.in, nil)
+		if err != nil && !j.last {
+			// Check if this was a full-length final chunk followed by
+			// trailing data, which Read reports after returning the chunk,
+			// like readChunk.
+			setLastChunkFlag(&j.nonce)
+			out, err = r.a.Open(j.out[:0], j.nonce[:], j.in, nil)
+			j.last, j.trailing = err == nil, err == nil
+		}
+		if err != nil {
+			j.err = ErrInvalidChunk
+			return
+		}
+		j.out = out
+	}()
+	r.pending = append(r.pending, j)
+}
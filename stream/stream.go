@@ -0,0 +1,635 @@
+// Copyright 2019 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package stream implements the variant of the STREAM chunked encryption
+// scheme used for the payload of age files.
+//
+// The plaintext is split into chunks of ChunkSize bytes, and each chunk is
+// encrypted with ChaCha20-Poly1305 under a 96-bit nonce made of an 88-bit
+// big-endian chunk counter and a final byte that is 0x01 for the last chunk and
+// 0x00 otherwise. Only the last chunk may be shorter than ChunkSize, and it
+// may be empty only if it's the only chunk. Truncation and reordering of the
+// chunks are detected as authentication failures.
+//
+// The constructors with a Size suffix use a different chunk size, up to
+// MaxChunkSize. The chunk size is not authenticated by the stream itself, and
+// must be the same for encryption and decryption, so applications need to
+// record it out of band. age stores it in the header.
+//
+// The package can be used independently of the age header format. The key
+// must be KeySize bytes, and must never be used to encrypt more than one
+// stream, since the nonces are deterministic. age derives a fresh key for
+// each file from the file key and a random nonce with HKDF-SHA-256.
+//
+// Streams are encrypted sequentially by Writer, or in any order by
+// ChunkSealer, and decrypted sequentially by Reader, or with random access by
+// ReaderAt, which can be wrapped in an io.SectionReader to implement
+// io.Seeker. Writer and Reader can also process multiple chunks concurrently,
+// while still reading and writing them in order, with SetConcurrency.
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/poly1305"
+)
+
+// ChunkSize is the default size of a plaintext chunk.
+const ChunkSize = 64 * 1024
+
+// MaxChunkSize is the largest chunk size accepted by the constructors with a
+// Size suffix.
+const MaxChunkSize = 16 * 1024 * 1024
+
+// KeySize is the size of the key of a stream.
+const KeySize = chacha20poly1305.KeySize
+
+// Errors returned by Reader and ReaderAt. A stream that ends at a chunk
+// boundary, without a chunk marked as the last one, is reported as
+// io.ErrUnexpectedEOF instead.
+var (
+	// ErrInvalidChunk is returned when a chunk fails to authenticate, because
+	// the stream is corrupted, truncated in the middle of a chunk, or
+	// encrypted with a different key or chunk size.
+	ErrInvalidChunk = errors.New("failed to decrypt and authenticate payload chunk")
+
+	// ErrEmptyLastChunk is returned when the stream ends with an empty chunk
+	// after a full one, which is not allowed.
+	ErrEmptyLastChunk = errors.New("last chunk is empty, try age v1.0.0, and please consider reporting this")
+
+	// ErrTrailingData is returned by Reader if there is more data after the
+	// chunk marked as the last one.
+	ErrTrailingData = errors.New("trailing data after end of encrypted file")
+)
+
+// A Reader decrypts a stream sequentially. Each chunk is authenticated
+// before any of its plaintext is returned, but an attacker can cause the
+// stream to fail at any chunk, so the plaintext should not be acted upon
+// before Read returns io.EOF.
+type Reader struct {
+	a   cipher.AEAD
+	src io.Reader
+
+	unread []byte // decrypted but unread data, backed by buf
+	buf    []byte // chunk size plus tag size
+
+	err   error
+	nonce [chacha20poly1305.NonceSize]byte
+
+	// br and delim are set for Readers returned by NewDelimitedReader.
+	br    *bufio.Reader
+	delim []byte
+
+	progress  func(processedBytes int64)
+	processed int64
+
+	// workers, pending, held, free, srcErr, and trailing are used by
+	// readChunkConcurrent. See SetConcurrency.
+	workers  int
+	pending  []*chunkJob
+	held     []byte
+	free     [][]byte
+	srcErr   error
+	trailing bool
+}
+
+const (
+	encChunkSize  = ChunkSize + poly1305.TagSize
+	lastChunkFlag = 0x01
+)
+
+// NewReader returns a Reader that decrypts the stream read from src, which
+// must end at the end of the stream. Any trailing data is an error.
+func NewReader(key []byte, src io.Reader) (*Reader, error) {
+	return NewReaderSize(key, src, ChunkSize)
+}
+
+// NewReaderSize is like NewReader, but for a stream encrypted with chunks of
+// chunkSize bytes.
+func NewReaderSize(key []byte, src io.Reader, chunkSize int) (*Reader, error) {
+	if err := checkChunkSize(chunkSize); err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{
+		a:   aead,
+		src: src,
+		buf: make([]byte, chunkSize+poly1305.TagSize),
+	}, nil
+}
+
+func checkChunkSize(chunkSize int) error {
+	if chunkSize < 1 || chunkSize > MaxChunkSize {
+		return fmt.Errorf("stream: invalid chunk size %d", chunkSize)
+	}
+	return nil
+}
+
+// NewDelimitedReader returns a Reader that decrypts a STREAM from src, which
+// might be followed by more data, as long as that data starts with delim. The
+// end of the STREAM is found by trying to authenticate the final chunk at each
+// position where delim appears, so src is read exactly up to the end of the
+// STREAM.
+//
+// src must have a buffer of at least ChunkSize + 16 + len(delim) bytes.
+func NewDelimitedReader(key []byte, src *bufio.Reader, delim []byte) (*Reader, error) {
+	if src.Size() < encChunkSize+len(delim) {
+		return nil, errors.New("stream: buffer too small for delimited reader")
+	}
+	r, err := NewReader(key, src)
+	if err != nil {
+		return nil, err
+	}
+	r.br = src
+	r.delim = delim
+	return r, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if len(r.unread) > 0 {
+		n := copy(p, r.unread)
+		r.unread = r.unread[n:]
+		return n, nil
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	last, err := r.readChunk()
+	if err != nil {
+		r.err = err
+		return 0, err
+	}
+	r.processed += int64(len(r.unread))
+	if r.progress != nil {
+		r.progress(r.processed)
+	}
+
+	n := copy(p, r.unread)
+	r.unread = r.unread[n:]
+
+	if last && r.br != nil {
+		// Any following data belongs to whatever comes after the STREAM.
+		r.err = io.EOF
+	} else if last && r.trailing {
+		// readChunkConcurrent already read past the full-length final chunk.
+		r.err = ErrTrailingData
+	} else if last {
+		// Ensure there is an EOF after the last chunk as expected. In other
+		// words, check for trailing data after a full-length final chunk.
+		// Hopefully, the underlying reader supports returning EOF even if it
+		// had previously returned an EOF to ReadFull.
+		if _, err := r.src.Read(make([]byte, 1)); err == nil {
+			r.err = ErrTrailingData
+		} else if err != io.EOF {
+			r.err = fmt.Errorf("non-EOF error reading after end of encrypted file: %w", err)
+		} else {
+			r.err = io.EOF
+		}
+	}
+
+	return n, nil
+}
+
+// SetProgressFunc sets a function that is called after each chunk is
+// decrypted and authenticated, with the total number of plaintext bytes
+// decrypted so far.
+func (r *Reader) SetProgressFunc(f func(processedBytes int64)) {
+	r.progress = f
+}
+
+// readChunk reads the next chunk of ciphertext from r.src and makes it available
+// in r.unread. last is true if the chunk was marked as the end of the message.
+// readChunk must not be called again after returning a last chunk or an error.
+func (r *Reader) readChunk() (last bool, err error) {
+	if len(r.unread) != 0 {
+		panic("stream: internal error: readChunk called with dirty buffer")
+	}
+	if r.br != nil {
+		return r.readDelimitedChunk()
+	}
+	if r.workers > 1 || len(r.pending) > 0 || r.held != nil || r.srcErr != nil {
+		return r.readChunkConcurrent()
+	}
+
+	in := r.buf
+	n, err := io.ReadFull(r.src, in)
+	switch {
+	case err == io.EOF:
+		// A message can't end without a marked chunk. This message is truncated.
+		return false, io.ErrUnexpectedEOF
+	case err == io.ErrUnexpectedEOF:
+		// The last chunk can be short, but not empty unless it's the first and
+		// only chunk.
+		if !nonceIsZero(&r.nonce) && n == r.a.Overhead() {
+			return false, ErrEmptyLastChunk
+		}
+		in = in[:n]
+		last = true
+		setLastChunkFlag(&r.nonce)
+	case err != nil:
+		return false, err
+	}
+
+	outBuf := make([]byte, 0, len(r.buf)-r.a.Overhead())
+	out, err := r.a.Open(outBuf, r.nonce[:], in, nil)
+	if err != nil && !last {
+		// Check if this was a full-length final chunk.
+		last = true
+		setLastChunkFlag(&r.nonce)
+		out, err = r.a.Open(outBuf, r.nonce[:], in, nil)
+	}
+	if err != nil {
+		return false, ErrInvalidChunk
+	}
+
+	incNonce(&r.nonce)
+	r.unread = r.buf[:copy(r.buf, out)]
+	return last, nil
+}
+
+// readDelimitedChunk is like readChunk, but for delimited Readers. It peeks at
+// the next chunk and delimiter, and only consumes the bytes of the chunk.
+func (r *Reader) readDelimitedChunk() (last bool, err error) {
+	encChunkSize := len(r.buf)
+	in, err := r.br.Peek(encChunkSize + len(r.delim))
+	atEOF := err == io.EOF
+	if err != nil && !atEOF {
+		return false, err
+	}
+	if len(in) == 0 {
+		return false, io.ErrUnexpectedEOF
+	}
+
+	if len(in) >= encChunkSize {
+		out, err := r.a.Open(r.buf[:0], r.nonce[:], in[:encChunkSize], nil)
+		if err == nil {
+			r.br.Discard(encChunkSize)
+			incNonce(&r.nonce)
+			r.unread = out
+			return false, nil
+		}
+	}
+
+	// Try the final chunk ending at each occurrence of the delimiter, and at
+	// the end of the input. The chunk can only be empty if it's the first one.
+	minSize := r.a.Overhead()
+	if !nonceIsZero(&r.nonce) {
+		minSize++
+	}
+	setLastChunkFlag(&r.nonce)
+	for n := minSize; n <= encChunkSize && n <= len(in); n++ {
+		if n == len(in) && !atEOF {
+			continue
+		}
+		if n < len(in) && !bytes.HasPrefix(in[n:], r.delim) {
+			continue
+		}
+		out, err := r.a.Open(r.buf[:0], r.nonce[:], in[:n], nil)
+		if err == nil {
+			r.br.Discard(n)
+			r.unread = out
+			return true, nil
+		}
+	}
+	return false, ErrInvalidChunk
+}
+
+func incNonce(nonce *[chacha20poly1305.NonceSize]byte) {
+	for i := len(nonce) - 2; i >= 0; i-- {
+		nonce[i]++
+		if nonce[i] != 0 {
+			break
+		} else if i == 0 {
+			// The counter is 88 bits, this is unreachable.
+			panic("stream: chunk counter wrapped around")
+		}
+	}
+}
+
+func setLastChunkFlag(nonce *[chacha20poly1305.NonceSize]byte) {
+	nonce[len(nonce)-1] = lastChunkFlag
+}
+
+func nonceIsZero(nonce *[chacha20poly1305.NonceSize]byte) bool {
+	return *nonce == [chacha20poly1305.NonceSize]byte{}
+}
+
+// A Writer encrypts a stream sequentially. Close must be called to encrypt
+// and write the last chunk.
+type Writer struct {
+	a         cipher.AEAD
+	dst       io.Writer
+	unwritten []byte // backed by buf
+	buf       []byte // chunk size plus tag size
+	chunkSize int
+	nonce     [chacha20poly1305.NonceSize]byte
+	err       error
+
+	progress  func(processedBytes int64)
+	processed int64
+
+	// workers, pending, and free are used by flushChunkConcurrent. See
+	// SetConcurrency.
+	workers int
+	pending []*chunkJob
+	free    [][]byte
+}
+
+// NewWriter returns a Writer that writes the encrypted stream to dst.
+func NewWriter(key []byte, dst io.Writer) (*Writer, error) {
+	return NewWriterSize(key, dst, ChunkSize)
+}
+
+// NewWriterSize is like NewWriter, but encrypts the stream in chunks of
+// chunkSize bytes. It must be decrypted with the same chunk size.
+func NewWriterSize(key []byte, dst io.Writer, chunkSize int) (*Writer, error) {
+	if err := checkChunkSize(chunkSize); err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{
+		a:         aead,
+		dst:       dst,
+		buf:       make([]byte, chunkSize+poly1305.TagSize),
+		chunkSize: chunkSize,
+	}
+	w.unwritten = w.buf[:0]
+	return w, nil
+}
+
+func (w *Writer) Write(p []byte) (n int, err error) {
+	// TODO: consider refactoring with a bytes.Buffer.
+	if w.err != nil {
+		return 0, w.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	total := len(p)
+	for len(p) > 0 {
+		freeBuf := w.buf[len(w.unwritten):w.chunkSize]
+		n := copy(freeBuf, p)
+		p = p[n:]
+		w.unwritten = w.unwritten[:len(w.unwritten)+n]
+
+		if len(w.unwritten) == w.chunkSize && len(p) > 0 {
+			if err := w.flushChunk(notLastChunk); err != nil {
+				w.err = err
+				return 0, err
+			}
+		}
+	}
+	return total, nil
+}
+
+// SetProgressFunc sets a function that is called after each chunk is
+// encrypted and written, with the total number of plaintext bytes encrypted
+// so far.
+func (w *Writer) SetProgressFunc(f func(processedBytes int64)) {
+	w.progress = f
+}
+
+// Close flushes the last chunk. It does not close the underlying Writer.
+func (w *Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+
+	w.err = w.flushChunk(lastChunk)
+	if w.err != nil {
+		return w.err
+	}
+
+	w.err = errors.New("stream.Writer is already closed")
+	return nil
+}
+
+const (
+	lastChunk    = true
+	notLastChunk = false
+)
+
+func (w *Writer) flushChunk(last bool) error {
+	if !last && len(w.unwritten) != w.chunkSize {
+		panic("stream: internal error: flush called with partial chunk")
+	}
+	if w.workers > 1 || len(w.pending) > 0 {
+		return w.flushChunkConcurrent(last)
+	}
+
+	if last {
+		setLastChunkFlag(&w.nonce)
+	}
+	n := len(w.unwritten)
+	buf := w.a.Seal(w.buf[:0], w.nonce[:], w.unwritten, nil)
+	_, err := w.dst.Write(buf)
+	w.unwritten = w.buf[:0]
+	incNonce(&w.nonce)
+	if err != nil {
+		return err
+	}
+	w.processed += int64(n)
+	if w.progress != nil {
+		w.progress(w.processed)
+	}
+	return nil
+}
+
+// A ChunkSealer encrypts individual chunks of a STREAM, which can be sealed in
+// any order and concurrently. The caller is responsible for sealing each chunk
+// exactly once, and for setting last only for the final chunk.
+type ChunkSealer struct {
+	a         cipher.AEAD
+	chunkSize int
+}
+
+// NewChunkSealer returns a ChunkSealer for the stream with the given key.
+func NewChunkSealer(key []byte) (*ChunkSealer, error) {
+	return NewChunkSealerSize(key, ChunkSize)
+}
+
+// NewChunkSealerSize is like NewChunkSealer, but for a stream with chunks of
+// chunkSize bytes.
+func NewChunkSealerSize(key []byte, chunkSize int) (*ChunkSealer, error) {
+	if err := checkChunkSize(chunkSize); err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return &ChunkSealer{a: aead, chunkSize: chunkSize}, nil
+}
+
+// EncryptedChunkSize is the size of a full encrypted chunk with the default
+// chunk size, which is ChunkSize plus the 16 bytes of the Poly1305 tag.
+const EncryptedChunkSize = encChunkSize
+
+// Seal appends the encryption of the chunk with the given index to dst, and
+// returns the updated slice. p must be a full chunk, unless last is true, in
+// which case it can be shorter, and empty only if index is zero.
+func (s *ChunkSealer) Seal(dst, p []byte, index uint64, last bool) []byte {
+	if len(p) > s.chunkSize || !last && len(p) != s.chunkSize || last && len(p) == 0 && index != 0 {
+		panic("stream: invalid chunk size")
+	}
+	var nonce [chacha20poly1305.NonceSize]byte
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:len(nonce)-1], index)
+	if last {
+		setLastChunkFlag(&nonce)
+	}
+	return s.a.Seal(dst, nonce[:], p, nil)
+}
+
+// A ReaderAt decrypts a STREAM of known length with random access. The final
+// chunk is authenticated by NewReaderAt, so that truncation is detected before
+// any data is returned, and every other chunk is authenticated when read.
+//
+// A ReaderAt is safe for concurrent use.
+type ReaderAt struct {
+	a         cipher.AEAD
+	src       io.ReaderAt
+	size      int64 // plaintext size
+	chunkSize int
+
+	chunks int64 // number of chunks, including the final one
+
+	mu       sync.Mutex
+	cached   int64 // index of the chunk in buf, or -1
+	cacheBuf []byte
+}
+
+// NewReaderAt returns a ReaderAt that decrypts the STREAM of encSize bytes
+// read from src. To seek in the plaintext, wrap it with
+// io.NewSectionReader(r, 0, r.Size()).
+func NewReaderAt(key []byte, src io.ReaderAt, encSize int64) (*ReaderAt, error) {
+	return NewReaderAtSize(key, src, encSize, ChunkSize)
+}
+
+// NewReaderAtSize is like NewReaderAt, but for a stream encrypted with chunks
+// of chunkSize bytes.
+func NewReaderAtSize(key []byte, src io.ReaderAt, encSize int64, chunkSize int) (*ReaderAt, error) {
+	if err := checkChunkSize(chunkSize); err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	encChunkSize := int64(chunkSize + aead.Overhead())
+	if encSize < int64(aead.Overhead()) {
+		return nil, errors.New("encrypted payload too short")
+	}
+	chunks := (encSize + encChunkSize - 1) / encChunkSize
+	lastSize := encSize - (chunks-1)*encChunkSize
+	if lastSize < int64(aead.Overhead()) {
+		return nil, errors.New("encrypted payload has a truncated final chunk")
+	}
+	if lastSize == int64(aead.Overhead()) && chunks > 1 {
+		return nil, ErrEmptyLastChunk
+	}
+	r := &ReaderAt{
+		a:         aead,
+		src:       src,
+		size:      encSize - chunks*int64(aead.Overhead()),
+		chunkSize: chunkSize,
+		chunks:    chunks,
+		cached:    -1,
+		cacheBuf:  make([]byte, 0, chunkSize),
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.chunk(chunks - 1); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Size returns the size of the plaintext.
+func (r *ReaderAt) Size() int64 {
+	return r.size
+}
+
+// chunk returns the plaintext of the chunk at index, which is only valid until
+// the next call. r.mu must be held.
+func (r *ReaderAt) chunk(index int64) ([]byte, error) {
+	if r.cached == index {
+		return r.cacheBuf, nil
+	}
+	r.cached = -1
+
+	encChunkSize := r.chunkSize + r.a.Overhead()
+	in := make([]byte, encChunkSize)
+	off := index * int64(encChunkSize)
+	n, err := r.src.ReadAt(in, off)
+	last := index == r.chunks-1
+	if last && err == io.EOF {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !last && n != encChunkSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	in = in[:n]
+
+	var nonce [chacha20poly1305.NonceSize]byte
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:len(nonce)-1], uint64(index))
+	if last {
+		setLastChunkFlag(&nonce)
+	}
+	out, err := r.a.Open(r.cacheBuf[:0], nonce[:], in, nil)
+	if err != nil {
+		return nil, ErrInvalidChunk
+	}
+	r.cacheBuf = out
+	r.cached = index
+	return out, nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *ReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for len(p) > 0 && off < r.size {
+		index := off / int64(r.chunkSize)
+		plaintext, err := r.chunk(index)
+		if err != nil {
+			return n, err
+		}
+		c := copy(p, plaintext[off-index*int64(r.chunkSize):])
+		p = p[c:]
+		n += c
+		off += int64(c)
+	}
+	if len(p) > 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,444 @@
+// Copyright 2019 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stream_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log"
+	"testing"
+
+	"filippo.io/age/stream"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const cs = stream.ChunkSize
+
+func TestRoundTrip(t *testing.T) {
+	for _, stepSize := range []int{512, 600, 1000, cs} {
+		for _, length := range []int{0, 1000, cs, cs + 100} {
+			t.Run(fmt.Sprintf("len=%d,step=%d", length, stepSize),
+				func(t *testing.T) { testRoundTrip(t, stepSize, length) })
+		}
+	}
+}
+
+func testRoundTrip(t *testing.T, stepSize, length int) {
+	src := make([]byte, length)
+	if _, err := rand.Read(src); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := stream.NewWriter(key, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+	for n < length {
+		b := length - n
+		if b > stepSize {
+			b = stepSize
+		}
+		nn, err := w.Write(src[n : n+b])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nn != b {
+			t.Errorf("Write returned %d, expected %d", nn, b)
+		}
+		n += nn
+
+		nn, err = w.Write(src[n:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nn != 0 {
+			t.Errorf("Write returned %d, expected 0", nn)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Error("Close returned an error:", err)
+	}
+
+	t.Logf("buffer size: %d", buf.Len())
+
+	r, err := stream.NewReader(key, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n = 0
+	readBuf := make([]byte, stepSize)
+	for n < length {
+		nn, err := r.Read(readBuf)
+		if err != nil {
+			t.Fatalf("Read error at index %d: %v", n, err)
+		}
+
+		if !bytes.Equal(readBuf[:nn], src[n:n+nn]) {
+			t.Errorf("wrong data at indexes %d - %d", n, n+nn)
+		}
+
+		n += nn
+	}
+}
+
+func TestProgress(t *testing.T) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	buf := &bytes.Buffer{}
+	w, err := stream.NewWriter(key, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wrote []int64
+	w.SetProgressFunc(func(n int64) { wrote = append(wrote, n) })
+	if _, err := w.Write(make([]byte, 2*cs+10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(wrote) != fmt.Sprint([]int64{cs, 2 * cs, 2*cs + 10}) {
+		t.Errorf("unexpected Writer progress: %v", wrote)
+	}
+
+	r, err := stream.NewReader(key, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var read []int64
+	r.SetProgressFunc(func(n int64) { read = append(read, n) })
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(read) != fmt.Sprint(wrote) {
+		t.Errorf("unexpected Reader progress: %v", read)
+	}
+}
+
+func TestChunkSealer(t *testing.T) {
+	for _, length := range []int{0, 1000, cs, 3*cs + 100} {
+		key := make([]byte, chacha20poly1305.KeySize)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+		src := make([]byte, length)
+		if _, err := rand.Read(src); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := &bytes.Buffer{}
+		w, err := stream.NewWriter(key, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(src); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := stream.NewChunkSealer(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks := (length + cs - 1) / cs
+		if chunks == 0 {
+			chunks = 1
+		}
+		sealed := make([][]byte, chunks)
+		for i := chunks - 1; i >= 0; i-- {
+			end := (i + 1) * cs
+			if end > length {
+				end = length
+			}
+			sealed[i] = s.Seal(nil, src[i*cs:end], uint64(i), i == chunks-1)
+		}
+		if got := bytes.Join(sealed, nil); !bytes.Equal(got, buf.Bytes()) {
+			t.Errorf("length %d: ChunkSealer output differs from Writer", length)
+		}
+	}
+}
+
+func TestReaderAt(t *testing.T) {
+	for _, length := range []int{0, 1000, cs, 2 * cs, 3*cs + 100} {
+		key := make([]byte, chacha20poly1305.KeySize)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+		src := make([]byte, length)
+		if _, err := rand.Read(src); err != nil {
+			t.Fatal(err)
+		}
+		buf := &bytes.Buffer{}
+		w, err := stream.NewWriter(key, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(src); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		enc := buf.Bytes()
+
+		r, err := stream.NewReaderAt(key, bytes.NewReader(enc), int64(len(enc)))
+		if err != nil {
+			t.Fatalf("length %d: %v", length, err)
+		}
+		if r.Size() != int64(length) {
+			t.Errorf("length %d: Size() = %d", length, r.Size())
+		}
+		got, err := io.ReadAll(io.NewSectionReader(r, 0, r.Size()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, src) {
+			t.Errorf("length %d: wrong sequential data", length)
+		}
+		for _, off := range []int{0, 1, cs - 1, cs, cs + 1, length - 1} {
+			if off < 0 || off >= length {
+				continue
+			}
+			p := make([]byte, 200)
+			n, err := r.ReadAt(p, int64(off))
+			if n < len(p) && err != io.EOF || n == len(p) && err != nil {
+				t.Errorf("length %d, off %d: n = %d, err = %v", length, off, n, err)
+			}
+			if !bytes.Equal(p[:n], src[off:off+n]) {
+				t.Errorf("length %d, off %d: wrong data", length, off)
+			}
+		}
+		if _, err := r.ReadAt(make([]byte, 1), int64(length)); err != io.EOF {
+			t.Errorf("length %d: expected EOF at end, got %v", length, err)
+		}
+
+		if length > cs {
+			// Truncating at a chunk boundary must be detected upfront.
+			trunc := enc[:stream.EncryptedChunkSize]
+			if _, err := stream.NewReaderAt(key, bytes.NewReader(trunc), int64(len(trunc))); err == nil {
+				t.Errorf("length %d: truncation not detected", length)
+			}
+		}
+		corrupted := append([]byte{}, enc...)
+		corrupted[0] ^= 1
+		r, err = stream.NewReaderAt(key, bytes.NewReader(corrupted), int64(len(corrupted)))
+		if err == nil {
+			if _, err := r.ReadAt(make([]byte, 1), 0); err == nil {
+				t.Errorf("length %d: corruption not detected", length)
+			}
+		}
+	}
+}
+
+func TestChunkSize(t *testing.T) {
+	const size = 1000
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	for _, length := range []int{0, 1, size, 3*size + 100} {
+		src := make([]byte, length)
+		if _, err := rand.Read(src); err != nil {
+			t.Fatal(err)
+		}
+		buf := &bytes.Buffer{}
+		w, err := stream.NewWriterSize(key, buf, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(src); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		enc := buf.Bytes()
+		chunks := (length + size - 1) / size
+		if chunks == 0 {
+			chunks = 1
+		}
+		if len(enc) != length+chunks*16 {
+			t.Errorf("length %d: encrypted size %d, expected %d chunks", length, len(enc), chunks)
+		}
+
+		s, err := stream.NewChunkSealerSize(key, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sealed []byte
+		for i := 0; i < chunks; i++ {
+			end := (i + 1) * size
+			if end > length {
+				end = length
+			}
+			sealed = s.Seal(sealed, src[i*size:end], uint64(i), i == chunks-1)
+		}
+		if !bytes.Equal(sealed, enc) {
+			t.Errorf("length %d: ChunkSealer output differs from Writer", length)
+		}
+
+		r, err := stream.NewReaderSize(key, bytes.NewReader(enc), size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, src) {
+			t.Errorf("length %d: Reader failed: %v", length, err)
+		}
+		ra, err := stream.NewReaderAtSize(key, bytes.NewReader(enc), int64(len(enc)), size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := io.ReadAll(io.NewSectionReader(ra, 0, ra.Size())); err != nil || !bytes.Equal(got, src) {
+			t.Errorf("length %d: ReaderAt failed: %v", length, err)
+		}
+
+		if length > size {
+			r, err := stream.NewReader(key, bytes.NewReader(enc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadAll(r); err == nil {
+				t.Errorf("length %d: decrypted with the wrong chunk size", length)
+			}
+		}
+	}
+
+	for _, size := range []int{0, -1, stream.MaxChunkSize + 1} {
+		if _, err := stream.NewWriterSize(key, io.Discard, size); err == nil {
+			t.Errorf("chunk size %d was accepted", size)
+		}
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	const size = 1000
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	encrypt := func(src []byte, workers int) []byte {
+		buf := &bytes.Buffer{}
+		w, err := stream.NewWriterSize(key, buf, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.SetConcurrency(workers)
+		var progress int64
+		w.SetProgressFunc(func(n int64) { progress = n })
+		// Write in odd sizes to exercise the buffering.
+		for p := src; len(p) > 0; {
+			n := 777
+			if n > len(p) {
+				n = len(p)
+			}
+			if _, err := w.Write(p[:n]); err != nil {
+				t.Fatal(err)
+			}
+			p = p[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if progress != int64(len(src)) {
+			t.Errorf("progress is %d, expected %d", progress, len(src))
+		}
+		return buf.Bytes()
+	}
+	decrypt := func(enc []byte, workers int) ([]byte, error) {
+		r, err := stream.NewReaderSize(key, bytes.NewReader(enc), size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.SetConcurrency(workers)
+		return io.ReadAll(r)
+	}
+
+	for _, length := range []int{0, 1, size, 2 * size, 20*size + 100} {
+		src := make([]byte, length)
+		if _, err := rand.Read(src); err != nil {
+			t.Fatal(err)
+		}
+		expected := encrypt(src, 1)
+		for _, workers := range []int{2, 3, 8} {
+			enc := encrypt(src, workers)
+			if !bytes.Equal(enc, expected) {
+				t.Errorf("length %d, workers %d: output differs from sequential Writer", length, workers)
+			}
+			got, err := decrypt(enc, workers)
+			if err != nil || !bytes.Equal(got, src) {
+				t.Errorf("length %d, workers %d: Reader failed: %v", length, workers, err)
+			}
+
+			for name, damaged := range map[string][]byte{
+				"trailing":  append(append([]byte{}, enc...), 0),
+				"truncated": enc[:len(enc)-1],
+				"corrupted": append(append([]byte{}, enc[:len(enc)/2]...), append([]byte{enc[len(enc)/2] ^ 1}, enc[len(enc)/2+1:]...)...),
+			} {
+				if length == 0 && name == "truncated" {
+					continue
+				}
+				got, err := decrypt(damaged, workers)
+				seqGot, seqErr := decrypt(damaged, 1)
+				if err == nil || seqErr == nil || err.Error() != seqErr.Error() {
+					t.Errorf("length %d, workers %d: %s: got %v, sequential Reader returned %v",
+						length, workers, name, err, seqErr)
+				}
+				if !bytes.Equal(got, seqGot) {
+					t.Errorf("length %d, workers %d: %s: returned %d bytes, sequential Reader returned %d",
+						length, workers, name, len(got), len(seqGot))
+				}
+			}
+		}
+	}
+}
+
+func ExampleNewReaderAt() {
+	// The key must be random and used for a single stream.
+	key := make([]byte, stream.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatalf("Failed to generate key: %v", err)
+	}
+
+	encrypted := &bytes.Buffer{}
+	w, err := stream.NewWriter(key, encrypted)
+	if err != nil {
+		log.Fatalf("Failed to create stream: %v", err)
+	}
+	if _, err := io.WriteString(w, "Black lives matter."); err != nil {
+		log.Fatalf("Failed to write to stream: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		log.Fatalf("Failed to close stream: %v", err)
+	}
+
+	ra, err := stream.NewReaderAt(key, bytes.NewReader(encrypted.Bytes()), int64(encrypted.Len()))
+	if err != nil {
+		log.Fatalf("Failed to open stream: %v", err)
+	}
+	r := io.NewSectionReader(ra, 0, ra.Size())
+	if _, err := r.Seek(6, io.SeekStart); err != nil {
+		log.Fatalf("Failed to seek: %v", err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		log.Fatalf("Failed to read stream: %v", err)
+	}
+
+	fmt.Printf("%s\n", out)
+	// Output:
+	// lives matter.
+}
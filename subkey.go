@@ -0,0 +1,182 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"filippo.io/age/bech32"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const x25519SubkeyLabel = "age-encryption.org/v1/X25519-subkey"
+
+// Subkey returns the X25519Recipient for the subkey of r with the given label.
+//
+// Subkeys are derived without hardening: the subkey recipient is the master
+// public key multiplied by a scalar derived with HKDF from the label and the
+// master public key. This means anyone with the master recipient can derive
+// any subkey recipient, and the master identity can decrypt files encrypted
+// to any of them, given the labels (see [X25519Identity.WithSubkeyLabels]). Files encrypted to a subkey are regular
+// X25519 files, and don't reveal the label or the master public key.
+//
+// The label must be a non-empty UTF-8 string, such as "backups/2024" or "ci".
+func (r *X25519Recipient) Subkey(label string) (*X25519Recipient, error) {
+	tweak, err := x25519SubkeyTweak(r.theirPublicKey, label)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := curve25519.X25519(tweak, r.theirPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive subkey: %v", err)
+	}
+	return newX25519RecipientFromPoint(publicKey)
+}
+
+// X25519SubkeyIdentity is the identity corresponding to the X25519Recipient
+// returned by [X25519Recipient.Subkey]. It's made of the master X25519Identity
+// and the label.
+type X25519SubkeyIdentity struct {
+	master       *X25519Identity
+	label        string
+	tweak        []byte
+	ourPublicKey []byte
+}
+
+var _ Identity = &X25519SubkeyIdentity{}
+
+// Subkey returns the X25519SubkeyIdentity for the subkey of i with the given
+// label. See [X25519Recipient.Subkey] for details.
+func (i *X25519Identity) Subkey(label string) (*X25519SubkeyIdentity, error) {
+	tweak, err := x25519SubkeyTweak(i.ourPublicKey, label)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := curve25519.X25519(tweak, i.ourPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive subkey: %v", err)
+	}
+	return &X25519SubkeyIdentity{
+		master:       i,
+		label:        label,
+		tweak:        tweak,
+		ourPublicKey: publicKey,
+	}, nil
+}
+
+// WithSubkeyLabels returns an Identity that decrypts files encrypted to i, or
+// to any of its subkeys with the given labels.
+//
+// Since files encrypted to a subkey don't reveal the label, the master
+// identity can only decrypt them if it's told which labels to try.
+func (i *X25519Identity) WithSubkeyLabels(labels ...string) (Identity, error) {
+	ids := &x25519SubkeysIdentity{master: i}
+	for _, label := range labels {
+		sk, err := i.Subkey(label)
+		if err != nil {
+			return nil, err
+		}
+		ids.subkeys = append(ids.subkeys, sk)
+	}
+	return ids, nil
+}
+
+// x25519SubkeysIdentity is the Identity returned by
+// [X25519Identity.WithSubkeyLabels].
+type x25519SubkeysIdentity struct {
+	master  *X25519Identity
+	subkeys []*X25519SubkeyIdentity
+}
+
+func (i *x25519SubkeysIdentity) Unwrap(stanzas []*Stanza) ([]byte, error) {
+	return multiUnwrap(i.unwrap, stanzas)
+}
+
+func (i *x25519SubkeysIdentity) unwrap(block *Stanza) ([]byte, error) {
+	fileKey, err := i.master.unwrap(block)
+	for _, sk := range i.subkeys {
+		if !errors.Is(err, ErrIncorrectIdentity) {
+			break
+		}
+		fileKey, err = sk.unwrap(block)
+	}
+	return fileKey, err
+}
+
+// ParseX25519SubkeyIdentity returns a new X25519SubkeyIdentity from a Bech32
+// private key encoding with the "AGE-SECRET-KEY-SUB-1" prefix, which encodes
+// the master private key followed by the label.
+func ParseX25519SubkeyIdentity(s string) (*X25519SubkeyIdentity, error) {
+	t, k, err := bech32.Decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("malformed secret key: %v", err)
+	}
+	if t != "AGE-SECRET-KEY-SUB-" {
+		return nil, fmt.Errorf("malformed secret key: unknown type %q", t)
+	}
+	if len(k) <= curve25519.ScalarSize {
+		return nil, errors.New("malformed secret key: missing label")
+	}
+	master, err := newX25519IdentityFromScalar(k[:curve25519.ScalarSize])
+	if err != nil {
+		return nil, fmt.Errorf("malformed secret key: %v", err)
+	}
+	i, err := master.Subkey(string(k[curve25519.ScalarSize:]))
+	if err != nil {
+		return nil, fmt.Errorf("malformed secret key: %v", err)
+	}
+	return i, nil
+}
+
+func (i *X25519SubkeyIdentity) Unwrap(stanzas []*Stanza) ([]byte, error) {
+	return multiUnwrap(i.unwrap, stanzas)
+}
+
+func (i *X25519SubkeyIdentity) unwrap(block *Stanza) ([]byte, error) {
+	return x25519Unwrap(block, i.ourPublicKey, func(publicKey []byte) ([]byte, error) {
+		sharedSecret, err := curve25519.X25519(i.master.secretKey, publicKey)
+		if err != nil {
+			return nil, err
+		}
+		return curve25519.X25519(i.tweak, sharedSecret)
+	})
+}
+
+// Recipient returns the public X25519Recipient value corresponding to i.
+func (i *X25519SubkeyIdentity) Recipient() *X25519Recipient {
+	r := &X25519Recipient{}
+	r.theirPublicKey = i.ourPublicKey
+	return r
+}
+
+// Label returns the label the subkey was derived with.
+func (i *X25519SubkeyIdentity) Label() string {
+	return i.label
+}
+
+// String returns the Bech32 private key encoding of i.
+func (i *X25519SubkeyIdentity) String() string {
+	k := append(append([]byte{}, i.master.secretKey...), i.label...)
+	s, _ := bech32.Encode("AGE-SECRET-KEY-SUB-", k)
+	return strings.ToUpper(s)
+}
+
+func x25519SubkeyTweak(masterPublicKey []byte, label string) ([]byte, error) {
+	if label == "" || !utf8.ValidString(label) {
+		return nil, errors.New("invalid subkey label")
+	}
+	h := hkdf.New(sha256.New, []byte(label), masterPublicKey, []byte(x25519SubkeyLabel))
+	tweak := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(h, tweak); err != nil {
+		return nil, err
+	}
+	return tweak, nil
+}
@@ -0,0 +1,443 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package pluginsim simulates age plugins, to test plugin clients hermetically.
+//
+// A Simulator runs a script of Actions for each plugin session, either in
+// process, by setting Simulator.Connect as plugin.ClientUI.Connect, or as a
+// real plugin process, by calling Simulator.Main from TestMain in a test
+// binary that is installed as age-plugin-NAME.
+//
+// Scripts can follow the protocol, like the default WrapFileKeys and
+// UnwrapFileKeys actions, which echo the file key as the stanza body, or
+// inject faults, like closing the connection early, sending oversized or
+// malformed stanzas, or stalling until a test releases them. The simulated
+// plugins provide no security whatsoever.
+package pluginsim
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/internal/format"
+)
+
+// An Action is a step of a script, run in order for each session.
+type Action func(s *Session) error
+
+// A Session is a simulated plugin session.
+type Session struct {
+	// Name and Protocol are the plugin name and the state machine, such as
+	// "recipient-v1", requested by the client.
+	Name, Protocol string
+
+	// Phase1 are the stanzas sent by the client in phase 1, as read by
+	// ReadPhase1, excluding the final "done".
+	Phase1 []*age.Stanza
+
+	// Response is the client's response to the last command sent by Send.
+	Response *age.Stanza
+
+	sr     *format.StanzaReader
+	w      io.Writer
+	closed <-chan struct{}
+}
+
+func (s *Session) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// errStop is returned by an Action to end the session without an error.
+var errStop = errors.New("pluginsim: stop")
+
+// ReadStanza reads the next stanza sent by the client.
+func (s *Session) ReadStanza() (*age.Stanza, error) {
+	st, err := s.sr.ReadStanza()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from the client: %w", err)
+	}
+	return (*age.Stanza)(st), nil
+}
+
+// WriteStanza sends a stanza to the client, without reading a response.
+func (s *Session) WriteStanza(typ string, args []string, body []byte) error {
+	st := &format.Stanza{Type: typ, Args: args, Body: body}
+	if err := st.Marshal(s.w); err != nil {
+		return fmt.Errorf("failed to write to the client: %w", err)
+	}
+	return nil
+}
+
+// Send sends a command to the client, and reads its response into Response.
+func (s *Session) Send(typ string, args []string, body []byte) error {
+	if err := s.WriteStanza(typ, args, body); err != nil {
+		return err
+	}
+	r, err := s.ReadStanza()
+	if err != nil {
+		return err
+	}
+	s.Response = r
+	return nil
+}
+
+// sendOK is like Send, but fails if the response is not "ok".
+func (s *Session) sendOK(typ string, args []string, body []byte) error {
+	if err := s.Send(typ, args, body); err != nil {
+		return err
+	}
+	if s.Response.Type != "ok" {
+		return fmt.Errorf("client responded to %q with %q", typ, s.Response.Type)
+	}
+	return nil
+}
+
+// ReadPhase1 reads the stanzas sent by the client up to "done" into
+// Session.Phase1.
+func ReadPhase1() Action {
+	return func(s *Session) error {
+		for {
+			st, err := s.ReadStanza()
+			if err != nil {
+				return err
+			}
+			if st.Type == "done" {
+				return nil
+			}
+			s.Phase1 = append(s.Phase1, st)
+		}
+	}
+}
+
+// Send sends a command to the client, and reads its response.
+func Send(typ string, args []string, body []byte) Action {
+	return func(s *Session) error {
+		return s.Send(typ, args, body)
+	}
+}
+
+// Expect fails the session unless the response to the last command was of
+// type typ, such as "ok" or "fail".
+func Expect(typ string) Action {
+	return func(s *Session) error {
+		if s.Response == nil || s.Response.Type != typ {
+			return fmt.Errorf("expected a %q response, got %v", typ, s.Response)
+		}
+		return nil
+	}
+}
+
+// Done ends phase 2 with a "done" stanza.
+func Done() Action {
+	return func(s *Session) error {
+		return s.WriteStanza("done", nil, nil)
+	}
+}
+
+// Error sends an error command, such as "error internal", with message msg.
+func Error(args []string, msg string) Action {
+	return Send("error", args, []byte(msg))
+}
+
+// WrapFileKeys sends a recipient-stanza of type stanzaType for each
+// wrap-file-key stanza read in phase 1, with the file key itself as the body.
+func WrapFileKeys(stanzaType string) Action {
+	return func(s *Session) error {
+		var n int
+		for _, st := range s.Phase1 {
+			if st.Type != "wrap-file-key" {
+				continue
+			}
+			args := []string{strconv.Itoa(n), stanzaType}
+			if err := s.sendOK("recipient-stanza", args, st.Body); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	}
+}
+
+// UnwrapFileKeys sends a file-key command for each file with a stanza of type
+// stanzaType read in phase 1, with the stanza body as the file key.
+func UnwrapFileKeys(stanzaType string) Action {
+	return func(s *Session) error {
+		seen := make(map[string]bool)
+		for _, st := range s.Phase1 {
+			if st.Type != "recipient-stanza" || len(st.Args) < 2 || st.Args[1] != stanzaType {
+				continue
+			}
+			if seen[st.Args[0]] {
+				continue
+			}
+			seen[st.Args[0]] = true
+			if err := s.sendOK("file-key", []string{st.Args[0]}, st.Body); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Raw writes b to the client as is, for example to send a malformed or
+// truncated stanza.
+func Raw(b []byte) Action {
+	return func(s *Session) error {
+		if _, err := s.w.Write(b); err != nil {
+			return fmt.Errorf("failed to write to the client: %w", err)
+		}
+		return nil
+	}
+}
+
+// Giant sends a recipient-stanza for the first file with a body of size bytes,
+// to exceed the client's stanza limits. It doesn't wait for a response, since
+// the client is expected to abort the session.
+func Giant(size int) Action {
+	return func(s *Session) error {
+		return s.WriteStanza("recipient-stanza", []string{"0", "giant"}, make([]byte, size))
+	}
+}
+
+// EOF ends the session immediately, closing the connection as if the plugin
+// exited successfully, wherever the protocol is.
+func EOF() Action {
+	return func(s *Session) error {
+		return errStop
+	}
+}
+
+// Exit ends the session immediately, as if the plugin exited with an error.
+// err is returned by the Close method of the connection, and is not recorded
+// by Simulator.Err.
+func Exit(err error) Action {
+	return func(s *Session) error {
+		return &exitError{err}
+	}
+}
+
+type exitError struct{ err error }
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+// Delay pauses the session for d, or until the client closes the connection.
+func Delay(d time.Duration) Action {
+	return func(s *Session) error {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+			return nil
+		case <-s.closed:
+			return errStop
+		}
+	}
+}
+
+// Wait pauses the session until ch is closed, or the client closes the
+// connection. It makes slow responses deterministic, since the test decides
+// exactly when the plugin proceeds. It doesn't work across processes.
+func Wait(ch <-chan struct{}) Action {
+	return func(s *Session) error {
+		select {
+		case <-ch:
+			return nil
+		case <-s.closed:
+			return errStop
+		}
+	}
+}
+
+// Func runs f as an Action, for custom behavior.
+func Func(f func(s *Session) error) Action {
+	return f
+}
+
+// A Simulator runs the scripts registered with Handle for each session. It's
+// safe for concurrent use.
+type Simulator struct {
+	mu       sync.Mutex
+	scripts  map[string][]Action
+	sessions int
+	errs     []error
+}
+
+// New returns a Simulator with no scripts.
+func New() *Simulator {
+	return &Simulator{scripts: make(map[string][]Action)}
+}
+
+// Handle sets the script for the sessions of the plugin name with the state
+// machine protocol, such as "recipient-v1" or "identity-v1".
+func (sim *Simulator) Handle(name, protocol string, script ...Action) {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	sim.scripts[name+" "+protocol] = script
+}
+
+// HandleDefaults sets scripts that wrap and unwrap file keys in stanzas of
+// type name, for the recipient-v1 and identity-v1 state machines.
+func (sim *Simulator) HandleDefaults(name string) {
+	sim.Handle(name, "recipient-v1", ReadPhase1(), WrapFileKeys(name), Done())
+	sim.Handle(name, "identity-v1", ReadPhase1(), UnwrapFileKeys(name), Done())
+}
+
+// Sessions returns the number of sessions started so far.
+func (sim *Simulator) Sessions() int {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	return sim.sessions
+}
+
+// Err returns the first error encountered by a script, for example because
+// the client sent an unexpected response, or nil.
+func (sim *Simulator) Err() error {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	if len(sim.errs) == 0 {
+		return nil
+	}
+	return sim.errs[0]
+}
+
+func (sim *Simulator) script(name, protocol string) ([]Action, error) {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	script, ok := sim.scripts[name+" "+protocol]
+	if !ok {
+		return nil, fmt.Errorf("pluginsim: no script for plugin %q with state machine %q", name, protocol)
+	}
+	sim.sessions++
+	return script, nil
+}
+
+// run runs script, and returns the error to report as the exit status.
+func (sim *Simulator) run(s *Session, script []Action) error {
+	for _, a := range script {
+		err := a(s)
+		if err == nil {
+			continue
+		}
+		var exit *exitError
+		switch {
+		case err == errStop:
+			return nil
+		case errors.As(err, &exit):
+			return exit.err
+		case s.isClosed():
+			// The client hung up, which is not the script's fault.
+			return nil
+		}
+		err = fmt.Errorf("pluginsim: %s %s: %w", s.Name, s.Protocol, err)
+		sim.mu.Lock()
+		sim.errs = append(sim.errs, err)
+		sim.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Connect starts a session in process. It can be used as
+// plugin.ClientUI.Connect.
+func (sim *Simulator) Connect(name, protocol string) (io.ReadWriteCloser, error) {
+	script, err := sim.script(name, protocol)
+	if err != nil {
+		return nil, err
+	}
+	clientR, pluginW := io.Pipe()
+	pluginR, clientW := io.Pipe()
+	c := &conn{
+		PipeReader: clientR, PipeWriter: clientW,
+		closed: make(chan struct{}), done: make(chan struct{}),
+	}
+	s := &Session{
+		Name: name, Protocol: protocol,
+		sr:     format.NewStanzaReader(bufio.NewReader(pluginR)),
+		w:      pluginW,
+		closed: c.closed,
+	}
+	go func() {
+		c.err = sim.run(s, script)
+		// Like a process exiting: the client reads EOF, and its writes fail.
+		pluginW.Close()
+		pluginR.CloseWithError(io.ErrClosedPipe)
+		close(c.done)
+	}()
+	return c, nil
+}
+
+// conn is the client side of an in-process session.
+type conn struct {
+	*io.PipeReader
+	*io.PipeWriter
+	closeOnce sync.Once
+	closed    chan struct{}
+	done      chan struct{}
+	err       error
+}
+
+// Close closes the connection, waits for the script to end, and returns its
+// error.
+func (c *conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.PipeReader.Close()
+		c.PipeWriter.Close()
+	})
+	<-c.done
+	return c.err
+}
+
+// Main runs a session on standard input and output and exits, if the program
+// was invoked as a plugin, that is, with a name starting with "age-plugin-"
+// and the --age-plugin=STATE-MACHINE flag. It also implements --version.
+// Otherwise, it returns.
+//
+// It's meant to be called from TestMain, with the test binary linked or
+// copied as age-plugin-NAME.
+func (sim *Simulator) Main() {
+	base := strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
+	if !strings.HasPrefix(base, "age-plugin-") || len(os.Args) != 2 {
+		return
+	}
+	name := strings.TrimPrefix(base, "age-plugin-")
+	if os.Args[1] == "--version" {
+		fmt.Printf("%s v0.0.0-pluginsim\n", base)
+		os.Exit(0)
+	}
+	if !strings.HasPrefix(os.Args[1], "--age-plugin=") {
+		return
+	}
+	protocol := strings.TrimPrefix(os.Args[1], "--age-plugin=")
+	script, err := sim.script(name, protocol)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	s := &Session{
+		Name: name, Protocol: protocol,
+		sr: format.NewStanzaReader(bufio.NewReader(os.Stdin)),
+		w:  os.Stdout,
+	}
+	if err := sim.run(s, script); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,201 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pluginsim_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/plugin"
+	"filippo.io/age/testkit/pluginsim"
+)
+
+// processSim is the Simulator run by the test binary when it's invoked as
+// age-plugin-simproc.
+var processSim = pluginsim.New()
+
+func TestMain(m *testing.M) {
+	processSim.HandleDefaults("simproc")
+	processSim.Main()
+	os.Exit(m.Run())
+}
+
+const helloWorld = "Hello, Twitch!"
+
+func encrypt(t *testing.T, ui *plugin.ClientUI, name string) ([]byte, error) {
+	t.Helper()
+	r, err := plugin.NewRecipient(plugin.EncodeRecipient(name, nil), ui)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, r)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), nil
+}
+
+func decrypt(t *testing.T, ui *plugin.ClientUI, name string, file []byte) error {
+	t.Helper()
+	i, err := plugin.NewIdentity(plugin.EncodeIdentity(name, nil), ui)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := age.Decrypt(bytes.NewReader(file), i)
+	if err != nil {
+		return err
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != helloWorld {
+		t.Errorf("wrong data: %q, expected %q", out, helloWorld)
+	}
+	return nil
+}
+
+func TestDefaults(t *testing.T) {
+	sim := pluginsim.New()
+	sim.HandleDefaults("sim")
+	ui := &plugin.ClientUI{Connect: sim.Connect}
+	file, err := encrypt(t, ui, "sim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := decrypt(t, ui, "sim", file); err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.Err(); err != nil {
+		t.Error(err)
+	}
+	if n := sim.Sessions(); n != 2 {
+		t.Errorf("got %d sessions, expected 2", n)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	sim := pluginsim.New()
+	ui := &plugin.ClientUI{Connect: sim.Connect}
+
+	sim.Handle("sim", "recipient-v1", pluginsim.ReadPhase1(), pluginsim.EOF())
+	if _, err := encrypt(t, ui, "sim"); err == nil {
+		t.Error("early EOF was not reported")
+	}
+
+	sim.Handle("sim", "recipient-v1", pluginsim.ReadPhase1(),
+		pluginsim.Raw([]byte("-> recipient-stanza 0 sim\nAAAA")), pluginsim.EOF())
+	if _, err := encrypt(t, ui, "sim"); err == nil {
+		t.Error("truncated stanza was not reported")
+	}
+
+	sim.Handle("sim", "recipient-v1", pluginsim.ReadPhase1(), pluginsim.Giant(1<<20))
+	var limitErr *plugin.StanzaLimitError
+	if _, err := encrypt(t, ui, "sim"); !errors.As(err, &limitErr) {
+		t.Errorf("expected StanzaLimitError, got %v", err)
+	}
+
+	sim.Handle("sim", "recipient-v1", pluginsim.ReadPhase1(),
+		pluginsim.Error([]string{"internal"}, "simulated failure"))
+	if _, err := encrypt(t, ui, "sim"); err == nil || !strings.Contains(err.Error(), "simulated failure") {
+		t.Errorf("expected the plugin error, got %v", err)
+	}
+
+	if err := sim.Err(); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := encrypt(t, ui, "unknown"); err == nil {
+		t.Error("plugin without a script was started")
+	}
+}
+
+func TestWait(t *testing.T) {
+	sim := pluginsim.New()
+	sim.HandleDefaults("sim")
+	gate := make(chan struct{})
+	released := false
+	sim.Handle("sim", "identity-v1", pluginsim.ReadPhase1(), pluginsim.Wait(gate),
+		pluginsim.UnwrapFileKeys("sim"), pluginsim.Done())
+	ui := &plugin.ClientUI{Connect: sim.Connect}
+	file, err := encrypt(t, ui, "sim")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := plugin.NewIdentity(plugin.EncodeIdentity("sim", nil), ui)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := age.Decrypt(bytes.NewReader(file), i)
+		if err == nil && !released {
+			err = errors.New("decryption finished before the plugin was released")
+		}
+		done <- err
+	}()
+	released = true
+	close(gate)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnexpectedResponse(t *testing.T) {
+	sim := pluginsim.New()
+	sim.HandleDefaults("sim")
+	ui := &plugin.ClientUI{Connect: sim.Connect}
+	file, err := encrypt(t, ui, "sim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without a RequestValue callback, the client responds with "fail".
+	sim.Handle("sim", "identity-v1", pluginsim.ReadPhase1(),
+		pluginsim.Send("request-public", nil, []byte("prompt")), pluginsim.Expect("ok"), pluginsim.Done())
+	if err := decrypt(t, ui, "sim", file); err == nil {
+		t.Error("decryption succeeded without a file key")
+	}
+	if err := sim.Err(); err == nil {
+		t.Error("unexpected response was not recorded")
+	}
+}
+
+func TestProcess(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows support is TODO")
+	}
+	temp := t.TempDir()
+	ex, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(ex, filepath.Join(temp, "age-plugin-simproc")); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", temp)
+
+	file, err := encrypt(t, &plugin.ClientUI{}, "simproc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := decrypt(t, &plugin.ClientUI{}, "simproc", file); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -14,34 +14,41 @@ import (
 	"errors"
 	"io"
 	"io/fs"
+	"os"
 	"strings"
 	"testing"
 
 	"filippo.io/age"
 	"filippo.io/age/armor"
 	"filippo.io/age/internal/format"
-	"filippo.io/age/internal/stream"
+	"filippo.io/age/stream"
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/hkdf"
 
 	agetest "c2sp.org/CCTV/age"
 )
 
+// localVectors are test vectors in the CCTV format for recipient types that
+// are specific to this implementation.
+var localVectors = os.DirFS("testdata/testkit")
+
 func forEachVector(t *testing.T, f func(t *testing.T, v *vector)) {
-	tests, err := fs.ReadDir(agetest.Vectors, ".")
-	if err != nil {
-		t.Fatal(err)
-	}
-	for _, test := range tests {
-		name := test.Name()
-		contents, err := fs.ReadFile(agetest.Vectors, name)
+	for _, vectors := range []fs.FS{agetest.Vectors, localVectors} {
+		tests, err := fs.ReadDir(vectors, ".")
 		if err != nil {
 			t.Fatal(err)
 		}
-		t.Run(name, func(t *testing.T) {
-			t.Parallel()
-			f(t, parseVector(t, contents))
-		})
+		for _, test := range tests {
+			name := test.Name()
+			contents, err := fs.ReadFile(vectors, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Run(name, func(t *testing.T) {
+				t.Parallel()
+				f(t, parseVector(t, contents))
+			})
+		}
 	}
 }
 
@@ -92,7 +99,15 @@ func parseVector(t *testing.T, test []byte) *vector {
 			}
 			v.fileKey = (*[16]byte)(h)
 		case "identity":
-			i, err := age.ParseX25519Identity(value)
+			var i age.Identity
+			var err error
+			if strings.HasPrefix(value, "AGE-SECRET-KEY-X448-1") {
+				i, err = age.ParseX448Identity(value)
+			} else if strings.HasPrefix(value, "AGE-SECRET-KEY-HPKE-1") {
+				i, err = age.ParseHPKEIdentity(value)
+			} else {
+				i, err = age.ParseX25519Identity(value)
+			}
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -124,7 +139,7 @@ func testVector(t *testing.T, v *vector) {
 		in = armor.NewReader(in)
 	}
 	r, err := age.Decrypt(in, v.identities...)
-	if err != nil && strings.HasSuffix(err.Error(), "bad header MAC") {
+	if e := new(age.HeaderMACError); errors.As(err, &e) {
 		if v.expect == "HMAC failure" {
 			t.Log(err)
 			return
@@ -162,6 +177,12 @@ func testVector(t *testing.T, v *vector) {
 				t.Errorf("expected armor.Error, got %T", err)
 			}
 		}
+		if v.expect == "payload failure" {
+			corrupt, truncated := new(age.PayloadCorruptError), new(age.PayloadTruncatedError)
+			if !errors.As(err, &corrupt) && !errors.As(err, &truncated) {
+				t.Errorf("expected PayloadCorruptError or PayloadTruncatedError, got %T", err)
+			}
+		}
 		if v.payloadHash != nil && sha256.Sum256(out) != *v.payloadHash {
 			t.Error("partial payload hash mismatch")
 		}
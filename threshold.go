@@ -0,0 +1,264 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"filippo.io/age/internal/format"
+)
+
+// ThresholdRecipient splits the file key into n shares with Shamir's secret
+// sharing, such that any k of them are sufficient to reconstruct it, and wraps
+// each share to a different inner Recipient.
+//
+// A file encrypted to a ThresholdRecipient can be decrypted with a
+// ThresholdIdentity holding the identities of at least k of the n inner
+// recipients. This can be used for escrow, or to implement a two-person rule.
+//
+// Each inner stanza is encoded as a "threshold" stanza with arguments group,
+// k, share index, and then the type and arguments of the inner stanza. The
+// group is a random value that ties together the shares of a ThresholdRecipient.
+type ThresholdRecipient struct {
+	k          int
+	recipients []Recipient
+}
+
+var _ Recipient = &ThresholdRecipient{}
+var _ RecipientWithLabels = &ThresholdRecipient{}
+
+// NewThresholdRecipient returns a new ThresholdRecipient which requires k of
+// the provided recipients to decrypt the file. There can be at most 255 inner
+// recipients.
+func NewThresholdRecipient(k int, recipients ...Recipient) (*ThresholdRecipient, error) {
+	if len(recipients) > 255 {
+		return nil, errors.New("too many recipients")
+	}
+	if k < 1 || k > len(recipients) {
+		return nil, fmt.Errorf("invalid threshold %d for %d recipients", k, len(recipients))
+	}
+	return &ThresholdRecipient{k: k, recipients: recipients}, nil
+}
+
+func (r *ThresholdRecipient) Wrap(fileKey []byte) ([]*Stanza, error) {
+	stanzas, _, err := r.WrapWithLabels(fileKey)
+	return stanzas, err
+}
+
+// WrapWithLabels implements [age.RecipientWithLabels], returning the labels of
+// the inner recipients, which must all be the same.
+func (r *ThresholdRecipient) WrapWithLabels(fileKey []byte) (stanzas []*Stanza, labels []string, err error) {
+	shares, err := shamirSplit(fileKey, r.k, len(r.recipients))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	group := make([]byte, 8)
+	if _, err := rand.Read(group); err != nil {
+		return nil, nil, err
+	}
+	groupArg := format.EncodeToString(group)
+
+	for i, rr := range r.recipients {
+		s, l, err := wrapWithLabels(rr, shares[i], nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to wrap share for recipient #%d: %v", i, err)
+		}
+		sort.Strings(l)
+		if i == 0 {
+			labels = l
+		} else if !slicesEqual(labels, l) {
+			return nil, nil, fmt.Errorf("incompatible recipients")
+		}
+		for _, s := range s {
+			args := []string{groupArg, strconv.Itoa(r.k), strconv.Itoa(i + 1), s.Type}
+			stanzas = append(stanzas, &Stanza{
+				Type: "threshold",
+				Args: append(args, s.Args...),
+				Body: s.Body,
+			})
+		}
+	}
+	return stanzas, labels, nil
+}
+
+// ThresholdIdentity reconstructs a file key wrapped by a ThresholdRecipient by
+// unwrapping shares with its inner identities.
+type ThresholdIdentity struct {
+	identities []Identity
+}
+
+var _ Identity = &ThresholdIdentity{}
+
+// NewThresholdIdentity returns a new ThresholdIdentity which will use the
+// provided identities to unwrap shares. Each identity is tried against each
+// share, so the identities don't need to be provided in any particular order.
+func NewThresholdIdentity(identities ...Identity) *ThresholdIdentity {
+	return &ThresholdIdentity{identities: identities}
+}
+
+type thresholdGroup struct {
+	k      int
+	shares map[byte][]byte
+}
+
+func (i *ThresholdIdentity) Unwrap(stanzas []*Stanza) ([]byte, error) {
+	groups := make(map[string]*thresholdGroup)
+	var order []string
+	for _, s := range stanzas {
+		if s.Type != "threshold" {
+			continue
+		}
+		if len(s.Args) < 4 {
+			return nil, errors.New("invalid threshold recipient block")
+		}
+		if g, err := format.DecodeString(s.Args[0]); err != nil || len(g) == 0 {
+			return nil, errors.New("invalid threshold recipient block: malformed group")
+		}
+		k, err := parseThresholdInt(s.Args[1])
+		if err != nil || k < 1 {
+			return nil, errors.New("invalid threshold recipient block: malformed threshold")
+		}
+		x, err := parseThresholdInt(s.Args[2])
+		if err != nil || x < 1 {
+			return nil, errors.New("invalid threshold recipient block: malformed share index")
+		}
+
+		g, ok := groups[s.Args[0]]
+		if !ok {
+			g = &thresholdGroup{k: k, shares: make(map[byte][]byte)}
+			groups[s.Args[0]] = g
+			order = append(order, s.Args[0])
+		}
+		if g.k != k {
+			return nil, errors.New("invalid threshold recipient block: inconsistent threshold")
+		}
+		if _, ok := g.shares[byte(x)]; ok || len(g.shares) >= g.k {
+			continue
+		}
+
+		inner := &Stanza{Type: s.Args[3], Args: s.Args[4:], Body: s.Body}
+		share, err := i.unwrapShare(inner)
+		if errors.Is(err, ErrIncorrectIdentity) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to unwrap share %d: %w", x, err)
+		}
+		if len(share) != fileKeySize {
+			return nil, errors.New("invalid threshold recipient block: incorrect share size")
+		}
+		g.shares[byte(x)] = share
+	}
+
+	for _, name := range order {
+		if g := groups[name]; len(g.shares) >= g.k {
+			return shamirCombine(g.shares), nil
+		}
+	}
+	return nil, ErrIncorrectIdentity
+}
+
+func (i *ThresholdIdentity) unwrapShare(s *Stanza) ([]byte, error) {
+	for _, id := range i.identities {
+		share, err := id.Unwrap([]*Stanza{s})
+		if errors.Is(err, ErrIncorrectIdentity) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return share, nil
+	}
+	return nil, ErrIncorrectIdentity
+}
+
+func parseThresholdInt(s string) (int, error) {
+	if !digitsRe.MatchString(s) {
+		return 0, fmt.Errorf("invalid encoding: %q", s)
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n > 255 {
+		return 0, fmt.Errorf("invalid value: %q", s)
+	}
+	return n, nil
+}
+
+// shamirSplit splits secret into n shares, any k of which can reconstruct it.
+// Share i is the evaluation at x = i + 1 of a random polynomial of degree k-1
+// over GF(2^8), for each byte of secret.
+func shamirSplit(secret []byte, k, n int) ([][]byte, error) {
+	coeffs := make([]byte, len(secret)*(k-1))
+	if _, err := rand.Read(coeffs); err != nil {
+		return nil, err
+	}
+	shares := make([][]byte, n)
+	for i := range shares {
+		x := byte(i + 1)
+		shares[i] = make([]byte, len(secret))
+		for j := range secret {
+			// Horner's method, from the highest degree coefficient.
+			var y byte
+			for c := k - 2; c >= 0; c-- {
+				y = gfMul(y, x) ^ coeffs[j*(k-1)+c]
+			}
+			shares[i][j] = gfMul(y, x) ^ secret[j]
+		}
+	}
+	return shares, nil
+}
+
+// shamirCombine reconstructs the secret from shares, indexed by their x value,
+// with Lagrange interpolation at x = 0.
+func shamirCombine(shares map[byte][]byte) []byte {
+	var xs []byte
+	for x := range shares {
+		xs = append(xs, x)
+	}
+	secret := make([]byte, fileKeySize)
+	for _, xi := range xs {
+		// Lagrange basis polynomial for xi, evaluated at zero. Subtraction is
+		// XOR in GF(2^8).
+		num, den := byte(1), byte(1)
+		for _, xj := range xs {
+			if xj == xi {
+				continue
+			}
+			num = gfMul(num, xj)
+			den = gfMul(den, xi^xj)
+		}
+		l := gfMul(num, gfInv(den))
+		for j, y := range shares[xi] {
+			secret[j] ^= gfMul(y, l)
+		}
+	}
+	return secret
+}
+
+// gfMul multiplies in GF(2^8) with the AES polynomial, in constant time.
+func gfMul(a, b byte) byte {
+	var p byte
+	for i := 0; i < 8; i++ {
+		p ^= a & -(b & 1)
+		hi := -(a >> 7)
+		a = (a << 1) ^ (0x1b & hi)
+		b >>= 1
+	}
+	return p
+}
+
+// gfInv returns the multiplicative inverse of a in GF(2^8), as a^254.
+func gfInv(a byte) byte {
+	r := byte(1)
+	for i := 0; i < 7; i++ {
+		a = gfMul(a, a)
+		r = gfMul(r, a)
+	}
+	return r
+}
@@ -0,0 +1,94 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"io"
+
+	"filippo.io/age/stream"
+)
+
+// A Tracer starts spans around the potentially slow steps of encryption and
+// decryption, to help find out where time goes. It can be implemented on top
+// of OpenTelemetry or any other tracing system.
+//
+// The following spans are started, with the listed attributes:
+//
+//   - "age.ParseHeader" around reading and parsing the header
+//   - "age.Wrap" around each Recipient.Wrap call ("recipient", "type")
+//   - "age.Unwrap" around each Identity.Unwrap call ("identity", "type"), or
+//     for the native identities, which are tried on each stanza as the header
+//     is read, from the first attempt until the end of the header
+//   - "age.Payload" from the start of the payload until the encrypting Writer
+//     is closed, or the decrypting Reader returns an error or io.EOF
+//
+// The filippo.io/age/plugin package also starts an "age.Plugin" span for the
+// lifetime of each plugin process ("plugin", "protocol").
+type Tracer interface {
+	// StartSpan starts a span with the given name and attributes, which are
+	// alternating string keys and values like for Logger.
+	StartSpan(name string, attrs ...any) Span
+}
+
+// A Span is a timed operation started by a Tracer.
+type Span interface {
+	// End ends the span. err is the error that ended the operation, if any.
+	End(err error)
+}
+
+type noopSpan struct{}
+
+func (noopSpan) End(error) {}
+
+func (opts *Options) startSpan(name string, attrs ...any) Span {
+	if opts == nil || opts.Tracer == nil {
+		return noopSpan{}
+	}
+	return opts.Tracer.StartSpan(name, attrs...)
+}
+
+// tracedWriter ends span when the underlying WriteCloser is closed.
+type tracedWriter struct {
+	io.WriteCloser
+	span Span
+}
+
+func (w *tracedWriter) SetProgressFunc(f func(processedBytes int64)) {
+	w.WriteCloser.(*stream.Writer).SetProgressFunc(f)
+}
+
+func (w *tracedWriter) Close() error {
+	err := w.WriteCloser.Close()
+	w.span.End(err)
+	return err
+}
+
+// tracedReader ends span when the underlying Reader returns an error.
+type tracedReader struct {
+	io.Reader
+	span Span
+	done bool
+}
+
+func (r *tracedReader) SetProgressFunc(f func(processedBytes int64)) {
+	r.Reader.(*payloadReader).SetProgressFunc(f)
+}
+
+func (r *tracedReader) Size() int64 {
+	return r.Reader.(*payloadReader).Size()
+}
+
+func (r *tracedReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && !r.done {
+		r.done = true
+		if err == io.EOF {
+			r.span.End(nil)
+		} else {
+			r.span.End(err)
+		}
+	}
+	return n, err
+}
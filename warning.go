@@ -0,0 +1,53 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"fmt"
+	"strings"
+
+	"filippo.io/age/internal/format"
+)
+
+// A Warning is a non-fatal anomaly observed while decrypting a file, which
+// doesn't prevent decryption but might be of interest to security-conscious
+// applications. Warnings are delivered to Options.Warn.
+type Warning struct {
+	// Code is a short, stable identifier for the kind of anomaly.
+	Code string
+	// Message is a human-readable description.
+	Message string
+}
+
+func (w *Warning) String() string {
+	return w.Code + ": " + w.Message
+}
+
+// Warning codes.
+const (
+	// WarningUnknownStanza is reported for each stanza of a type that is not
+	// implemented by this module, and which was therefore skipped unless it
+	// was handled by a custom Identity or a plugin. Grease stanzas, which
+	// encoders add on purpose, are not reported.
+	WarningUnknownStanza = "unknown-stanza"
+)
+
+func (opts *Options) warn(code, format string, a ...interface{}) {
+	if opts == nil || opts.Warn == nil {
+		return
+	}
+	opts.Warn(&Warning{Code: code, Message: fmt.Sprintf(format, a...)})
+}
+
+// warnHeader reports the warnings that can be observed from a successfully
+// decrypted header.
+func warnHeader(opts *Options, hdr *format.Header) {
+	for i, s := range hdr.Recipients {
+		if knownStanzaTypes[s.Type] || strings.HasSuffix(s.Type, "-grease") {
+			continue
+		}
+		opts.warn(WarningUnknownStanza, "skipped stanza #%d of unknown type %q", i, s.Type)
+	}
+}
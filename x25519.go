@@ -5,14 +5,17 @@
 package age
 
 import (
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
 	"errors"
 	"fmt"
 	"io"
 	"strings"
 
-	"filippo.io/age/internal/bech32"
+	"filippo.io/age/bech32"
 	"filippo.io/age/internal/format"
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/curve25519"
@@ -21,6 +24,8 @@ import (
 
 const x25519Label = "age-encryption.org/v1/X25519"
 
+const x25519CompactLabel = "age-encryption.org/v1/X25519-compact"
+
 // X25519Recipient is the standard age public key. Messages encrypted to this
 // recipient can be decrypted with the corresponding X25519Identity.
 //
@@ -62,18 +67,23 @@ func ParseX25519Recipient(s string) (*X25519Recipient, error) {
 }
 
 func (r *X25519Recipient) Wrap(fileKey []byte) ([]*Stanza, error) {
+	s, _, err := r.wrapWithRand(fileKey, rand.Reader)
+	return s, err
+}
+
+func (r *X25519Recipient) wrapWithRand(fileKey []byte, rand io.Reader) ([]*Stanza, []string, error) {
 	ephemeral := make([]byte, curve25519.ScalarSize)
-	if _, err := rand.Read(ephemeral); err != nil {
-		return nil, err
+	if _, err := io.ReadFull(rand, ephemeral); err != nil {
+		return nil, nil, err
 	}
 	ourPublicKey, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	sharedSecret, err := curve25519.X25519(ephemeral, r.theirPublicKey)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	l := &Stanza{
@@ -81,22 +91,71 @@ func (r *X25519Recipient) Wrap(fileKey []byte) ([]*Stanza, error) {
 		Args: []string{format.EncodeToString(ourPublicKey)},
 	}
 
-	salt := make([]byte, 0, len(ourPublicKey)+len(r.theirPublicKey))
-	salt = append(salt, ourPublicKey...)
-	salt = append(salt, r.theirPublicKey...)
-	h := hkdf.New(sha256.New, sharedSecret, salt, []byte(x25519Label))
-	wrappingKey := make([]byte, chacha20poly1305.KeySize)
-	if _, err := io.ReadFull(h, wrappingKey); err != nil {
-		return nil, err
+	wrappingKey, err := x25519WrappingKey(sharedSecret, ourPublicKey, r.theirPublicKey, x25519Label)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	wrappedKey, err := aeadEncrypt(wrappingKey, fileKey)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	l.Body = wrappedKey
 
-	return []*Stanza{l}, nil
+	return []*Stanza{l}, nil, nil
+}
+
+// wrapX25519Compact wraps fileKey for multiple X25519 recipients in a single
+// "X25519-compact" stanza. The stanza has one ephemeral share argument shared by
+// all recipients, and a body which is the concatenation of the file key wrapped
+// for each recipient, with a wrapping key derived like for X25519 stanzas, but
+// with a different label.
+//
+// This saves the ephemeral share and the stanza framing for every recipient
+// after the first one.
+func wrapX25519Compact(fileKey []byte, recipients []*X25519Recipient, rand io.Reader) (*Stanza, error) {
+	ephemeral := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(rand, ephemeral); err != nil {
+		return nil, err
+	}
+	ourPublicKey, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Stanza{
+		Type: "X25519-compact",
+		Args: []string{format.EncodeToString(ourPublicKey)},
+	}
+	for _, r := range recipients {
+		sharedSecret, err := curve25519.X25519(ephemeral, r.theirPublicKey)
+		if err != nil {
+			return nil, err
+		}
+		wrappingKey, err := x25519WrappingKey(sharedSecret, ourPublicKey, r.theirPublicKey, x25519CompactLabel)
+		if err != nil {
+			return nil, err
+		}
+		wrappedKey, err := aeadEncrypt(wrappingKey, fileKey)
+		if err != nil {
+			return nil, err
+		}
+		l.Body = append(l.Body, wrappedKey...)
+	}
+
+	return l, nil
+}
+
+func x25519WrappingKey(sharedSecret, ephemeral, recipient []byte, label string) ([]byte, error) {
+	salt := make([]byte, 0, len(ephemeral)+len(recipient))
+	salt = append(salt, ephemeral...)
+	salt = append(salt, recipient...)
+	h := hkdf.New(sha256.New, sharedSecret, salt, []byte(label))
+	wrappingKey := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(h, wrappingKey); err != nil {
+		return nil, err
+	}
+	return wrappingKey, nil
 }
 
 // String returns the Bech32 public key encoding of r.
@@ -105,6 +164,29 @@ func (r *X25519Recipient) String() string {
 	return s
 }
 
+// Equal reports whether r and other are the same public key. It runs in
+// constant time.
+func (r *X25519Recipient) Equal(other *X25519Recipient) bool {
+	return subtle.ConstantTimeCompare(r.theirPublicKey, other.theirPublicKey) == 1
+}
+
+// MarshalText implements encoding.TextMarshaler, returning the same encoding as
+// String.
+func (r *X25519Recipient) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, parsing the encoding like
+// ParseX25519Recipient.
+func (r *X25519Recipient) UnmarshalText(text []byte) error {
+	parsed, err := ParseX25519Recipient(string(text))
+	if err != nil {
+		return err
+	}
+	*r = *parsed
+	return nil
+}
+
 // X25519Identity is the standard age private key, which can decrypt messages
 // encrypted to the corresponding X25519Recipient.
 type X25519Identity struct {
@@ -135,6 +217,27 @@ func GenerateX25519Identity() (*X25519Identity, error) {
 	return newX25519IdentityFromScalar(secretKey)
 }
 
+// X25519IdentityFromEd25519Seed derives an X25519Identity from an Ed25519
+// private key seed, as defined in RFC 8032, Section 5.1.5. The X25519 scalar is
+// the clamped first half of the SHA-512 hash of the seed, which is also the
+// Ed25519 scalar, so the recipient is the Montgomery form of the Ed25519
+// public key.
+//
+// This allows systems that provision a single Ed25519 seed to derive a stable
+// age identity from it. The same conversion is used by the ssh-ed25519
+// recipient type, but the resulting identity is a regular X25519 identity.
+func X25519IdentityFromEd25519Seed(seed []byte) (*X25519Identity, error) {
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.New("invalid Ed25519 seed size")
+	}
+	h := sha512.Sum512(seed)
+	s := h[:curve25519.ScalarSize]
+	s[0] &= 248
+	s[31] &= 127
+	s[31] |= 64
+	return newX25519IdentityFromScalar(s)
+}
+
 // ParseX25519Identity returns a new X25519Identity from a Bech32 private key
 // encoding with the "AGE-SECRET-KEY-1" prefix.
 func ParseX25519Identity(s string) (*X25519Identity, error) {
@@ -157,34 +260,57 @@ func (i *X25519Identity) Unwrap(stanzas []*Stanza) ([]byte, error) {
 }
 
 func (i *X25519Identity) unwrap(block *Stanza) ([]byte, error) {
-	if block.Type != "X25519" {
+	return x25519Unwrap(block, i.ourPublicKey, func(publicKey []byte) ([]byte, error) {
+		return curve25519.X25519(i.secretKey, publicKey)
+	})
+}
+
+// x25519Unwrap unwraps an X25519 or X25519-compact stanza addressed to
+// ourPublicKey, using dh to compute the shared secret with the ephemeral share.
+func x25519Unwrap(block *Stanza, ourPublicKey []byte, dh func(publicKey []byte) ([]byte, error)) ([]byte, error) {
+	if block.Type != "X25519" && block.Type != "X25519-compact" {
 		return nil, ErrIncorrectIdentity
 	}
 	if len(block.Args) != 1 {
-		return nil, errors.New("invalid X25519 recipient block")
+		return nil, fmt.Errorf("invalid %s recipient block", block.Type)
 	}
 	publicKey, err := format.DecodeString(block.Args[0])
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse X25519 recipient: %v", err)
+		return nil, fmt.Errorf("failed to parse %s recipient: %v", block.Type, err)
 	}
 	if len(publicKey) != curve25519.PointSize {
-		return nil, errors.New("invalid X25519 recipient block")
+		return nil, fmt.Errorf("invalid %s recipient block", block.Type)
 	}
 
-	sharedSecret, err := curve25519.X25519(i.secretKey, publicKey)
+	wrappedKeySize := fileKeySize + chacha20poly1305.Overhead
+	label := x25519Label
+	if block.Type == "X25519-compact" {
+		if len(block.Body) == 0 || len(block.Body)%wrappedKeySize != 0 {
+			return nil, errors.New("invalid X25519-compact recipient block: incorrect body size")
+		}
+		label = x25519CompactLabel
+	}
+
+	sharedSecret, err := dh(publicKey)
 	if err != nil {
-		return nil, fmt.Errorf("invalid X25519 recipient: %v", err)
+		return nil, fmt.Errorf("invalid %s recipient: %v", block.Type, err)
 	}
 
-	salt := make([]byte, 0, len(publicKey)+len(i.ourPublicKey))
-	salt = append(salt, publicKey...)
-	salt = append(salt, i.ourPublicKey...)
-	h := hkdf.New(sha256.New, sharedSecret, salt, []byte(x25519Label))
-	wrappingKey := make([]byte, chacha20poly1305.KeySize)
-	if _, err := io.ReadFull(h, wrappingKey); err != nil {
+	wrappingKey, err := x25519WrappingKey(sharedSecret, publicKey, ourPublicKey, label)
+	if err != nil {
 		return nil, err
 	}
 
+	if block.Type == "X25519-compact" {
+		for body := block.Body; len(body) > 0; body = body[wrappedKeySize:] {
+			fileKey, err := aeadDecrypt(wrappingKey, fileKeySize, body[:wrappedKeySize])
+			if err == nil {
+				return fileKey, nil
+			}
+		}
+		return nil, ErrIncorrectIdentity
+	}
+
 	fileKey, err := aeadDecrypt(wrappingKey, fileKeySize, block.Body)
 	if err == errIncorrectCiphertextSize {
 		return nil, errors.New("invalid X25519 recipient block: incorrect file key size")
@@ -206,3 +332,27 @@ func (i *X25519Identity) String() string {
 	s, _ := bech32.Encode("AGE-SECRET-KEY-", i.secretKey)
 	return strings.ToUpper(s)
 }
+
+// Equal reports whether i and other are the same private key. It runs in
+// constant time.
+func (i *X25519Identity) Equal(other *X25519Identity) bool {
+	return subtle.ConstantTimeCompare(i.secretKey, other.secretKey) == 1
+}
+
+// MarshalText implements encoding.TextMarshaler, returning the same encoding as
+// String. Note that this makes the secret key part of any encoding of values
+// containing i, such as JSON.
+func (i *X25519Identity) MarshalText() ([]byte, error) {
+	return []byte(i.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, parsing the encoding like
+// ParseX25519Identity.
+func (i *X25519Identity) UnmarshalText(text []byte) error {
+	parsed, err := ParseX25519Identity(string(text))
+	if err != nil {
+		return err
+	}
+	*i = *parsed
+	return nil
+}
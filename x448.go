@@ -0,0 +1,213 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"filippo.io/age/bech32"
+	"filippo.io/age/internal/format"
+	"filippo.io/age/internal/x448"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const x448Label = "age-encryption.org/v1/X448"
+
+// X448Recipient is a public key recipient like X25519Recipient, but based on
+// the X448 function from RFC 7748, for users with policies requiring a
+// classical security level above 128 bits for the key agreement. Note that the
+// file key and the payload encryption are the same as for every other
+// recipient type.
+//
+// The stanza has type "X448" and a single argument which is the ephemeral X448
+// share. Like X25519Recipient, this recipient is anonymous.
+type X448Recipient struct {
+	theirPublicKey []byte
+}
+
+var _ Recipient = &X448Recipient{}
+
+// newX448RecipientFromPoint returns a new X448Recipient from a raw X448 point.
+func newX448RecipientFromPoint(publicKey []byte) (*X448Recipient, error) {
+	if len(publicKey) != x448.PointSize {
+		return nil, errors.New("invalid X448 public key")
+	}
+	r := &X448Recipient{
+		theirPublicKey: make([]byte, x448.PointSize),
+	}
+	copy(r.theirPublicKey, publicKey)
+	return r, nil
+}
+
+// ParseX448Recipient returns a new X448Recipient from a Bech32 public key
+// encoding with the "age1x4481" prefix.
+func ParseX448Recipient(s string) (*X448Recipient, error) {
+	t, k, err := bech32.Decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("malformed recipient %q: %v", s, err)
+	}
+	if t != "age1x448" {
+		return nil, fmt.Errorf("malformed recipient %q: invalid type %q", s, t)
+	}
+	r, err := newX448RecipientFromPoint(k)
+	if err != nil {
+		return nil, fmt.Errorf("malformed recipient %q: %v", s, err)
+	}
+	return r, nil
+}
+
+func (r *X448Recipient) Wrap(fileKey []byte) ([]*Stanza, error) {
+	ephemeral := make([]byte, x448.ScalarSize)
+	if _, err := rand.Read(ephemeral); err != nil {
+		return nil, err
+	}
+	ourPublicKey, err := x448.X448(ephemeral, x448.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	sharedSecret, err := x448.X448(ephemeral, r.theirPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Stanza{
+		Type: "X448",
+		Args: []string{format.EncodeToString(ourPublicKey)},
+	}
+
+	wrappingKey, err := x448WrappingKey(sharedSecret, ourPublicKey, r.theirPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	wrappedKey, err := aeadEncrypt(wrappingKey, fileKey)
+	if err != nil {
+		return nil, err
+	}
+	l.Body = wrappedKey
+
+	return []*Stanza{l}, nil
+}
+
+// String returns the Bech32 public key encoding of r.
+func (r *X448Recipient) String() string {
+	s, _ := bech32.Encode("age1x448", r.theirPublicKey)
+	return s
+}
+
+// X448Identity is the private key corresponding to an X448Recipient.
+type X448Identity struct {
+	secretKey, ourPublicKey []byte
+}
+
+var _ Identity = &X448Identity{}
+
+// newX448IdentityFromScalar returns a new X448Identity from a raw X448 scalar.
+func newX448IdentityFromScalar(secretKey []byte) (*X448Identity, error) {
+	if len(secretKey) != x448.ScalarSize {
+		return nil, errors.New("invalid X448 secret key")
+	}
+	i := &X448Identity{
+		secretKey: make([]byte, x448.ScalarSize),
+	}
+	copy(i.secretKey, secretKey)
+	i.ourPublicKey, _ = x448.X448(i.secretKey, x448.Basepoint)
+	return i, nil
+}
+
+// GenerateX448Identity randomly generates a new X448Identity.
+func GenerateX448Identity() (*X448Identity, error) {
+	secretKey := make([]byte, x448.ScalarSize)
+	if _, err := rand.Read(secretKey); err != nil {
+		return nil, fmt.Errorf("internal error: %v", err)
+	}
+	return newX448IdentityFromScalar(secretKey)
+}
+
+// ParseX448Identity returns a new X448Identity from a Bech32 private key
+// encoding with the "AGE-SECRET-KEY-X448-1" prefix.
+func ParseX448Identity(s string) (*X448Identity, error) {
+	t, k, err := bech32.Decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("malformed secret key: %v", err)
+	}
+	if t != "AGE-SECRET-KEY-X448-" {
+		return nil, fmt.Errorf("malformed secret key: unknown type %q", t)
+	}
+	r, err := newX448IdentityFromScalar(k)
+	if err != nil {
+		return nil, fmt.Errorf("malformed secret key: %v", err)
+	}
+	return r, nil
+}
+
+func (i *X448Identity) Unwrap(stanzas []*Stanza) ([]byte, error) {
+	return multiUnwrap(i.unwrap, stanzas)
+}
+
+func (i *X448Identity) unwrap(block *Stanza) ([]byte, error) {
+	if block.Type != "X448" {
+		return nil, ErrIncorrectIdentity
+	}
+	if len(block.Args) != 1 {
+		return nil, errors.New("invalid X448 recipient block")
+	}
+	publicKey, err := format.DecodeString(block.Args[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse X448 recipient: %v", err)
+	}
+	if len(publicKey) != x448.PointSize {
+		return nil, errors.New("invalid X448 recipient block")
+	}
+
+	sharedSecret, err := x448.X448(i.secretKey, publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid X448 recipient: %v", err)
+	}
+
+	wrappingKey, err := x448WrappingKey(sharedSecret, publicKey, i.ourPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	fileKey, err := aeadDecrypt(wrappingKey, fileKeySize, block.Body)
+	if err == errIncorrectCiphertextSize {
+		return nil, errors.New("invalid X448 recipient block: incorrect file key size")
+	} else if err != nil {
+		return nil, ErrIncorrectIdentity
+	}
+	return fileKey, nil
+}
+
+// Recipient returns the public X448Recipient value corresponding to i.
+func (i *X448Identity) Recipient() *X448Recipient {
+	r := &X448Recipient{}
+	r.theirPublicKey = i.ourPublicKey
+	return r
+}
+
+// String returns the Bech32 private key encoding of i.
+func (i *X448Identity) String() string {
+	s, _ := bech32.Encode("AGE-SECRET-KEY-X448-", i.secretKey)
+	return strings.ToUpper(s)
+}
+
+func x448WrappingKey(sharedSecret, ephemeral, recipient []byte) ([]byte, error) {
+	salt := make([]byte, 0, len(ephemeral)+len(recipient))
+	salt = append(salt, ephemeral...)
+	salt = append(salt, recipient...)
+	h := hkdf.New(sha256.New, sharedSecret, salt, []byte(x448Label))
+	wrappingKey := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(h, wrappingKey); err != nil {
+		return nil, err
+	}
+	return wrappingKey, nil
+}